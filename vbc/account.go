@@ -0,0 +1,983 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* What crossposting an account goes through, as set up by runPair. */
+type accountDeps struct {
+	store Store
+	ms    *mastodonSession
+	/* Only there with an access token, for what needs one. */
+	writer   *mastodonWriter
+	bs       *blueskySession
+	leader   *leaderLock
+	reporter *errorReporter
+	health   *instanceHealth
+	state    *pairState
+
+	instance     string
+	acct         *madon.Account
+	bskyProfile  *bluesky.Profile
+	transform    TransformConfig
+	pollInterval time.Duration
+	/* See VBC_PAUSE_AFTER and VBC_RECONCILE_LAST. */
+	pauseAfter    int
+	reconcileLast int
+}
+
+/* Crossposts an account, in stages that fetch its statuses, prepare the posts
+ * they turn into and publish those, each running on its own, see
+ * pipelineItem. Each one only runs the once. */
+type accountPipeline struct {
+	accountDeps
+	key AccountKey
+
+	offline bool
+	shadow  bool
+
+	/* Crossposts and polls in a row that failed in ways retrying won't
+	 * fix, down to the account rather than any one status. Enough of them
+	 * and there's no point in going on until someone has a look. */
+	failuresInARow atomic.Int32
+
+	/* Keeps backfills from flooding followers, see maxPerHour. */
+	limiter *postLimiter
+	/* Keeps catching up from posting a wall of crossposts, see postDelay. */
+	spacer *postSpacer
+	/* Catches statuses clients posted twice, see DuplicateWindow. */
+	duplicates *duplicateFilter
+	/* Keeps muted topics off Bluesky, see FilterConfig.MastodonFilters. */
+	hideFilters *serverFilters
+	/* Holds crossposts back while the Bluesky account is deactivated or
+	 * taken down. */
+	target *targetStatus
+	/* Statuses deleted on Mastodon whose crossposts are to come down, see
+	 * checkDeletions. */
+	deletions *deletionTracker
+	/* When the account was last checked on, see checkAccount. */
+	checked time.Time
+
+	/* Statuses only count as seen once the publisher is done with them, be
+	 * it by crossposting them or by queueing them up for another go. */
+	cursorMu sync.Mutex
+	cursor   int64
+
+	fetched  chan *pipelineItem
+	prepared chan *pipelineItem
+	inflight *inflightSet
+	/* Held while a status gets published, so snapshots of the state of the
+	 * pair never catch one halfway through, see pairState.Snapshot. */
+	publishing sync.Mutex
+}
+
+func newAccountPipeline(deps accountDeps) *accountPipeline {
+	p := &accountPipeline{
+		accountDeps: deps,
+		key:         AccountKey{Instance: deps.instance, ID: deps.acct.ID, Target: deps.bskyProfile.DID},
+		offline:     offlineMode(),
+		shadow:      deps.transform.Shadow != nil && *deps.transform.Shadow,
+		spacer:      newPostSpacer(deps.transform),
+		duplicates:  &duplicateFilter{},
+		target:      &targetStatus{},
+		deletions:   newDeletionTracker(),
+		checked:     time.Now(),
+		fetched:     make(chan *pipelineItem, PipelineDepth),
+		prepared:    make(chan *pipelineItem, PipelineDepth),
+		inflight:    newInflightSet(),
+	}
+	if deps.transform.MaxPerHour != nil {
+		p.limiter = newPostLimiter(*deps.transform.MaxPerHour)
+	}
+	if deps.transform.Filters != nil && deps.transform.Filters.MastodonFilters && deps.writer != nil {
+		p.hideFilters = newServerFilters(deps.writer)
+	}
+	return p
+}
+
+/* Crossposts the account until ctx is done, or until it's paused or fails,
+ * bootstrapping it first if it's new. */
+func (p *accountPipeline) Run(ctx context.Context) error {
+	/* Check to see if we're bootstrapping this account. */
+	bootstrapped, err := p.store.HasAccount(p.key)
+	if err != nil {
+		return err
+	}
+
+	/* State from before accounts could be crossposted to more than one
+	 * place carries over to each of the places they now are. */
+	if !bootstrapped {
+		legacy := AccountKey{Instance: p.instance, ID: p.acct.ID}
+		found, err := p.store.HasAccount(legacy)
+		if err != nil {
+			return err
+		}
+		if found {
+			log.Printf("carrying state of @%v over to @%v", p.acct.Username, p.bskyProfile.Handle)
+			if err := p.store.CopyAccount(legacy, p.key); err != nil {
+				return err
+			}
+			bootstrapped = true
+		}
+	}
+	if !bootstrapped {
+		if err := bootstrapAccount(ctx, p.store, p.ms, p.bs, p.key, p.acct); err != nil {
+			return err
+		}
+	}
+
+	/* Catch up on whatever a crash left behind, before anything new goes
+	 * over. Not being able to isn't worth stopping over. */
+	if p.reconcileLast > 0 && p.leader.Leading() {
+		p.state.SetStatus("reconciling")
+		err := reconcileAccount(ctx, p.store, p.ms, p.bs, p.key, p.acct, p.bskyProfile.DID, statusQueryFor(p.transform), p.reconcileLast)
+		if err != nil {
+			log.Printf("WARNING: could not reconcile @%v with @%v: %v", p.acct.Username, p.bskyProfile.Handle, err)
+		}
+	}
+
+	/* Whatever's held back when we stop still gets written down. */
+	defer func() {
+		if err := flushWrites(p.store, p.key); err != nil {
+			log.Printf("ERROR: could not write down state of @%v: %v", p.acct.Username, err)
+		}
+	}()
+
+	cursor, err := p.store.Cursor(p.key)
+	if err != nil {
+		return err
+	}
+	p.cursor = cursor
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p.state.SetSnapshot(func(then func()) (*accountState, error) {
+		p.publishing.Lock()
+		defer p.publishing.Unlock()
+		if err := flushWrites(p.store, p.key); err != nil {
+			return nil, err
+		}
+		snapshot, err := exportAccountState(p.store, p.key, p.bskyProfile.Handle)
+		if err == nil && then != nil {
+			then()
+		}
+		return snapshot, err
+	})
+	defer p.state.SetSnapshot(nil)
+
+	/* The first stage to fail stops the others, and says why. Without any
+	 * failing, they only stop with --once. */
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+	for _, stage := range []func(context.Context) error{p.fetch, p.prepare, p.publish} {
+		wg.Add(1)
+		go func(stage func(context.Context) error) {
+			defer wg.Done()
+			if err := stage(ctx); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(stage)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+/* Counts a failure towards pausing the account, handing back the pausedError
+ * to stop with, if it's paused. */
+func (p *accountPipeline) failed(err error) error {
+	failures := int(p.failuresInARow.Add(1))
+	if p.pauseAfter > 0 && failures >= p.pauseAfter {
+		return pausedError{failures: failures, err: err}
+	}
+	return nil
+}
+
+/* Decides what to do about a status that failed to be crossposted,
+ * based on what went wrong: either it gets another go later on, or we
+ * give up on it right away. */
+func (p *accountPipeline) fail(entry RetryEntry, url string, err error) error {
+	/* Whatever else gets posted is fine, so this is no reason to stop
+	 * crossposting the account. */
+	if reason, ok := rejectionReason(err); ok {
+		log.Printf("ERROR: Bluesky turned %v down: %v", url, reason)
+		p.state.Failed(err)
+		p.reporter.Report(err, url, p.acct.Username)
+		stored := putRejectedMapping(p.store, p.key, entry.Status, reason)
+		if stored == nil {
+			stored = p.store.RemoveRetry(p.key, entry.Status)
+		}
+		if stored == nil {
+			recordEvent(p.store, p.key, pipelineEvent{Kind: EventFailed, Status: entry.Status, URL: url, Reason: reason})
+		}
+		return stored
+	}
+
+	/* Neither is it with a Bluesky account that's no longer active,
+	 * which only gets noticed and reported the once. */
+	if reason, ok := targetInactiveReason(err); ok {
+		if p.target.Inactive(reason) {
+			inactive := errors.New(fmt.Sprintf("Bluesky account @%v is %v", p.bskyProfile.Handle, reason))
+			log.Printf("ERROR: @%v is %v, holding crossposts until it's active again, checking every %v: %v",
+				p.bskyProfile.Handle,
+				reason,
+				TargetInactiveCheckInterval,
+				err)
+			p.state.Failed(inactive)
+			p.reporter.Report(inactive, url, p.acct.Username)
+			metrics.Set("vbc_target_inactive", "Whether a Bluesky account crossposted to is deactivated or taken down.", 1,
+				"handle", p.bskyProfile.Handle)
+		}
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(TargetInactiveCheckInterval)
+		return p.store.PutRetry(p.key, entry)
+	}
+
+	/* Without a network, nothing is wrong with the status, it just has
+	 * to wait for the network to come back, see offlineMode. */
+	if p.offline && isOfflineError(err) {
+		log.Printf("Bluesky: offline, holding %v back until the network is back", url)
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Time{}
+		return p.store.PutRetry(p.key, entry)
+	}
+
+	class := classifyError(err)
+	log.Printf("ERROR: failed to repost %v to Bluesky (%v): %v", url, class, err)
+	p.state.Failed(err)
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if class == errorReauth {
+		log.Printf("WARNING: credentials were rejected, they may need to be renewed")
+	}
+
+	var stored error
+	if class == errorPermanent || entry.Attempts >= RetryMaxAttempts {
+		log.Printf("giving up on %v after %v attempt(s)", url, entry.Attempts)
+		p.reporter.Report(err, url, p.acct.Username)
+		stored = p.store.PutDeadLetter(p.key, entry)
+		if stored == nil {
+			stored = putFailedMapping(p.store, p.key, entry)
+		}
+		if stored == nil {
+			stored = p.store.RemoveRetry(p.key, entry.Status)
+		}
+		if stored == nil {
+			recordEvent(p.store, p.key, pipelineEvent{Kind: EventFailed, Status: entry.Status, URL: url, Reason: err.Error()})
+		}
+	} else {
+		delay := backoffDelay(entry.Attempts, RetryBaseDelay, RetryMaxDelay)
+		var limited ErrRateLimited
+		if errors.As(err, &limited) && limited.RetryAfter > delay {
+			delay = limited.RetryAfter
+		}
+		entry.NextAttempt = time.Now().Add(delay)
+		log.Printf("will retry %v in %v", url, delay.Round(time.Second))
+		stored = p.store.PutRetry(p.key, entry)
+		if stored == nil {
+			recordEvent(p.store, p.key, pipelineEvent{Kind: EventRetried, Status: entry.Status, URL: url, Reason: err.Error()})
+		}
+	}
+	if stored != nil {
+		return stored
+	}
+
+	if accountFailure(err) {
+		return p.failed(err)
+	}
+	return nil
+}
+
+/* Puts a status the transformer is done with up on Bluesky, and records
+ * where it went. */
+func (p *accountPipeline) crosspost(item *pipelineItem) error {
+	status := item.status
+	entry := item.entry
+
+	/* Over the limit, statuses wait their turn in the retry queue. */
+	if wait := p.limiter.Wait(); wait > 0 {
+		item.span.End(nil)
+		entry.NextAttempt = time.Now().Add(wait)
+		log.Printf("Mastodon: holding back %v for %v, @%v is at its limit of %v crosspost(s) an hour",
+			status.URL,
+			wait.Round(time.Second),
+			p.acct.Username,
+			*p.transform.MaxPerHour)
+		return p.store.PutRetry(p.key, entry)
+	}
+	if wait := p.target.Wait(); wait > 0 {
+		item.span.End(nil)
+		entry.NextAttempt = time.Now().Add(wait)
+		log.Printf("Bluesky: holding back %v for %v, @%v is %v",
+			status.URL,
+			wait.Round(time.Second),
+			p.bskyProfile.Handle,
+			p.target.Reason())
+		return p.store.PutRetry(p.key, entry)
+	}
+
+	ctx := item.ctx
+	var spanErr error
+	defer func() { item.span.End(spanErr) }()
+
+	var mapping *StatusMapping
+	err := item.err
+	if original := p.duplicates.Check(status); err == nil && original != "" {
+		log.Printf("Mastodon: %v looks like %v posted again, only crossposting the first", status.URL, original)
+		err = skipped("duplicate of %v", original)
+	}
+	if err == nil && p.shadow {
+		mapping = shadowRepost(item.posts)
+		log.Printf("Bluesky: shadow mode, not crossposting %v as %v post(s)", status.URL, len(item.posts))
+		p.failuresInARow.Store(0)
+		p.duplicates.Sent(status)
+	} else if err == nil {
+		if wait := p.spacer.Wait(); wait > 0 {
+			log.Printf("Mastodon: waiting %v before crossposting %v, see postDelay", wait.Round(time.Second), status.URL)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				spanErr = ctx.Err()
+				return ctx.Err()
+			}
+		}
+
+		/* Other accounts crossposted to the same place go first, when
+		 * their statuses are older. */
+		done, waitErr := p.bs.publishes.Wait(ctx, status.CreatedAt)
+		if waitErr != nil {
+			spanErr = waitErr
+			return waitErr
+		}
+		if p.transform.SelfBoosts == SelfBoostsRepost && isSelfBoost(status) {
+			mapping, err = publishSelfBoost(ctx, p.store, p.key, status, p.bs, p.bskyProfile.DID)
+		} else {
+			mapping, err = publishRepost(ctx, p.store, p.key, status, item.posts, p.bs, p.bskyProfile, p.transform)
+		}
+		done()
+		if err == nil {
+			if reason, was := p.target.Active(); was {
+				log.Printf("Bluesky: @%v is no longer %v, catching up", p.bskyProfile.Handle, reason)
+				metrics.Set("vbc_target_inactive", "Whether a Bluesky account crossposted to is deactivated or taken down.", 0,
+					"handle", p.bskyProfile.Handle)
+			}
+			p.failuresInARow.Store(0)
+			p.limiter.Sent()
+			p.spacer.Sent()
+			p.duplicates.Sent(status)
+		}
+	}
+	spanErr = err
+
+	/* Keep an eye on how the crosspost does. */
+	if err == nil && mapping.Posted() {
+		if err := trackEngagement(p.store, p.bskyProfile.DID, mapping.Uri, status.URL); err != nil {
+			log.Printf("WARNING: could not track engagement of %v: %v", mapping.Uri, err)
+		}
+	}
+
+	/* Skipped statuses still get a mapping, saying why they were. */
+	var skip skipError
+	if errors.As(err, &skip) {
+		log.Printf("Mastodon: not reposting %v: %v", status.URL, skip.reason)
+		skippedMapping := newMapping(MappingSkipped)
+		skippedMapping.Error = skip.reason
+		mapping = &skippedMapping
+	} else if err != nil {
+		return p.fail(entry, status.URL, err)
+	}
+
+	value, err := encodeMapping(*mapping)
+	if err != nil {
+		return err
+	}
+
+	_, write := startSpan(ctx, "store")
+	err = p.store.PutMapping(p.key, status.ID, value)
+	if err == nil {
+		err = p.store.RemoveRetry(p.key, status.ID)
+	}
+	write.End(err)
+	if err != nil {
+		spanErr = err
+		return err
+	}
+	if mapping.Posted() {
+		recordEvent(p.store, p.key, pipelineEvent{
+			Kind:   EventPosted,
+			Status: status.ID,
+			URL:    status.URL,
+			Post:   blueskyPostURL(p.bskyProfile.Handle, mapping.Uri),
+		})
+	} else if mapping.State == MappingSkipped {
+		recordEvent(p.store, p.key, pipelineEvent{Kind: EventSkipped, Status: status.ID, URL: status.URL, Reason: mapping.Error})
+	}
+
+	/* Nothing held back gets lost in a crash that'd have the status
+	 * crossposted again, but the reply and the webhook below would be
+	 * sent again along with it, so the mapping goes down first. */
+	crossLink := p.writer != nil && p.transform.CrossLink != ""
+	if mapping.Posted() && (crossLink || p.transform.Webhook != "") {
+		if err := flushWrites(p.store, p.key); err != nil {
+			spanErr = err
+			return err
+		}
+	}
+
+	/* Point people on Mastodon to the crosspost. It's up either way, so
+	 * this isn't worth failing over. */
+	if mapping.Posted() && crossLink {
+		link := blueskyPostURL(p.bskyProfile.Handle, mapping.Uri)
+		if err := p.writer.CrossLink(ctx, status, link, p.transform.CrossLink); err != nil {
+			log.Printf("WARNING: could not link %v to %v: %v", status.URL, link, err)
+		}
+	}
+
+	if p.transform.Webhook != "" && mapping.Posted() {
+		event := crosspostEvent{
+			Status:  status.URL,
+			Post:    blueskyPostURL(p.bskyProfile.Handle, mapping.Uri),
+			Uri:     mapping.Uri,
+			Text:    renderStatusText(status.Content),
+			Posts:   make([]string, 0, len(item.posts)),
+			Account: accountHandle(p.acct),
+			Handle:  p.bskyProfile.Handle,
+			Time:    time.Now().UTC(),
+		}
+		for _, post := range item.posts {
+			event.Posts = append(event.Posts, post.Text)
+		}
+		sendCrosspostWebhook(p.transform.Webhook, event)
+	}
+	return nil
+}
+
+/* Brings edits of a crossposted status over, once per version of it. A
+ * status without a revision written down has it written down as it is,
+ * there being no telling what was crossposted. */
+func (p *accountPipeline) syncEdit(ctx context.Context, status *madon.Status, value []byte) error {
+	mapped, err := decodeMapping(value)
+	if err != nil || !mapped.Posted() {
+		return nil
+	}
+	revision := statusRevision(status)
+	if mapped.Revision == revision {
+		return nil
+	}
+
+	if mapped.Revision != "" {
+		log.Printf("Mastodon: @%v edited status %v, bringing the edit over", p.acct.Username, status.URL)
+		updated, err := propagateEdit(ctx, p.store, p.key, status, mapped, p.ms, p.bs, p.bskyProfile, p.transform)
+		var skip skipError
+		if errors.As(err, &skip) {
+			log.Printf("Mastodon: not bringing the edit of %v over: %v", status.URL, skip.reason)
+		} else if err != nil && classifyError(err) != errorPermanent {
+			/* It gets another go the next time around. */
+			log.Printf("WARNING: could not bring the edit of %v over: %v", status.URL, err)
+			return nil
+		} else if err != nil {
+			log.Printf("ERROR: could not bring the edit of %v over: %v", status.URL, err)
+		} else {
+			mapped = updated
+			recordEvent(p.store, p.key, pipelineEvent{
+				Kind:   EventEdited,
+				Status: status.ID,
+				URL:    status.URL,
+				Post:   blueskyPostURL(p.bskyProfile.Handle, mapped.Uri),
+			})
+		}
+	}
+
+	mapped.Revision = revision
+	mapped.Updated = time.Now().UTC()
+	value, err = encodeMapping(*mapped)
+	if err != nil {
+		return err
+	}
+	return p.store.PutMapping(p.key, status.ID, value)
+}
+
+/* Waits out the account having gone away, if it has, handing back
+ * whether it had. */
+func (p *accountPipeline) checkAccount(ctx context.Context) (bool, error) {
+	p.checked = time.Now()
+	reason, err := p.ms.AccountGone(p.acct.ID)
+	if err != nil {
+		log.Printf("WARNING: could not check on @%v: %v", p.acct.Username, err)
+		return false, nil
+	}
+	if reason == "" {
+		return false, nil
+	}
+	if err := flushWrites(p.store, p.key); err != nil {
+		return true, err
+	}
+	return true, watchAccount(ctx, p.ms, p.acct.ID, "@"+p.acct.Username, reason, p.transform.AccountGone, p.reporter, p.state)
+}
+
+func (p *accountPipeline) currentCursor() int64 {
+	p.cursorMu.Lock()
+	defer p.cursorMu.Unlock()
+	return p.cursor
+}
+
+/* Moves the cursor on to id, unless it's past it already. */
+func (p *accountPipeline) advanceCursor(id int64) error {
+	p.cursorMu.Lock()
+	defer p.cursorMu.Unlock()
+	if id <= p.cursor {
+		return nil
+	}
+	p.cursor = id
+	return p.store.PutCursor(p.key, id)
+}
+
+/* Whether a status is waiting in the retry queue. */
+func (p *accountPipeline) isQueued(id int64) (bool, error) {
+	queue, err := p.store.RetryQueue(p.key)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range queue {
+		if entry.Status == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/* Says how many statuses are waiting on each stage. */
+func (p *accountPipeline) report() {
+	reportPipeline(p.key, p.state, len(p.fetched), len(p.prepared))
+}
+
+/* Takes the crossposts of statuses deleted on Mastodon down, once
+ * they've stayed deleted for long enough, see deleteGrace. */
+func (p *accountPipeline) checkDeletions(ctx context.Context, statuses []madon.Status) error {
+	if p.transform.Deletions != DeletionsPropagate {
+		return nil
+	}
+	grace := deleteGrace(p.transform)
+	for _, id := range p.deletions.Polled(statuses) {
+		value, err := p.store.Mapping(p.key, id)
+		if err != nil {
+			return err
+		}
+		if mapped, err := decodeMapping(value); value == nil || err != nil || !mapped.Posted() {
+			continue
+		}
+		log.Printf("Mastodon: status %v of @%v is gone, deleting its crosspost in %v unless it comes back",
+			id,
+			p.acct.Username,
+			grace)
+		p.deletions.Schedule(id, time.Now().Add(grace))
+	}
+
+	for _, id := range p.deletions.Due(time.Now()) {
+		if p.inflight.Has(id) {
+			continue
+		}
+		gone, err := p.ms.StatusGone(id)
+		if err != nil {
+			/* Not knowing is no reason to delete, it gets checked
+			 * again the next time around. */
+			log.Printf("WARNING: could not check whether status %v of @%v is gone: %v", id, p.acct.Username, err)
+			continue
+		}
+		if !gone {
+			log.Printf("Mastodon: status %v of @%v is back, leaving its crosspost up", id, p.acct.Username)
+			p.deletions.Cancel(id)
+			continue
+		}
+
+		value, err := p.store.Mapping(p.key, id)
+		if err != nil {
+			return err
+		}
+		mapped, err := decodeMapping(value)
+		if value == nil || err != nil || !mapped.Posted() {
+			p.deletions.Cancel(id)
+			continue
+		}
+		if err := deleteCrosspost(ctx, p.bs, p.bskyProfile.DID, mapped, p.transform); err != nil {
+			log.Printf("ERROR: could not delete %v, the crosspost of deleted status %v: %v", mapped.Uri, id, err)
+			continue
+		}
+		log.Printf("Bluesky: deleted %v, as status %v of @%v was", mapped.Uri, id, p.acct.Username)
+		p.deletions.Cancel(id)
+
+		mapped.State = MappingDeleted
+		mapped.Updated = time.Now().UTC()
+		updated, err := encodeMapping(*mapped)
+		if err != nil {
+			return err
+		}
+		if err := p.store.PutMapping(p.key, id, updated); err != nil {
+			return err
+		}
+		recordEvent(p.store, p.key, pipelineEvent{
+			Kind:   EventDeleted,
+			Status: id,
+			Post:   blueskyPostURL(p.bskyProfile.Handle, mapped.Uri),
+		})
+	}
+	return nil
+}
+
+/* Finds what needs crossposting: statuses in the retry queue that are
+ * due, new statuses, and crossposted ones that got edited. */
+func (p *accountPipeline) fetch(ctx context.Context) error {
+	defer close(p.fetched)
+	send := func(item *pipelineItem) error {
+		err := sendItem(ctx, p.fetched, item)
+		p.report()
+		return err
+	}
+
+	pollFailures := 0
+	gaps := 0
+	for {
+		if !p.leader.Leading() {
+			log.Printf("leader: not the leader, waiting before polling @%v", p.acct.Username)
+			p.state.SetStatus("waiting to become the leader")
+			if err := p.leader.WaitLeading(ctx); err != nil {
+				return err
+			}
+		}
+
+		/* Wait out instances that are down, rather than failing to
+		 * poll them over and over. */
+		if delay, up := p.health.Check(ctx); !up {
+			if pollOnce {
+				return errors.New(fmt.Sprintf("%v is down", p.instance))
+			}
+			p.state.SetStatus("waiting for the instance to come back")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		/* Suspended accounts just have no statuses, so polling alone
+		 * doesn't tell. */
+		if time.Since(p.checked) > AccountCheckInterval {
+			if _, err := p.checkAccount(ctx); err != nil {
+				return err
+			}
+		}
+
+		p.state.SetStatus("polling")
+
+		/* Give the statuses that failed before another go, once
+		 * they're due. */
+		queue, err := p.store.RetryQueue(p.key)
+		if err != nil {
+			return err
+		}
+		/* Oldest first, so replies waiting on what they reply to
+		 * go after it. */
+		sort.Slice(queue, func(i, j int) bool { return queue[i].Status < queue[j].Status })
+		for _, entry := range queue {
+			if !p.leader.Leading() {
+				break
+			}
+			if time.Now().Before(entry.NextAttempt) || !p.inflight.Add(entry.Status) {
+				continue
+			}
+
+			var status *madon.Status
+			err := p.ms.Do(func(mc *madon.Client) error {
+				s, err := mc.GetStatus(entry.Status)
+				status = s
+				return err
+			})
+			if err != nil {
+				if err := send(&pipelineItem{entry: entry, err: err}); err != nil {
+					return err
+				}
+				continue
+			}
+			if entry.Attempts > 0 {
+				log.Printf("Mastodon: retrying status %v", status.URL)
+			} else {
+				log.Printf("Mastodon: reposting held back status %v", status.URL)
+			}
+			if err := send(&pipelineItem{status: status, entry: entry}); err != nil {
+				return err
+			}
+		}
+
+		statuses, err := p.ms.AccountStatuses(p.acct.ID, statusQueryFor(p.transform), &madon.LimitParams{Limit: PollLimit})
+		if err != nil {
+			if code, _ := errorStatusCode(err); code == http.StatusNotFound || code == http.StatusGone {
+				gone, err := p.checkAccount(ctx)
+				if err != nil {
+					return err
+				}
+				if gone {
+					continue
+				}
+			}
+			if classifyError(err) != errorRetryable {
+				if err := p.failed(err); err != nil {
+					return err
+				}
+			}
+			if pollOnce {
+				return errors.New(fmt.Sprintf("could not fetch statuses of @%v: %v", p.acct.Username, err))
+			}
+
+			/* Don't hammer an instance that's having a bad time. */
+			pollFailures++
+			delay := backoffDelay(pollFailures, PollBaseDelay, PollMaxDelay)
+			log.Printf("ERROR: could not fetch statuses of @%v, trying again in %v: %v",
+				p.acct.Username,
+				delay.Round(time.Second),
+				err)
+			p.state.Failed(err)
+			p.state.Polled(p.currentCursor(), len(queue), time.Now().Add(delay))
+			p.state.SetStatus("waiting to poll again after failing to")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		pollFailures = 0
+		if err := p.checkDeletions(ctx, statuses); err != nil {
+			return err
+		}
+
+		/* More statuses than fit in a poll having been posted since
+		 * the last one leaves those in between out, so should the
+		 * page start past the cursor, go back as far as it for
+		 * them, rather than have them go missing without a word. */
+		if oldest := len(statuses) - 1; oldest >= 0 && p.currentCursor() > 0 && statuses[oldest].ID > p.currentCursor() {
+			missed, err := p.ms.AccountStatuses(p.acct.ID, statusQueryFor(p.transform), &madon.LimitParams{
+				SinceID: p.currentCursor(),
+				MaxID:   statuses[oldest].ID,
+				All:     true,
+			})
+			if err != nil {
+				log.Printf("WARNING: Mastodon: possible gap in the statuses of @%v, after %v, could not go back for them: %v",
+					p.acct.Username,
+					p.currentCursor(),
+					err)
+			} else if len(missed) > 0 {
+				gaps++
+				log.Printf("WARNING: Mastodon: @%v posted %v status(es) more than the last poll saw, catching up on them",
+					p.acct.Username,
+					len(missed))
+				metrics.Set("vbc_poll_gaps", "Times polling an account found statuses it would have missed, and went back for them.", float64(gaps),
+					"account", fmt.Sprintf("%v@%v", p.acct.ID, p.instance), "handle", p.bskyProfile.Handle)
+				statuses = append(statuses, missed...)
+			}
+		}
+
+		/* Oldest first, the same order they were posted in, with
+		 * replies after what they reply to. */
+		ordered := threadOrder(statuses)
+		for i := range ordered {
+			status := ordered[i]
+			if !p.leader.Leading() {
+				break
+			}
+			/* Still on its way, the publisher takes it from here. */
+			if p.inflight.Has(status.ID) {
+				continue
+			}
+
+			mapping, err := p.store.Mapping(p.key, status.ID)
+			if err != nil {
+				return err
+			}
+			if mapping != nil {
+				if err := p.advanceCursor(status.ID); err != nil {
+					return err
+				}
+				mapped, err := decodeMapping(mapping)
+				if err != nil || !mapped.Posted() || mapped.Revision == statusRevision(&status) {
+					continue
+				}
+				if !p.inflight.Add(status.ID) {
+					continue
+				}
+				if err := send(&pipelineItem{status: &status, edited: mapping}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			/* Statuses from before the cursor were seen already, unless
+			 * they're scheduled ones that only just got published. */
+			late := status.ID <= p.currentCursor()
+			if late && time.Since(status.CreatedAt) > ScheduledGrace {
+				continue
+			}
+			if late {
+				queued, err := p.isQueued(status.ID)
+				if err != nil {
+					return err
+				}
+				if queued {
+					continue
+				}
+				log.Printf("Mastodon: @%v has scheduled status to repost, published after newer ones: %v",
+					p.acct.Username,
+					status.URL)
+			} else {
+				log.Printf("Mastodon: @%v has new status to repost: %v",
+					p.acct.Username,
+					status.URL)
+			}
+
+			if !p.inflight.Add(status.ID) {
+				continue
+			}
+			if err := send(&pipelineItem{status: &status, entry: RetryEntry{Status: status.ID}}); err != nil {
+				return err
+			}
+		}
+
+		/* With --once, what's been sent off is all there is, and the
+		 * other stages stop once they're done with it. */
+		if pollOnce {
+			p.state.Polled(p.currentCursor(), len(queue), time.Time{})
+			p.state.SetStatus("finishing up")
+			return nil
+		}
+		p.state.Polled(p.currentCursor(), len(queue), time.Now().Add(p.pollInterval))
+		p.state.SetStatus("waiting to poll")
+		select {
+		case <-time.After(p.pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/* Turns the statuses the fetcher found into posts, fetching what they
+ * link to along the way. Edits and statuses that couldn't be fetched go
+ * straight through to the publisher. */
+func (p *accountPipeline) prepare(ctx context.Context) error {
+	defer close(p.prepared)
+	for item := range p.fetched {
+		p.report()
+		if item.status != nil && item.edited == nil {
+			item.ctx, item.span = startSpan(ctx, "crosspost",
+				"mastodon.status", item.status.URL,
+				"mastodon.account", p.acct.Username,
+				"bluesky.did", p.bskyProfile.DID)
+
+			_, fetch := startSpan(item.ctx, "fetch")
+			extras, err := p.ms.StatusExtras(item.status.ID)
+			fetch.End(err)
+			item.extras = extras
+
+			if err != nil {
+				item.err = err
+			} else if extras.LocalOnly {
+				item.err = skipped("status is local-only")
+			} else if title, hidden, err := p.hideFilters.Match(item.ctx, item.status); err != nil {
+				item.err = err
+			} else if hidden {
+				item.err = skipped("status matches filter %q", title)
+			} else if p.transform.SelfBoosts == SelfBoostsRepost && isSelfBoost(item.status) {
+				/* Nothing to turn into posts, its crosspost gets
+				 * reposted instead. */
+			} else if isCrossLinkReply(item.status, renderStatusText(item.status.Content)) {
+				item.err = skipped("status links to a crosspost")
+			} else {
+				item.posts, item.err = prepareRepost(item.ctx, p.store, p.key, item.status, extras, p.bskyProfile, p.transform)
+			}
+		}
+
+		err := sendItem(ctx, p.prepared, item)
+		p.report()
+		if err != nil {
+			if item.ctx != nil {
+				item.span.End(err)
+			}
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+/* Puts what the transformer made up on Bluesky, one status at a time,
+ * writing down everything it does in one go whenever it catches up. */
+func (p *accountPipeline) publishItem(ctx context.Context, item *pipelineItem) error {
+	p.publishing.Lock()
+	defer p.publishing.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id := item.entry.Status
+	if item.status != nil {
+		id = item.status.ID
+	}
+
+	/* Whoever leads now finds the status again. */
+	if !p.leader.Leading() {
+		if item.ctx != nil {
+			item.span.End(nil)
+		}
+		p.inflight.Remove(id)
+		return nil
+	}
+
+	holdWrites(p.store, p.key)
+	var err error
+	switch {
+	case item.edited != nil:
+		err = p.syncEdit(ctx, item.status, item.edited)
+	case item.status == nil:
+		err = p.fail(item.entry, strconv.FormatInt(item.entry.Status, 10), item.err)
+	default:
+		err = p.crosspost(item)
+		if err == nil {
+			err = p.advanceCursor(item.status.ID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	p.inflight.Remove(id)
+	if len(p.prepared) == 0 {
+		return flushWrites(p.store, p.key)
+	}
+	return nil
+}
+
+func (p *accountPipeline) publish(ctx context.Context) error {
+	for item := range p.prepared {
+		p.report()
+		if err := p.publishItem(ctx, item); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* How many of the latest crossposts of every account get looked at, when
+ * not told otherwise. */
+const AuditLastDefault = 50
+
+/* Why an image went out without alt text. */
+const (
+	AltNotDescribed    = "not described on Mastodon either"
+	AltDescribedLater  = "described on Mastodon after it was crossposted"
+	AltLost            = "described on Mastodon, but lost on the way over"
+	AltStatusGone      = "status is no longer on Mastodon to tell why"
+	AltNoMatchingMedia = "no image on Mastodon to match it with"
+)
+
+/* An image of a crosspost that went out without alt text. */
+type altTextFinding struct {
+	Instance  string `json:"instance"`
+	Account   int64  `json:"account"`
+	Handle    string `json:"handle"`
+	Status    int64  `json:"status"`
+	StatusURL string `json:"statusUrl"`
+	PostURL   string `json:"postUrl"`
+	/* Which of the images of the crosspost it is, from 1. */
+	Image  int    `json:"image"`
+	Reason string `json:"reason"`
+}
+
+/* Looks through the last crossposts of a pair for images without alt text,
+ * handing back how many images were looked at along with those. Images go
+ * over in the order they're attached in on Mastodon, so that's how they're
+ * told apart. */
+func auditAltText(
+	ctx context.Context,
+	store Store,
+	pair accountPair,
+	appview *xrpc.Client,
+	last int) (int, []altTextFinding, error) {
+
+	key, bootstrapped, err := storedPairKey(ctx, store, pair)
+	if err != nil || !bootstrapped {
+		return 0, nil, err
+	}
+	values, err := store.Mappings(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ids := make([]int64, 0, len(values))
+	for id, value := range values {
+		if mapping, err := decodeMapping(value); err == nil && mapping.Posted() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if last > 0 && len(ids) > last {
+		ids = ids[:last]
+	}
+	var uris []string
+	for _, id := range ids {
+		uris = append(uris, mappingPostURIs(values[id])...)
+	}
+	posts, err := fetchExportPosts(ctx, appview, uris)
+	if err != nil {
+		return 0, nil, err
+	}
+	mc, err := madon.RestoreApp(AppName, pair.Instance, "", "", nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	images := 0
+	var findings []altTextFinding
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		mapping, _ := decodeMapping(values[id])
+		var alts []string
+		for _, uri := range mappingPostURIs(values[id]) {
+			if post, found := posts[uri]; found && post.Embed != nil {
+				for _, image := range post.Embed.Images {
+					alts = append(alts, image.Alt)
+				}
+			}
+		}
+		images += len(alts)
+		if len(alts) == 0 {
+			continue
+		}
+
+		statusURL := fmt.Sprintf("%v/web/statuses/%v", pair.Instance, id)
+		var descriptions []string
+		status, statusErr := mc.GetStatus(id)
+		if statusErr == nil {
+			statusURL = status.URL
+			for _, attachment := range status.MediaAttachments {
+				if attachment.Type != "image" {
+					continue
+				}
+				description := ""
+				if attachment.Description != nil {
+					description = strings.TrimSpace(*attachment.Description)
+				}
+				descriptions = append(descriptions, description)
+			}
+		}
+
+		for n, alt := range alts {
+			if strings.TrimSpace(alt) != "" {
+				continue
+			}
+			reason := AltStatusGone
+			switch {
+			case statusErr != nil:
+			case n >= len(descriptions):
+				reason = AltNoMatchingMedia
+			case descriptions[n] == "":
+				reason = AltNotDescribed
+			case mapping.Revision != "" && mapping.Revision != statusRevision(status):
+				reason = AltDescribedLater
+			default:
+				reason = AltLost
+			}
+			findings = append(findings, altTextFinding{
+				Instance:  pair.Instance,
+				Account:   pair.AccountID,
+				Handle:    pair.Handle,
+				Status:    id,
+				StatusURL: statusURL,
+				PostURL:   blueskyPostURL(pair.Handle, mapping.Uri),
+				Image:     n + 1,
+				Reason:    reason,
+			})
+		}
+	}
+	return images, findings, nil
+}
+
+func auditCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: vbc audit alt-text [--last <n>] [--json]\n\n")
+		fmt.Fprintf(os.Stderr, "Alt-text looks through the latest crossposts of every account for\n")
+		fmt.Fprintf(os.Stderr, "images that went out without alt text, and says why: whether they\n")
+		fmt.Fprintf(os.Stderr, "weren't described on Mastodon either, were described after being\n")
+		fmt.Fprintf(os.Stderr, "crossposted, or lost their description on the way over. Can be done\n")
+		fmt.Fprintf(os.Stderr, "while vbc is running.\n")
+	}
+	if len(args) == 0 || args[0] != "alt-text" {
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("audit alt-text", flag.ExitOnError)
+	last := fs.Int("last", AuditLastDefault, "how many of the latest crossposts of every account to look at, 0 for all of them")
+	asJSON := fs.Bool("json", false, "print images without alt text as JSON lines")
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(os.Stderr, "\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args[1:])
+	if fs.NArg() != 0 || *last < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	appview := &xrpc.Client{Host: PublicAppView}
+	encoder := json.NewEncoder(os.Stdout)
+	for i, pair := range config.Pairs() {
+		images, findings, err := auditAltText(ctx, store, pair, appview, *last)
+		if err != nil {
+			log.Fatalf("could not audit account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+		}
+
+		if *asJSON {
+			for _, finding := range findings {
+				_ = encoder.Encode(finding)
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%v on %v to @%v: %v of %v image(s) without alt text\n",
+			pair.AccountID,
+			pair.Instance,
+			pair.Handle,
+			len(findings),
+			images)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, finding := range findings {
+			fmt.Fprintf(w, "  %v\timage %v\t%v\n", finding.PostURL, finding.Image, finding.Reason)
+		}
+		_ = w.Flush()
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* Runs fn, and if it failed because our credentials got rejected, runs reauth
+ * followed by fn once more. */
+func withReauth(fn func() error, reauth func() error) error {
+	err := fn()
+	if err == nil || classifyError(err) != errorReauth {
+		return err
+	}
+
+	if rerr := reauth(); rerr != nil {
+		return errors.New(fmt.Sprintf("%v (and could not authenticate again: %v)", err, rerr))
+	}
+	return fn()
+}
+
+/* Keeps a Bluesky client logged in. Sessions set up with `vbc bsky-login`
+ * have their OAuth tokens refreshed as needed, while app password sessions
+ * log in again from scratch whenever they get rejected mid-run.
+ *
+ * Every pair crossposting to the same Bluesky account shares its session,
+ * along with whatever else runs for the account, so it's safe to use from
+ * any number of goroutines, and they all go through the same rate limit. */
+type blueskySession struct {
+	server  string
+	handle  string
+	appKey  *string
+	oauth   *oauthSession
+	limiter *rateLimiter
+
+	/* Held while logging in again, so only one goroutine ever does. */
+	reauthMu sync.Mutex
+
+	mu     sync.Mutex
+	client *bluesky.Client
+	/* Goes up every time we log in again, see Reauth. */
+	generation uint64
+
+	/* Whose turn it is to publish, among the accounts crossposted here. */
+	publishes publishOrder
+}
+
+func newBlueskySession(
+	ctx context.Context,
+	store Store,
+	server string,
+	handle string,
+	appKey *string,
+	rateLimit float64) (*blueskySession, error) {
+
+	oauth, err := loadOAuthSession(store, handle)
+	if err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("could not load OAuth session from store: %v", err)))
+	}
+	if oauth != nil {
+		log.Printf("Bluesky: using OAuth session of @%v", handle)
+		if appKey != nil {
+			log.Printf("WARNING: VBC_BSKY_APP_KEY is set along with an OAuth session, ignoring.")
+		}
+		return &blueskySession{
+			server:  server,
+			handle:  handle,
+			oauth:   oauth,
+			limiter: newRateLimiter(rateLimit),
+		}, nil
+	}
+
+	if appKey == nil {
+		return nil, permanent(errors.New(fmt.Sprintf("no credentials for @%v, set VBC_BSKY_APP_KEY or run `vbc bsky-login %v`", handle, handle)))
+	}
+	client, err := newBlueskyClient(ctx, server, handle, *appKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blueskySession{
+		server:  server,
+		handle:  handle,
+		appKey:  appKey,
+		limiter: newRateLimiter(rateLimit),
+		client:  client,
+	}, nil
+}
+
+func (s *blueskySession) Client() *bluesky.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client
+}
+
+func (s *blueskySession) Generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.generation
+}
+
+/* Logs in again, unless that already happened since generation, which is the
+ * one the rejected request went out with. Goroutines whose requests get
+ * rejected at the same time would otherwise all log in again, one after the
+ * other, each throwing away the session the one before it got. */
+func (s *blueskySession) Reauth(ctx context.Context, generation uint64) error {
+	s.reauthMu.Lock()
+	defer s.reauthMu.Unlock()
+
+	if s.Generation() != generation {
+		return nil
+	}
+
+	if s.oauth != nil {
+		log.Printf("Bluesky: access token was rejected, refreshing it")
+		if err := s.oauth.Refresh(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.generation++
+		s.mu.Unlock()
+		return nil
+	}
+
+	log.Printf("Bluesky: session was rejected, logging in again as @%v", s.handle)
+	client, err := newBlueskyClient(ctx, s.server, s.handle, *s.appKey)
+	if err != nil {
+		log.Printf("ERROR: could not log into Bluesky again. If the app key was revoked,")
+		log.Printf("ERROR: create a new one and set it in VBC_BSKY_APP_KEY.")
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.client
+	s.client = client
+	s.generation++
+	s.mu.Unlock()
+
+	_ = old.Close()
+	return nil
+}
+
+/* Switches over to a new app key, logging in with it before letting go of
+ * the session we have, so nothing fails in between. Should the key not work,
+ * the old session goes on being used. OAuth sessions have nothing to rotate,
+ * they refresh themselves. */
+func (s *blueskySession) Rotate(ctx context.Context, appKey *string) (bool, error) {
+	s.reauthMu.Lock()
+	defer s.reauthMu.Unlock()
+
+	if s.oauth != nil || appKey == nil || (s.appKey != nil && *s.appKey == *appKey) {
+		return false, nil
+	}
+	client, err := newBlueskyClient(ctx, s.server, s.handle, *appKey)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	old := s.client
+	s.client = client
+	s.appKey = appKey
+	s.generation++
+	s.mu.Unlock()
+
+	_ = old.Close()
+	return true, nil
+}
+
+func (s *blueskySession) customCall(fn func(client *xrpc.Client) error) error {
+	if s.oauth != nil {
+		return fn(s.oauth.XRPC())
+	}
+	return s.Client().CustomCall(fn)
+}
+
+func (s *blueskySession) CustomCall(ctx context.Context, fn func(client *xrpc.Client) error) error {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	generation := s.Generation()
+	err := withReauth(
+		func() error { return s.customCall(fn) },
+		func() error { return s.Reauth(ctx, generation) })
+	return rejected(rateLimited(err, 0))
+}
+
+func (s *blueskySession) FetchProfile(ctx context.Context, id string) (*bluesky.Profile, error) {
+	if s.oauth != nil {
+		return s.fetchOAuthProfile(ctx, id)
+	}
+
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	var profile *bluesky.Profile
+	generation := s.Generation()
+	err := withReauth(
+		func() error {
+			p, err := s.Client().FetchProfile(ctx, id)
+			profile = p
+			return err
+		},
+		func() error { return s.Reauth(ctx, generation) })
+	return profile, err
+}
+
+/* go-bluesky can't be handed our OAuth client, so fetch the bits of the
+ * profile we use ourselves. */
+func (s *blueskySession) fetchOAuthProfile(ctx context.Context, id string) (*bluesky.Profile, error) {
+	var res struct {
+		Did         string  `json:"did"`
+		Handle      string  `json:"handle"`
+		DisplayName *string `json:"displayName"`
+		Description *string `json:"description"`
+	}
+	err := s.CustomCall(ctx, func(client *xrpc.Client) error {
+		return client.Do(ctx, xrpc.Query, "", "app.bsky.actor.getProfile",
+			map[string]interface{}{"actor": id}, nil, &res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &bluesky.Profile{
+		Handle: res.Handle,
+		DID:    res.Did,
+	}
+	if res.DisplayName != nil {
+		profile.Name = *res.DisplayName
+	}
+	if res.Description != nil {
+		profile.Bio = *res.Description
+	}
+	return profile, nil
+}
+
+func newBlueskyClient(ctx context.Context, server string, handle string, appKey string) (*bluesky.Client, error) {
+	log.Printf("Bluesky: connecting to %v", server)
+	bc, err := bluesky.Dial(ctx, server)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not connect to %v: %v", server, err))
+	}
+
+	log.Printf("Bluesky: logging in as @%v", handle)
+	err = bc.Login(ctx, handle, appKey)
+	if err != nil {
+		_ = bc.Close()
+		return nil, errors.New(fmt.Sprintf("could not login to %v: %v", server, err))
+	}
+
+	return bc, nil
+}
+
+/* Keeps a Mastodon client around, rebuilding it whenever the instance starts
+ * rejecting it. */
+type mastodonSession struct {
+	store     Store
+	instance  string
+	appId     *string
+	appSecret *string
+
+	/* Held while setting the client up again, so accounts on the same
+	 * instance don't each register an app of their own. */
+	reauthMu sync.Mutex
+
+	mu     sync.Mutex
+	client *madon.Client
+	/* Goes up every time the client gets set up again. */
+	generation uint64
+}
+
+/* The app credentials in the environment, if instance is the one they go
+ * with. Every other instance gets an app of its own in the store. */
+func envAppCredentials(instance string) (*string, *string) {
+	env := envOrNil("VBC_MASTODON_INSTANCE")
+	if env == nil || canonicalizeInstanceName(*env) != instance {
+		return nil, nil
+	}
+	return envOrNil("VBC_MASTODON_APP_ID"), envOrNil("VBC_MASTODON_APP_SECRET")
+}
+
+func newMastodonSession(store Store, instanceName string, appId, appSecret *string) (*mastodonSession, error) {
+	client, err := newMastodonClient(store, instanceName, appId, appSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mastodonSession{
+		store:     store,
+		instance:  instanceName,
+		appId:     appId,
+		appSecret: appSecret,
+		client:    client,
+	}, nil
+}
+
+func (s *mastodonSession) Client() *madon.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client
+}
+
+func (s *mastodonSession) Generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.generation
+}
+
+/* Sets the client up again, unless that already happened since generation,
+ * same as blueskySession.Reauth. */
+func (s *mastodonSession) Reauth(generation uint64) error {
+	s.reauthMu.Lock()
+	defer s.reauthMu.Unlock()
+
+	if s.Generation() != generation {
+		return nil
+	}
+
+	log.Printf("Mastodon: %v rejected our client, setting it up again", s.instance)
+	client, err := newMastodonClient(s.store, s.instance, s.appId, s.appSecret)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.client = client
+	s.generation++
+	s.mu.Unlock()
+	return nil
+}
+
+/* Runs fn against the client, setting it up again and retrying once if the
+ * instance rejects it. */
+func (s *mastodonSession) Do(fn func(mc *madon.Client) error) error {
+	generation := s.Generation()
+	err := withReauth(
+		func() error { return fn(s.Client()) },
+		func() error { return s.Reauth(generation) })
+	if err != nil && classifyError(err) == errorReauth && s.appId != nil {
+		log.Printf("ERROR: %v keeps rejecting our client. If the app was removed from", s.instance)
+		log.Printf("ERROR: the instance, unset VBC_MASTODON_APP_ID and VBC_MASTODON_APP_SECRET")
+		log.Printf("ERROR: so a new one gets registered.")
+	}
+	return err
+}
+
+/* Whether the instance turned down the app itself, rather than a token. */
+func isInvalidClient(err error) bool {
+	return strings.Contains(err.Error(), "invalid_client") || classifyError(err) == errorReauth
+}
+
+func newMastodonClient(store Store, instanceName string, appId, appSecret *string) (*madon.Client, error) {
+	var client *madon.Client
+
+	if appId != nil && appSecret != nil {
+		log.Printf("Mastodon: restoring client from environment variables")
+		mc, err := madon.RestoreApp(
+			AppName,
+			instanceName,
+			*appId,
+			*appSecret,
+			nil)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not restore client: %v", err))
+		}
+		client = mc
+	} else {
+		if appId != nil && appSecret == nil {
+			log.Printf("WARNING: VBC_MASTODON_APP_SECRET is not set when VCB_MASTODON_APP_ID is, ignoring.")
+		} else if appSecret != nil && appId == nil {
+			log.Printf("WARNING: VBC_MASTODON_APP_ID is not set when VCB_MASTODON_APP_SECRET is, ignoring.")
+		}
+
+		/* If we're already registered, don't register again. */
+		creds, err := store.AppCredentials(instanceName)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not restore client info from store: %v", err)))
+		}
+		if creds != nil {
+			log.Printf("Mastodon: restoring client from store")
+			mc, err := madon.RestoreApp(
+				AppName,
+				instanceName,
+				creds.ID,
+				creds.Secret,
+				nil)
+			if err != nil && isInvalidClient(err) {
+				/* Admins purge apps every so often, which is no reason for
+				 * anyone to go digging in the store. */
+				log.Printf("WARNING: %v no longer knows the app in the store, registering a new one: %v",
+					instanceName,
+					err)
+			} else if err != nil {
+				return nil, errors.New(fmt.Sprintf("could not restore client info from store: %v", err))
+			} else {
+				client = mc
+			}
+		}
+	}
+
+	/* We're gonna have to register our app. */
+	if client == nil {
+		log.Printf("Mastodon: creating client from new app")
+		mc, err := madon.NewApp(
+			AppName,
+			AppWebsite,
+			[]string{"read:statuses"},
+			madon.NoRedirect,
+			instanceName)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not register new app: %v", err))
+		}
+
+		/* Save it to the store. */
+		err = store.PutAppCredentials(instanceName, AppCredentials{
+			ID:     mc.ID,
+			Secret: mc.Secret,
+		})
+		if err != nil {
+			log.Printf("WARNING: App ID and secret could not be saved to the s-")
+			log.Printf("WARNING: tore. Please, use the following environment va-")
+			log.Printf("WARNING: riables going forward:")
+			log.Printf("WARNING:")
+			log.Printf("WARNING: VBC_MASTODON_APP_ID=\"%v\"", mc.ID)
+			log.Printf("WARNING: VBC_MASTODON_APP_SECRET=\"%v\"", mc.Secret)
+		}
+		client = mc
+	}
+
+	return client, nil
+}
+
+/* Which of the statuses of an account get fetched. */
+type statusQuery struct {
+	/* Leaves out statuses that reply to anything, the account's own
+	 * included. */
+	ExcludeReplies bool
+	/* Leaves out boosts of other statuses. */
+	ExcludeReblogs bool
+	/* Only fetches statuses with media attached. */
+	OnlyMedia bool
+}
+
+/* The statuses the configuration asks to be crossposted. */
+func statusQueryFor(config TransformConfig) statusQuery {
+	query := statusQuery{}
+	if config.ExcludeReplies != nil {
+		query.ExcludeReplies = *config.ExcludeReplies
+	}
+	if config.ExcludeReblogs != nil {
+		query.ExcludeReblogs = *config.ExcludeReblogs
+	}
+	if config.OnlyMedia != nil {
+		query.OnlyMedia = *config.OnlyMedia
+	}
+	return query
+}
+
+/* Fetches the statuses of an account, newest first. Mastodon can leave out
+ * boosts itself, but madon has no way of asking it to, so they get dropped
+ * here instead, which can leave fewer than the limit asked for. */
+func (s *mastodonSession) AccountStatuses(id int64, query statusQuery, limit *madon.LimitParams) ([]madon.Status, error) {
+	var statuses []madon.Status
+	err := s.Do(func(mc *madon.Client) error {
+		/* Pinned statuses only, which is never what's wanted here. */
+		const onlyPinned = false
+		st, err := mc.GetAccountStatuses(id, onlyPinned, query.OnlyMedia, query.ExcludeReplies, limit)
+		statuses = st
+		return err
+	})
+	if err != nil || !query.ExcludeReblogs {
+		return statuses, err
+	}
+
+	kept := statuses[:0]
+	for _, status := range statuses {
+		if status.Reblog == nil {
+			kept = append(kept, status)
+		}
+	}
+	return kept, nil
+}
+
+/* Fetches what madon leaves out of a status, see fetchStatusExtras. */
+func (s *mastodonSession) StatusExtras(id int64) (*statusExtras, error) {
+	var extras *statusExtras
+	err := s.Do(func(mc *madon.Client) error {
+		e, err := fetchStatusExtras(mc, id)
+		extras = e
+		return err
+	})
+	return extras, err
+}
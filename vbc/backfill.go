@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* What Bluesky lets a single account write, in points, each post going for
+ * BlueskyPointsPerCreate of them. Uploads don't count. */
+const (
+	BlueskyPointsPerHour   = 5000
+	BlueskyPointsPerDay    = 35000
+	BlueskyPointsPerCreate = 3
+)
+
+/* A status a backfill is going to crosspost, and what it'll take. */
+type backfillItem struct {
+	status  madon.Status
+	posts   int
+	uploads int
+	/* Whether the status is only in an archive, see replayCommand, and
+	 * can't be asked about on Mastodon. */
+	archived bool
+}
+
+/* Everything a backfill is going to crosspost to a single account. */
+type backfillPlan struct {
+	pair      accountPair
+	key       AccountKey
+	ms        *mastodonSession
+	bs        *blueskySession
+	profile   *bluesky.Profile
+	transform TransformConfig
+	items     []backfillItem
+}
+
+func (p *backfillPlan) Totals() (posts int, uploads int) {
+	for _, item := range p.items {
+		posts += item.posts
+		uploads += item.uploads
+	}
+	return posts, uploads
+}
+
+/* How long the plan should take at the least, going by whichever limit it
+ * runs into the hardest: VBC_BSKY_RATE_LIMIT, maxPerHour, or the points
+ * Bluesky hands out. Doesn't count the time uploads take. */
+func (p *backfillPlan) Estimate(rateLimit float64) time.Duration {
+	posts, uploads := p.Totals()
+	var estimate time.Duration
+	longest := func(d time.Duration) {
+		if d > estimate {
+			estimate = d
+		}
+	}
+
+	if rateLimit > 0 {
+		longest(time.Duration(float64(posts+uploads) / rateLimit * float64(time.Second)))
+	}
+	if limit := p.transform.MaxPerHour; limit != nil && *limit > 0 && len(p.items) > *limit {
+		longest(time.Duration(len(p.items)-*limit) * time.Hour / time.Duration(*limit))
+	}
+	points := posts * BlueskyPointsPerCreate
+	if points > BlueskyPointsPerHour {
+		longest(time.Duration(points-BlueskyPointsPerHour) * time.Hour / BlueskyPointsPerHour)
+	}
+	if points > BlueskyPointsPerDay {
+		longest(time.Duration(points-BlueskyPointsPerDay) * 24 * time.Hour / BlueskyPointsPerDay)
+	}
+	return estimate
+}
+
+/* Adds a status to the plan, unless it wouldn't be crossposted anyway. */
+func (p *backfillPlan) Add(status madon.Status, archived bool) {
+	/* Without the extras, which would take a request a status, but they
+	 * hardly ever change how many posts there are. */
+	posts, err := transformStatus(&status, nil, p.transform)
+	if err != nil {
+		return
+	}
+	item := backfillItem{status: status, posts: len(posts), archived: archived}
+	for _, post := range posts {
+		if post.Embed != nil {
+			item.uploads += len(post.Embed.uploads())
+		}
+	}
+	p.items = append(p.items, item)
+}
+
+/* An empty plan for crossposting to a pair, logged into Bluesky. */
+func newBackfillPlan(ctx context.Context, store Store, config *Config, pair accountPair, ms *mastodonSession) (*backfillPlan, error) {
+	bs, err := newBlueskySession(ctx, store, pair.Server, pair.Handle, pair.AppKey, backfillRateLimit())
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", pair.Handle, err))
+	}
+	profile, err := bs.FetchProfile(ctx, pair.Handle)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not fetch Bluesky profile of @%v: %v", pair.Handle, err))
+	}
+	if err := checkExpectedDID(pair.Handle, profile.DID); err != nil {
+		return nil, err
+	}
+	return &backfillPlan{
+		pair:      pair,
+		key:       AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: profile.DID},
+		ms:        ms,
+		bs:        bs,
+		profile:   profile,
+		transform: config.TransformFor(pair.Instance, pair.AccountID, pair.Handle),
+	}, nil
+}
+
+/* Works out what crossposting the statuses of a pair that were left alone
+ * when it was bootstrapped, or seen in shadow mode, would take, oldest first.
+ * Statuses that wouldn't be crossposted anyway are left out. */
+func planBackfill(ctx context.Context, store Store, config *Config, pair accountPair, ms *mastodonSession, since time.Time) (*backfillPlan, error) {
+	plan, err := newBackfillPlan(ctx, store, config, pair, ms)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Accounts that haven't been bootstrapped have everything ahead of
+	 * them, and the daemon takes care of that. */
+	bootstrapped, err := store.HasAccount(plan.key)
+	if err != nil {
+		return nil, err
+	}
+	if !bootstrapped {
+		return plan, nil
+	}
+	/* Nor do accounts in shadow mode, which would only write down what a
+	 * backfill would post, having nothing to show for it. */
+	if shadow := plan.transform.Shadow; shadow != nil && *shadow {
+		log.Printf("Bluesky: @%v is in shadow mode, leaving it out of the backfill", pair.Handle)
+		return plan, nil
+	}
+
+	statuses, err := ms.AccountStatuses(pair.AccountID, statusQueryFor(plan.transform), &madon.LimitParams{All: true})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+
+	for _, status := range statuses {
+		if status.CreatedAt.Before(since) {
+			continue
+		}
+		value, err := store.Mapping(plan.key, status.ID)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		mapping, err := decodeMapping(value)
+		if err != nil || (mapping.State != MappingIgnored && mapping.State != MappingShadowed) {
+			continue
+		}
+		plan.Add(status, false)
+	}
+	return plan, nil
+}
+
+/* Crossposts everything in the plan, writing down each status as it goes,
+ * so a backfill that gets interrupted picks up where it left off when run
+ * again. Stops early once stop is closed, after the status under way. */
+func runBackfill(ctx context.Context, store Store, plan *backfillPlan, stop <-chan struct{}) (int, error) {
+	var limiter *postLimiter
+	if plan.transform.MaxPerHour != nil {
+		limiter = newPostLimiter(*plan.transform.MaxPerHour)
+	}
+	spacer := newPostSpacer(plan.transform)
+
+	done := 0
+	for i := 0; i < len(plan.items); i++ {
+		status := &plan.items[i].status
+		select {
+		case <-stop:
+			return done, nil
+		default:
+		}
+
+		if wait := limiter.Wait(); wait > 0 {
+			log.Printf("holding back %v for %v, @%v is at its limit of %v crosspost(s) an hour",
+				status.URL,
+				wait.Round(time.Second),
+				plan.pair.Handle,
+				*plan.transform.MaxPerHour)
+			select {
+			case <-stop:
+				return done, nil
+			case <-time.After(wait):
+			}
+		}
+		if wait := spacer.Wait(); wait > 0 {
+			select {
+			case <-stop:
+				return done, nil
+			case <-time.After(wait):
+			}
+		}
+
+		var extras *statusExtras
+		if !plan.items[i].archived {
+			var err error
+			if extras, err = plan.ms.StatusExtras(status.ID); err != nil {
+				return done, err
+			}
+		}
+		mapping, err := repost(ctx, store, plan.key, status, extras, plan.bs, plan.profile, plan.transform)
+
+		var skip skipError
+		var limited ErrRateLimited
+		if errors.As(err, &skip) {
+			log.Printf("not backfilling %v: %v", status.URL, skip.reason)
+			continue
+		} else if errors.As(err, &limited) {
+			wait := limited.RetryAfter
+			if wait <= 0 {
+				wait = time.Minute
+			}
+			log.Printf("Bluesky: asked to slow down, trying %v again in %v", status.URL, wait.Round(time.Second))
+			select {
+			case <-stop:
+				return done, nil
+			case <-time.After(wait):
+			}
+			i--
+			continue
+		} else if reason, ok := rejectionReason(err); ok {
+			log.Printf("WARNING: Bluesky turned down %v: %v", status.URL, reason)
+			if err := putRejectedMapping(store, plan.key, status.ID, reason); err != nil {
+				return done, err
+			}
+			continue
+		} else if err != nil && classifyError(err) == errorPermanent {
+			log.Printf("WARNING: giving up on %v: %v", status.URL, err)
+			entry := RetryEntry{Status: status.ID, LastError: err.Error()}
+			if err := putFailedMapping(store, plan.key, entry); err != nil {
+				return done, err
+			}
+			continue
+		} else if err != nil {
+			return done, errors.New(fmt.Sprintf("could not crosspost %v: %v", status.URL, err))
+		}
+		limiter.Sent()
+		spacer.Sent()
+
+		value, err := encodeMapping(*mapping)
+		if err != nil {
+			return done, err
+		}
+		if err := store.PutMapping(plan.key, status.ID, value); err != nil {
+			return done, err
+		}
+		done++
+		log.Printf("[%v/%v] backfilled %v to %v", i+1, len(plan.items), status.URL, blueskyPostURL(plan.pair.Handle, mapping.Uri))
+	}
+	return done, nil
+}
+
+/* Asks on the terminal whether to go ahead with a plan. */
+func askToGoAhead() bool {
+	fmt.Printf("go ahead? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+/* Closes the channel it hands back once interrupted, so whatever is being
+ * crossposted gets to finish, rather than being cut off halfway through. */
+func stopOnInterrupt() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("stopping once the status under way is over, interrupt again to stop right away")
+		close(stop)
+		signal.Stop(signals)
+	}()
+	return stop
+}
+
+/* Requests per second for Bluesky, as the daemon would make them. */
+func backfillRateLimit() float64 {
+	rate, err := strconv.ParseFloat(envOrDefault("VBC_BSKY_RATE_LIMIT", strconv.Itoa(BlueskyRateLimitDefault)), 64)
+	if err != nil {
+		log.Fatalf("VBC_BSKY_RATE_LIMIT is not a number: %v", err)
+	}
+	return rate
+}
+
+func backfillCommand(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := fs.String("since", "", "only statuses posted on or after this date, as YYYY-MM-DD")
+	dryRun := fs.Bool("dry-run", false, "print the plan and stop there")
+	yes := fs.Bool("yes", false, "go ahead without asking")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc backfill [--since YYYY-MM-DD] [--dry-run] [--yes]\n\n")
+		fmt.Fprintf(fs.Output(), "Crossposts the statuses that were left alone when each account was\n")
+		fmt.Fprintf(fs.Output(), "bootstrapped, oldest first. Prints how many posts and image uploads that\n")
+		fmt.Fprintf(fs.Output(), "comes to and about how long it'll take under the rate limits before\n")
+		fmt.Fprintf(fs.Output(), "asking to go ahead. Each status is written down as soon as it's over, so\n")
+		fmt.Fprintf(fs.Output(), "an interrupted backfill picks up where it left off when run again.\n")
+		fmt.Fprintf(fs.Output(), "Needs vbc stopped.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var from time.Time
+	if *since != "" {
+		t, err := time.ParseInLocation("2006-01-02", *since, time.Local)
+		if err != nil {
+			log.Fatalf("--since %q is not a date: %v", *since, err)
+		}
+		from = t
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	sessions := make(map[string]*mastodonSession)
+	var plans []*backfillPlan
+	for _, pair := range config.Pairs() {
+		ms, found := sessions[pair.Instance]
+		if !found {
+			appId, appSecret := envAppCredentials(pair.Instance)
+			ms, err = newMastodonSession(store, pair.Instance, appId, appSecret)
+			if err != nil {
+				log.Fatalf("could not set up Mastodon client for %v: %v", pair.Instance, err)
+			}
+			sessions[pair.Instance] = ms
+		}
+
+		plan, err := planBackfill(ctx, store, config, pair, ms, from)
+		if err != nil {
+			log.Fatalf("could not plan backfill of account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+		}
+		if len(plan.items) > 0 {
+			plans = append(plans, plan)
+		}
+	}
+	if len(plans) == 0 {
+		fmt.Printf("Nothing to backfill.\n")
+		return
+	}
+
+	rateLimit := backfillRateLimit()
+	var estimate time.Duration
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ACCOUNT\tTO\tSTATUSES\tPOSTS\tUPLOADS\tESTIMATE\n")
+	for _, plan := range plans {
+		posts, uploads := plan.Totals()
+		fmt.Fprintf(w, "%v on %v\t@%v\t%v\t%v\t%v\t%v\n",
+			plan.pair.AccountID,
+			plan.pair.Instance,
+			plan.pair.Handle,
+			len(plan.items),
+			posts,
+			uploads,
+			plan.Estimate(rateLimit).Round(time.Minute))
+		estimate += plan.Estimate(rateLimit)
+	}
+	_ = w.Flush()
+	fmt.Printf("\nAbout %v all told, one account after the other.\n", estimate.Round(time.Minute))
+	if *dryRun {
+		return
+	}
+
+	if !*yes && !askToGoAhead() {
+		return
+	}
+
+	stop := stopOnInterrupt()
+	for _, plan := range plans {
+		done, err := runBackfill(ctx, store, plan, stop)
+		log.Printf("backfilled %v of %v status(es) to @%v", done, len(plan.items), plan.pair.Handle)
+		if err != nil {
+			log.Fatalf("backfill stopped, run it again to pick up where it left off: %v", err)
+		}
+		select {
+		case <-stop:
+			log.Printf("backfill stopped, run it again to pick up where it left off")
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"lobisomem.gay/vbc/v2/internal/fakes"
+)
+
+/* Tests of planBackfill and runBackfill against the fakes in internal/fakes,
+ * the same ones the pipeline tests use, with nothing else running. */
+
+/* A store that closes stop once after mappings have been put, so a backfill
+ * can be stopped at a known point. */
+type stoppingStore struct {
+	Store
+	after int
+	stop  chan struct{}
+}
+
+func (s *stoppingStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	err := s.Store.PutMapping(acct, status, value)
+	s.after--
+	if s.after == 0 {
+		close(s.stop)
+	}
+	return err
+}
+
+/* A pair on fresh fakes, bootstrapped with a status in each of the states a
+ * mapping can be in that matters to a backfill, handing back the statuses
+ * that should get backfilled, oldest first. */
+func startBackfill(t *testing.T) (*pipelineHarness, accountPair, []int64) {
+	t.Helper()
+
+	pipelineTransport.Do(func() {
+		http.DefaultTransport = newBreakerTransport(http.DefaultTransport)
+	})
+	h := &pipelineHarness{
+		t:        t,
+		mastodon: fakes.NewMastodon(109000000000000001, "vbc"),
+		bluesky:  fakes.NewBluesky("did:plc:vbcfakevbcfakevbcfake", "vbc.test"),
+		store:    newMemoryStore(),
+		done:     make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		h.mastodon.Close()
+		h.bluesky.Close()
+	})
+
+	appKey := "xxxx-xxxx-xxxx-xxxx"
+	pair := accountPair{
+		Instance:  canonicalizeInstanceName(h.mastodon.URL()),
+		AccountID: h.mastodon.AccountID,
+		Handle:    h.bluesky.Handle,
+		Server:    h.bluesky.URL(),
+		AppKey:    &appKey,
+	}
+	h.key = AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: "did:plc:vbcfakevbcfakevbcfake"}
+
+	state := func(mapping StatusMapping) []byte {
+		value, err := encodeMapping(mapping)
+		if err != nil {
+			t.Fatalf("could not encode mapping: %v", err)
+		}
+		return value
+	}
+	add := func(what string) int64 {
+		return h.mastodon.AddStatus(fakes.Status{Content: fmt.Sprintf("<p>This one was %v.</p>", what)})
+	}
+
+	mappings := make(map[int64][]byte)
+	var wanted []int64
+	for i := 1; i <= 2; i++ {
+		id := add(fmt.Sprintf("left alone when bootstrapping, number %v", i))
+		mappings[id] = state(newMapping(MappingIgnored))
+		wanted = append(wanted, id)
+	}
+	id := add("crossposted already")
+	mappings[id] = state(newPostedMapping("at://did:plc:vbcfakevbcfakevbcfake/app.bsky.feed.post/aaaaaaaaaaaaa", "bafyfake"))
+	id = add("skipped")
+	skipped := newMapping(MappingSkipped)
+	skipped.Error = "not meant to go over"
+	mappings[id] = state(skipped)
+	id = add("seen in shadow mode")
+	mappings[id] = state(newMapping(MappingShadowed))
+	wanted = append(wanted, id)
+	/* Which the daemon has yet to get to, and takes care of itself. */
+	add("never seen")
+
+	if err := h.store.BootstrapAccount(h.key, mappings); err != nil {
+		t.Fatalf("could not bootstrap: %v", err)
+	}
+	return h, pair, wanted
+}
+
+/* Plans a backfill of pair and runs it on store until stop is closed. */
+func runTestBackfill(t *testing.T, h *pipelineHarness, store Store, pair accountPair, stop <-chan struct{}) (*backfillPlan, int) {
+	t.Helper()
+	ctx := context.Background()
+	appId, appSecret := "fake-client-id", "fake-client-secret"
+	ms, err := newMastodonSession(store, pair.Instance, &appId, &appSecret)
+	if err != nil {
+		t.Fatalf("could not set up Mastodon session: %v", err)
+	}
+	plan, err := planBackfill(ctx, store, &Config{}, pair, ms, time.Time{})
+	if err != nil {
+		t.Fatalf("could not plan backfill: %v", err)
+	}
+	if plan.key != h.key {
+		t.Fatalf("planned a backfill of %+v rather than %+v", plan.key, h.key)
+	}
+	done, err := runBackfill(ctx, store, plan, stop)
+	if err != nil {
+		t.Fatalf("backfill failed: %v", err)
+	}
+	return plan, done
+}
+
+/* The statuses in a plan, in the order it'd go through them. */
+func planStatuses(plan *backfillPlan) []int64 {
+	var ids []int64
+	for _, item := range plan.items {
+		ids = append(ids, item.status.ID)
+	}
+	return ids
+}
+
+func TestBackfillPostsOnlyIgnoredAndShadowed(t *testing.T) {
+	h, pair, wanted := startBackfill(t)
+
+	plan, done := runTestBackfill(t, h, h.store, pair, make(chan struct{}))
+	if got := planStatuses(plan); fmt.Sprint(got) != fmt.Sprint(wanted) {
+		t.Fatalf("planned %v rather than %v", got, wanted)
+	}
+	if done != len(wanted) {
+		t.Errorf("backfilled %v status(es) rather than %v", done, len(wanted))
+	}
+
+	posts := h.posts()
+	if len(posts) != len(wanted) {
+		t.Fatalf("expected %v posts, got %+v", len(wanted), posts)
+	}
+	for i, id := range wanted {
+		mapping := h.mapping(id)
+		if mapping == nil || !mapping.Posted() {
+			t.Errorf("status %v was not written down as crossposted: %+v", id, mapping)
+			continue
+		}
+		if mapping.Uri != posts[i].URI {
+			t.Errorf("status %v points to %v rather than %v", id, mapping.Uri, posts[i].URI)
+		}
+	}
+}
+
+/* A backfill that's stopped partway has to pick up where it left off, rather
+ * than crossposting what it got to all over again. */
+func TestBackfillResumesAfterStop(t *testing.T) {
+	h, pair, wanted := startBackfill(t)
+
+	store := &stoppingStore{Store: h.store, after: 1, stop: make(chan struct{})}
+	plan, done := runTestBackfill(t, h, store, pair, store.stop)
+	if len(plan.items) != len(wanted) {
+		t.Fatalf("planned %v status(es) rather than %v", len(plan.items), len(wanted))
+	}
+	if done != 1 {
+		t.Fatalf("backfilled %v status(es) before stopping rather than 1", done)
+	}
+	if posts := h.posts(); len(posts) != 1 {
+		t.Fatalf("expected a single post before stopping, got %+v", posts)
+	}
+
+	plan, done = runTestBackfill(t, h, h.store, pair, make(chan struct{}))
+	if got := planStatuses(plan); fmt.Sprint(got) != fmt.Sprint(wanted[1:]) {
+		t.Fatalf("planned %v on resuming rather than %v", got, wanted[1:])
+	}
+	if done != len(wanted)-1 {
+		t.Errorf("backfilled %v status(es) on resuming rather than %v", done, len(wanted)-1)
+	}
+
+	posts := h.posts()
+	if len(posts) != len(wanted) {
+		t.Fatalf("expected %v posts all told, got %+v", len(wanted), posts)
+	}
+	seen := make(map[string]bool)
+	for _, post := range posts {
+		if seen[post.Text] {
+			t.Errorf("%q went up twice", post.Text)
+		}
+		seen[post.Text] = true
+	}
+}
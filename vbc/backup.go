@@ -0,0 +1,503 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/scrypt"
+)
+
+/* Backups are laid out as the magic, followed by the scrypt salt, the GCM
+ * nonce and the encrypted gzip of a tar of a bolt snapshot of every file of
+ * the store, see archiveSnapshots. Backups from before the store could be
+ * split up have BackupMagicV1, and the gzip of the one snapshot instead. */
+const (
+	BackupMagic     = "vbc-backup-v2\n"
+	BackupMagicV1   = "vbc-backup-v1\n"
+	BackupSaltSize  = 16
+	BackupScryptN   = 1 << 15
+	BackupScryptR   = 8
+	BackupScryptP   = 1
+	BackupKeySize   = 32
+	BackupLockWait  = time.Second
+	BackupFileMode  = 0600
+	SnapshotTimeout = time.Minute
+	SnapshotSizeLen = 8
+)
+
+/* The daemon holds an exclusive lock on the bolt file, so while it's running
+ * snapshots are taken by asking it for one through this socket. */
+func backupSocketPath(storePath string) string {
+	return storePath + ".sock"
+}
+
+/* Hands a snapshot of the store to whoever connects to the socket at path. */
+func serveSnapshots(ctx context.Context, store *boltStore, path string) {
+	/* A socket left over from a previous run would keep us from listening,
+	 * and we hold the store lock, so nobody else can be using it. */
+	_ = os.Remove(path)
+
+	/* Snapshots have every secret the store does in them, so nobody else
+	 * gets to connect, not even for a moment. */
+	listener, err := listenPrivate(path)
+	if err != nil {
+		log.Printf("WARNING: could not listen on %v, backups will need vbc stopped: %v", path, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WARNING: stopped serving snapshots: %v", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			_ = conn.SetWriteDeadline(time.Now().Add(SnapshotTimeout))
+
+			n, err := sendSnapshot(conn, store)
+			if err != nil {
+				log.Printf("WARNING: could not send snapshot: %v", err)
+				return
+			}
+			log.Printf("sent a %v byte snapshot of the store for backup", n)
+		}()
+	}
+}
+
+/* Writes a snapshot of store to w, preceded by how big it is, so the other end
+ * can tell one that got cut short, say by SnapshotTimeout, from a whole one. */
+func sendSnapshot(w io.Writer, store *boltStore) (int64, error) {
+	var n int64
+	err := store.view(func(tx *bolt.Tx) error {
+		var size [SnapshotSizeLen]byte
+		binary.BigEndian.PutUint64(size[:], uint64(tx.Size()))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		written, err := tx.WriteTo(w)
+		n = written
+		return err
+	})
+	return n, err
+}
+
+/* Reads a snapshot sendSnapshot wrote, refusing it unless all of it made it. */
+func receiveSnapshot(r io.Reader) ([]byte, error) {
+	var size [SnapshotSizeLen]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read snapshot size: %v", err))
+	}
+	expected := binary.BigEndian.Uint64(size[:])
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, int64(expected))
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New(fmt.Sprintf("snapshot was cut short after %v of %v bytes", n, expected))
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/* Takes a snapshot of the bolt file at path, from the running daemon if
+ * there's one, and from the file itself otherwise. */
+func snapshotStore(path string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	conn, err := net.Dial("unix", backupSocketPath(path))
+	if err == nil {
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(SnapshotTimeout))
+
+		snapshot, err := receiveSnapshot(conn)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not receive snapshot from vbc: %v", err))
+		}
+		return snapshot, nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	store, err := openBoltStoreWith(path, &bolt.Options{ReadOnly: true, Timeout: BackupLockWait})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errors.New(fmt.Sprintf("%v is locked by a running vbc that isn't serving snapshots", path))
+	} else if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if _, err := store.Snapshot(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, BackupScryptN, BackupScryptR, BackupScryptP, BackupKeySize)
+}
+
+func sealBackup(snapshot []byte, passphrase string) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(snapshot); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, BackupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	/* The header goes in as additional data, so it can't be tampered with
+	 * either. */
+	header := append(append([]byte(BackupMagic), salt...), nonce...)
+	return aead.Seal(header, nonce, compressed.Bytes(), header), nil
+}
+
+/* Decrypts and decompresses a backup, with whether it's from before the
+ * store could be split up and holds a single snapshot, see BackupMagicV1. */
+func openBackup(sealed []byte, passphrase string) ([]byte, bool, error) {
+	v1 := bytes.HasPrefix(sealed, []byte(BackupMagicV1))
+	if !v1 && !bytes.HasPrefix(sealed, []byte(BackupMagic)) {
+		return nil, false, errors.New("not a vbc backup")
+	}
+
+	salt := sealed[len(BackupMagic):]
+	if len(salt) < BackupSaltSize {
+		return nil, false, errors.New("backup is truncated")
+	}
+	salt = salt[:BackupSaltSize]
+
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, false, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, false, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, false, err
+	}
+
+	headerSize := len(BackupMagic) + BackupSaltSize + aead.NonceSize()
+	if len(sealed) < headerSize {
+		return nil, false, errors.New("backup is truncated")
+	}
+	header := sealed[:headerSize]
+	nonce := header[len(BackupMagic)+BackupSaltSize:]
+
+	compressed, err := aead.Open(nil, nonce, sealed[headerSize:], header)
+	if err != nil {
+		return nil, false, errors.New("could not decrypt backup, wrong passphrase or corrupted file")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, false, err
+	}
+	defer zr.Close()
+	plain, err := io.ReadAll(zr)
+	return plain, v1, err
+}
+
+/* A snapshot of one of the files of the store, named after it. */
+type backupFile struct {
+	Name     string
+	Snapshot []byte
+}
+
+/* Puts snapshots in a tar, the main file of the store first. */
+func archiveSnapshots(files []backupFile) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.Name,
+			Mode:    BackupFileMode,
+			Size:    int64(len(file.Snapshot)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/* Takes the snapshots archiveSnapshots put in a tar back out. */
+func unarchiveSnapshots(archive []byte) ([]backupFile, error) {
+	var files []backupFile
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		/* Nothing in a backup gets to go anywhere but next to the store. */
+		if header.Name != filepath.Base(header.Name) || header.Name == "." || header.Name == ".." {
+			return nil, errors.New(fmt.Sprintf("backup has a file named %q", header.Name))
+		}
+		snapshot, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, backupFile{Name: header.Name, Snapshot: snapshot})
+	}
+	if len(files) == 0 {
+		return nil, errors.New("backup has nothing in it")
+	}
+	return files, nil
+}
+
+/* Where each file of a backup goes when restoring it to the store at path.
+ * The files of each pair are named after the main one, see shardPath, which
+ * may have been named something else when the backup was taken. */
+func restorePaths(path string, files []backupFile) ([]string, error) {
+	stem := func(name string) string {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	from, to := stem(files[0].Name), stem(filepath.Base(path))
+
+	paths := []string{path}
+	for _, file := range files[1:] {
+		if !strings.HasPrefix(file.Name, from+"-") {
+			return nil, errors.New(fmt.Sprintf("backup has %v, which isn't a file of %v", file.Name, files[0].Name))
+		}
+		paths = append(paths, filepath.Join(filepath.Dir(path), to+strings.TrimPrefix(file.Name, from)))
+	}
+	return paths, nil
+}
+
+/* Writes data to path by way of a temporary file, so a crash never leaves a
+ * half written file behind. */
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), BackupFileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/* Figures out which bolt file the store commands should work on. */
+func boltStorePath() string {
+	spec := storeSpec()
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		log.Fatalf("only bolt stores can be backed up, restored and upgraded, Redis has its own persistence and needs no upgrading")
+	}
+	return spec
+}
+
+func storeCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: vbc store backup <file>\n")
+		fmt.Fprintf(os.Stderr, "       vbc store restore <file>\n")
+		fmt.Fprintf(os.Stderr, "       vbc store upgrade\n")
+		fmt.Fprintf(os.Stderr, "       vbc store downgrade\n")
+		fmt.Fprintf(os.Stderr, "       vbc store import-account <file>\n\n")
+		fmt.Fprintf(os.Stderr, "Backs up the bolt store, the file of every pair included when it's split\n")
+		fmt.Fprintf(os.Stderr, "up, to an encrypted, compressed file, or restores it from one. The passphrase\n")
+		fmt.Fprintf(os.Stderr, "is read from VBC_BACKUP_PASSPHRASE. Backups can be taken while vbc is\n")
+		fmt.Fprintf(os.Stderr, "running, restoring needs it stopped.\n\n")
+		fmt.Fprintf(os.Stderr, "Upgrade brings a store written by an older vbc up to date, keeping a\n")
+		fmt.Fprintf(os.Stderr, "copy of it as it was next to it, and needs vbc stopped as well.\n")
+		fmt.Fprintf(os.Stderr, "Downgrade takes the last upgrade back, the same way, for the vbc from\n")
+		fmt.Fprintf(os.Stderr, "before it to carry on where this one left off.\n\n")
+		fmt.Fprintf(os.Stderr, "Import-account puts an account handed off by another vbc through its\n")
+		fmt.Fprintf(os.Stderr, "admin API in the store, for this one to carry on with it.\n")
+	}
+	/* Only backups can be taken from under the daemon, see serveSnapshots. */
+	if len(args) > 0 && args[0] != "backup" {
+		refuseWhileRunning()
+	}
+	if len(args) == 1 && args[0] == "upgrade" {
+		upgradeStore()
+		return
+	}
+	if len(args) == 1 && args[0] == "downgrade" {
+		downgradeStore()
+		return
+	}
+	if len(args) != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "backup":
+		backupStore(args[1])
+	case "restore":
+		restoreStore(args[1])
+	case "import-account":
+		importAccountCommand(args[1])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+/* Backs up every file of the store, see boltStoreFiles. */
+func backupStore(file string) {
+	passphrase := requireEnv("VBC_BACKUP_PASSPHRASE")
+	paths := boltStoreFiles()
+
+	var files []backupFile
+	size := 0
+	for _, path := range paths {
+		snapshot, err := snapshotStore(path)
+		if err != nil {
+			log.Fatalf("could not take snapshot of %v: %v", path, err)
+		}
+		files = append(files, backupFile{Name: filepath.Base(path), Snapshot: snapshot})
+		size += len(snapshot)
+	}
+	archive, err := archiveSnapshots(files)
+	if err != nil {
+		log.Fatalf("could not archive snapshots: %v", err)
+	}
+	sealed, err := sealBackup(archive, passphrase)
+	if err != nil {
+		log.Fatalf("could not encrypt backup: %v", err)
+	}
+	if err := writeFileAtomic(file, sealed); err != nil {
+		log.Fatalf("could not write backup to %v: %v", file, err)
+	}
+	log.Printf("backed up %v files of %v to %v (%v bytes, %v compressed)", len(files), paths[0], file, size, len(sealed))
+}
+
+/* Puts every file of a backup back, moving every file of the store there is
+ * now out of the way first, so none of them get mixed up with the ones from
+ * the backup. */
+func restoreStore(file string) {
+	passphrase := requireEnv("VBC_BACKUP_PASSPHRASE")
+	path := boltStorePath()
+
+	sealed, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("could not read backup %v: %v", file, err)
+	}
+	plain, v1, err := openBackup(sealed, passphrase)
+	if err != nil {
+		log.Fatalf("could not open backup %v: %v", file, err)
+	}
+	files := []backupFile{{Name: filepath.Base(path), Snapshot: plain}}
+	if !v1 {
+		files, err = unarchiveSnapshots(plain)
+		if err != nil {
+			log.Fatalf("could not read backup %v: %v", file, err)
+		}
+	}
+	paths, err := restorePaths(path, files)
+	if err != nil {
+		log.Fatalf("could not restore backup %v: %v", file, err)
+	}
+	if len(files) > 1 && !storePerAccount() {
+		log.Printf("WARNING: the backup has the files of %v pairs, which are only used with VBC_STORE_PER_ACCOUNT set", len(files)-1)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		current := boltStoreFiles()
+
+		/* Make sure nobody is using the store we're about to replace,
+		 * read-only, so it gets kept as it is rather than migrated. */
+		for _, path := range current {
+			store, err := openBoltStoreWith(path, &bolt.Options{ReadOnly: true, Timeout: BackupLockWait})
+			if errors.Is(err, bolt.ErrTimeout) {
+				log.Fatalf("%v is in use, stop vbc before restoring", path)
+			} else if err == nil {
+				_ = store.Close()
+			}
+		}
+
+		suffix := fmt.Sprintf(".%v.old", time.Now().Unix())
+		for _, path := range current {
+			if err := os.Rename(path, path+suffix); err != nil {
+				log.Fatalf("could not move %v out of the way: %v", path, err)
+			}
+			log.Printf("moved %v to %v", path, path+suffix)
+		}
+	}
+
+	for i, path := range paths {
+		if err := writeFileAtomic(path, files[i].Snapshot); err != nil {
+			log.Fatalf("could not write store to %v: %v", path, err)
+		}
+
+		/* Make sure what came out is actually a store. */
+		store, err := openBoltStoreWith(path, &bolt.Options{ReadOnly: true, Timeout: BackupLockWait})
+		if err != nil {
+			log.Fatalf("restored store at %v does not open: %v", path, err)
+		}
+		_ = store.Close()
+	}
+	log.Printf("restored %v files of %v from %v", len(paths), path, file)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestArchiveSnapshots(t *testing.T) {
+	files := []backupFile{
+		{Name: "vbc.bolt", Snapshot: []byte("main")},
+		{Name: "vbc-tiggi.es-109000000000000001-did_plc_vbcfake.bolt", Snapshot: []byte("pair")},
+		{Name: "vbc-tiggi.es-109000000000000002.bolt", Snapshot: []byte{}},
+	}
+	archive, err := archiveSnapshots(files)
+	if err != nil {
+		t.Fatalf("could not archive snapshots: %v", err)
+	}
+	got, err := unarchiveSnapshots(archive)
+	if err != nil {
+		t.Fatalf("could not unarchive snapshots: %v", err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("snapshots came back as %q rather than %q", got, files)
+	}
+
+	escaping, err := archiveSnapshots([]backupFile{{Name: "../vbc.bolt", Snapshot: []byte("main")}})
+	if err != nil {
+		t.Fatalf("could not archive snapshots: %v", err)
+	}
+	if _, err := unarchiveSnapshots(escaping); err == nil {
+		t.Errorf("unarchived a file from outside the store")
+	}
+}
+
+/* Pairs follow the main file when it's restored under another name. */
+func TestRestorePaths(t *testing.T) {
+	files := []backupFile{
+		{Name: "vbc.bolt"},
+		{Name: "vbc-tiggi.es-109000000000000001.bolt"},
+	}
+	paths, err := restorePaths("/var/lib/vbc/store.db", files)
+	if err != nil {
+		t.Fatalf("could not figure out where files go: %v", err)
+	}
+	expected := []string{"/var/lib/vbc/store.db", "/var/lib/vbc/store-tiggi.es-109000000000000001.bolt"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("files go to %v rather than %v", paths, expected)
+	}
+
+	files = append(files, backupFile{Name: "other.bolt"})
+	if _, err := restorePaths("/var/lib/vbc/vbc.bolt", files); err == nil {
+		t.Errorf("restored a file that isn't one of the store's")
+	}
+}
+
+/* A snapshot the daemon couldn't send all of never makes it into a backup. */
+func TestReceiveSnapshot(t *testing.T) {
+	store, err := openBoltStore(filepath.Join(t.TempDir(), "vbc.bolt"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer store.Close()
+	if err := store.BootstrapAccount(testAccount, map[int64][]byte{1: []byte("{}")}); err != nil {
+		t.Fatalf("could not bootstrap: %v", err)
+	}
+
+	var sent bytes.Buffer
+	if _, err := sendSnapshot(&sent, store); err != nil {
+		t.Fatalf("could not send snapshot: %v", err)
+	}
+
+	snapshot, err := receiveSnapshot(bytes.NewReader(sent.Bytes()))
+	if err != nil {
+		t.Fatalf("could not receive snapshot: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "received.bolt")
+	if err := os.WriteFile(path, snapshot, 0600); err != nil {
+		t.Fatalf("could not write snapshot: %v", err)
+	}
+	received, err := openBoltStoreWith(path, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("received snapshot does not open: %v", err)
+	}
+	_ = received.Close()
+
+	for _, cut := range []int{0, SnapshotSizeLen - 1, SnapshotSizeLen, sent.Len() / 2, sent.Len() - 1} {
+		if _, err := receiveSnapshot(bytes.NewReader(sent.Bytes()[:cut])); err == nil {
+			t.Errorf("took a snapshot cut short at %v of %v bytes", cut, sent.Len())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+/* How long connecting may take, and how often connections are kept alive,
+ * same as the default transport. */
+const (
+	BindDialTimeout = 30 * time.Second
+	BindKeepAlive   = 30 * time.Second
+)
+
+/* The local addresses VBC_BIND_ADDR names: the address itself, or those of
+ * the network interface by that name, IPv4 first. Link-local addresses are
+ * left out, as they can't reach anything worth reaching. */
+func bindAddrs(value string) ([]net.IP, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("neither an IP address nor a network interface: %v", err))
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if !ok || !network.IP.IsGlobalUnicast() {
+			continue
+		}
+		if network.IP.To4() != nil && v4 == nil {
+			v4 = network.IP
+		} else if network.IP.To4() == nil && v6 == nil {
+			v6 = network.IP
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New(fmt.Sprintf("network interface %v has no addresses to connect from", value))
+	}
+	return ips, nil
+}
+
+/* Makes the connections of transport go out from VBC_BIND_ADDR, for servers
+ * with more than one address whose instance only lets one of them in. With
+ * an address of each family, each connection goes out from the one that can
+ * reach where it's going. Handed back as it is when it's unset. */
+func bindTransport(transport http.RoundTripper) (http.RoundTripper, error) {
+	value := envOrNil("VBC_BIND_ADDR")
+	if value == nil {
+		return transport, nil
+	}
+	ips, err := bindAddrs(*value)
+	if err != nil {
+		return nil, err
+	}
+	base, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("can't bind a %T", transport))
+	}
+
+	dialers := make([]*net.Dialer, 0, len(ips))
+	for _, ip := range ips {
+		dialers = append(dialers, &net.Dialer{
+			Timeout:   BindDialTimeout,
+			KeepAlive: BindKeepAlive,
+			LocalAddr: &net.TCPAddr{IP: ip},
+		})
+	}
+
+	bound := base.Clone()
+	bound.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		var err error
+		for _, dialer := range dialers {
+			conn, dialErr := dialer.DialContext(ctx, network, addr)
+			if dialErr == nil {
+				return conn, nil
+			}
+			if err == nil {
+				err = dialErr
+			}
+		}
+		return nil, err
+	}
+	log.Printf("connecting from %v", ips)
+	return bound, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const RepostCollection = "app.bsky.feed.repost"
+
+/* See app.bsky.feed.repost. */
+type repostRecord struct {
+	LexiconTypeID string    `json:"$type"`
+	Subject       strongRef `json:"subject"`
+	CreatedAt     string    `json:"createdAt"`
+}
+
+/* Whether a status is its account boosting a status of its own, the way
+ * older statuses get bumped back up. */
+func isSelfBoost(status *madon.Status) bool {
+	return status.Reblog != nil &&
+		status.Account != nil &&
+		status.Reblog.Account != nil &&
+		status.Reblog.Account.ID == status.Account.ID
+}
+
+/* Reposts the crosspost of the status a self boost boosts, see isSelfBoost,
+ * handing back the mapping saying where the repost went. Boosts of statuses
+ * that never made it over get skipped. */
+func publishSelfBoost(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	status *madon.Status,
+	bs *blueskySession,
+	did string) (*StatusMapping, error) {
+
+	boosted := status.Reblog
+	value, err := store.Mapping(key, boosted.ID)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, skipped("boosts %v, which was never crossposted", boosted.URL)
+	}
+	mapped, err := decodeMapping(value)
+	if err != nil {
+		return nil, err
+	}
+	if !mapped.Posted() || mapped.Cid == "" {
+		return nil, skipped("boosts %v, which isn't up on Bluesky", boosted.URL)
+	}
+
+	repost := repostRecord{
+		LexiconTypeID: RepostCollection,
+		Subject:       strongRef{Uri: mapped.Uri, Cid: mapped.Cid},
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	/* Same as for posts, a retry puts the same record again rather than
+	 * reposting twice. */
+	rkey := statusRkey(status, 0)
+	var out *atproto.RepoPutRecord_Output
+	err = bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		out, err = putRawRecord(ctx, client, did, RepostCollection, rkey, repost)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Bluesky: reposted %v, boosted on Mastodon as %v", mapped.Uri, status.URL)
+
+	mapping := newMapping(MappingReposted)
+	mapping.Uri = out.Uri
+	mapping.Cid = out.Cid
+	mapping.Rkey = rkey
+	return &mapping, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* Records looked at on Bluesky when bootstrapping, for posts another
+	 * crossposter made of the statuses being bootstrapped. */
+	BootstrapMatchRecords = 1000
+	/* How long after a status a post may have been made and still be taken
+	 * to be of it. Crossposters don't always get to statuses right away. */
+	BootstrapMatchAfter = 30 * time.Minute
+	/* And how long before, for clocks that are off. */
+	BootstrapMatchBefore = time.Minute
+	/* Text matched on the strength of one being the start of the other has
+	 * to be at least this long, so short posts don't match anything. */
+	BootstrapMatchMinPrefix = 20
+)
+
+/* A post in a repo, along with what it takes to match it to a status. */
+type repoPost struct {
+	Uri   string `json:"uri"`
+	Cid   string `json:"cid"`
+	Value struct {
+		Text      string      `json:"text"`
+		CreatedAt string      `json:"createdAt"`
+		Reply     interface{} `json:"reply"`
+	} `json:"value"`
+}
+
+/* Looks through the posts on Bluesky for those another crossposter already
+ * made of statuses, so an account that used to be crossposted some other way
+ * gets them mapped rather than ignored, and edits and deletes of them still
+ * make it over. A post is taken to be of a status when it went up around the
+ * same time and has the same text, links aside, or the start of it. */
+func matchExistingPosts(ctx context.Context, bs *blueskySession, did string, statuses []madon.Status) (map[int64]mappedPost, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	oldest := statuses[0].CreatedAt
+	for _, status := range statuses {
+		if status.CreatedAt.Before(oldest) {
+			oldest = status.CreatedAt
+		}
+	}
+
+	var posts []repoPost
+	var texts []string
+	cursor := ""
+	for seen := 0; seen < BootstrapMatchRecords; {
+		var out struct {
+			Cursor  *string    `json:"cursor"`
+			Records []repoPost `json:"records"`
+		}
+		err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			params := map[string]interface{}{
+				"repo":       did,
+				"collection": PostCollection,
+				"limit":      ReconcileRecords,
+			}
+			if cursor != "" {
+				params["cursor"] = cursor
+			}
+			return client.Do(ctx, xrpc.Query, "", "com.atproto.repo.listRecords", params, nil, &out)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		seen += len(out.Records)
+		older := false
+		for _, record := range out.Records {
+			if created, err := time.Parse(time.RFC3339, record.Value.CreatedAt); err == nil &&
+				created.Before(oldest.Add(-BootstrapMatchBefore)) {
+				older = true
+			}
+
+			/* Only the first post of a thread is of a status, replies are
+			 * the rest of it or something else entirely. */
+			if record.Value.Reply == nil {
+				posts = append(posts, record)
+				texts = append(texts, matchText(record.Value.Text))
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 || older {
+			break
+		}
+		cursor = *out.Cursor
+	}
+
+	matched := make(map[int64]mappedPost)
+	taken := make(map[string]bool)
+	for _, status := range statuses {
+		if status.Reblog != nil {
+			continue
+		}
+		text := matchText(renderStatusText(status.Content))
+
+		var best *repoPost
+		var bestGap time.Duration
+		for i := range posts {
+			post := &posts[i]
+			if taken[post.Uri] {
+				continue
+			}
+			created, err := time.Parse(time.RFC3339, post.Value.CreatedAt)
+			if err != nil {
+				continue
+			}
+			gap := created.Sub(status.CreatedAt)
+			if gap < -BootstrapMatchBefore || gap > BootstrapMatchAfter {
+				continue
+			}
+			if !sameText(text, texts[i]) {
+				continue
+			}
+			if gap < 0 {
+				gap = -gap
+			}
+			if best == nil || gap < bestGap {
+				best, bestGap = post, gap
+			}
+		}
+		if best != nil {
+			taken[best.Uri] = true
+			matched[status.ID] = mappedPost{Cid: best.Cid, Uri: best.Uri}
+		}
+	}
+	return matched, nil
+}
+
+/* Finds a post of a status already up on Bluesky, such as one crossposted
+ * since the backup the store was restored from, see matchExistingPosts. Nil
+ * when there's none, or when the status has a mapping, which says where its
+ * crosspost is already. */
+func findExistingPost(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	bs *blueskySession,
+	did string,
+	status *madon.Status) (*mappedPost, error) {
+
+	value, err := store.Mapping(key, status.ID)
+	if err != nil || value != nil {
+		return nil, err
+	}
+	matched, err := matchExistingPosts(ctx, bs, did, []madon.Status{*status})
+	if err != nil {
+		return nil, err
+	}
+	if post, found := matched[status.ID]; found {
+		return &post, nil
+	}
+	return nil, nil
+}
+
+/* Text boiled down to its words, without links, which crossposters all have
+ * their own ways of shortening, or punctuation, or case. */
+func matchText(text string) string {
+	var words []string
+	for _, word := range strings.Fields(text) {
+		if strings.Contains(word, "://") || looksLikeDomain(word) {
+			continue
+		}
+		word = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, word)
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+/* Whether a word is a link with its scheme cut off, such as example.com/a... */
+func looksLikeDomain(word string) bool {
+	host, _, _ := strings.Cut(strings.TrimRight(word, ".…"), "/")
+	dot := strings.LastIndex(host, ".")
+	if dot <= 0 || dot == len(host)-1 {
+		return false
+	}
+	for _, r := range host[dot+1:] {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return strings.Contains(word, "/") || len(host)-dot-1 >= 2
+}
+
+/* Whether two texts boiled down by matchText are the same, or one is the
+ * start of the other, as crossposters cut statuses that are too long. */
+func sameText(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return len(a) >= BootstrapMatchMinPrefix && strings.HasPrefix(b, a)
+}
+
+/* Logs the statuses being bootstrapped, and works out their mappings: those
+ * that were already crossposted point to where they went, and the rest get
+ * ignored. */
+func bootstrapMappings(ctx context.Context, bs *blueskySession, did string, statuses []madon.Status) (map[int64][]byte, error) {
+	matched, err := matchExistingPosts(ctx, bs, did, statuses)
+	if err != nil {
+		log.Printf("WARNING: could not look for posts already on Bluesky, ignoring every status: %v", err)
+		matched = nil
+	}
+
+	ignored, err := encodeMapping(newMapping(MappingIgnored))
+	if err != nil {
+		return nil, err
+	}
+	mappings := make(map[int64][]byte)
+	for _, status := range statuses {
+		if post, found := matched[status.ID]; found {
+			log.Printf("    matched: post %v made in %v to %v", status.URL, status.CreatedAt, post.Uri)
+			mapping, err := encodeMapping(newPostedMapping(post.Uri, post.Cid))
+			if err != nil {
+				return nil, err
+			}
+			mappings[status.ID] = mapping
+			continue
+		}
+		log.Printf("    ignore: post %v made in %v", status.URL, status.CreatedAt)
+		mappings[status.ID] = ignored
+	}
+	return mappings, nil
+}
+
+/* Starts keeping state for an account, with every status it has so far
+ * either mapped to where it already went or ignored. */
+func bootstrapAccount(
+	ctx context.Context,
+	store Store,
+	ms *mastodonSession,
+	bs *blueskySession,
+	key AccountKey,
+	acct *madon.Account) error {
+
+	log.Printf("bootstrapping account @%v", acct.Username)
+	/* Everything, whatever gets crossposted, so none of what the account
+	 * posted so far shows up as new should that change. */
+	statuses, err := ms.AccountStatuses(acct.ID, statusQuery{}, &madon.LimitParams{All: true})
+	if err != nil {
+		return err
+	}
+
+	mappings, err := bootstrapMappings(ctx, bs, key.Target, statuses)
+	if err != nil {
+		return err
+	}
+	return store.BootstrapAccount(key, mappings)
+}
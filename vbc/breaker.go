@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	/* Attempts at a single request that keeps failing in ways that might go
+	 * away, and the delays between them. */
+	HTTPRetryAttempts  = 3
+	HTTPRetryBaseDelay = 500 * time.Millisecond
+	HTTPRetryMaxDelay  = 10 * time.Second
+
+	/* Requests in a row that have to fail for calls to a host to be paused,
+	 * and for how long they get paused. */
+	BreakerThreshold = 5
+	BreakerCooldown  = time.Minute
+)
+
+/* Returned for calls to a host while calls to it are paused. */
+type breakerOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e breakerOpenError) Error() string {
+	return fmt.Sprintf("calls to %v are paused until %v after repeated failures",
+		e.host,
+		e.until.Format(time.RFC3339))
+}
+
+/* Keeps track of how a single host has been doing. */
+type hostBreaker struct {
+	failures  int
+	openUntil time.Time
+	/* Whether a request is out checking if the host is back. */
+	probing bool
+}
+
+/* Sits under every HTTP client we use, retrying requests that fail in ways
+ * that might go away on their own, and pausing calls to hosts that keep on
+ * failing, so a struggling instance gets left alone for a while. */
+type breakerTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+func newBreakerTransport(base http.RoundTripper) *breakerTransport {
+	return &breakerTransport{
+		base:  base,
+		hosts: make(map[string]*hostBreaker),
+	}
+}
+
+/* Whether a request to the host may go out. Once the cooldown is over, a
+ * single request gets through to see whether the host is back. */
+func (t *breakerTransport) allow(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	breaker, found := t.hosts[host]
+	if !found || breaker.failures < BreakerThreshold {
+		return nil
+	}
+	if time.Now().Before(breaker.openUntil) || breaker.probing {
+		return breakerOpenError{host: host, until: breaker.openUntil}
+	}
+	breaker.probing = true
+	return nil
+}
+
+func (t *breakerTransport) record(host string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	breaker, found := t.hosts[host]
+	if !found {
+		breaker = &hostBreaker{}
+		t.hosts[host] = breaker
+	}
+	breaker.probing = false
+
+	if !failed {
+		if breaker.failures >= BreakerThreshold {
+			log.Printf("%v is back, resuming calls to it", host)
+		}
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures >= BreakerThreshold {
+		/* Only say so when it trips, not for every call it turns away. */
+		if breaker.failures == BreakerThreshold {
+			log.Printf("WARNING: %v keeps failing, pausing calls to it for %v", host, BreakerCooldown)
+		}
+		breaker.openUntil = time.Now().Add(BreakerCooldown)
+	}
+}
+
+/* Whether a request can be sent again without risk of doing the same thing
+ * twice. Rate limited requests weren't acted on, so those always can. */
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || req.Context().Err() != nil {
+		return false
+	}
+
+	if res != nil && res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+/* Whether a response counts against the host. Errors on our end, like 404s,
+ * say nothing about how the host is doing. */
+func hostFailed(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+}
+
+/* How long to wait before trying again, going with what the host asked for
+ * when it's reasonable. */
+func retryDelay(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if delay, ok := retryAfter(res); ok && delay <= HTTPRetryMaxDelay {
+			return delay
+		}
+	}
+	return backoffDelay(attempt, HTTPRetryBaseDelay, HTTPRetryMaxDelay)
+}
+
+/* How long a response asks us to wait before trying again, in seconds in its
+ * Retry-After, if it says. */
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	for attempt := 1; ; attempt++ {
+		if err := t.allow(host); err != nil {
+			return nil, err
+		}
+
+		try := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try = req.Clone(req.Context())
+			try.Body = body
+		}
+
+		res, err := t.base.RoundTrip(try)
+		failed := hostFailed(res, err)
+		t.record(host, failed)
+		if !failed || attempt >= HTTPRetryAttempts || !retryable(req, res, err) {
+			return res, err
+		}
+
+		delay := retryDelay(attempt, res)
+		if res != nil {
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* How many requests a minute each host may get, from every account going to
+ * it put together, see VBC_HOST_RATE_LIMIT. */
+type hostRateLimits struct {
+	/* For hosts not in hosts, 0 for no limit. */
+	fallback float64
+	hosts    map[string]float64
+}
+
+/* Parses VBC_HOST_RATE_LIMIT, a number of requests a minute for every host,
+ * host=number pairs for single hosts, or both, separated by commas, such as
+ * 120,mastodon.social=60. */
+func parseHostRateLimits(value string) (hostRateLimits, error) {
+	limits := hostRateLimits{hosts: make(map[string]float64)}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		host, rate, found := strings.Cut(field, "=")
+		if !found {
+			host, rate = "", field
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if err != nil || n < 0 {
+			return limits, errors.New(fmt.Sprintf("%q is not a number of requests a minute of at least 0", rate))
+		}
+		host = strings.ToLower(strings.TrimSpace(host))
+		if found && host == "" {
+			return limits, errors.New(fmt.Sprintf("%q has no host", field))
+		}
+		if found {
+			limits.hosts[host] = n
+		} else {
+			limits.fallback = n
+		}
+	}
+	return limits, nil
+}
+
+/* Requests a minute a host may get, 0 for no limit. */
+func (l hostRateLimits) For(host string) float64 {
+	if rate, found := l.hosts[strings.ToLower(host)]; found {
+		return rate
+	}
+	return l.fallback
+}
+
+/* Sits under every HTTP client we use, keeping the requests made to each host
+ * under its budget, however many accounts they're made for, so instances and
+ * PDSes shared by several of them don't get more from us than from one.
+ * Requests over the budget wait their turn rather than failing. */
+type budgetTransport struct {
+	base   http.RoundTripper
+	limits hostRateLimits
+
+	mu    sync.Mutex
+	hosts map[string]*rateLimiter
+}
+
+func newBudgetTransport(base http.RoundTripper, limits hostRateLimits) *budgetTransport {
+	return &budgetTransport{
+		base:   base,
+		limits: limits,
+		hosts:  make(map[string]*rateLimiter),
+	}
+}
+
+func (t *budgetTransport) limiter(host string) *rateLimiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limiter, found := t.hosts[host]
+	if !found {
+		limiter = newRateLimiter(t.limits.For(host) / 60)
+		t.hosts[host] = limiter
+	}
+	return limiter
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter(req.URL.Hostname()).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
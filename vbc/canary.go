@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+func runCommand(args []string, ephemeral bool) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	canary := fs.String("canary", "", "status to crosspost, by URL or ID, logging everything it goes through, then exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc run [--canary <status url or id>]\n\n")
+		fmt.Fprintf(fs.Output(), "Runs the crossposter, same as vbc without a command. With --canary, only\n")
+		fmt.Fprintf(fs.Output(), "crossposts the one status, to every account it would get crossposted\n")
+		fmt.Fprintf(fs.Output(), "to, logging what was done to it and every step it went through along\n")
+		fmt.Fprintf(fs.Output(), "with how long each took, then exits, with a status other than 0 if it\n")
+		fmt.Fprintf(fs.Output(), "failed. Meant for trying a new version of vbc on a status known to be\n")
+		fmt.Fprintf(fs.Output(), "tricky before running it for good. Crossposts that are already up get\n")
+		fmt.Fprintf(fs.Output(), "written over rather than posted twice. Needs vbc stopped.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *canary == "" {
+		runDaemon(context.Background(), ephemeral)
+		return
+	}
+	canaryCommand(*canary)
+}
+
+/* Crossposts a single status with everything it goes through logged, see
+ * runCommand. */
+func canaryCommand(raw string) {
+	verbose = true
+	logSpans = true
+	log.Printf("canary: vbc %v crossposting %v", readBuildInfo(), raw)
+
+	ctx := context.Background()
+	if err := setupTracing(ctx); err != nil {
+		log.Fatalf("could not set up tracing: %v", err)
+	}
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+
+	started := time.Now()
+	err = repostStatus(ctx, config, store, raw)
+	flushTracing(ctx)
+	store.Close()
+	if err != nil {
+		log.Fatalf("canary: failed after %v: %v", time.Since(started).Round(time.Millisecond), err)
+	}
+	log.Printf("canary: done in %v", time.Since(started).Round(time.Millisecond))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Failures to inject on purpose, for soak testing how retries, the retry
+ * queue and reconciliation hold up, see TestSoak. Set with flags left out of
+ * the usage, as they're no use to anyone running vbc for real. */
+type chaosConfig struct {
+	/* How many Bluesky requests, from 0 to 1, fail with a 5xx. */
+	BlueskyErrors float64
+	/* Longest Mastodon requests get held up by, each by a random amount. */
+	MastodonDelay time.Duration
+	/* How many store writes, from 0 to 1, fail. */
+	StoreErrors float64
+}
+
+var chaos chaosConfig
+
+/* Flags usage leaves out. */
+var hiddenFlags = map[string]bool{
+	"chaos-bsky-5xx":       true,
+	"chaos-mastodon-delay": true,
+	"chaos-store-errors":   true,
+}
+
+func registerChaosFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&chaos.BlueskyErrors, "chaos-bsky-5xx", 0, "fraction of Bluesky requests to fail with a 5xx")
+	fs.DurationVar(&chaos.MastodonDelay, "chaos-mastodon-delay", 0, "longest to hold up Mastodon requests by")
+	fs.Float64Var(&chaos.StoreErrors, "chaos-store-errors", 0, "fraction of store writes to fail")
+}
+
+func (c chaosConfig) Enabled() bool {
+	return c.BlueskyErrors > 0 || c.MastodonDelay > 0 || c.StoreErrors > 0
+}
+
+/* Prints the defaults of every flag of fs that isn't hidden. */
+func printVisibleDefaults(fs *flag.FlagSet) {
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+/* Sits right above the network, failing and holding up requests as chaos
+ * says, so everything above it gets to deal with them as it would with the
+ * real thing. Bluesky and Mastodon are told apart by their paths. */
+type chaosTransport struct {
+	base http.RoundTripper
+}
+
+func newChaosTransport(base http.RoundTripper) *chaosTransport {
+	log.Printf("WARNING: injecting failures: %v of Bluesky requests fail, Mastodon requests held up by up to %v, %v of store writes fail",
+		chaos.BlueskyErrors,
+		chaos.MastodonDelay,
+		chaos.StoreErrors)
+	return &chaosTransport{base: base}
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/api/") && chaos.MastodonDelay > 0 {
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(chaos.MastodonDelay)))):
+		case <-req.Context().Done():
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+
+	if strings.HasPrefix(path, "/xrpc/") && rand.Float64() < chaos.BlueskyErrors {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		statuses := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+		status := statuses[rand.Intn(len(statuses))]
+		body := fmt.Sprintf(`{"error":"InternalServerError","message":"injected %v"}`, status)
+		return &http.Response{
+			Status:        fmt.Sprintf("%v %v", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+/* A store whose writes to what crossposting keeps track of fail every so
+ * often, as chaos says. */
+type chaosStore struct {
+	Store
+}
+
+/* Store as it is, unless chaos has its writes failing. */
+func withChaos(store Store) Store {
+	if chaos.StoreErrors > 0 {
+		return &chaosStore{Store: store}
+	}
+	return store
+}
+
+func (s *chaosStore) fail() error {
+	if rand.Float64() < chaos.StoreErrors {
+		return errors.New("injected store write error")
+	}
+	return nil
+}
+
+func (s *chaosStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.PutMapping(acct, status, value)
+}
+
+func (s *chaosStore) PutCursor(acct AccountKey, status int64) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.PutCursor(acct, status)
+}
+
+func (s *chaosStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.PutRetry(acct, entry)
+}
+
+func (s *chaosStore) RemoveRetry(acct AccountKey, status int64) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.RemoveRetry(acct, status)
+}
+
+func (s *chaosStore) PutDeadLetter(acct AccountKey, entry RetryEntry) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.PutDeadLetter(acct, entry)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+/* Multicodec codes going into the CIDs of records, see
+ * https://github.com/multiformats/multicodec. */
+const (
+	cidVersion1     = 0x01
+	cidCodecDagCbor = 0x71
+	cidHashSha256   = 0x12
+)
+
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* Works out the CID a record will have once it's in a repo, the same way a
+ * PDS does: as the SHA-256 of its DAG-CBOR encoding. That lets records that
+ * point to each other, like the posts of a thread, be written in one go. */
+func recordCID(record interface{}) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	var encoded bytes.Buffer
+	if err := encodeDagCbor(&encoded, value); err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(encoded.Bytes())
+
+	cid := []byte{cidVersion1, cidCodecDagCbor, cidHashSha256, byte(len(digest))}
+	cid = append(cid, digest[:]...)
+	return "b" + strings.ToLower(cidBase32.EncodeToString(cid)), nil
+}
+
+/* Encodes a value decoded from JSON as DAG-CBOR, with the conventions
+ * atproto has for JSON: {"$link": cid} is a link, {"$bytes": base64} is a
+ * byte string, and there are no floats. */
+func encodeDagCbor(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v is not an integer, which is all records may have", v))
+		}
+		if n < 0 {
+			writeCborHead(buf, 1, uint64(-(n + 1)))
+		} else {
+			writeCborHead(buf, 0, uint64(n))
+		}
+	case string:
+		writeCborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCborHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeDagCbor(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if link, ok := v["$link"].(string); ok {
+				return writeCborLink(buf, link)
+			}
+			if data, ok := v["$bytes"].(string); ok {
+				raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+				if err != nil {
+					return err
+				}
+				writeCborHead(buf, 2, uint64(len(raw)))
+				buf.Write(raw)
+				return nil
+			}
+		}
+
+		/* Keys go shortest first, then in byte order. */
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+
+		writeCborHead(buf, 5, uint64(len(v)))
+		for _, key := range keys {
+			writeCborHead(buf, 3, uint64(len(key)))
+			buf.WriteString(key)
+			if err := encodeDagCbor(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("can't encode %T as DAG-CBOR", value))
+	}
+	return nil
+}
+
+/* Writes the head of a data item, with the argument as short as it goes. */
+func writeCborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+/* Writes a link to a CID in its base32 string form, as tag 42 over the CID
+ * prefixed with the identity multibase. */
+func writeCborLink(buf *bytes.Buffer, link string) error {
+	if !strings.HasPrefix(link, "b") {
+		return errors.New(fmt.Sprintf("CID %q is not in base32", link))
+	}
+	cid, err := cidBase32.DecodeString(strings.ToUpper(link[1:]))
+	if err != nil {
+		return errors.New(fmt.Sprintf("bad CID %q: %v", link, err))
+	}
+
+	buf.Write([]byte{0xd8, 42})
+	writeCborHead(buf, 2, uint64(len(cid)+1))
+	buf.WriteByte(0x00)
+	buf.Write(cid)
+	return nil
+}
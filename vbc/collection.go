@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* What NSIDs look like: a reversed domain name, then a name. */
+var nsidRe = regexp.MustCompile(`^[a-zA-Z]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)+\.[a-zA-Z][a-zA-Z0-9]*$`)
+
+/* Helpers record templates get on top of templateFuncs. */
+var recordTemplateFuncs = template.FuncMap{
+	/* Writes a value out as JSON, as in "text": {{json .text}}. */
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+/* How many tags a post may have, and how long each may be, in graphemes,
+ * which we take to be runes. */
+const (
+	MaxMirrorTags      = 8
+	MaxMirrorTagLength = 64
+)
+
+/* Tags as they go in posts, without the # they may have been written with. */
+func mirrorTags(transform TransformConfig) []string {
+	var tags []string
+	for _, tag := range transform.MirrorTags {
+		tags = append(tags, strings.TrimPrefix(tag, "#"))
+	}
+	return tags
+}
+
+func checkMirrorTag(tag string) error {
+	tag = strings.TrimPrefix(tag, "#")
+	switch {
+	case tag == "":
+		return errors.New("it is empty")
+	case strings.IndexFunc(tag, unicode.IsSpace) >= 0:
+		return errors.New("it has spaces in it")
+	case utf8.RuneCountInString(tag) > MaxMirrorTagLength:
+		return errors.New(fmt.Sprintf("it is longer than %v characters", MaxMirrorTagLength))
+	}
+	return nil
+}
+
+/* What crossposts of an account go up as: records of which collection, and
+ * shaped how, see TransformConfig.Collection, RecordTemplate and
+ * RecordFields. */
+type recordShape struct {
+	Collection string
+	Template   string
+	Fields     map[string]interface{}
+}
+
+func recordShapeFor(transform TransformConfig) recordShape {
+	shape := recordShape{
+		Collection: PostCollection,
+		Template:   transform.RecordTemplate,
+		Fields:     transform.RecordFields,
+	}
+	if transform.Collection != "" {
+		shape.Collection = transform.Collection
+	}
+	return shape
+}
+
+func parseRecordTemplate(text string) (*template.Template, error) {
+	return template.New("recordTemplate").Funcs(templateFuncs).Funcs(recordTemplateFuncs).Parse(text)
+}
+
+/* The record a post goes up as: the post itself, or what the template makes
+ * of it, given the post as its JSON would have it, such as {{.text}} and
+ * {{json .embed}}. Records made by the template are JSON objects, which get
+ * the collection as their $type unless they say otherwise. Fields get added
+ * to records that don't have them already either way. */
+func (s recordShape) Record(post *postRecord) (interface{}, error) {
+	if s.Template == "" {
+		if s.Collection == PostCollection && len(s.Fields) == 0 {
+			return post, nil
+		}
+		var record map[string]interface{}
+		if err := remarshal(post, &record); err != nil {
+			return nil, err
+		}
+		record["$type"] = s.Collection
+		s.addFields(record)
+		return record, nil
+	}
+
+	tmpl, err := parseRecordTemplate(s.Template)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	var data map[string]interface{}
+	if err := remarshal(post, &data); err != nil {
+		return nil, err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("could not execute recordTemplate: %v", err)))
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("recordTemplate did not make a JSON object: %v", err)))
+	}
+	if _, found := record["$type"]; !found {
+		record["$type"] = s.Collection
+	}
+	s.addFields(record)
+	return record, nil
+}
+
+func (s recordShape) addFields(record map[string]interface{}) {
+	for name, value := range s.Fields {
+		if _, found := record[name]; !found {
+			record[name] = value
+		}
+	}
+}
+
+/* Turns a value into another through its JSON. */
+func remarshal(from interface{}, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+/* The collection of the record an at:// URI points to, that of posts when
+ * it doesn't say. */
+func uriCollection(uri string) string {
+	parts := strings.Split(strings.TrimPrefix(uri, "at://"), "/")
+	if len(parts) == 3 && parts[1] != "" {
+		return parts[1]
+	}
+	return PostCollection
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+const (
+	/* How often the community list is checked, when checkInterval isn't
+	 * set. */
+	CommunityCheckIntervalDefault = 10 * time.Minute
+	/* Profile field members give their Bluesky handle in, when handleField
+	 * isn't set. */
+	CommunityHandleFieldDefault = "Bluesky"
+)
+
+/* An account on a Mastodon list, with what we need out of it. */
+type listMember struct {
+	ID     int64  `json:"id,string"`
+	Acct   string `json:"acct"`
+	URL    string `json:"url"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+/* Every account on a list of the account the token is of. */
+func (w *mastodonWriter) ListMembers(ctx context.Context, list string) ([]listMember, error) {
+	var members []listMember
+	/* No limit hands back the whole list at once. */
+	err := w.call(ctx, http.MethodGet, "/api/v1/lists/"+url.PathEscape(list)+"/accounts?limit=0", nil, &members)
+	return members, err
+}
+
+/* The Bluesky handle of a member, going by the handle map first, then by the
+ * profile field named field, which may hold either the handle or a link to
+ * the profile. Empty when neither has one. */
+func memberHandle(member listMember, field string, handles map[string]string) string {
+	if handle := lookupHandle(handles, accountHandle(&madon.Account{Acct: member.Acct, URL: member.URL})); handle != "" {
+		return handle
+	}
+
+	for _, f := range member.Fields {
+		if !strings.EqualFold(strings.TrimSpace(f.Name), field) {
+			continue
+		}
+		value := strings.TrimSpace(renderStatusText(f.Value))
+		if i := strings.Index(value, "bsky.app/profile/"); i >= 0 {
+			value = value[i+len("bsky.app/profile/"):]
+			value, _, _ = strings.Cut(value, "/")
+		}
+		value = strings.TrimPrefix(value, "@")
+		if strings.Contains(value, ".") && !strings.ContainsAny(value, " /:@") {
+			return strings.ToLower(value)
+		}
+	}
+	return ""
+}
+
+/* Keeps the accounts on the community list crossposted, starting a pair for
+ * every member that joins and stopping it when they leave. Members need a
+ * Bluesky handle vbc can find, see memberHandle, and to have been logged in
+ * with `vbc bsky-login`, until which they're waited on. Runs until ctx is
+ * done. */
+func watchCommunity(
+	ctx context.Context,
+	config *Config,
+	store Store,
+	start func(ctx context.Context, pair accountPair)) {
+
+	community := config.Community
+	writer := newMastodonWriter(community.Mastodon, envOrNil(community.TokenEnv))
+	interval := CommunityCheckIntervalDefault
+	if community.CheckInterval != "" {
+		interval, _ = time.ParseDuration(community.CheckInterval)
+	}
+	field := community.HandleField
+	if field == "" {
+		field = CommunityHandleFieldDefault
+	}
+	server := envOrDefault("VBC_BSKY_SERVER", bluesky.ServerBskySocial)
+	if community.BlueskyServer != "" {
+		server = community.BlueskyServer
+	}
+
+	/* Accounts crossposted on their own are left to that. */
+	configured := make(map[accountPair]bool)
+	for _, pair := range config.Pairs() {
+		configured[accountPair{Instance: pair.Instance, AccountID: pair.AccountID, Handle: pair.Handle}] = true
+	}
+
+	err := retryStartup(ctx, "verify community token", func() error {
+		return writer.VerifyScopes(ctx, []requiredScope{{"read:lists", "community"}})
+	})
+	if err != nil {
+		log.Printf("ERROR: community: could not verify the token in %v, not crossposting the community: %v", community.TokenEnv, err)
+		return
+	}
+
+	running := make(map[accountPair]context.CancelFunc)
+	/* What members are being waited on for, so it's only said once. */
+	waiting := make(map[int64]string)
+	log.Printf("community: crossposting every account on list %v of %v", community.List, community.Mastodon)
+	for {
+		members, err := writer.ListMembers(ctx, community.List)
+		if err != nil {
+			log.Printf("ERROR: community: could not fetch the members of list %v: %v", community.List, err)
+		} else {
+			wanted := make(map[accountPair]accountPair)
+			for _, member := range members {
+				handle := memberHandle(member, field, config.Handles)
+				if handle == "" {
+					if waiting[member.ID] != "handle" {
+						log.Printf("community: @%v has no Bluesky handle in their %v profile field, waiting for one", member.Acct, field)
+						waiting[member.ID] = "handle"
+					}
+					continue
+				}
+
+				key := accountPair{Instance: community.Mastodon, AccountID: member.ID, Handle: handle}
+				if configured[key] {
+					continue
+				}
+				if _, found := running[key]; !found {
+					session, err := loadOAuthSession(store, handle)
+					if err != nil {
+						log.Printf("WARNING: community: could not load the OAuth session of @%v: %v", handle, err)
+						continue
+					}
+					if session == nil {
+						if waiting[member.ID] != handle {
+							log.Printf("community: @%v joined, waiting for @%v to be logged in with `vbc bsky-login %v`", member.Acct, handle, handle)
+							waiting[member.ID] = handle
+						}
+						continue
+					}
+				}
+				delete(waiting, member.ID)
+
+				pair := key
+				pair.Server = server
+				wanted[key] = pair
+			}
+
+			for key, stop := range running {
+				if _, found := wanted[key]; !found {
+					log.Printf("community: account %v left, no longer crossposting it to @%v", key.AccountID, key.Handle)
+					stop()
+					delete(running, key)
+				}
+			}
+			for key, pair := range wanted {
+				if _, found := running[key]; found {
+					continue
+				}
+				log.Printf("community: crossposting account %v on %v to @%v", pair.AccountID, pair.Instance, pair.Handle)
+				pairCtx, stop := context.WithCancel(ctx)
+				running[key] = stop
+				start(pairCtx, pair)
+			}
+		}
+
+		/* With --once, the members there are now get polled once like
+		 * every other account, and that's it. */
+		if pollOnce {
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	/* So timezones can be found wherever vbc runs, Windows and bare
+	 * containers included. */
+	_ "time/tzdata"
+)
+
+/* How statuses too long for a single Bluesky post get handled. */
+const (
+	SplitThread   = "thread"
+	SplitTruncate = "truncate"
+	SplitSkip     = "skip"
+)
+
+/* Where the content warning of a status goes. */
+const (
+	/* Wherever the template puts it, which is nowhere by default. */
+	ContentWarningsInline = "inline"
+	/* In a post of its own, with the rest of the status in replies. */
+	ContentWarningsThread = "thread"
+)
+
+/* What links in a status turn into, besides text. */
+const (
+	LinksCard  = "card"
+	LinksPlain = "plain"
+)
+
+/* What the media of a status turns into. */
+const (
+	/* Images uploaded to Bluesky, as they are on Mastodon. */
+	MediaUpload = "upload"
+	/* A card linking to the status, with nothing uploaded, see
+	 * mediaLinkEmbed. */
+	MediaLink = "link"
+)
+
+/* What a status that's nothing but a link turns into. */
+const (
+	/* A post with the link as its text, and a card for it. */
+	LinkOnlyText = "text"
+	/* A post with only a card for the link, and no text. */
+	LinkOnlyCard = "card"
+)
+
+/* What happens to statuses that turn into posts with nothing in them. */
+const (
+	EmptyPostsSkip = "skip"
+	EmptyPostsKeep = "keep"
+)
+
+/* What happens to the custom emoji of the instance, which are only ever
+ * shortcodes on Bluesky. */
+const (
+	CustomEmojiKeep  = "keep"
+	CustomEmojiStrip = "strip"
+)
+
+/* What happens to statuses whose HTML fails to render out to text. Their
+ * raw HTML never gets posted either way. */
+const (
+	/* Post them with their tags stripped out, see stripTags. */
+	HTMLFallbackStrip = "strip"
+	HTMLFallbackSkip  = "skip"
+	/* Give up on them, leaving them in the dead letters. */
+	HTMLFallbackDeadLetter = "dead-letter"
+)
+
+/* What happens to boosts of statuses of the account's own, see
+ * isSelfBoost. */
+const (
+	/* Nothing special, the same as for other boosts. */
+	SelfBoostsSkip = "skip"
+	/* Repost the crosspost of the boosted status, see publishSelfBoost. */
+	SelfBoostsRepost = "repost"
+)
+
+/* What happens to statuses linking to a blocked domain. */
+const (
+	BlockedLinksSkip  = "skip"
+	BlockedLinksStrip = "strip"
+)
+
+/* Who gets to reply to crossposts, see app.bsky.feed.threadgate. */
+const (
+	ThreadgateNobody    = "nobody"
+	ThreadgateMentioned = "mentioned"
+	ThreadgateFollowing = "following"
+	/* No threadgate at all, for overriding one set at a level above. */
+	ThreadgateEveryone = "everyone"
+)
+
+/* Who gets to quote crossposts, see app.bsky.feed.postgate. */
+const (
+	QuotesEveryone = "everyone"
+	QuotesNobody   = "nobody"
+)
+
+/* When crossposts say they were made. */
+const (
+	/* When the status was, which Bluesky shows as archived when it's not
+	 * around when the post went up. */
+	TimestampsOriginal = "original"
+	/* When the post went up. */
+	TimestampsNow = "now"
+)
+
+/* What happens when the Mastodon account goes away, see watchAccount. */
+const (
+	/* Stop crossposting, and check on the account until it's back. */
+	AccountGoneWatch = "watch"
+	/* Stop crossposting until vbc is restarted. */
+	AccountGonePause = "pause"
+)
+
+/* Transform configurations that come with vbc, that any level can pick by
+ * name in profile, along with those in profiles, see TransformFor. */
+var TransformProfiles = map[string]TransformConfig{
+	/* Crossposts that look as much as possible like they were made on
+	 * Bluesky, with nothing added to them. */
+	"strict": {
+		Template:        "{{.Text}}",
+		Footer:          new(string),
+		Attribution:     new(string),
+		SensitiveLabels: []string{},
+		Threadgate:      []string{ThreadgateEveryone},
+		Quotes:          QuotesEveryone,
+		Timestamps:      TimestampsNow,
+	},
+}
+
+/* Which statuses get left out. */
+type FilterConfig struct {
+	/* Skip statuses with any of these hashtags. */
+	SkipTags []string `json:"skipTags,omitempty"`
+	/* Only crosspost statuses with one of these hashtags, if any are set. */
+	OnlyTags []string `json:"onlyTags,omitempty"`
+	/* Skip statuses containing any of these words, ignoring case. */
+	SkipWords []string `json:"skipWords,omitempty"`
+	/* Skip statuses marked as sensitive. */
+	SkipSensitive bool `json:"skipSensitive,omitempty"`
+	/* Skip statuses in any of these languages, see matchesLanguage. */
+	SkipLanguages []string `json:"skipLanguages,omitempty"`
+	/* Only crosspost statuses in one of these languages, if any are set. */
+	OnlyLanguages []string `json:"onlyLanguages,omitempty"`
+	/* Domains never linked to from Bluesky, subdomains included, see
+	 * blockedDomain. */
+	BlockDomains []string `json:"blockDomains,omitempty"`
+	/* One of skip, the default, or strip, taking out just the links. */
+	BlockedLinks string `json:"blockedLinks,omitempty"`
+	/* Skip statuses the account's own hide filters on its server match,
+	 * see serverFilters. Needs an access token. */
+	MastodonFilters bool `json:"mastodonFilters,omitempty"`
+}
+
+/* Controls how statuses are turned into posts. Fields that are left unset
+ * are inherited from the level above, see TransformFor. */
+type TransformConfig struct {
+	/* Name of a profile the rest of this goes on top of, see
+	 * TransformProfiles. */
+	Profile string        `json:"profile,omitempty"`
+	Filters *FilterConfig `json:"filters,omitempty"`
+	/* Go template for the text of the post, see templateData. */
+	Template string `json:"template,omitempty"`
+	/* Go template for text added at the very end of the post. */
+	Footer *string `json:"footer,omitempty"`
+	/* Go template for a line saying whose status it was, put before the
+	 * footer. Meant for several accounts crossposting to the same place. */
+	Attribution *string `json:"attribution,omitempty"`
+	/* One of thread, truncate or skip. */
+	Split string `json:"split,omitempty"`
+	/* Any of mentioned and following, or nobody on its own. Unset lets
+	 * everyone reply. */
+	Threadgate []string `json:"threadgate,omitempty"`
+	/* One of everyone or nobody. */
+	Quotes string `json:"quotes,omitempty"`
+	/* One of keep, skip, strip or link, see applyMentionsPolicy. */
+	Mentions string `json:"mentions,omitempty"`
+	/* Self-labels put on posts of statuses marked as sensitive. */
+	SensitiveLabels []string `json:"sensitiveLabels,omitempty"`
+	/* Mastodon visibilities that get crossposted. Private and direct ones
+	 * only go to handles in AllowPrivate, see guardPrivate. */
+	Visibility []string `json:"visibility,omitempty"`
+	/* Bluesky handles followers-only and direct statuses may go out to,
+	 * where anyone can see them, when visibility says they're crossposted. */
+	AllowPrivate []string `json:"allowPrivate,omitempty"`
+	/* Which statuses get fetched from Mastodon at all, see statusQuery. */
+	ExcludeReplies *bool `json:"excludeReplies,omitempty"`
+	ExcludeReblogs *bool `json:"excludeReblogs,omitempty"`
+	OnlyMedia      *bool `json:"onlyMedia,omitempty"`
+	/* Starlark script run on every post, see runStarlarkScript. */
+	Script string `json:"script,omitempty"`
+	/* Command the post gets piped through, see runHookCommand. */
+	Command []string `json:"command,omitempty"`
+	/* Aspect ratio, such as 16:9, images get cropped to around their focal
+	 * point. Unset leaves them as they are. */
+	Crop string `json:"crop,omitempty"`
+	/* How many posts a status may be split into, the last one linking to
+	 * the rest of it, see capThread. Unset or 0 for no limit. */
+	MaxThread *int `json:"maxThread,omitempty"`
+	/* One of upload or link. */
+	Media string `json:"media,omitempty"`
+	/* One of card or plain, see attachLinkCards. */
+	Links string `json:"links,omitempty"`
+	/* How long fetching the page of a card and its thumbnail may take each,
+	 * as a duration such as 10s, and how big in bytes a thumbnail may be.
+	 * Unset goes with LinkCardTimeout and LinkCardThumbLimit. */
+	CardTimeout   string `json:"cardTimeout,omitempty"`
+	CardThumbSize *int   `json:"cardThumbSize,omitempty"`
+	/* One of text or card, see blueskyPosts. */
+	LinkOnly string `json:"linkOnly,omitempty"`
+	/* Go template for the text of statuses that are nothing but media. */
+	MediaCaption *string `json:"mediaCaption,omitempty"`
+	/* One of skip or keep. */
+	EmptyPosts string `json:"emptyPosts,omitempty"`
+	/* One of strip, skip or dead-letter, see renderStatusSegments. */
+	HTMLFallback string `json:"htmlFallback,omitempty"`
+	/* One of skip or repost. */
+	SelfBoosts string `json:"selfBoosts,omitempty"`
+	/* One of original or now. */
+	Timestamps string `json:"timestamps,omitempty"`
+	/* One of inline or thread. */
+	ContentWarnings string `json:"contentWarnings,omitempty"`
+	/* File of rules saying which content warnings get which labels, and
+	 * which get prefixed or skipped, see parseContentWarningRules. */
+	ContentWarningRules string `json:"contentWarningRules,omitempty"`
+	/* Whether to resolve short links, and to strip tracking parameters
+	 * from links, see cleanLinks. */
+	Unshorten     *bool `json:"unshorten,omitempty"`
+	StripTracking *bool `json:"stripTracking,omitempty"`
+	/* Whether to show links shortened, see shortenLinks. */
+	ShortenLinks *bool `json:"shortenLinks,omitempty"`
+	/* One of quote, link or keep, see resolveSelfLinks. */
+	SelfLinks string `json:"selfLinks,omitempty"`
+	/* One of reply or edit, unset leaving statuses alone, see
+	 * mastodonWriter.CrossLink. */
+	CrossLink string `json:"crossLink,omitempty"`
+	/* Whether to like the crossposts of statuses favourited on Mastodon,
+	 * see mirrorFavourites. */
+	MirrorFavorites *bool `json:"mirrorFavorites,omitempty"`
+	/* Whether to bring how private the Mastodon account is over to
+	 * Bluesky, see mirrorPrivacy. */
+	MirrorPrivacy *bool `json:"mirrorPrivacy,omitempty"`
+	/* IANA name of the timezone times get shown in, such as
+	 * America/Sao_Paulo. Unset leaves them in UTC. */
+	Timezone string `json:"timezone,omitempty"`
+	/* How many statuses may be crossposted in any one hour, the rest being
+	 * held back until there's room, see postLimiter. Unset or 0 for no
+	 * limit. */
+	MaxPerHour *int `json:"maxPerHour,omitempty"`
+	/* How long to leave between crossposts, as a duration such as 30s, so
+	 * catching up doesn't post them all at once, see postSpacer. */
+	PostDelay string `json:"postDelay,omitempty"`
+	/* One of watch or pause, for when the Mastodon account gets suspended,
+	 * deleted or moved. */
+	AccountGone string `json:"accountGone,omitempty"`
+	/* One of keep or propagate, and how long statuses have to stay deleted
+	 * for before their crossposts go too, as a duration such as 10m. Unset
+	 * goes with DeleteGraceDefault. */
+	Deletions   string `json:"deletions,omitempty"`
+	DeleteGrace string `json:"deleteGrace,omitempty"`
+	/* URL told about every crosspost, see sendCrosspostWebhook. */
+	Webhook string `json:"webhook,omitempty"`
+	/* Whether to go through everything but putting posts up, writing down
+	 * what would have been posted instead, see MappingShadowed. */
+	Shadow *bool `json:"shadow,omitempty"`
+	/* Whether to look for a post of a status already on Bluesky before
+	 * crossposting it, see matchExistingPosts. */
+	MatchExisting *bool `json:"matchExisting,omitempty"`
+	/* NSID of the collection crossposts go in, for custom lexicons and
+	 * AppViews other than Bluesky's. Posts when unset. */
+	Collection string `json:"collection,omitempty"`
+	/* Template turning each post into the JSON of the record it goes up
+	 * as, for collections whose records aren't shaped like posts, see
+	 * recordShape. */
+	RecordTemplate string `json:"recordTemplate,omitempty"`
+	/* Tags put on every crosspost without showing up in its text, for
+	 * feeds and mutes to tell crossposts apart by, see MaxMirrorTags. */
+	MirrorTags []string `json:"mirrorTags,omitempty"`
+	/* Fields added to the record of every crosspost, on top of those it
+	 * already has. */
+	RecordFields map[string]interface{} `json:"recordFields,omitempty"`
+	/* One of keep, the default, or strip, see instanceInfo. */
+	CustomEmoji string `json:"customEmoji,omitempty"`
+}
+
+/* What a crossposter does when not told otherwise. */
+var DefaultTransformConfig = TransformConfig{
+	Filters:    &FilterConfig{},
+	Template:   "{{.Text}}",
+	Footer:     new(string),
+	Split:      SplitThread,
+	Mentions:   MentionsKeep,
+	Links:      LinksCard,
+	Media:      MediaUpload,
+	Visibility: []string{"public", "unlisted"},
+	/* Blurred by default, same as on Mastodon. */
+	SensitiveLabels: []string{"graphic-media"},
+	ContentWarnings: ContentWarningsInline,
+	SelfLinks:       SelfLinksQuote,
+	LinkOnly:        LinkOnlyText,
+	EmptyPosts:      EmptyPostsSkip,
+	AccountGone:     AccountGoneWatch,
+	Deletions:       DeletionsKeep,
+}
+
+/* Applies the fields set in over on top of c. */
+func (c TransformConfig) Merge(over TransformConfig) TransformConfig {
+	if over.Filters != nil {
+		c.Filters = over.Filters
+	}
+	if over.Template != "" {
+		c.Template = over.Template
+	}
+	if over.Footer != nil {
+		c.Footer = over.Footer
+	}
+	if over.Attribution != nil {
+		c.Attribution = over.Attribution
+	}
+	if over.Split != "" {
+		c.Split = over.Split
+	}
+	if over.Threadgate != nil {
+		c.Threadgate = over.Threadgate
+		if len(c.Threadgate) == 1 && c.Threadgate[0] == ThreadgateEveryone {
+			c.Threadgate = nil
+		}
+	}
+	if over.Quotes != "" {
+		c.Quotes = over.Quotes
+	}
+	if over.Mentions != "" {
+		c.Mentions = over.Mentions
+	}
+	if over.SensitiveLabels != nil {
+		c.SensitiveLabels = over.SensitiveLabels
+	}
+	if over.Visibility != nil {
+		c.Visibility = over.Visibility
+	}
+	if over.AllowPrivate != nil {
+		c.AllowPrivate = over.AllowPrivate
+	}
+	if over.ExcludeReplies != nil {
+		c.ExcludeReplies = over.ExcludeReplies
+	}
+	if over.ExcludeReblogs != nil {
+		c.ExcludeReblogs = over.ExcludeReblogs
+	}
+	if over.OnlyMedia != nil {
+		c.OnlyMedia = over.OnlyMedia
+	}
+	if over.Script != "" {
+		c.Script = over.Script
+	}
+	if over.Command != nil {
+		c.Command = over.Command
+	}
+	if over.Crop != "" {
+		c.Crop = over.Crop
+	}
+	if over.MaxThread != nil {
+		c.MaxThread = over.MaxThread
+	}
+	if over.Media != "" {
+		c.Media = over.Media
+	}
+	if over.Links != "" {
+		c.Links = over.Links
+	}
+	if over.ContentWarnings != "" {
+		c.ContentWarnings = over.ContentWarnings
+	}
+	if over.ContentWarningRules != "" {
+		c.ContentWarningRules = over.ContentWarningRules
+	}
+	if over.Unshorten != nil {
+		c.Unshorten = over.Unshorten
+	}
+	if over.StripTracking != nil {
+		c.StripTracking = over.StripTracking
+	}
+	if over.ShortenLinks != nil {
+		c.ShortenLinks = over.ShortenLinks
+	}
+	if over.SelfLinks != "" {
+		c.SelfLinks = over.SelfLinks
+	}
+	if over.CrossLink != "" {
+		c.CrossLink = over.CrossLink
+	}
+	if over.CardTimeout != "" {
+		c.CardTimeout = over.CardTimeout
+	}
+	if over.CardThumbSize != nil {
+		c.CardThumbSize = over.CardThumbSize
+	}
+	if over.LinkOnly != "" {
+		c.LinkOnly = over.LinkOnly
+	}
+	if over.MediaCaption != nil {
+		c.MediaCaption = over.MediaCaption
+	}
+	if over.EmptyPosts != "" {
+		c.EmptyPosts = over.EmptyPosts
+	}
+	if over.HTMLFallback != "" {
+		c.HTMLFallback = over.HTMLFallback
+	}
+	if over.SelfBoosts != "" {
+		c.SelfBoosts = over.SelfBoosts
+	}
+	if over.Timestamps != "" {
+		c.Timestamps = over.Timestamps
+	}
+	if over.MirrorFavorites != nil {
+		c.MirrorFavorites = over.MirrorFavorites
+	}
+	if over.MirrorPrivacy != nil {
+		c.MirrorPrivacy = over.MirrorPrivacy
+	}
+	if over.MaxPerHour != nil {
+		c.MaxPerHour = over.MaxPerHour
+	}
+	if over.PostDelay != "" {
+		c.PostDelay = over.PostDelay
+	}
+	if over.Timezone != "" {
+		c.Timezone = over.Timezone
+	}
+	if over.AccountGone != "" {
+		c.AccountGone = over.AccountGone
+	}
+	if over.Deletions != "" {
+		c.Deletions = over.Deletions
+	}
+	if over.DeleteGrace != "" {
+		c.DeleteGrace = over.DeleteGrace
+	}
+	if over.Webhook != "" {
+		c.Webhook = over.Webhook
+	}
+	if over.Shadow != nil {
+		c.Shadow = over.Shadow
+	}
+	if over.MatchExisting != nil {
+		c.MatchExisting = over.MatchExisting
+	}
+	if over.Collection != "" {
+		c.Collection = over.Collection
+	}
+	if over.RecordTemplate != "" {
+		c.RecordTemplate = over.RecordTemplate
+	}
+	if over.MirrorTags != nil {
+		c.MirrorTags = over.MirrorTags
+	}
+	if over.RecordFields != nil {
+		c.RecordFields = over.RecordFields
+	}
+	if over.CustomEmoji != "" {
+		c.CustomEmoji = over.CustomEmoji
+	}
+	return c
+}
+
+func (c TransformConfig) Validate() error {
+	switch c.Split {
+	case "", SplitThread, SplitTruncate, SplitSkip:
+	default:
+		return errors.New(fmt.Sprintf("unknown split mode %q", c.Split))
+	}
+
+	switch c.Mentions {
+	case "", MentionsKeep, MentionsSkip, MentionsStrip, MentionsLink:
+	default:
+		return errors.New(fmt.Sprintf("unknown mentions policy %q", c.Mentions))
+	}
+
+	switch c.Quotes {
+	case "", QuotesEveryone, QuotesNobody:
+	default:
+		return errors.New(fmt.Sprintf("unknown quotes mode %q", c.Quotes))
+	}
+
+	switch c.Links {
+	case "", LinksCard, LinksPlain:
+	default:
+		return errors.New(fmt.Sprintf("unknown links mode %q", c.Links))
+	}
+
+	switch c.Media {
+	case "", MediaUpload, MediaLink:
+	default:
+		return errors.New(fmt.Sprintf("unknown media mode %q", c.Media))
+	}
+
+	switch c.SelfLinks {
+	case "", SelfLinksQuote, SelfLinksLink, SelfLinksKeep:
+	default:
+		return errors.New(fmt.Sprintf("unknown self links mode %q", c.SelfLinks))
+	}
+
+	switch c.CrossLink {
+	case "", CrossLinkReply, CrossLinkEdit:
+	default:
+		return errors.New(fmt.Sprintf("unknown cross link mode %q", c.CrossLink))
+	}
+
+	switch c.ContentWarnings {
+	case "", ContentWarningsInline, ContentWarningsThread:
+	default:
+		return errors.New(fmt.Sprintf("unknown content warnings mode %q", c.ContentWarnings))
+	}
+
+	switch c.LinkOnly {
+	case "", LinkOnlyText, LinkOnlyCard:
+	default:
+		return errors.New(fmt.Sprintf("unknown link only mode %q", c.LinkOnly))
+	}
+
+	switch c.EmptyPosts {
+	case "", EmptyPostsSkip, EmptyPostsKeep:
+	default:
+		return errors.New(fmt.Sprintf("unknown empty posts mode %q", c.EmptyPosts))
+	}
+
+	switch c.HTMLFallback {
+	case "", HTMLFallbackStrip, HTMLFallbackSkip, HTMLFallbackDeadLetter:
+	default:
+		return errors.New(fmt.Sprintf("unknown HTML fallback mode %q", c.HTMLFallback))
+	}
+
+	switch c.SelfBoosts {
+	case "", SelfBoostsSkip, SelfBoostsRepost:
+	default:
+		return errors.New(fmt.Sprintf("unknown self boosts mode %q", c.SelfBoosts))
+	}
+
+	switch c.Timestamps {
+	case "", TimestampsOriginal, TimestampsNow:
+	default:
+		return errors.New(fmt.Sprintf("unknown timestamps mode %q", c.Timestamps))
+	}
+
+	switch c.AccountGone {
+	case "", AccountGoneWatch, AccountGonePause:
+	default:
+		return errors.New(fmt.Sprintf("unknown account gone mode %q", c.AccountGone))
+	}
+
+	switch c.Deletions {
+	case "", DeletionsKeep, DeletionsPropagate:
+	default:
+		return errors.New(fmt.Sprintf("unknown deletions mode %q", c.Deletions))
+	}
+	if c.DeleteGrace != "" {
+		if grace, err := time.ParseDuration(c.DeleteGrace); err != nil || grace < 0 {
+			return errors.New(fmt.Sprintf("deleteGrace %q should be a duration such as 10m, or 0", c.DeleteGrace))
+		}
+	}
+
+	if c.Webhook != "" {
+		if err := checkServerURL(c.Webhook); err != nil {
+			return errors.New(fmt.Sprintf("webhook %q is not a valid URL: %v", c.Webhook, err))
+		}
+	}
+
+	if c.Filters != nil {
+		for _, language := range append(copySlice(c.Filters.SkipLanguages), c.Filters.OnlyLanguages...) {
+			if language == "" || strings.ContainsAny(language, " ,") {
+				return errors.New(fmt.Sprintf("language %q should be a code such as en or pt-BR", language))
+			}
+		}
+		for _, domain := range c.Filters.BlockDomains {
+			if normalizeDomain(domain) == "" || strings.ContainsAny(domain, " /:") {
+				return errors.New(fmt.Sprintf("blocked domain %q should be a domain such as example.com", domain))
+			}
+		}
+		switch c.Filters.BlockedLinks {
+		case "", BlockedLinksSkip, BlockedLinksStrip:
+		default:
+			return errors.New(fmt.Sprintf("unknown blocked links mode %q", c.Filters.BlockedLinks))
+		}
+	}
+
+	if c.MaxThread != nil && *c.MaxThread < 0 {
+		return errors.New(fmt.Sprintf("maxThread %v can't be negative", *c.MaxThread))
+	}
+	if c.MaxPerHour != nil && *c.MaxPerHour < 0 {
+		return errors.New(fmt.Sprintf("maxPerHour %v can't be negative", *c.MaxPerHour))
+	}
+	if c.PostDelay != "" {
+		if delay, err := time.ParseDuration(c.PostDelay); err != nil || delay < 0 {
+			return errors.New(fmt.Sprintf("postDelay %q should be a duration such as 30s, or 0", c.PostDelay))
+		}
+	}
+
+	if c.CardTimeout != "" {
+		if timeout, err := time.ParseDuration(c.CardTimeout); err != nil || timeout <= 0 {
+			return errors.New(fmt.Sprintf("cardTimeout %q should be a positive duration such as 10s", c.CardTimeout))
+		}
+	}
+	if c.CardThumbSize != nil && *c.CardThumbSize <= 0 {
+		return errors.New(fmt.Sprintf("cardThumbSize %v should be positive", *c.CardThumbSize))
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			return errors.New(fmt.Sprintf("unknown timezone %q", c.Timezone))
+		}
+	}
+
+	for _, rule := range c.Threadgate {
+		switch rule {
+		case ThreadgateMentioned, ThreadgateFollowing:
+		case ThreadgateNobody, ThreadgateEveryone:
+			if len(c.Threadgate) != 1 {
+				return errors.New(fmt.Sprintf("threadgate %v can't be combined with other rules", rule))
+			}
+		default:
+			return errors.New(fmt.Sprintf("unknown threadgate rule %q", rule))
+		}
+	}
+
+	for _, label := range c.SensitiveLabels {
+		switch label {
+		case "sexual", "nudity", "porn", "graphic-media":
+		default:
+			return errors.New(fmt.Sprintf("unknown self-label %q", label))
+		}
+	}
+
+	for _, visibility := range c.Visibility {
+		switch visibility {
+		case "public", "unlisted", "private", "direct":
+		default:
+			return errors.New(fmt.Sprintf("unknown visibility %q", visibility))
+		}
+	}
+	for _, handle := range c.AllowPrivate {
+		if handle == "" || strings.HasPrefix(handle, "@") {
+			return errors.New(fmt.Sprintf("allowPrivate handle %q should not be empty or start with an @", handle))
+		}
+	}
+
+	if c.ContentWarningRules != "" {
+		if _, err := loadContentWarningRules(c.ContentWarningRules); err != nil {
+			return errors.New(fmt.Sprintf("bad content warning rules: %v", err))
+		}
+	}
+
+	if c.Script != "" {
+		if !StarlarkSupported {
+			return errors.New("scripts need vbc to be built with -tags starlark")
+		}
+		if _, err := os.Stat(c.Script); err != nil {
+			return errors.New(fmt.Sprintf("bad script: %v", err))
+		}
+	}
+
+	if len(c.Command) > 0 {
+		if _, err := exec.LookPath(c.Command[0]); err != nil {
+			return errors.New(fmt.Sprintf("bad command: %v", err))
+		}
+	}
+
+	if c.Crop != "" {
+		if _, _, err := parseAspectRatio(c.Crop); err != nil {
+			return errors.New(fmt.Sprintf("bad crop: %v", err))
+		}
+	}
+
+	if _, err := parseTemplate("template", c.Template); err != nil {
+		return errors.New(fmt.Sprintf("bad template: %v", err))
+	}
+	if c.Footer != nil {
+		if _, err := parseTemplate("footer", *c.Footer); err != nil {
+			return errors.New(fmt.Sprintf("bad footer: %v", err))
+		}
+	}
+	if c.Attribution != nil {
+		if _, err := parseTemplate("attribution", *c.Attribution); err != nil {
+			return errors.New(fmt.Sprintf("bad attribution: %v", err))
+		}
+	}
+	if c.MediaCaption != nil {
+		if _, err := parseTemplate("media caption", *c.MediaCaption); err != nil {
+			return errors.New(fmt.Sprintf("bad media caption: %v", err))
+		}
+	}
+	if c.Collection != "" && !nsidRe.MatchString(c.Collection) {
+		return errors.New(fmt.Sprintf("collection %q is not an NSID, such as app.bsky.feed.post", c.Collection))
+	}
+	if _, err := parseRecordTemplate(c.RecordTemplate); err != nil {
+		return errors.New(fmt.Sprintf("bad record template: %v", err))
+	}
+	if len(c.MirrorTags) > MaxMirrorTags {
+		return errors.New(fmt.Sprintf("posts can't have more than %v mirrorTags", MaxMirrorTags))
+	}
+	for _, tag := range c.MirrorTags {
+		if err := checkMirrorTag(tag); err != nil {
+			return errors.New(fmt.Sprintf("bad mirror tag %q: %v", tag, err))
+		}
+	}
+	if _, found := c.RecordFields["$type"]; found {
+		return errors.New("recordFields can't set $type, collection does that")
+	}
+	switch c.CustomEmoji {
+	case "", CustomEmojiKeep, CustomEmojiStrip:
+	default:
+		return errors.New(fmt.Sprintf("unknown custom emoji mode %q", c.CustomEmoji))
+	}
+	return nil
+}
+
+/* Configuration specific to a pair of Mastodon and Bluesky accounts. */
+type AccountConfig struct {
+	/* Instance URL and account ID on Mastodon. */
+	Mastodon  string `json:"mastodon"`
+	AccountID int64  `json:"accountId"`
+	/* Handle on Bluesky, optional. When set, the account gets crossposted
+	 * to that handle, and this only applies when it does. */
+	Bluesky string `json:"bluesky,omitempty"`
+	/* Bluesky server to log into, defaulting to VBC_BSKY_SERVER. */
+	BlueskyServer string `json:"blueskyServer,omitempty"`
+	/* Environment variable holding the app key of the Bluesky account. Not
+	 * needed when logged in with OAuth, or for VBC_BSKY_HANDLE itself. */
+	BlueskyAppKeyEnv string `json:"blueskyAppKeyEnv,omitempty"`
+	/* Environment variable holding an access token of the Mastodon account,
+	 * for crossLink. Defaults to VBC_MASTODON_TOKEN for the account in the
+	 * environment. */
+	MastodonTokenEnv string `json:"mastodonTokenEnv,omitempty"`
+	/* Bluesky handles statuses with a hashtag go to instead, by hashtag,
+	 * see routesFor. */
+	Routes map[string]string `json:"routes,omitempty"`
+
+	Transform TransformConfig `json:"transform"`
+}
+
+/* Crossposts every account on a Mastodon list, for instance admins serving a
+ * whole community, see watchCommunity. */
+type CommunityConfig struct {
+	/* Instance URL the list is on. */
+	Mastodon string `json:"mastodon"`
+	/* ID of the list, which belongs to the account whose token is in
+	 * TokenEnv. */
+	List     string `json:"list"`
+	TokenEnv string `json:"tokenEnv"`
+	/* Bluesky server members are on, defaulting to VBC_BSKY_SERVER. */
+	BlueskyServer string `json:"blueskyServer,omitempty"`
+	/* Name of the profile field members give their Bluesky handle in, see
+	 * memberHandle. */
+	HandleField string `json:"handleField,omitempty"`
+	/* How often the list is checked for members coming and going, as a
+	 * duration such as 10m. */
+	CheckInterval string `json:"checkInterval,omitempty"`
+
+	/* Applies to members that aren't in accounts. */
+	Transform TransformConfig `json:"transform"`
+}
+
+/* Contents of the file in VBC_CONFIG. */
+type Config struct {
+	/* Where editors find the schema of the file, see configSchema. */
+	Schema string `json:"$schema,omitempty"`
+	/* Applies to every account, unless overridden. */
+	Transform TransformConfig `json:"transform"`
+	Accounts  []AccountConfig `json:"accounts,omitempty"`
+	/* Bluesky handles of Mastodon accounts, by user@instance. */
+	Handles map[string]string `json:"handles,omitempty"`
+	/* Transform configurations any level can pick by name in profile, on
+	 * top of TransformProfiles, which they take the place of when they
+	 * share a name. */
+	Profiles map[string]TransformConfig `json:"profiles,omitempty"`
+	/* Accounts that opt in by being on a list. */
+	Community *CommunityConfig `json:"community,omitempty"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	return readConfig(path, true)
+}
+
+/* Reads and checks the configuration file at path, along with whether the
+ * environment variables it names are set when checkEnv is, which they may
+ * well not be wherever it's only being checked. */
+func readConfig(path string, checkEnv bool) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+
+	for name, profile := range config.Profiles {
+		if err := profile.Validate(); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: profile %v: %v", path, name, err))
+		}
+		if err := config.checkProfile(profile.Profile, name); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: profile %v: %v", path, name, err))
+		}
+	}
+	if err := DefaultTransformConfig.Merge(config.Transform).Validate(); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: transform: %v", path, err))
+	}
+	if err := config.checkProfile(config.Transform.Profile); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: transform: %v", path, err))
+	}
+	for i, account := range config.Accounts {
+		if account.Mastodon == "" || account.AccountID == 0 {
+			return nil, errors.New(fmt.Sprintf("%v: account %v needs both mastodon and accountId", path, i))
+		}
+		instance, err := parseInstanceName(account.Mastodon)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: account %v: %v", path, i, err))
+		}
+		config.Accounts[i].Mastodon = instance
+		config.Accounts[i].Bluesky = strings.TrimPrefix(account.Bluesky, "@")
+
+		if checkEnv && account.BlueskyAppKeyEnv != "" && os.Getenv(account.BlueskyAppKeyEnv) == "" {
+			return nil, errors.New(fmt.Sprintf("%v: account %v: %v is not set", path, i, account.BlueskyAppKeyEnv))
+		}
+		if checkEnv && account.MastodonTokenEnv != "" && os.Getenv(account.MastodonTokenEnv) == "" {
+			return nil, errors.New(fmt.Sprintf("%v: account %v: %v is not set", path, i, account.MastodonTokenEnv))
+		}
+		if err := account.Transform.Validate(); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: account %v: transform: %v", path, i, err))
+		}
+		if err := config.checkProfile(account.Transform.Profile); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: account %v: transform: %v", path, i, err))
+		}
+
+		routes := make(map[string]string, len(account.Routes))
+		for tag, handle := range account.Routes {
+			tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+			handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+			if tag == "" || handle == "" || strings.ContainsAny(tag, " #") {
+				return nil, errors.New(fmt.Sprintf("%v: account %v: routes should map hashtags to Bluesky handles", path, i))
+			}
+			routes[tag] = handle
+		}
+		config.Accounts[i].Routes = routes
+	}
+
+	if community := config.Community; community != nil {
+		if community.Mastodon == "" || community.List == "" || community.TokenEnv == "" {
+			return nil, errors.New(fmt.Sprintf("%v: community needs mastodon, list and tokenEnv", path))
+		}
+		instance, err := parseInstanceName(community.Mastodon)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: community: %v", path, err))
+		}
+		community.Mastodon = instance
+		if checkEnv && os.Getenv(community.TokenEnv) == "" {
+			return nil, errors.New(fmt.Sprintf("%v: community: %v is not set", path, community.TokenEnv))
+		}
+		if community.CheckInterval != "" {
+			if interval, err := time.ParseDuration(community.CheckInterval); err != nil || interval <= 0 {
+				return nil, errors.New(fmt.Sprintf("%v: community: checkInterval %q should be a positive duration such as 10m", path, community.CheckInterval))
+			}
+		}
+		if err := community.Transform.Validate(); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: community: transform: %v", path, err))
+		}
+		if err := config.checkProfile(community.Transform.Profile); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: community: transform: %v", path, err))
+		}
+	}
+	return config, nil
+}
+
+/* Loads the file in VBC_CONFIG, or an empty configuration if it isn't set. */
+func loadConfigFromEnv() (*Config, error) {
+	path := envOrNil("VBC_CONFIG")
+	if path == nil {
+		return &Config{}, nil
+	}
+	return loadConfig(*path)
+}
+
+/* Works out the transform configuration of an account pair, starting from the
+ * defaults, then the global configuration, then that of the account, or that
+ * of the community for members that aren't in accounts. */
+func (c *Config) TransformFor(instance string, accountID int64, handle string) TransformConfig {
+	transform, _ := c.transformFor(instance, accountID, handle).guardPrivate(handle)
+	return transform
+}
+
+/* The visibilities TransformFor leaves out for handle, as they'd have had
+ * private statuses go out to it without it being in allowPrivate. */
+func (c *Config) PrivateHeldBack(instance string, accountID int64, handle string) []string {
+	_, held := c.transformFor(instance, accountID, handle).guardPrivate(handle)
+	return held
+}
+
+/* Mirroring private statuses to a public network is too easy to do by
+ * mistake, with a visibility setting inherited from a level meant for some
+ * other account, so it takes handle being allowed to have them. Hands back
+ * the transform without the visibilities it isn't allowed, and which those
+ * were. */
+func (c TransformConfig) guardPrivate(handle string) (TransformConfig, []string) {
+	for _, allowed := range c.AllowPrivate {
+		if strings.EqualFold(allowed, handle) {
+			return c, nil
+		}
+	}
+	var kept, held []string
+	for _, visibility := range c.Visibility {
+		if isPrivateVisibility(visibility) {
+			held = append(held, visibility)
+		} else {
+			kept = append(kept, visibility)
+		}
+	}
+	if len(held) == 0 {
+		return c, nil
+	}
+	/* Not nil, so it doesn't read as unset. */
+	c.Visibility = append([]string{}, kept...)
+	return c, held
+}
+
+/* Whether statuses of visibility aren't for everyone to see. */
+func isPrivateVisibility(visibility string) bool {
+	return visibility == "private" || visibility == "direct"
+}
+
+func (c *Config) transformFor(instance string, accountID int64, handle string) TransformConfig {
+	transform := c.mergeProfile(DefaultTransformConfig, c.Transform)
+	configured := false
+	for _, account := range c.Accounts {
+		if account.Mastodon != instance || account.AccountID != accountID {
+			continue
+		}
+		configured = true
+		if account.Bluesky != "" && account.Bluesky != handle {
+			continue
+		}
+		transform = c.mergeProfile(transform, account.Transform)
+	}
+	if !configured && c.Community != nil && c.Community.Mastodon == instance {
+		transform = c.mergeProfile(transform, c.Community.Transform)
+	}
+
+	/* Routed statuses only go where they're routed to. */
+	routes := c.routesFor(instance, accountID)
+	if len(routes) == 0 {
+		return transform
+	}
+	filters := FilterConfig{}
+	if transform.Filters != nil {
+		filters = *transform.Filters
+	}
+	var tags, routed []string
+	for tag, target := range routes {
+		tags = append(tags, tag)
+		if target == handle {
+			routed = append(routed, tag)
+		}
+	}
+	sort.Strings(tags)
+	sort.Strings(routed)
+	if len(routed) > 0 {
+		filters.OnlyTags = routed
+	} else {
+		filters.SkipTags = append(copySlice(filters.SkipTags), tags...)
+	}
+	transform.Filters = &filters
+	return transform
+}
+
+/* Applies over on top of transform, with the profile it picks, if any, going
+ * in right under it. Profiles may pick profiles of their own. */
+func (c *Config) mergeProfile(transform TransformConfig, over TransformConfig) TransformConfig {
+	if profile, found := c.profile(over.Profile); found {
+		transform = c.mergeProfile(transform, profile)
+	}
+	return transform.Merge(over)
+}
+
+/* The profile with the given name, see Profiles. */
+func (c *Config) profile(name string) (TransformConfig, bool) {
+	if name == "" {
+		return TransformConfig{}, false
+	}
+	if profile, found := c.Profiles[name]; found {
+		return profile, true
+	}
+	profile, found := TransformProfiles[name]
+	return profile, found
+}
+
+/* Makes sure the profile with the given name, and every profile it picks in
+ * turn, is there, and that none of them pick one already on the way to
+ * them, which would never end. */
+func (c *Config) checkProfile(name string, seen ...string) error {
+	for name != "" {
+		for _, other := range seen {
+			if other == name {
+				return errors.New(fmt.Sprintf("profile %q ends up picking itself", name))
+			}
+		}
+		profile, found := c.profile(name)
+		if !found {
+			return errors.New(fmt.Sprintf("unknown profile %q", name))
+		}
+		seen = append(seen, name)
+		name = profile.Profile
+	}
+	return nil
+}
+
+/* Where the statuses of an account go by hashtag, instead of wherever they'd
+ * go otherwise, out of the routes of every entry of accounts for it. Hashtags
+ * are lowercase and without the #. */
+func (c *Config) routesFor(instance string, accountID int64) map[string]string {
+	routes := make(map[string]string)
+	for _, account := range c.Accounts {
+		if account.Mastodon != instance || account.AccountID != accountID {
+			continue
+		}
+		for tag, handle := range account.Routes {
+			routes[tag] = handle
+		}
+	}
+	return routes
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+/* Where the schema vbc config schema prints says it follows. */
+const ConfigSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+/* Values fields of the configuration take, by type and JSON name, for the
+ * schema to offer. Validate is what holds them to it. */
+var configEnums = map[string][]string{
+	"TransformConfig.split":           {SplitThread, SplitTruncate, SplitSkip},
+	"TransformConfig.mentions":        {MentionsKeep, MentionsSkip, MentionsStrip, MentionsLink},
+	"TransformConfig.quotes":          {QuotesEveryone, QuotesNobody},
+	"TransformConfig.links":           {LinksCard, LinksPlain},
+	"TransformConfig.media":           {MediaUpload, MediaLink},
+	"TransformConfig.selfLinks":       {SelfLinksQuote, SelfLinksLink, SelfLinksKeep},
+	"TransformConfig.crossLink":       {CrossLinkReply, CrossLinkEdit},
+	"TransformConfig.contentWarnings": {ContentWarningsInline, ContentWarningsThread},
+	"TransformConfig.linkOnly":        {LinkOnlyText, LinkOnlyCard},
+	"TransformConfig.emptyPosts":      {EmptyPostsSkip, EmptyPostsKeep},
+	"TransformConfig.customEmoji":     {CustomEmojiKeep, CustomEmojiStrip},
+	"TransformConfig.htmlFallback":    {HTMLFallbackStrip, HTMLFallbackSkip, HTMLFallbackDeadLetter},
+	"TransformConfig.selfBoosts":      {SelfBoostsSkip, SelfBoostsRepost},
+	"TransformConfig.timestamps":      {TimestampsOriginal, TimestampsNow},
+	"TransformConfig.accountGone":     {AccountGoneWatch, AccountGonePause},
+	"TransformConfig.deletions":       {DeletionsKeep, DeletionsPropagate},
+	"TransformConfig.threadgate":      {ThreadgateNobody, ThreadgateMentioned, ThreadgateFollowing, ThreadgateEveryone},
+	"TransformConfig.sensitiveLabels": {"sexual", "nudity", "porn", "graphic-media"},
+	"TransformConfig.visibility":      {"public", "unlisted", "private", "direct"},
+	"FilterConfig.blockedLinks":       {BlockedLinksSkip, BlockedLinksStrip},
+}
+
+/* Builds a JSON Schema of the configuration file out of Config, so it can't
+ * fall behind it. Fields take the names they have in JSON, those without
+ * omitempty being required, unless they're whole sections, and unknown
+ * fields are turned down, same as loadConfig does. */
+func configSchema() map[string]interface{} {
+	defs := make(map[string]interface{})
+	root := structSchema(reflect.TypeOf(Config{}), defs)
+	root["$schema"] = ConfigSchemaDialect
+	root["title"] = "vbc configuration"
+	root["$defs"] = defs
+	return root
+}
+
+/* The schema of a value of type t, with the structs it's made of put in
+ * defs and referred to by name. */
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, found := defs[t.Name()]; !found {
+			/* Taken before it's filled in, for structs made of
+			 * themselves. */
+			defs[t.Name()] = nil
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := typeSchema(field.Type, defs)
+		if values, found := configEnums[t.Name()+"."+name]; found {
+			if items, ok := schema["items"].(map[string]interface{}); ok {
+				items["enum"] = values
+			} else {
+				schema["enum"] = values
+			}
+		}
+		properties[name] = schema
+
+		section := field.Type.Kind() == reflect.Struct || field.Type.Kind() == reflect.Pointer
+		if !strings.Contains(options, "omitempty") && !section {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func configCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: vbc config validate [--no-env] [file]\n")
+		fmt.Fprintf(os.Stderr, "       vbc config schema\n\n")
+		fmt.Fprintf(os.Stderr, "Validate checks a configuration file, VBC_CONFIG unless one is given,\n")
+		fmt.Fprintf(os.Stderr, "the same way vbc does when it starts, exiting with 3 when there's\n")
+		fmt.Fprintf(os.Stderr, "something wrong with it. Schema prints a JSON Schema of the file, for\n")
+		fmt.Fprintf(os.Stderr, "editors to check it and offer completion with.\n")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(ExitUsage)
+	}
+
+	switch args[0] {
+	case "validate":
+		validateConfigCommand(args[1:])
+	case "schema":
+		if len(args) != 1 {
+			usage()
+			os.Exit(ExitUsage)
+		}
+		out, err := json.MarshalIndent(configSchema(), "", "  ")
+		if err != nil {
+			fatalf(ExitFailure, "could not encode the schema: %v", err)
+		}
+		fmt.Println(string(out))
+	default:
+		usage()
+		os.Exit(ExitUsage)
+	}
+}
+
+func validateConfigCommand(args []string) {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	noEnv := fs.Bool("no-env", false, "don't check that the environment variables the file names are set, such as in CI")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc config validate [--no-env] [file]\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	path := envOrDefault("VBC_CONFIG", "")
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	if path == "" {
+		fatalf(ExitUsage, "no configuration file given, and VBC_CONFIG isn't set")
+	}
+
+	config, err := readConfig(path, !*noEnv)
+	if err != nil {
+		fatalf(ExitConfig, "%v", err)
+	}
+	fmt.Printf("%v: ok, %v account(s) and %v profile(s)", path, len(config.Accounts), len(config.Profiles))
+	if config.Community != nil {
+		fmt.Printf(", crossposting list %v of %v", config.Community.List, config.Community.Mastodon)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* How long a command sent to the daemon gets to run. */
+const ControlTimeout = 5 * time.Minute
+
+/* A command sent to the daemon through its control socket, see
+ * controlCommands. */
+type controlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+/* What the daemon hands back once a command is done. */
+type controlReply struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+/* Commands the daemon runs for the CLI while it's running, with the store it
+ * already has open, so the two never write to it at once. Given the
+ * arguments left once the command has parsed its flags. */
+var controlCommands = map[string]func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error{
+	"status": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		return printStatus(ctx, store, config, w)
+	},
+	"repost": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("repost takes a single status")
+		}
+		if err := repostStatus(ctx, config, store, args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reposted %v\n", args[0])
+		return nil
+	},
+	"retry": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("retry takes a single status")
+		}
+		return retryStatus(ctx, config, store, args[0], w)
+	},
+	"pause": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("pause takes a single handle")
+		}
+		return pauseHandle(config, args[0], w)
+	},
+	"delete": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("delete takes a single status")
+		}
+		/* Only ever sent with --yes, see deleteCommand. */
+		yes := func(string) bool { return true }
+		return deleteStatus(ctx, config, store, args[0], yes, w)
+	},
+	"import": func(ctx context.Context, store Store, config *Config, args []string, w io.Writer) error {
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		fs.SetOutput(w)
+		dryRun := fs.Bool("dry-run", false, "")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 2 {
+			return errors.New("import takes a handle and a file")
+		}
+		return importFile(ctx, config, store, fs.Arg(0), fs.Arg(1), *dryRun, w)
+	},
+}
+
+/* Where the daemon listens for commands, next to the store when it's a
+ * file. */
+func controlSocketPath() string {
+	return storeSocketPath("control.sock")
+}
+
+/* Where a socket of the daemon named after suffix goes: next to the store
+ * when it's a file, and otherwise in the temporary directory, named after the
+ * Redis server and database, so daemons of different stores on the same host
+ * never take over each other's sockets. */
+func storeSocketPath(suffix string) string {
+	spec := storeSpec()
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("vbc-%v.%v", redisStoreID(spec), suffix))
+	}
+	return spec + "." + suffix
+}
+
+/* Tells Redis stores apart by the server and database, however the URL
+ * spells them, leaving credentials out. */
+func redisStoreID(spec string) string {
+	id := spec
+	if u, err := url.Parse(spec); err == nil {
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		db, _ := strconv.Atoi(strings.Trim(u.Path, "/"))
+		id = fmt.Sprintf("%v/%v", addr, db)
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+/* Runs the commands sent to the socket at path, see controlCommands. */
+func serveControl(ctx context.Context, path string, store Store, config *Config) {
+	/* A socket left over from a previous run would keep us from listening. */
+	_ = os.Remove(path)
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		log.Printf("WARNING: could not listen on %v, commands will need vbc stopped: %v", path, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WARNING: stopped serving commands: %v", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(ControlTimeout))
+
+			var request controlRequest
+			if err := json.NewDecoder(conn).Decode(&request); err != nil {
+				return
+			}
+			var reply controlReply
+			run, found := controlCommands[request.Command]
+			if !found {
+				reply.Error = fmt.Sprintf("vbc %v can't be run through the daemon", request.Command)
+			} else {
+				log.Printf("running vbc %v for the command line", strings.TrimSpace(request.Command+" "+strings.Join(request.Args, " ")))
+				runCtx, cancel := context.WithTimeout(ctx, ControlTimeout)
+				var out bytes.Buffer
+				if err := run(runCtx, store, config, request.Args, &out); err != nil {
+					reply.Error = err.Error()
+				}
+				cancel()
+				reply.Output = out.String()
+			}
+			_ = json.NewEncoder(conn).Encode(reply)
+		}()
+	}
+}
+
+/* Whether there's a daemon answering on the control socket. */
+func daemonRunning() bool {
+	conn, err := net.Dial("unix", controlSocketPath())
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+/* Exits when there's a daemon running, for commands that write to the store
+ * but can't go through it, rather than have them wait on it for the store or
+ * write to it at the same time. */
+func refuseWhileRunning() {
+	if daemonRunning() {
+		log.Fatalf("vbc is running, stop it first")
+	}
+}
+
+/* Has the running daemon run a command, printing what it says. Hands back
+ * false when there's no daemon to run it, for the command to go to the store
+ * itself. */
+func viaDaemon(command string, args []string) bool {
+	path := controlSocketPath()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ControlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command, Args: args}); err != nil {
+		log.Fatalf("could not reach the running vbc through %v: %v", path, err)
+	}
+	var reply controlReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		log.Fatalf("could not hear back from the running vbc: %v", err)
+	}
+	fmt.Print(reply.Output)
+	if reply.Error != "" {
+		log.Fatalf("%v", reply.Error)
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* How statuses get linked to where they went on Bluesky. */
+const (
+	/* With a reply to the status. */
+	CrossLinkReply = "reply"
+	/* By adding the link to the end of the status itself. */
+	CrossLinkEdit = "edit"
+)
+
+/* What the link to a crosspost looks like on Mastodon. */
+const CrossLinkFormat = "Also on Bluesky: %v"
+
+/* Writes to a Mastodon account with an access token of its own, which is
+ * needed for anything other than reading public statuses. The app we
+ * register only ever gets to read. */
+type mastodonWriter struct {
+	instance string
+	client   *http.Client
+
+	/* Changes when the token gets rotated, see Rotate. */
+	mu    sync.Mutex
+	token string
+	/* What the instance takes, see SetLimits. */
+	limits sinkLimits
+}
+
+/* Gives back nil without a token, as there's nothing it could do. */
+func newMastodonWriter(instance string, token *string) *mastodonWriter {
+	if token == nil || *token == "" {
+		return nil
+	}
+	return &mastodonWriter{
+		instance: instance,
+		token:    *token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		limits:   MastodonLimits,
+	}
+}
+
+/* Has statuses go by what the instance says it takes, rather than by
+ * MastodonLimits. */
+func (w *mastodonWriter) SetLimits(limits sinkLimits) {
+	w.mu.Lock()
+	w.limits = limits
+	w.mu.Unlock()
+}
+
+func (w *mastodonWriter) Limits() sinkLimits {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.limits
+}
+
+func (w *mastodonWriter) call(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(w.instance, "/")+path, reader)
+	if err != nil {
+		return permanent(err)
+	}
+	w.mu.Lock()
+	token := w.token
+	w.mu.Unlock()
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("%v %v: bad server status code (%v)", method, path, res.StatusCode))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+/* Switches over to a new token, once Mastodon takes it. Until then, and
+ * should it not, the old one goes on being used. */
+func (w *mastodonWriter) Rotate(ctx context.Context, token string) (bool, error) {
+	w.mu.Lock()
+	current := w.token
+	w.mu.Unlock()
+	if token == "" || token == current {
+		return false, nil
+	}
+
+	candidate := newMastodonWriter(w.instance, &token)
+	if err := candidate.call(ctx, http.MethodGet, "/api/v1/accounts/verify_credentials", nil, nil); err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	w.token = token
+	w.mu.Unlock()
+	return true, nil
+}
+
+/* Links a status to the post it became on Bluesky, the way the config asks
+ * for. Doing it twice is harmless, an edit that's already there is left
+ * alone, and a reply that's already there is posted again. */
+func (w *mastodonWriter) CrossLink(ctx context.Context, status *madon.Status, link string, mode string) error {
+	text := fmt.Sprintf(CrossLinkFormat, link)
+
+	switch mode {
+	case CrossLinkReply:
+		/* Public replies would land on the timelines of followers, who saw
+		 * the status already. */
+		visibility := status.Visibility
+		if visibility == "public" {
+			visibility = "unlisted"
+		}
+		return w.call(ctx, http.MethodPost, "/api/v1/statuses", map[string]interface{}{
+			"status":         text,
+			"in_reply_to_id": fmt.Sprint(status.ID),
+			"visibility":     visibility,
+		}, nil)
+
+	case CrossLinkEdit:
+		/* Edits replace the whole status, so start from what was written
+		 * rather than from the HTML it got turned into. */
+		var source struct {
+			Text        string `json:"text"`
+			SpoilerText string `json:"spoiler_text"`
+		}
+		path := fmt.Sprintf("/api/v1/statuses/%v", status.ID)
+		if err := w.call(ctx, http.MethodGet, path+"/source", nil, &source); err != nil {
+			return err
+		}
+		if strings.Contains(source.Text, link) {
+			return nil
+		}
+		edited := appendFooter(source.Text, text)
+		if limits := w.Limits(); limits.Count(edited) > limits.Length {
+			log.Printf("Mastodon: status %v has no room left for a link to its crosspost, replying with it instead", status.ID)
+			return w.CrossLink(ctx, status, link, CrossLinkReply)
+		}
+
+		edit := map[string]interface{}{
+			"status":       edited,
+			"spoiler_text": source.SpoilerText,
+			"sensitive":    status.Sensitive,
+		}
+		if status.Language != "" {
+			edit["language"] = status.Language
+		}
+		return w.call(ctx, http.MethodPut, path, edit, nil)
+	}
+	return nil
+}
+
+/* Whether a status is a reply we made linking to a crosspost, which should
+ * never be crossposted itself. */
+func isCrossLinkReply(status *madon.Status, text string) bool {
+	prefix, _, _ := strings.Cut(CrossLinkFormat, "%v")
+	return status.InReplyToID != nil && strings.HasPrefix(strings.TrimSpace(text), prefix)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* What a content warning rule can do, besides putting self-labels on. */
+const (
+	/* Puts the warning in front of the text of the post. */
+	ContentWarningPrefix = "prefix"
+	/* Leaves the status out altogether. */
+	ContentWarningSkip = "skip"
+	/* Nothing, for warnings that shouldn't get labeled. */
+	ContentWarningNone = "none"
+)
+
+/* What goes in front of posts whose content warning is to be a prefix. */
+const ContentWarningPrefixFormat = "CW: %v"
+
+/* A line of a contentWarningRules file, such as `lewd -> sexual, prefix`,
+ * for content warnings that have the keyword in them, ignoring case. */
+type contentWarningRule struct {
+	Keyword string
+	Labels  []string
+	Prefix  bool
+	Skip    bool
+}
+
+/* What the rules matching a content warning say to do with it, all of them
+ * put together. */
+type contentWarningAction struct {
+	/* Whether any rule matched, as the labels only replace sensitiveLabels
+	 * when one did. */
+	Matched bool
+	Labels  []string
+	Prefix  bool
+	/* The keyword of a rule skipping it, if one does. */
+	Skip string
+}
+
+/* Reads a file of content warning rules, one per line, with empty lines
+ * and those starting with # left out. Each line has a keyword, then -> or
+ * →, then what to do with warnings that have it, as a comma separated list
+ * of self-labels, prefix, skip or none. */
+func parseContentWarningRules(data []byte) ([]contentWarningRule, error) {
+	var rules []contentWarningRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		keyword, actions, found := strings.Cut(text, "->")
+		if !found {
+			keyword, actions, found = strings.Cut(text, "→")
+		}
+		keyword = strings.TrimSpace(keyword)
+		if !found || keyword == "" {
+			return nil, errors.New(fmt.Sprintf("line %v: should be a keyword, -> and what to do with it", line))
+		}
+
+		rule := contentWarningRule{Keyword: strings.ToLower(keyword)}
+		for _, action := range strings.Split(actions, ",") {
+			switch action = strings.TrimSpace(action); action {
+			case ContentWarningPrefix:
+				rule.Prefix = true
+			case ContentWarningSkip:
+				rule.Skip = true
+			case ContentWarningNone:
+			case "sexual", "nudity", "porn", "graphic-media":
+				rule.Labels = append(rule.Labels, action)
+			case "":
+				return nil, errors.New(fmt.Sprintf("line %v: says nothing about what to do with %q", line, keyword))
+			default:
+				return nil, errors.New(fmt.Sprintf("line %v: unknown action %q", line, action))
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+/* Reads the rules at path. They're read again for every status, the same as
+ * scripts, so they can be changed without restarting. */
+func loadContentWarningRules(path string) ([]contentWarningRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseContentWarningRules(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+	return rules, nil
+}
+
+/* Works out what to do with a content warning, going by every rule whose
+ * keyword is in it. */
+func matchContentWarning(rules []contentWarningRule, warning string) contentWarningAction {
+	var action contentWarningAction
+	warning = strings.ToLower(warning)
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if !strings.Contains(warning, rule.Keyword) {
+			continue
+		}
+		action.Matched = true
+		action.Prefix = action.Prefix || rule.Prefix
+		if rule.Skip && action.Skip == "" {
+			action.Skip = rule.Keyword
+		}
+		for _, label := range rule.Labels {
+			if !seen[label] {
+				seen[label] = true
+				action.Labels = append(action.Labels, label)
+			}
+		}
+	}
+	return action
+}
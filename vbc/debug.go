@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* How long `vbc debug dump` waits on the daemon. */
+const DebugDumpTimeout = 10 * time.Second
+
+/* What every account is up to, for when vbc looks stuck. Dumped to the log on
+ * SIGUSR1, and handed to `vbc debug dump` through a socket. */
+type debugRegistry struct {
+	mu      sync.Mutex
+	started time.Time
+	leader  *leaderLock
+	pairs   []*pairState
+}
+
+var debugState = &debugRegistry{started: time.Now()}
+
+/* What a single pair of accounts is up to. */
+type pairState struct {
+	mu   sync.Mutex
+	pair accountPair
+
+	username string
+	status   string
+	cursor   int64
+	queued   int
+	/* Statuses waiting on the transformer and publisher, see
+	 * pipelineItem. */
+	transforming int
+	publishing   int
+	lastPoll     time.Time
+	nextPoll     time.Time
+
+	lastError   string
+	lastErrorAt time.Time
+
+	/* Takes a snapshot of the state of the pair while it's running, and
+	 * stops it, see pairState.Handoff and pairState.Pause. */
+	snapshot  func(then func()) (*accountState, error)
+	stop      context.CancelFunc
+	handedOff bool
+	paused    bool
+}
+
+func (d *debugRegistry) SetLeader(leader *leaderLock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.leader = leader
+}
+
+func (d *debugRegistry) Pair(pair accountPair) *pairState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := &pairState{pair: pair, status: "starting"}
+	d.pairs = append(d.pairs, state)
+	return state
+}
+
+func (s *pairState) SetUsername(username string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username = username
+}
+
+func (s *pairState) SetStatus(status string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+/* Writes down how a poll went, and when the next one is. */
+func (s *pairState) Polled(cursor int64, queued int, next time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursor = cursor
+	s.queued = queued
+	s.lastPoll = time.Now()
+	s.nextPoll = next
+}
+
+func (s *pairState) Pipeline(transforming int, publishing int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transforming = transforming
+	s.publishing = publishing
+}
+
+func (s *pairState) Failed(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+/* Writes a snapshot of everything to w, for people to read. */
+func (d *debugRegistry) Dump(w io.Writer) {
+	d.mu.Lock()
+	pairs := copySlice(d.pairs)
+	leading := d.leader.Leading()
+	started := d.started
+	d.mu.Unlock()
+
+	now := time.Now()
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%v (%v ago)", t.Format(time.RFC3339), now.Sub(t).Round(time.Second))
+	}
+	in := func(t time.Time) string {
+		if t.IsZero() {
+			return "not scheduled"
+		} else if t.Before(now) {
+			return fmt.Sprintf("%v (overdue by %v)", t.Format(time.RFC3339), now.Sub(t).Round(time.Second))
+		}
+		return fmt.Sprintf("%v (in %v)", t.Format(time.RFC3339), t.Sub(now).Round(time.Second))
+	}
+
+	fmt.Fprintf(w, "vbc %v, up since %v\n", readBuildInfo().Version, ago(started))
+	fmt.Fprintf(w, "leading: %v\n", leading)
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].pair.Handle < pairs[j].pair.Handle
+	})
+	for _, state := range pairs {
+		state.mu.Lock()
+		name := fmt.Sprintf("%v", state.pair.AccountID)
+		if state.username != "" {
+			name = "@" + state.username
+		}
+		fmt.Fprintf(w, "\n%v on %v to @%v\n", name, state.pair.Instance, state.pair.Handle)
+		fmt.Fprintf(w, "  status:      %v\n", state.status)
+		fmt.Fprintf(w, "  cursor:      %v\n", state.cursor)
+		fmt.Fprintf(w, "  retry queue: %v status(es)\n", state.queued)
+		fmt.Fprintf(w, "  pipeline:    %v status(es) waiting to be transformed, %v to be published\n",
+			state.transforming,
+			state.publishing)
+		fmt.Fprintf(w, "  last poll:   %v\n", ago(state.lastPoll))
+		fmt.Fprintf(w, "  next poll:   %v\n", in(state.nextPoll))
+		if state.lastError != "" {
+			fmt.Fprintf(w, "  last error:  %v, %v\n", ago(state.lastErrorAt), state.lastError)
+		} else {
+			fmt.Fprintf(w, "  last error:  none\n")
+		}
+		state.mu.Unlock()
+	}
+}
+
+/* Where the daemon listens for `vbc debug dump`, next to the store when it's
+ * a file. */
+func debugSocketPath() string {
+	return storeSocketPath("debug.sock")
+}
+
+/* Hands a dump to whoever connects to the socket at path. */
+func serveDebugDumps(ctx context.Context, path string) {
+	/* A socket left over from a previous run would keep us from listening. */
+	_ = os.Remove(path)
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		log.Printf("WARNING: could not listen on %v, state dumps will only go to the log: %v", path, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WARNING: stopped serving state dumps: %v", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			_ = conn.SetWriteDeadline(time.Now().Add(DebugDumpTimeout))
+			debugState.Dump(conn)
+		}()
+	}
+}
+
+func debugCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: vbc debug dump\n\n")
+		fmt.Fprintf(os.Stderr, "Prints what the running vbc is up to: the cursor, retry queue, last\n")
+		fmt.Fprintf(os.Stderr, "error and next poll of every account. Sending vbc SIGUSR1 writes the\n")
+		fmt.Fprintf(os.Stderr, "same to its log.\n")
+	}
+	if len(args) != 1 || args[0] != "dump" {
+		usage()
+		os.Exit(2)
+	}
+
+	path := debugSocketPath()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		log.Fatalf("could not reach a running vbc through %v: %v", path, err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(DebugDumpTimeout))
+
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		log.Fatalf("could not receive state dump from vbc: %v", err)
+	}
+}
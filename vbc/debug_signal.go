@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/* Dumps the state of every account to the log on SIGUSR1. */
+func watchDumpSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				log.Printf("dumping state on SIGUSR1")
+				debugState.Dump(log.Writer())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
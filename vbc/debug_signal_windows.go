@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "context"
+
+/* There's no SIGUSR1 on Windows, only `vbc debug dump`. */
+func watchDumpSignal(ctx context.Context) {}
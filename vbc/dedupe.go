@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* How close together two statuses with the same text have to be posted for
+ * the second to be taken as the same status posted twice, which some clients
+ * do on flaky connections. */
+const DuplicateWindow = 5 * time.Minute
+
+/* Keeps the last status an account crossposted around, to tell whether the
+ * next one is it posted again. */
+type duplicateFilter struct {
+	key     string
+	url     string
+	created time.Time
+}
+
+/* What a status says, with case and spacing evened out, along with its
+ * content warning and what its media shows. Statuses saying nothing at all
+ * have no key, as there's no telling them apart. */
+func duplicateKey(status *madon.Status) string {
+	normalize := func(text string) string {
+		return strings.ToLower(strings.Join(strings.Fields(text), " "))
+	}
+
+	parts := []string{normalize(renderStatusText(status.Content)), normalize(status.SpoilerText)}
+	for _, attachment := range status.MediaAttachments {
+		if attachment.Description == nil {
+			parts = append(parts, "")
+			continue
+		}
+		parts = append(parts, normalize(*attachment.Description))
+	}
+	if strings.TrimSpace(strings.Join(parts, "")) == "" {
+		return ""
+	}
+	return strings.Join(parts, "\x00")
+}
+
+/* The URL of the status this one is a duplicate of, if it is one. */
+func (f *duplicateFilter) Check(status *madon.Status) string {
+	if f.key == "" {
+		return ""
+	}
+	gap := status.CreatedAt.Sub(f.created)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap > DuplicateWindow || duplicateKey(status) != f.key {
+		return ""
+	}
+	return f.url
+}
+
+/* Notes down a status having gone out, for the next one to be checked
+ * against. */
+func (f *duplicateFilter) Sent(status *madon.Status) {
+	f.key = duplicateKey(status)
+	f.url = status.URL
+	f.created = status.CreatedAt
+}
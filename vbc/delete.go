@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func deleteCommand(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "delete without asking")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc delete [--yes] <status url or id>\n\n")
+		fmt.Fprintf(fs.Output(), "Deletes the crosspost of a status from Bluesky, the whole thread of it,\n")
+		fmt.Fprintf(fs.Output(), "leaving the status on Mastodon as it is. The status is written down as\n")
+		fmt.Fprintf(fs.Output(), "deleted, so it doesn't get crossposted again. Every account it was\n")
+		fmt.Fprintf(fs.Output(), "crossposted to gets it deleted. Can be done while vbc is running, which\n")
+		fmt.Fprintf(fs.Output(), "then does it, as long as --yes is given.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	/* The daemon has nobody to ask. */
+	if !*yes && daemonRunning() {
+		log.Fatalf("vbc is running, stop it first, or give --yes for it to do the deleting")
+	}
+	if *yes && viaDaemon("delete", fs.Args()) {
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	confirm := func(prompt string) bool {
+		if *yes {
+			return true
+		}
+		fmt.Printf("%v [y/N] ", prompt)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+	if err := deleteStatus(ctx, config, store, fs.Arg(0), confirm, os.Stdout); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+/* Deletes the crossposts of a status, given by its URL or ID, from every
+ * account it was crossposted to, once confirm says to go ahead with each,
+ * see deleteCommand. */
+func deleteStatus(ctx context.Context, config *Config, store Store, raw string, confirm func(prompt string) bool, w io.Writer) error {
+	instance, id, err := parseStatusURL(raw)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, pair := range config.Pairs() {
+		if pair.Instance != instance {
+			continue
+		}
+
+		bs, err := newBlueskySession(ctx, store, pair.Server, pair.Handle, pair.AppKey, 0)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", pair.Handle, err))
+		}
+		profile, err := bs.FetchProfile(ctx, pair.Handle)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not fetch Bluesky profile of @%v: %v", pair.Handle, err))
+		}
+		if err := checkExpectedDID(pair.Handle, profile.DID); err != nil {
+			return err
+		}
+		key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: profile.DID}
+
+		value, err := store.Mapping(key, id)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not look up mapping of %v: %v", raw, err))
+		}
+		if value == nil {
+			continue
+		}
+		mapping, err := decodeMapping(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not decode mapping of %v: %v", raw, err))
+		}
+		if !mapping.Posted() {
+			fmt.Fprintf(w, "%v is %v on @%v, there's nothing to delete\n", raw, mapping.State, pair.Handle)
+			found = true
+			continue
+		}
+		found = true
+
+		/* Every post of the thread, so none of it is left behind. */
+		rkeys := []string{mapping.Rkey}
+		records, _, err := listRecentPosts(ctx, bs, profile.DID)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not list the posts of @%v: %v", pair.Handle, err))
+		}
+		if _, listed := records[mapping.Rkey]; listed {
+			for rkey := nextStatusRkey(mapping.Rkey); rkey != ""; rkey = nextStatusRkey(rkey) {
+				if _, listed := records[rkey]; !listed {
+					break
+				}
+				rkeys = append(rkeys, rkey)
+			}
+		}
+
+		prompt := fmt.Sprintf("delete %v post(s) of %v from @%v?",
+			len(rkeys),
+			blueskyPostURL(pair.Handle, mapping.Uri),
+			pair.Handle)
+		if !confirm(prompt) {
+			continue
+		}
+
+		transform := config.TransformFor(pair.Instance, pair.AccountID, pair.Handle)
+		if transform.Threadgate != nil {
+			if err := deleteRecord(ctx, bs, profile.DID, ThreadgateCollection, mapping.Rkey); err != nil {
+				return err
+			}
+		}
+		if hasPostgate(transform.Quotes) {
+			if err := deleteRecord(ctx, bs, profile.DID, PostgateCollection, mapping.Rkey); err != nil {
+				return err
+			}
+		}
+		/* Replies first, so the thread never points to a post that's gone. */
+		for i := len(rkeys) - 1; i >= 0; i-- {
+			if err := deleteRecord(ctx, bs, profile.DID, uriCollection(mapping.Uri), rkeys[i]); err != nil {
+				return err
+			}
+		}
+
+		mapping.State = MappingDeleted
+		mapping.Updated = time.Now().UTC()
+		updated, err := encodeMapping(*mapping)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not encode mapping: %v", err))
+		}
+		if err := store.PutMapping(key, id, updated); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", raw, err))
+		}
+		if err := store.RemoveRetry(key, id); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", raw, err))
+		}
+		fmt.Fprintf(w, "deleted %v post(s) from @%v\n", len(rkeys), pair.Handle)
+	}
+
+	if !found {
+		return errors.New(fmt.Sprintf("%v was never crossposted by vbc", raw))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* What happens to the crossposts of statuses deleted on Mastodon. */
+const (
+	/* Left up on Bluesky. */
+	DeletionsKeep = "keep"
+	/* Deleted along with the status, once deleteGrace is up. */
+	DeletionsPropagate = "propagate"
+)
+
+/* How long a status has to stay deleted before its crosspost goes too, so
+ * deleting by mistake and redrafting, or instances that 404 for a moment,
+ * don't take crossposts down. */
+const DeleteGraceDefault = 10 * time.Minute
+
+/* How long the crossposts of an account wait for their statuses to come
+ * back before going, see deleteGrace. */
+func deleteGrace(config TransformConfig) time.Duration {
+	if config.DeleteGrace == "" {
+		return DeleteGraceDefault
+	}
+	grace, err := time.ParseDuration(config.DeleteGrace)
+	if err != nil {
+		return DeleteGraceDefault
+	}
+	return grace
+}
+
+/* Keeps track of statuses that went missing from the timeline of an
+ * account, and of when their crossposts are due to be deleted. Statuses are
+ * only missed between two polls, so those deleted while vbc wasn't running
+ * are left alone. */
+type deletionTracker struct {
+	/* Statuses the last poll found, nil before the first one. */
+	seen map[int64]bool
+	due  map[int64]time.Time
+}
+
+func newDeletionTracker() *deletionTracker {
+	return &deletionTracker{due: make(map[int64]time.Time)}
+}
+
+/* Takes in what a poll found, handing back the statuses the last one found
+ * that are now missing from between the oldest and newest of them. Those
+ * that came back are no longer due. */
+func (t *deletionTracker) Polled(statuses []madon.Status) []int64 {
+	if len(statuses) == 0 {
+		return nil
+	}
+	seen := make(map[int64]bool, len(statuses))
+	oldest := statuses[0].ID
+	for _, status := range statuses {
+		seen[status.ID] = true
+		delete(t.due, status.ID)
+		if status.ID < oldest {
+			oldest = status.ID
+		}
+	}
+
+	var missing []int64
+	for id := range t.seen {
+		if !seen[id] && id >= oldest {
+			missing = append(missing, id)
+		}
+	}
+	t.seen = seen
+	return missing
+}
+
+/* Has the crosspost of a status deleted at when, unless it's due already. */
+func (t *deletionTracker) Schedule(id int64, when time.Time) {
+	if _, found := t.due[id]; !found {
+		t.due[id] = when
+	}
+}
+
+func (t *deletionTracker) Cancel(id int64) {
+	delete(t.due, id)
+}
+
+/* The statuses whose crossposts are due to be deleted by now. */
+func (t *deletionTracker) Due(now time.Time) []int64 {
+	var due []int64
+	for id, when := range t.due {
+		if !now.Before(when) {
+			due = append(due, id)
+		}
+	}
+	return due
+}
+
+/* Whether a status is gone for good, as opposed to Mastodon failing to say
+ * where it is. */
+func (s *mastodonSession) StatusGone(id int64) (bool, error) {
+	err := s.Do(func(mc *madon.Client) error {
+		_, err := mc.GetStatus(id)
+		return err
+	})
+	if err == nil {
+		return false, nil
+	}
+	if code, _ := errorStatusCode(err); code == http.StatusNotFound || code == http.StatusGone {
+		return true, nil
+	}
+	return false, err
+}
+
+/* Deletes every post of a crosspost from Bluesky, replies first so the
+ * thread never points to a post that's gone, along with its gates. */
+func deleteCrosspost(ctx context.Context, bs *blueskySession, did string, mapping *StatusMapping, transform TransformConfig) error {
+	if transform.Threadgate != nil {
+		if err := deleteRecord(ctx, bs, did, ThreadgateCollection, mapping.Rkey); err != nil {
+			return err
+		}
+	}
+	if hasPostgate(transform.Quotes) {
+		if err := deleteRecord(ctx, bs, did, PostgateCollection, mapping.Rkey); err != nil {
+			return err
+		}
+	}
+
+	rkeys := []string{mapping.Rkey}
+	for i := 1; i < mapping.Parts; i++ {
+		rkey := nextStatusRkey(rkeys[len(rkeys)-1])
+		if rkey == "" {
+			break
+		}
+		rkeys = append(rkeys, rkey)
+	}
+	for i := len(rkeys) - 1; i >= 0; i-- {
+		if err := deleteRecord(ctx, bs, did, uriCollection(mapping.Uri), rkeys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
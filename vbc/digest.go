@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* Where digests go when VBC_DIGEST isn't set. */
+	DigestToLog = "log"
+	/* A direct message to the Mastodon account itself. */
+	DigestToDM = "dm"
+
+	/* Pages of notifications to go through at most, for a single digest. */
+	DigestMaxPages = 10
+)
+
+/* Something someone did with a crosspost on Bluesky. */
+type digestItem struct {
+	/* One of reply, quote or mention. */
+	Reason string    `json:"reason"`
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	URI    string    `json:"uri"`
+	URL    string    `json:"url"`
+	Time   time.Time `json:"time"`
+}
+
+/* What gets posted to a webhook. */
+type digest struct {
+	Handle string       `json:"handle"`
+	Since  time.Time    `json:"since"`
+	Items  []digestItem `json:"items"`
+}
+
+/* Bluesky accounts getting digests already, so those several Mastodon
+ * accounts crosspost to get them once. */
+var digestsStarted sync.Map
+
+/* Sends a digest of the replies, quotes and mentions a Bluesky account got
+ * every interval, until ctx is done, so conversations happening on the
+ * crossposts don't go unnoticed. */
+func sendDigests(
+	ctx context.Context,
+	store Store,
+	writer *mastodonWriter,
+	bs *blueskySession,
+	leader *leaderLock,
+	handle string,
+	did string,
+	username string,
+	to string,
+	interval time.Duration) {
+
+	if _, started := digestsStarted.LoadOrStore(did, true); started {
+		return
+	}
+	if to == DigestToDM && writer == nil {
+		log.Printf("WARNING: digests as direct messages need an access token, logging them instead")
+		to = DigestToLog
+	}
+
+	for {
+		if leader.Leading() {
+			if err := sendDigest(ctx, store, writer, bs, handle, did, username, to); err != nil {
+				log.Printf("ERROR: could not send digest for @%v: %v", handle, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			/* So the account gets digests again once its pairs start
+			 * back up. */
+			digestsStarted.Delete(did)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func sendDigest(
+	ctx context.Context,
+	store Store,
+	writer *mastodonWriter,
+	bs *blueskySession,
+	handle string,
+	did string,
+	username string,
+	to string) error {
+
+	/* The first digest would be everything there ever was, so start from
+	 * now instead. */
+	value, err := store.DigestCursor(did)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return store.PutDigestCursor(did, []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+	}
+	since, err := time.Parse(time.RFC3339Nano, string(value))
+	if err != nil {
+		return permanent(errors.New(fmt.Sprintf("bad digest cursor %q: %v", value, err)))
+	}
+
+	items, err := fetchDigestItems(ctx, bs, since)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	d := digest{Handle: handle, Since: since, Items: items}
+	switch to {
+	case DigestToLog:
+		for _, line := range strings.Split(d.Text(), "\n") {
+			log.Printf("digest: %v", line)
+		}
+	case DigestToDM:
+		text := "@" + username + " " + d.Text()
+		if err := writer.DirectMessage(ctx, writer.Limits().Truncate(text)); err != nil {
+			return err
+		}
+	default:
+		if err := postDigest(ctx, to, d); err != nil {
+			return err
+		}
+	}
+
+	newest := items[len(items)-1].Time
+	return store.PutDigestCursor(did, []byte(newest.UTC().Format(time.RFC3339Nano)))
+}
+
+/* Goes through the notifications of the account for replies, quotes and
+ * mentions newer than since, oldest first. */
+func fetchDigestItems(ctx context.Context, bs *blueskySession, since time.Time) ([]digestItem, error) {
+	var items []digestItem
+	cursor := ""
+	for page := 0; page < DigestMaxPages; page++ {
+		var out struct {
+			Cursor        string `json:"cursor"`
+			Notifications []struct {
+				Uri    string `json:"uri"`
+				Reason string `json:"reason"`
+				Author struct {
+					Handle string `json:"handle"`
+				} `json:"author"`
+				Record struct {
+					Text string `json:"text"`
+				} `json:"record"`
+				IndexedAt string `json:"indexedAt"`
+			} `json:"notifications"`
+		}
+		err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			params := map[string]interface{}{"limit": 100}
+			if cursor != "" {
+				params["cursor"] = cursor
+			}
+			return client.Do(ctx, xrpc.Query, "", "app.bsky.notification.listNotifications", params, nil, &out)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		older := false
+		for _, n := range out.Notifications {
+			at, err := time.Parse(time.RFC3339, n.IndexedAt)
+			if err != nil {
+				continue
+			}
+			if !at.After(since) {
+				older = true
+				continue
+			}
+			switch n.Reason {
+			case "reply", "quote", "mention":
+			default:
+				continue
+			}
+			items = append(items, digestItem{
+				Reason: n.Reason,
+				Author: n.Author.Handle,
+				Text:   n.Record.Text,
+				URI:    n.Uri,
+				URL:    blueskyPostURL(n.Author.Handle, n.Uri),
+				Time:   at,
+			})
+		}
+		if older || out.Cursor == "" {
+			break
+		}
+		cursor = out.Cursor
+	}
+
+	/* Notifications come newest first. */
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+/* The digest as text for people to read. */
+func (d digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v new on Bluesky for @%v:", len(d.Items), d.Handle)
+	for _, item := range d.Items {
+		text := truncateText(strings.Join(strings.Fields(item.Text), " "), 80)
+		fmt.Fprintf(&b, "\n- @%v (%v): %v %v", item.Author, item.Reason, text, item.URL)
+	}
+	return b.String()
+}
+
+func postDigest(ctx context.Context, target string, d digest) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+	return nil
+}
+
+/* Sends a direct message, which only those mentioned in it get to see. */
+func (w *mastodonWriter) DirectMessage(ctx context.Context, text string) error {
+	return w.call(ctx, http.MethodPost, "/api/v1/statuses", map[string]interface{}{
+		"status":     text,
+		"visibility": "direct",
+	}, nil)
+}
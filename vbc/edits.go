@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* A fingerprint of everything about a status that makes it into its
+ * crosspost, which changes whenever the status gets edited. The link
+ * CrossLink adds is left out, so it doesn't count as an edit. */
+func statusRevision(status *madon.Status) string {
+	prefix, _, _ := strings.Cut(CrossLinkFormat, "%v")
+	var lines []string
+	for _, line := range strings.Split(renderStatusText(status.Content), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			lines = append(lines, line)
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %v %q\n", strings.Join(lines, "\n"), status.SpoilerText, status.Sensitive, status.Language)
+	for _, attachment := range status.MediaAttachments {
+		description := ""
+		if attachment.Description != nil {
+			description = *attachment.Description
+		}
+		fmt.Fprintf(h, "%v %q\n", attachment.ID, description)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+/* Brings the latest version of an edited status over to its crosspost, by
+ * putting it over the posts it became, and deleting those left over when it
+ * became fewer of them. However many edits there were since the last time,
+ * only the one the status is at now gets brought over. Gives back the
+ * mapping the status has now. */
+func propagateEdit(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	status *madon.Status,
+	mapped *StatusMapping,
+	ms *mastodonSession,
+	bs *blueskySession,
+	bskyProfile *bluesky.Profile,
+	transform TransformConfig) (*StatusMapping, error) {
+
+	/* Posts vbc didn't make, such as those matched when bootstrapping,
+	 * aren't where putting the status again would land. */
+	if mapped.Rkey == legacyStatusRkey(status, 0) {
+		log.Printf("Mastodon: %v was edited, but its crosspost is under a record key vbc no longer gives it, leaving it be", status.URL)
+		return mapped, nil
+	}
+	if mapped.Rkey != statusRkey(status, 0) {
+		log.Printf("Mastodon: %v was edited, but its crosspost was not made by vbc, leaving it be", status.URL)
+		return mapped, nil
+	}
+
+	extras, err := ms.StatusExtras(status.ID)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := repost(ctx, store, key, status, extras, bs, bskyProfile, transform)
+	if err != nil {
+		return nil, err
+	}
+	for part := updated.Parts; part < mapped.Parts; part++ {
+		if err := deleteRecord(ctx, bs, bskyProfile.DID, uriCollection(mapped.Uri), statusRkey(status, part)); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	updated.Created = mapped.Created
+	updated.Edited = &now
+	return updated, nil
+}
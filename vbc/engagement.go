@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* How often crossposts get checked on, and for how long after they
+	 * went up. Most of what happens to a post happens in its first days. */
+	EngagementInterval = time.Hour
+	EngagementTrackFor = 30 * 24 * time.Hour
+
+	/* Samples kept for every post, the oldest going first. */
+	EngagementMaxSamples = 100
+	/* Posts that can be looked up in one go, see app.bsky.feed.getPosts. */
+	EngagementBatch = 25
+)
+
+/* How a crosspost has been doing since it went up. */
+type engagementRecord struct {
+	Status  string             `json:"status"`
+	Posted  time.Time          `json:"posted"`
+	Samples []engagementSample `json:"samples"`
+}
+
+type engagementSample struct {
+	Time    time.Time `json:"time"`
+	Likes   int       `json:"likes"`
+	Reposts int       `json:"reposts"`
+	Replies int       `json:"replies"`
+}
+
+/* The newest sample, or an empty one if there's none yet. */
+func (r *engagementRecord) Latest() engagementSample {
+	if len(r.Samples) == 0 {
+		return engagementSample{}
+	}
+	return r.Samples[len(r.Samples)-1]
+}
+
+/* Starts keeping track of how a crosspost does. */
+func trackEngagement(store Store, did string, uri string, status string) error {
+	value, err := json.Marshal(engagementRecord{
+		Status:  status,
+		Posted:  time.Now().UTC(),
+		Samples: []engagementSample{},
+	})
+	if err != nil {
+		return err
+	}
+	return store.PutEngagement(did, uri, value)
+}
+
+/* Bluesky accounts whose crossposts are being checked on already, so those
+ * several Mastodon accounts crosspost to get checked on once. */
+var engagementStarted sync.Map
+
+/* Checks on the crossposts to a Bluesky account every so often, until ctx is
+ * done, writing down how many likes, reposts and replies they
+ * have whenever that changes. */
+func collectEngagement(ctx context.Context, store Store, bs *blueskySession, leader *leaderLock, did string) {
+	if _, started := engagementStarted.LoadOrStore(did, true); started {
+		return
+	}
+
+	for {
+		if leader.Leading() {
+			if err := collectEngagementOnce(ctx, store, bs, did); err != nil {
+				log.Printf("ERROR: could not check on crossposts to %v: %v", did, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			/* So the crossposts get checked on again once the pairs
+			 * start back up. */
+			engagementStarted.Delete(did)
+			return
+		case <-time.After(EngagementInterval):
+		}
+	}
+}
+
+func collectEngagementOnce(ctx context.Context, store Store, bs *blueskySession, did string) error {
+	values, err := store.Engagement()
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string]*engagementRecord)
+	var uris []string
+	for key, value := range values {
+		if key[0] != did {
+			continue
+		}
+		record := &engagementRecord{}
+		if err := json.Unmarshal(value, record); err != nil {
+			log.Printf("WARNING: bad engagement record for %v: %v", key[1], err)
+			continue
+		}
+		if time.Since(record.Posted) > EngagementTrackFor {
+			continue
+		}
+		records[key[1]] = record
+		uris = append(uris, key[1])
+	}
+
+	for start := 0; start < len(uris); start += EngagementBatch {
+		end := start + EngagementBatch
+		if end > len(uris) {
+			end = len(uris)
+		}
+
+		var out struct {
+			Posts []struct {
+				Uri         string `json:"uri"`
+				LikeCount   int    `json:"likeCount"`
+				RepostCount int    `json:"repostCount"`
+				ReplyCount  int    `json:"replyCount"`
+			} `json:"posts"`
+		}
+		err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			params := map[string]interface{}{"uris": uris[start:end]}
+			return client.Do(ctx, xrpc.Query, "", "app.bsky.feed.getPosts", params, nil, &out)
+		})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		for _, post := range out.Posts {
+			record, found := records[post.Uri]
+			if !found {
+				continue
+			}
+			sample := engagementSample{
+				Time:    now,
+				Likes:   post.LikeCount,
+				Reposts: post.RepostCount,
+				Replies: post.ReplyCount,
+			}
+			reportEngagement(did, record.Status, sample)
+
+			latest := record.Latest()
+			if len(record.Samples) > 0 && latest.Likes == sample.Likes &&
+				latest.Reposts == sample.Reposts && latest.Replies == sample.Replies {
+				continue
+			}
+			record.Samples = append(record.Samples, sample)
+			if len(record.Samples) > EngagementMaxSamples {
+				record.Samples = record.Samples[len(record.Samples)-EngagementMaxSamples:]
+			}
+
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := store.PutEngagement(did, post.Uri, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func reportEngagement(did string, status string, sample engagementSample) {
+	metrics.Set("vbc_crosspost_likes", "Likes of a crosspost on Bluesky.",
+		float64(sample.Likes), "did", did, "status", status)
+	metrics.Set("vbc_crosspost_reposts", "Reposts of a crosspost on Bluesky.",
+		float64(sample.Reposts), "did", did, "status", status)
+	metrics.Set("vbc_crosspost_replies", "Replies to a crosspost on Bluesky.",
+		float64(sample.Replies), "did", did, "status", status)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* How we should react to an error coming out of either API. */
+type errorClass int
+
+const (
+	/* Might go away on its own, try again later. */
+	errorRetryable errorClass = iota
+	/* Our credentials were rejected, log in again before retrying. */
+	errorReauth
+	/* Trying again won't help, give up on whatever caused it. */
+	errorPermanent
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorRetryable:
+		return "retryable"
+	case errorReauth:
+		return "reauth"
+	case errorPermanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+/* Kinds of errors that come out of crossposting, to be told apart with
+ * errors.Is rather than by what their messages say. */
+var (
+	/* The status is too long for Bluesky, and isn't to be split up. */
+	ErrTooLong = errors.New("too long")
+	/* The status has media Bluesky doesn't take. */
+	ErrUnsupportedMedia = errors.New("unsupported media")
+	/* Trying again won't help, see permanent. */
+	ErrPermanent = errors.New("permanent")
+	/* Bluesky turned a record down over what's in it, see rejected. */
+	ErrRejected = errors.New("rejected")
+)
+
+/* Errors Bluesky turns records down with over what's in them, such as labels
+ * it doesn't take, rather than over how they were put together. */
+var (
+	rejectionNames = map[string]bool{
+		"ContentRejected": true,
+		"RecordRejected":  true,
+		"InvalidLabel":    true,
+	}
+	rejectionRe = regexp.MustCompile(`(?i)content polic|self-label|not allowed|prohibited`)
+)
+
+/* Either API asked us to slow down. Found with errors.As. */
+type ErrRateLimited struct {
+	/* How long we were asked to wait for, 0 when we weren't told. */
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e ErrRateLimited) Error() string {
+	return e.Err.Error()
+}
+
+func (e ErrRateLimited) Unwrap() error {
+	return e.Err
+}
+
+/* Marks errors saying we were asked to slow down as ErrRateLimited, leaving
+ * every other error as it is. */
+func rateLimited(err error, retryAfter time.Duration) error {
+	var limited ErrRateLimited
+	if err == nil || errors.As(err, &limited) {
+		return err
+	}
+	if code, ok := errorStatusCode(err); !ok || code != http.StatusTooManyRequests {
+		return err
+	}
+	return ErrRateLimited{RetryAfter: retryAfter, Err: err}
+}
+
+/* Marks an error as one that won't go away by retrying. */
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func (e permanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+/* Bluesky turning a record down, for the reason it gave. Trying again won't
+ * help either. */
+type rejectedError struct {
+	err    error
+	reason string
+}
+
+func (e rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e rejectedError) Unwrap() error {
+	return e.err
+}
+
+func (e rejectedError) Is(target error) bool {
+	return target == ErrRejected || target == ErrPermanent
+}
+
+/* Marks errors saying Bluesky turned a record down over what's in it as
+ * ErrRejected, leaving every other error as it is. */
+func rejected(err error) error {
+	var xerr *xrpc.XRPCError
+	if err == nil || errors.Is(err, ErrRejected) || !errors.As(err, &xerr) {
+		return err
+	}
+	if !rejectionNames[xerr.ErrStr] && !rejectionRe.MatchString(xerr.Message) {
+		return err
+	}
+
+	reason := xerr.Message
+	if reason == "" {
+		reason = xerr.ErrStr
+	}
+	return rejectedError{err: err, reason: reason}
+}
+
+/* Why Bluesky turned a record down, if it did. */
+func rejectionReason(err error) (string, bool) {
+	var rerr rejectedError
+	if errors.As(err, &rerr) {
+		return rerr.reason, true
+	}
+	return "", false
+}
+
+/* Stops the loop of an account that keeps failing in ways that won't go away
+ * by retrying, such as a revoked token, leaving every other account be. */
+type pausedError struct {
+	failures int
+	err      error
+}
+
+func (e pausedError) Error() string {
+	return fmt.Sprintf("paused after %v failure(s) in a row, the last one being: %v", e.failures, e.err)
+}
+
+func (e pausedError) Unwrap() error {
+	return e.err
+}
+
+/* Whether err is down to the account rather than to the status that ran into
+ * it, such as revoked credentials, which every status after it would run into
+ * as well. Only those count towards pausing it, see pausedError. */
+func accountFailure(err error) bool {
+	if classifyError(err) == errorReauth {
+		return true
+	}
+	code, ok := errorStatusCode(err)
+	return ok && code == http.StatusForbidden
+}
+
+/* madon doesn't give us typed errors, just this in the message. */
+var madonStatusRe = regexp.MustCompile(`bad server status code \((\d{3})\)`)
+
+/* Pulls the HTTP status code out of an error from either API, if there's one
+ * in there. */
+func errorStatusCode(err error) (int, bool) {
+	var xerr *xrpc.Error
+	if errors.As(err, &xerr) {
+		return xerr.StatusCode, true
+	}
+
+	if match := madonStatusRe.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return code, true
+	}
+	return 0, false
+}
+
+func classifyError(err error) errorClass {
+	if errors.Is(err, ErrPermanent) {
+		return errorPermanent
+	}
+	var limited ErrRateLimited
+	if errors.As(err, &limited) {
+		return errorRetryable
+	}
+
+	/* Expired sessions come back as 400s with a telling error name. */
+	var xerr *xrpc.XRPCError
+	if errors.As(err, &xerr) {
+		switch xerr.ErrStr {
+		case "ExpiredToken", "InvalidToken", "AuthenticationRequired":
+			return errorReauth
+		}
+	}
+
+	if code, ok := errorStatusCode(err); ok {
+		switch {
+		case code == http.StatusUnauthorized:
+			return errorReauth
+		case code == http.StatusTooManyRequests,
+			code == http.StatusRequestTimeout,
+			code >= 500:
+			return errorRetryable
+		case code >= 400:
+			return errorPermanent
+		}
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return errorRetryable
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorRetryable
+	}
+
+	/* When in doubt, try again. Whatever it is will end up dead-lettered
+	 * if it keeps happening. */
+	return errorRetryable
+}
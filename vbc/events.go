@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* Events kept for every account, the oldest going first. */
+const EventLogSize = 1000
+
+/* What was done with a status, see pipelineEvent. */
+const (
+	EventPosted  = "posted"
+	EventSkipped = "skipped"
+	EventRetried = "retried"
+	EventFailed  = "failed"
+	EventDeleted = "deleted"
+	EventEdited  = "edited"
+)
+
+/* Something vbc did with a status of an account, written down so whoever
+ * runs it can tell what became of it without going through the logs. */
+type pipelineEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Status int64     `json:"status"`
+	URL    string    `json:"url,omitempty"`
+	/* The crosspost, for events that have one. */
+	Post string `json:"post,omitempty"`
+	/* Why it was skipped, or what went wrong. */
+	Reason string `json:"reason,omitempty"`
+}
+
+/* Writes an event down in the log of an account. Not being able to isn't
+ * worth stopping over, so it's only logged. */
+func recordEvent(store Store, key AccountKey, event pipelineEvent) {
+	event.Time = time.Now().UTC()
+	value, err := json.Marshal(event)
+	if err == nil {
+		err = store.PutEvent(key, value, EventLogSize)
+	}
+	if err != nil {
+		log.Printf("WARNING: could not write down that status %v was %v: %v", event.Status, event.Kind, err)
+	}
+}
+
+/* The last tail events of an account, oldest first, all of them for a tail
+ * of 0. Events that can't be read are left out. */
+func accountEvents(store Store, key AccountKey, tail int) ([]pipelineEvent, error) {
+	values, err := store.Events(key)
+	if err != nil {
+		return nil, err
+	}
+	if tail > 0 && len(values) > tail {
+		values = values[len(values)-tail:]
+	}
+
+	events := make([]pipelineEvent, 0, len(values))
+	for _, value := range values {
+		var event pipelineEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func logCommand(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	account := fs.String("account", "", "account to print the events of, as <id>@<instance>")
+	handle := fs.String("handle", "", "only print the events of crossposts to this Bluesky handle")
+	tail := fs.Int("tail", 50, "how many of the latest events to print, 0 for all of them")
+	asJSON := fs.Bool("json", false, "print events as JSON lines")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc log --account <id>@<instance> [--handle <handle>] [--tail <n>] [--json]\n\n")
+		fmt.Fprintf(fs.Output(), "Prints what vbc did with the latest statuses of an account: which it\n")
+		fmt.Fprintf(fs.Output(), "crossposted, skipped and why, retried, gave up on, deleted and brought\n")
+		fmt.Fprintf(fs.Output(), "edits of over. The store keeps the last %v events of every account. Can\n", EventLogSize)
+		fmt.Fprintf(fs.Output(), "be done while vbc is running, through a snapshot of the store.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	id, instance, _ := strings.Cut(*account, "@")
+	accountID, err := strconv.ParseInt(id, 10, 64)
+	if fs.NArg() != 0 || err != nil || instance == "" || *tail < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	instance = canonicalizeInstanceName(instance)
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	var pairs []accountPair
+	for _, pair := range config.Pairs() {
+		if pair.Instance != instance || pair.AccountID != accountID {
+			continue
+		}
+		if *handle != "" && pair.Handle != strings.TrimPrefix(*handle, "@") {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) == 0 {
+		log.Fatalf("account %v on %v is not crossposted anywhere in the configuration", accountID, instance)
+	}
+
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	for i, pair := range pairs {
+		key, bootstrapped, err := storedPairKey(ctx, store, pair)
+		if err != nil {
+			log.Fatalf("could not look up account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+		}
+		var events []pipelineEvent
+		if bootstrapped {
+			events, err = accountEvents(store, key, *tail)
+			if err != nil {
+				log.Fatalf("could not read events of account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+			}
+		}
+
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			for _, event := range events {
+				_ = encoder.Encode(event)
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%v on %v to @%v\n", pair.AccountID, pair.Instance, pair.Handle)
+		if len(events) == 0 {
+			fmt.Printf("  nothing yet\n")
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, event := range events {
+			url := event.URL
+			if url == "" {
+				url = strconv.FormatInt(event.Status, 10)
+			}
+			detail := event.Reason
+			if detail == "" {
+				detail = event.Post
+			}
+			fmt.Fprintf(w, "  %v\t%v\t%v\t%v\n", event.Time.Local().Format(time.RFC3339), event.Kind, url, detail)
+		}
+		_ = w.Flush()
+	}
+}
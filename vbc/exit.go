@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+/* What the daemon exits with, so whatever runs it can tell what went wrong
+ * without reading the log. Commands exit with ExitUsage when given arguments
+ * they don't take, and with ExitFailure when anything else goes wrong. */
+const (
+	ExitOK = 0
+	/* Something went wrong along the way, see the log. */
+	ExitFailure = 1
+	ExitUsage   = 2
+	/* The settings or configuration file have something wrong in them. */
+	ExitConfig = 3
+	/* Either side turned our credentials down. */
+	ExitAuth = 4
+	/* The store couldn't be opened. */
+	ExitStore = 5
+)
+
+/* What each exit code is called in the status line of --once. */
+var exitNames = map[int]string{
+	ExitOK:      "ok",
+	ExitFailure: "failure",
+	ExitUsage:   "usage",
+	ExitConfig:  "config",
+	ExitAuth:    "auth",
+	ExitStore:   "store",
+}
+
+/* Whether --once was passed, polling every account once and exiting once
+ * whatever turned up is crossposted, rather than running for good. There's
+ * nobody around to wait for anything then, so whatever would be waited out
+ * gets reported instead. */
+var pollOnce bool
+
+/* How many times to try getting going with --once, before giving up. */
+const OnceStartupAttempts = 3
+
+/* Like log.Fatalf, but exiting with code, and with the status line of
+ * --once. */
+func fatalf(code int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Print(message)
+	if pollOnce {
+		printOnceStatus(onceStatus{Code: code, Error: message})
+	}
+	os.Exit(code)
+}
+
+/* Marks an error as our credentials having been turned down, see
+ * ExitAuth. */
+type authError struct {
+	err error
+}
+
+func (e authError) Error() string {
+	return e.err.Error()
+}
+
+func (e authError) Unwrap() error {
+	return e.err
+}
+
+/* Marks err as our credentials having been turned down, when cause, the
+ * error it came from, is one retrying wouldn't fix. Anything else might have
+ * gone away on its own. */
+func authFailed(err error, cause error) error {
+	if classifyError(cause) == errorRetryable {
+		return err
+	}
+	return authError{err: err}
+}
+
+/* What to exit with, after a pair stopped over err. */
+func exitCodeFor(err error) int {
+	var aerr authError
+	if errors.As(err, &aerr) || classifyError(err) == errorReauth {
+		return ExitAuth
+	}
+	return ExitFailure
+}
+
+/* How every pair did, for the exit code and the status line of --once. */
+type pairResults struct {
+	mu      sync.Mutex
+	results []onceAccount
+}
+
+func (r *pairResults) Add(pair accountPair, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := onceAccount{
+		Account: fmt.Sprintf("%v@%v", pair.AccountID, pair.Instance),
+		Handle:  pair.Handle,
+		Code:    ExitOK,
+	}
+	if err != nil {
+		result.Code = exitCodeFor(err)
+		result.Error = err.Error()
+	}
+	r.results = append(r.results, result)
+}
+
+/* The exit code saying how the pairs did, credentials being turned down
+ * taking precedence over anything else. */
+func (r *pairResults) Code() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code := ExitOK
+	for _, result := range r.results {
+		if result.Code == ExitAuth || code == ExitOK {
+			code = result.Code
+		}
+	}
+	return code
+}
+
+func (r *pairResults) Accounts() []onceAccount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copySlice(r.results)
+}
+
+/* The line --once ends with on standard output, the log going to standard
+ * error. */
+type onceStatus struct {
+	Status   string        `json:"status"`
+	Code     int           `json:"code"`
+	Error    string        `json:"error,omitempty"`
+	Accounts []onceAccount `json:"accounts,omitempty"`
+}
+
+type onceAccount struct {
+	Account string `json:"account"`
+	Handle  string `json:"handle"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Error   string `json:"error,omitempty"`
+}
+
+func printOnceStatus(status onceStatus) {
+	status.Status = exitNames[status.Code]
+	for i := range status.Accounts {
+		status.Accounts[i].Status = exitNames[status.Accounts[i].Code]
+	}
+	line, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("WARNING: could not encode the status line: %v", err)
+		return
+	}
+	fmt.Println(string(line))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* Formats `vbc export` writes. */
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+/* Bluesky's public API, which serves posts without logging in. */
+const PublicAppView = "https://public.api.bsky.app"
+
+/* A crossposted status, along with what became of it, for people to keep. */
+type exportItem struct {
+	Instance  string `json:"instance"`
+	Account   int64  `json:"account"`
+	Status    int64  `json:"status"`
+	StatusURL string `json:"statusUrl"`
+	Handle    string `json:"handle"`
+	PostURI   string `json:"postUri"`
+	PostURL   string `json:"postUrl"`
+
+	/* The status as it is now on Mastodon, empty when it's no longer
+	 * there to be fetched. */
+	HTML  string   `json:"html"`
+	Text  string   `json:"text"`
+	Media []string `json:"media"`
+	/* The posts it became, in order, and the CIDs of their images. */
+	Posts []string `json:"posts"`
+	Blobs []string `json:"blobs"`
+
+	StatusCreated *time.Time `json:"statusCreated"`
+	Crossposted   time.Time  `json:"crossposted"`
+	Edited        *time.Time `json:"edited"`
+}
+
+/* A post as getPosts hands it back, with what exportItem and auditAltText
+ * need out of it. */
+type exportPost struct {
+	Uri    string `json:"uri"`
+	Record struct {
+		Text string `json:"text"`
+	} `json:"record"`
+	Embed *struct {
+		Images []struct {
+			Fullsize string `json:"fullsize"`
+			Alt      string `json:"alt"`
+		} `json:"images"`
+	} `json:"embed"`
+}
+
+/* Looks up posts on the public API, by URI. Posts that are gone are left
+ * out. */
+func fetchExportPosts(ctx context.Context, client *xrpc.Client, uris []string) (map[string]exportPost, error) {
+	posts := make(map[string]exportPost, len(uris))
+	for start := 0; start < len(uris); start += EngagementBatch {
+		end := start + EngagementBatch
+		if end > len(uris) {
+			end = len(uris)
+		}
+
+		var out struct {
+			Posts []exportPost `json:"posts"`
+		}
+		params := map[string]interface{}{"uris": uris[start:end]}
+		if err := client.Do(ctx, xrpc.Query, "", "app.bsky.feed.getPosts", params, nil, &out); err != nil {
+			return nil, err
+		}
+		for _, post := range out.Posts {
+			posts[post.Uri] = post
+		}
+	}
+	return posts, nil
+}
+
+/* The CID of an image, out of the URL the public API serves it at, which
+ * ends in <cid>@<format>. */
+func blobFromImageURL(url string) string {
+	cid := url[strings.LastIndex(url, "/")+1:]
+	cid, _, _ = strings.Cut(cid, "@")
+	return cid
+}
+
+/* Gathers everything crossposted between a pair of accounts, oldest first. */
+func exportPair(ctx context.Context, store Store, pair accountPair, appview *xrpc.Client) ([]exportItem, error) {
+	did, err := resolveHandle(ctx, http.DefaultClient, pair.Handle)
+	if err != nil {
+		return nil, err
+	}
+	key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: did}
+	values, err := store.Mappings(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		/* State from before accounts could be crossposted to more than
+		 * one place. */
+		values, err = store.Mappings(AccountKey{Instance: pair.Instance, ID: pair.AccountID})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	type posted struct {
+		status  int64
+		mapping *StatusMapping
+		uris    []string
+	}
+	var statuses []posted
+	var uris []string
+	for id, value := range values {
+		mapping, err := decodeMapping(value)
+		if err != nil {
+			log.Printf("WARNING: bad mapping for status %v: %v", id, err)
+			continue
+		}
+		if !mapping.Posted() {
+			continue
+		}
+
+		/* Threads go up with a record key after the other, see
+		 * nextStatusRkey. */
+		p := posted{status: id, mapping: mapping, uris: []string{mapping.Uri}}
+		base := strings.TrimSuffix(mapping.Uri, mapping.Rkey)
+		rkey := mapping.Rkey
+		for i := 1; i < mapping.Parts; i++ {
+			if rkey = nextStatusRkey(rkey); rkey == "" {
+				break
+			}
+			p.uris = append(p.uris, base+rkey)
+		}
+		statuses = append(statuses, p)
+		uris = append(uris, p.uris...)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].status < statuses[j].status })
+
+	posts, err := fetchExportPosts(ctx, appview, uris)
+	if err != nil {
+		return nil, err
+	}
+	mc, err := madon.RestoreApp(AppName, pair.Instance, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]exportItem, 0, len(statuses))
+	for _, p := range statuses {
+		item := exportItem{
+			Instance:    pair.Instance,
+			Account:     pair.AccountID,
+			Status:      p.status,
+			StatusURL:   fmt.Sprintf("%v/web/statuses/%v", pair.Instance, p.status),
+			Handle:      pair.Handle,
+			PostURI:     p.mapping.Uri,
+			PostURL:     blueskyPostURL(pair.Handle, p.mapping.Uri),
+			Media:       []string{},
+			Posts:       []string{},
+			Blobs:       []string{},
+			Crossposted: p.mapping.Created,
+			Edited:      p.mapping.Edited,
+		}
+
+		/* Private statuses can't be fetched without logging in, and deleted
+		 * ones can't be fetched at all, but what's in the store is still
+		 * worth keeping. */
+		status, err := mc.GetStatus(p.status)
+		if err != nil {
+			log.Printf("WARNING: could not fetch status %v on %v, exporting it without its text: %v", p.status, pair.Instance, err)
+		} else {
+			item.StatusURL = status.URL
+			item.HTML = status.Content
+			item.Text = renderStatusText(status.Content)
+			created := status.CreatedAt
+			item.StatusCreated = &created
+			for _, attachment := range status.MediaAttachments {
+				item.Media = append(item.Media, attachment.URL)
+			}
+		}
+
+		for _, uri := range p.uris {
+			post, found := posts[uri]
+			if !found {
+				continue
+			}
+			item.Posts = append(item.Posts, post.Record.Text)
+			if post.Embed != nil {
+				for _, image := range post.Embed.Images {
+					item.Blobs = append(item.Blobs, blobFromImageURL(image.Fullsize))
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+/* Writes the items as CSV, with lists joined by newlines. */
+func writeExportCSV(w io.Writer, items []exportItem) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{
+		"instance", "account", "status", "status_url", "handle", "post_uri", "post_url",
+		"html", "text", "media", "posts", "blobs", "status_created", "crossposted", "edited",
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	for _, item := range items {
+		err := out.Write([]string{
+			item.Instance,
+			strconv.FormatInt(item.Account, 10),
+			strconv.FormatInt(item.Status, 10),
+			item.StatusURL,
+			item.Handle,
+			item.PostURI,
+			item.PostURL,
+			item.HTML,
+			item.Text,
+			strings.Join(item.Media, "\n"),
+			strings.Join(item.Posts, "\n\n"),
+			strings.Join(item.Blobs, "\n"),
+			timestamp(item.StatusCreated),
+			timestamp(&item.Crossposted),
+			timestamp(item.Edited),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", ExportJSONL, "what to write, jsonl, csv or html")
+	output := fs.String("output", "", "file to write to, rather than standard output, or with html, the directory")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc export [--format jsonl|csv] [--output <file>]\n")
+		fmt.Fprintf(fs.Output(), "       vbc export --format html --output <dir>\n\n")
+		fmt.Fprintf(fs.Output(), "Writes out every status vbc crossposted, with its HTML and text as it is\n")
+		fmt.Fprintf(fs.Output(), "now on Mastodon, its media, the text and images of the posts it became on\n")
+		fmt.Fprintf(fs.Output(), "Bluesky, the URLs of both and when it was posted, crossposted and edited.\n")
+		fmt.Fprintf(fs.Output(), "With html, writes a site to browse all of that with instead, media\n")
+		fmt.Fprintf(fs.Output(), "included. Can be done while vbc is running.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || (*format != ExportJSONL && *format != ExportCSV && *format != ExportHTML) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format == ExportHTML && *output == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	appview := &xrpc.Client{Host: PublicAppView}
+	var items []exportItem
+	for _, pair := range config.Pairs() {
+		exported, err := exportPair(ctx, store, pair, appview)
+		if err != nil {
+			log.Fatalf("could not export account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+		}
+		log.Printf("exporting %v crosspost(s) of account %v on %v to @%v", len(exported), pair.AccountID, pair.Instance, pair.Handle)
+		items = append(items, exported...)
+	}
+
+	if *format == ExportHTML {
+		if err := writeExportHTML(*output, items); err != nil {
+			log.Fatalf("could not write export: %v", err)
+		}
+		log.Printf("wrote %v, open %v to browse it", *output, filepath.Join(*output, "index.html"))
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("could not create %v: %v", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *format == ExportCSV {
+		err = writeExportCSV(w, items)
+	} else {
+		encoder := json.NewEncoder(w)
+		for _, item := range items {
+			if err = encoder.Encode(item); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Fatalf("could not write export: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* With it, `vbc export` writes a site rather than a file, see
+ * writeExportHTML. */
+const ExportHTML = "html"
+
+/* How long downloading a single attachment for the archive may take. */
+const ExportMediaTimeout = time.Minute
+
+const exportStyle = `
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+article { border-top: 1px solid #ddd; padding: 1em 0; }
+.text, .post { white-space: pre-wrap; }
+.post { border-left: 3px solid #1185fe; padding-left: .75em; margin: .5em 0; color: #444; }
+.meta { font-size: .85em; color: #777; }
+img { max-width: 100%; margin: .25em 0; }
+`
+
+var exportIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Crossposts</title>
+<style>` + exportStyle + `</style>
+</head>
+<body>
+<h1>Crossposts</h1>
+<p class="meta">Exported by vbc on {{.Exported.Format "2006-01-02 15:04 MST"}}.</p>
+<ul>
+{{range .Accounts}}<li><a href="{{.Page}}">{{.Account}} on {{.Instance}} to @{{.Handle}}</a>, {{len .Items}} crosspost(s)</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+var exportAccountTemplate = template.Must(template.New("account").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Crossposts to @{{.Handle}}</title>
+<style>` + exportStyle + `</style>
+</head>
+<body>
+<p><a href="index.html">All accounts</a></p>
+<h1>{{.Account}} on {{.Instance}} to @{{.Handle}}</h1>
+{{range .Items}}<article>
+<p class="meta">
+{{if .StatusCreated}}Posted {{.StatusCreated.Format "2006-01-02 15:04 MST"}}, {{end}}crossposted {{.Crossposted.Format "2006-01-02 15:04 MST"}}{{if .Edited}}, last edited {{.Edited.Format "2006-01-02 15:04 MST"}}{{end}}
+</p>
+{{if .Text}}<div class="text">{{.Text}}</div>
+{{else}}<p class="meta">The status could not be fetched from Mastodon.</p>
+{{end}}{{range .Media}}<a href="{{.}}"><img src="{{.}}" alt=""></a>
+{{end}}{{range .Posts}}<div class="post">{{.}}</div>
+{{end}}<p class="meta"><a href="{{.StatusURL}}">On Mastodon</a> · <a href="{{.PostURL}}">On Bluesky</a></p>
+</article>
+{{end}}</body>
+</html>
+`))
+
+/* The crossposts of a pair of accounts, for a page of their own. */
+type exportAccount struct {
+	Instance string
+	Account  int64
+	Handle   string
+	Page     string
+	Items    []exportItem
+}
+
+/* Downloads an attachment into the media directory of the archive, handing
+ * back where it went, relative to the archive. Attachments that were there
+ * already are left alone. */
+func downloadExportMedia(client *http.Client, dir string, status int64, i int, raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%v-%v%v", status, i, strings.ToLower(path.Ext(u.Path)))
+	relative := path.Join("media", name)
+	target := filepath.Join(dir, "media", name)
+	if _, err := os.Stat(target); err == nil {
+		return relative, nil
+	}
+
+	res, err := client.Get(raw)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+
+	/* Written under another name first, so a download that fails halfway
+	 * isn't taken to be there the next time around. */
+	file, err := os.Create(target + ".part")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, res.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return relative, os.Rename(target+".part", target)
+}
+
+/* Writes the items to dir as a site that can be browsed without either
+ * network, with an index of accounts, a page for each, newest first, and
+ * their media downloaded next to them. Attachments that can't be downloaded
+ * get linked to where they are. */
+func writeExportHTML(dir string, items []exportItem) error {
+	if err := os.MkdirAll(filepath.Join(dir, "media"), 0755); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: ExportMediaTimeout}
+	accounts := make(map[string]*exportAccount)
+	var order []*exportAccount
+	for _, item := range items {
+		key := fmt.Sprintf("%v %v %v", item.Instance, item.Account, item.Handle)
+		account, found := accounts[key]
+		if !found {
+			host := item.Instance
+			if u, err := url.Parse(item.Instance); err == nil && u.Host != "" {
+				host = u.Host
+			}
+			account = &exportAccount{
+				Instance: item.Instance,
+				Account:  item.Account,
+				Handle:   item.Handle,
+				Page:     fmt.Sprintf("%v-%v-%v.html", host, item.Account, item.Handle),
+			}
+			accounts[key] = account
+			order = append(order, account)
+		}
+
+		for i, media := range item.Media {
+			local, err := downloadExportMedia(client, dir, item.Status, i, media)
+			if err != nil {
+				log.Printf("WARNING: could not download %v, linking to it instead: %v", media, err)
+				continue
+			}
+			item.Media[i] = local
+		}
+		account.Items = append(account.Items, item)
+	}
+
+	for _, account := range order {
+		sort.Slice(account.Items, func(i, j int) bool { return account.Items[i].Status > account.Items[j].Status })
+		if err := writeExportPage(filepath.Join(dir, account.Page), exportAccountTemplate, account); err != nil {
+			return err
+		}
+	}
+	return writeExportPage(filepath.Join(dir, "index.html"), exportIndexTemplate, struct {
+		Exported time.Time
+		Accounts []*exportAccount
+	}{time.Now(), order})
+}
+
+func writeExportPage(path string, tmpl *template.Template, data interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const LikeCollection = "app.bsky.feed.like"
+
+const (
+	/* How often favourites get checked for new ones. They're not worth
+	 * bothering the instance about as often as statuses are. */
+	FavouritesPollInterval = time.Minute
+
+	/* How far apart a status and its crosspost may have been posted for
+	 * them to be taken as the same, and how much of their text, links left
+	 * out, has to match. */
+	FavouriteMatchWindow = 10 * time.Minute
+	FavouriteMatchPrefix = 30
+)
+
+/* See app.bsky.feed.like. */
+type likeRecord struct {
+	LexiconTypeID string    `json:"$type"`
+	Subject       strongRef `json:"subject"`
+	CreatedAt     string    `json:"createdAt"`
+}
+
+/* Favourites of the account, newest first. */
+func (w *mastodonWriter) Favourites(ctx context.Context) ([]madon.Status, error) {
+	var statuses []madon.Status
+	err := w.call(ctx, http.MethodGet, "/api/v1/favourites?limit=40", nil, &statuses)
+	return statuses, err
+}
+
+/* Mirrors the favourites of a Mastodon account as likes on Bluesky, until ctx
+ * is done. Only statuses of accounts with a Bluesky account in
+ * the handle map can be liked, as long as their crosspost can be found. */
+func mirrorFavourites(
+	ctx context.Context,
+	store Store,
+	writer *mastodonWriter,
+	bs *blueskySession,
+	leader *leaderLock,
+	handles map[string]string,
+	instance string,
+	acct *madon.Account,
+	did string) {
+
+	for {
+		if leader.Leading() {
+			err := mirrorFavouritesOnce(ctx, store, writer, bs, handles, instance, acct, did)
+			if err != nil {
+				log.Printf("ERROR: could not mirror favourites of @%v: %v", acct.Username, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(FavouritesPollInterval):
+		}
+	}
+}
+
+func mirrorFavouritesOnce(
+	ctx context.Context,
+	store Store,
+	writer *mastodonWriter,
+	bs *blueskySession,
+	handles map[string]string,
+	instance string,
+	acct *madon.Account,
+	did string) error {
+
+	statuses, err := writer.Favourites(ctx)
+	if err != nil {
+		return err
+	}
+
+	/* Favourites from before we started mirroring them stay as they are,
+	 * the same as statuses do when an account gets bootstrapped. */
+	marker := fmt.Sprintf("bootstrapped:%v@%v", acct.ID, instance)
+	bootstrapped, err := store.Like(did, marker)
+	if err != nil {
+		return err
+	}
+	if bootstrapped == nil {
+		for _, status := range statuses {
+			if err := putLikeSkipped(store, did, status.URI, "favourited before mirroring started"); err != nil {
+				return err
+			}
+		}
+		return store.PutLike(did, marker, []byte("{}"))
+	}
+
+	/* Oldest first, so likes go up in the order the favourites were made. */
+	for i := len(statuses) - 1; i >= 0; i-- {
+		status := &statuses[i]
+		done, err := store.Like(did, status.URI)
+		if err != nil {
+			return err
+		}
+		if done != nil || status.Account == nil {
+			continue
+		}
+
+		author := accountHandle(status.Account)
+		handle := lookupHandle(handles, author)
+		if handle == "" {
+			if err := putLikeSkipped(store, did, status.URI, "no known Bluesky account"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		/* Can't find it now, but it might be found later, once it's been
+		 * crossposted. */
+		post, err := findCrosspost(ctx, bs, handle, status)
+		if err != nil {
+			log.Printf("WARNING: could not look for %v on Bluesky: %v", status.URL, err)
+			continue
+		}
+		if post == nil {
+			if time.Since(status.CreatedAt) > FavouriteMatchWindow {
+				if err := putLikeSkipped(store, did, status.URI, "no matching post on Bluesky"); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		like := likeRecord{
+			LexiconTypeID: LikeCollection,
+			Subject:       *post,
+			CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+		}
+		var output json.RawMessage
+		err = bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			o, err := putRawRecord(ctx, client, did, LikeCollection, statusRkey(status, 0), like)
+			if err != nil {
+				return err
+			}
+			output, err = json.Marshal(o)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Bluesky: liked %v, favourited on Mastodon as %v", post.Uri, status.URL)
+
+		if err := store.PutLike(did, status.URI, output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putLikeSkipped(store Store, did string, status string, reason string) error {
+	value, err := json.Marshal(map[string]string{"skipped": reason})
+	if err != nil {
+		return err
+	}
+	return store.PutLike(did, status, value)
+}
+
+/* The Bluesky handle of a Mastodon account, going by the handle map. */
+func lookupHandle(handles map[string]string, account string) string {
+	for acct, handle := range handles {
+		if strings.EqualFold(strings.TrimPrefix(acct, "@"), account) {
+			return strings.TrimPrefix(handle, "@")
+		}
+	}
+	return ""
+}
+
+/* Text as it gets compared between networks, with links, which get changed
+ * on the way, and differences in whitespace left out. */
+func matchableText(text string) string {
+	runes := []rune(strings.Join(strings.Fields(linkRe.ReplaceAllString(text, "")), " "))
+	if len(runes) > FavouriteMatchPrefix {
+		runes = runes[:FavouriteMatchPrefix]
+	}
+	return string(runes)
+}
+
+/* Looks for the crosspost of a status among the recent posts of the Bluesky
+ * account it should be on, going by when it was posted and how it starts. */
+func findCrosspost(ctx context.Context, bs *blueskySession, handle string, status *madon.Status) (*strongRef, error) {
+	var feed struct {
+		Feed []struct {
+			Post struct {
+				Uri    string `json:"uri"`
+				Cid    string `json:"cid"`
+				Record struct {
+					Text      string `json:"text"`
+					CreatedAt string `json:"createdAt"`
+				} `json:"record"`
+			} `json:"post"`
+			/* Set for reposts, which aren't theirs. */
+			Reason json.RawMessage `json:"reason"`
+		} `json:"feed"`
+	}
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		params := map[string]interface{}{"actor": handle, "limit": 50}
+		return client.Do(ctx, xrpc.Query, "", "app.bsky.feed.getAuthorFeed", params, nil, &feed)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	want := matchableText(renderStatusText(status.Content))
+	for _, item := range feed.Feed {
+		if item.Reason != nil {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, item.Post.Record.CreatedAt)
+		if err != nil {
+			continue
+		}
+		apart := createdAt.Sub(status.CreatedAt)
+		if apart < 0 {
+			apart = -apart
+		}
+		if apart > FavouriteMatchWindow {
+			continue
+		}
+
+		/* Crossposts made by vbc keep the time of the status to the second,
+		 * which is as good a match as any. */
+		if apart < time.Second || (want != "" && matchableText(item.Post.Record.Text) == want) {
+			return &strongRef{Cid: item.Post.Cid, Uri: item.Post.Uri}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+const (
+	/* How often an account that went away gets checked on, to see if it's
+	 * back. */
+	AccountGoneCheckInterval = 30 * time.Minute
+	/* How often an account gets checked on while it's being polled. The
+	 * statuses of suspended accounts just come back empty, so polling alone
+	 * doesn't tell. */
+	AccountCheckInterval = time.Hour
+)
+
+/* Fetches an account ourselves into out, to get at what madon leaves out,
+ * handing back the status code. Only a 200 gets decoded, and only 404s and
+ * 410s are handed back without an error. */
+func fetchRawAccount(mc *madon.Client, id int64, out interface{}) (int, error) {
+	url := fmt.Sprintf("%v/api/v1/accounts/%v", strings.TrimSuffix(mc.InstanceURL, "/"), id)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if mc.UserToken != nil {
+		req.Header.Set("Authorization", "Bearer "+mc.UserToken.AccessToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	case http.StatusNotFound, http.StatusGone:
+		return res.StatusCode, nil
+	default:
+		/* Same wording as madon, so classifyError picks it up. */
+		return res.StatusCode, errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+}
+
+/* Asks Mastodon whether the account is still around, handing back what
+ * became of it if it isn't, or nothing if it is. */
+func fetchAccountGone(mc *madon.Client, id int64) (string, error) {
+	var raw struct {
+		Suspended bool `json:"suspended"`
+		Moved     *struct {
+			Acct string `json:"acct"`
+		} `json:"moved"`
+	}
+	code, err := fetchRawAccount(mc, id, &raw)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case code == http.StatusNotFound:
+		return "not found", nil
+	case code == http.StatusGone:
+		return "gone", nil
+	case raw.Suspended:
+		return "suspended", nil
+	case raw.Moved != nil:
+		return fmt.Sprintf("moved to @%v", raw.Moved.Acct), nil
+	}
+	return "", nil
+}
+
+/* Checks on an account that went away, see fetchAccountGone. */
+func (s *mastodonSession) AccountGone(id int64) (string, error) {
+	var reason string
+	err := s.Do(func(mc *madon.Client) error {
+		r, err := fetchAccountGone(mc, id)
+		reason = r
+		return err
+	})
+	return reason, err
+}
+
+/* Stops crossposting an account that went away for the reason given. With
+ * accountGone set to watch, it gets checked on until it's back, which is when
+ * this returns. Otherwise, it's paused until vbc is restarted. */
+func watchAccount(
+	ctx context.Context,
+	ms *mastodonSession,
+	id int64,
+	name string,
+	reason string,
+	mode string,
+	reporter *errorReporter,
+	state *pairState) error {
+
+	err := errors.New(fmt.Sprintf("Mastodon account %v is %v", name, reason))
+	state.Failed(err)
+	if mode == AccountGonePause || pollOnce {
+		return pausedError{failures: 1, err: err}
+	}
+
+	log.Printf("ERROR: stopped crossposting %v, checking on it every %v: %v", name, AccountGoneCheckInterval, err)
+	reporter.Report(err, "", name)
+	labels := []string{"account", fmt.Sprintf("%v@%v", id, ms.instance)}
+	metrics.Set("vbc_account_gone", "Whether a Mastodon account has gone away, and is being checked on.", 1, labels...)
+	state.SetStatus(fmt.Sprintf("account is %v, checking on it every %v", reason, AccountGoneCheckInterval))
+
+	for {
+		select {
+		case <-time.After(AccountGoneCheckInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		current, err := ms.AccountGone(id)
+		if err != nil {
+			log.Printf("WARNING: could not check on %v: %v", name, err)
+			continue
+		}
+		if current == "" {
+			log.Printf("Mastodon: %v is back, crossposting it again", name)
+			metrics.Set("vbc_account_gone", "Whether a Mastodon account has gone away, and is being checked on.", 0, labels...)
+			return nil
+		}
+		if current != reason {
+			log.Printf("Mastodon: %v is now %v", name, current)
+			reason = current
+			state.SetStatus(fmt.Sprintf("account is %v, checking on it every %v", reason, AccountGoneCheckInterval))
+		}
+	}
+}
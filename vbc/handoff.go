@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Version of the format below. Bump it whenever it changes, and teach
+ * importAccountState how to read the older one. */
+const AccountStateVersion = 1
+
+/* How long a handoff waits on a pair to wind down. */
+const HandoffTimeout = time.Minute
+
+/* Everything the store has on a pair that it needs to carry on somewhere
+ * else, neither losing nor crossposting anything twice. */
+type accountState struct {
+	Version   int    `json:"version"`
+	Instance  string `json:"instance"`
+	AccountID int64  `json:"accountId"`
+	Target    string `json:"target"`
+	Handle    string `json:"handle"`
+	Cursor    int64  `json:"cursor"`
+	/* Mappings by status ID, as they are in the store. */
+	Mappings    map[string]json.RawMessage `json:"mappings"`
+	RetryQueue  []RetryEntry               `json:"retryQueue"`
+	DeadLetters []RetryEntry               `json:"deadLetters"`
+}
+
+func exportAccountState(store Store, key AccountKey, handle string) (*accountState, error) {
+	state := &accountState{
+		Version:   AccountStateVersion,
+		Instance:  key.Instance,
+		AccountID: key.ID,
+		Target:    key.Target,
+		Handle:    handle,
+		Mappings:  make(map[string]json.RawMessage),
+	}
+
+	var err error
+	if state.Cursor, err = store.Cursor(key); err != nil {
+		return nil, err
+	}
+	mappings, err := store.Mappings(key)
+	if err != nil {
+		return nil, err
+	}
+	for id, value := range mappings {
+		state.Mappings[strconv.FormatInt(id, 10)] = json.RawMessage(copySlice(value))
+	}
+	if state.RetryQueue, err = store.RetryQueue(key); err != nil {
+		return nil, err
+	}
+	if state.DeadLetters, err = store.DeadLetters(key); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/* Puts the state of a pair exported elsewhere in the store, which mustn't
+ * have that pair already. */
+func importAccountState(store Store, state *accountState) (AccountKey, error) {
+	key := AccountKey{Instance: state.Instance, ID: state.AccountID, Target: state.Target}
+	if state.Version != AccountStateVersion {
+		return key, errors.New(fmt.Sprintf("unknown account state version %v", state.Version))
+	}
+	if bootstrapped, err := store.HasAccount(key); err != nil {
+		return key, err
+	} else if bootstrapped {
+		return key, errors.New(fmt.Sprintf("account %v on %v is already in the store", key.ID, key.Instance))
+	}
+
+	mappings := make(map[int64][]byte, len(state.Mappings))
+	for id, value := range state.Mappings {
+		status, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return key, errors.New(fmt.Sprintf("bad status ID %q", id))
+		}
+		mappings[status] = value
+	}
+	if err := store.BootstrapAccount(key, mappings); err != nil {
+		return key, err
+	}
+	if err := store.PutCursor(key, state.Cursor); err != nil {
+		return key, err
+	}
+	for _, entry := range state.RetryQueue {
+		if err := store.PutRetry(key, entry); err != nil {
+			return key, err
+		}
+	}
+	for _, entry := range state.DeadLetters {
+		if err := store.PutDeadLetter(key, entry); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+func (s *pairState) SetSnapshot(snapshot func(then func()) (*accountState, error)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snapshot
+}
+
+func (s *pairState) SetStop(stop context.CancelFunc) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop = stop
+}
+
+/* Takes a snapshot of the state of the pair, between two statuses being
+ * published, so it's the same as what's in the store. */
+func (s *pairState) Snapshot() (*accountState, error) {
+	s.mu.Lock()
+	snapshot := s.snapshot
+	s.mu.Unlock()
+	if snapshot == nil {
+		return nil, errors.New("not crossposting right now")
+	}
+	return snapshot(nil)
+}
+
+/* Stops the pair right after taking a snapshot of its state, so nothing gets
+ * crossposted after it, and waits for it to wind down. It stays stopped until
+ * vbc is restarted, for it to be carried on elsewhere. */
+func (s *pairState) Handoff() (*accountState, error) {
+	return s.stopWith(func() { s.handedOff = true })
+}
+
+/* Stops the pair between two statuses being published, the same way Handoff
+ * does, for it to stay paused until vbc is restarted. */
+func (s *pairState) Pause() error {
+	_, err := s.stopWith(func() { s.paused = true })
+	return err
+}
+
+/* Whether the pair was stopped by Pause. */
+func (s *pairState) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+/* Stops the pair right after taking a snapshot of its state, marking it with
+ * mark, called with mu held, and waits for it to wind down. */
+func (s *pairState) stopWith(mark func()) (*accountState, error) {
+	s.mu.Lock()
+	snapshot, stop := s.snapshot, s.stop
+	s.mu.Unlock()
+	if snapshot == nil || stop == nil {
+		return nil, errors.New("not crossposting right now")
+	}
+
+	state, err := snapshot(func() {
+		s.mu.Lock()
+		mark()
+		s.mu.Unlock()
+		stop()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(HandoffTimeout)
+	for {
+		s.mu.Lock()
+		running := s.snapshot != nil
+		s.mu.Unlock()
+		if !running {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("stopped, but still winding down")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/* Finds the pair of an account crossposted to a handle, the latest one there
+ * was should it have been started more than once. */
+func (d *debugRegistry) Find(instance string, accountID int64, handle string) *pairState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := len(d.pairs) - 1; i >= 0; i-- {
+		pair := d.pairs[i].pair
+		if pair.Instance == instance && pair.AccountID == accountID && pair.Handle == handle {
+			return d.pairs[i]
+		}
+	}
+	return nil
+}
+
+/* How many pairs were handed off, and are waiting on vbc to be restarted. */
+func (d *debugRegistry) HandedOff() int {
+	d.mu.Lock()
+	pairs := copySlice(d.pairs)
+	d.mu.Unlock()
+
+	count := 0
+	for _, state := range pairs {
+		state.mu.Lock()
+		if state.handedOff {
+			count++
+		}
+		state.mu.Unlock()
+	}
+	return count
+}
+
+/* Serves the admin API on addr for as long as we're running, to whoever has
+ * the token:
+ *
+ *   GET /accounts/state?account=<id>@<instance>&handle=<handle>
+ *   POST /accounts/handoff?account=<id>@<instance>&handle=<handle>
+ *   GET /accounts/events?account=<id>@<instance>&handle=<handle>&tail=<n>
+ *
+ * The first two answer with the state of the pair, see accountState, and
+ * handoff stops the pair as well. Events answers with the latest of what was
+ * done with its statuses, see pipelineEvent. */
+func serveAdmin(addr string, token string, store Store) {
+	log.Printf("serving the admin API on %v", addr)
+	if err := http.ListenAndServe(addr, adminHandler(token, store)); err != nil {
+		log.Printf("ERROR: could not serve the admin API: %v", err)
+	}
+}
+
+func adminHandler(token string, store Store) http.Handler {
+	authorized := func(r *http.Request) bool {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	findPair := func(w http.ResponseWriter, r *http.Request) *pairState {
+		id, instance, _ := strings.Cut(r.URL.Query().Get("account"), "@")
+		accountID, err := strconv.ParseInt(id, 10, 64)
+		handle := strings.TrimPrefix(r.URL.Query().Get("handle"), "@")
+		if err != nil || instance == "" || handle == "" {
+			http.Error(w, "account should be <id>@<instance>, and handle a Bluesky handle", http.StatusBadRequest)
+			return nil
+		}
+		instance, err = parseInstanceName(instance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		state := debugState.Find(instance, accountID, handle)
+		if state == nil {
+			http.Error(w, "no such account", http.StatusNotFound)
+		}
+		return state
+	}
+	respond := func(w http.ResponseWriter, state *accountState, err error) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts/state", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if pair := findPair(w, r); pair != nil {
+			state, err := pair.Snapshot()
+			respond(w, state, err)
+		}
+	})
+	mux.HandleFunc("/accounts/handoff", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if pair := findPair(w, r); pair != nil {
+			state, err := pair.Handoff()
+			if err == nil {
+				log.Printf("handed account %v on %v to @%v off, not crossposting it until vbc is restarted",
+					state.AccountID,
+					state.Instance,
+					state.Handle)
+			}
+			respond(w, state, err)
+		}
+	})
+
+	mux.HandleFunc("/accounts/events", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tail := 50
+		if given := r.URL.Query().Get("tail"); given != "" {
+			n, err := strconv.Atoi(given)
+			if err != nil || n < 0 {
+				http.Error(w, "tail should be a number of events", http.StatusBadRequest)
+				return
+			}
+			tail = n
+		}
+		pair := findPair(w, r)
+		if pair == nil {
+			return
+		}
+		key, _, err := storedPairKey(r.Context(), store, pair.pair)
+		var events []pipelineEvent
+		if err == nil {
+			events, err = accountEvents(store, key, tail)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(events)
+	})
+	return mux
+}
+
+/* Puts the state of a pair handed off elsewhere in the store, see
+ * serveAdmin, for vbc to carry on from where it was left. */
+func importAccountCommand(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("could not read %v: %v", file, err)
+	}
+	var state accountState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Fatalf("could not read %v: %v", file, err)
+	}
+
+	store, err := openStore(storeSpec())
+	if err != nil {
+		fatalf(ExitStore, "could not open store: %v", err)
+	}
+	defer store.Close()
+
+	key, err := importAccountState(store, &state)
+	if err != nil {
+		log.Fatalf("could not import %v: %v", file, err)
+	}
+	log.Printf("imported account %v on %v to %v, with %v mapping(s), %v status(es) in the retry queue and %v in the dead letters",
+		key.ID,
+		key.Instance,
+		key.Target,
+		len(state.Mappings),
+		len(state.RetryQueue),
+		len(state.DeadLetters))
+}
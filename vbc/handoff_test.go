@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/* Asks the admin API about a pair the same way the README does, with the
+ * instance as a bare host, and about one on an instance that isn't one. */
+func TestAdminFindsPairByBareHost(t *testing.T) {
+	debugState.Pair(accountPair{
+		Instance:  canonicalizeInstanceName("https://mastodon.social"),
+		AccountID: 1234,
+		Handle:    "you.bsky.social",
+	})
+	handler := adminHandler("token", newMemoryStore())
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/accounts/state?"+query, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	/* Found, but not crossposting, as nothing was started for it. */
+	w := get("account=1234@mastodon.social&handle=you.bsky.social")
+	if w.Code != http.StatusConflict {
+		t.Errorf("pair on a bare host answered %v rather than %v: %v", w.Code, http.StatusConflict, w.Body)
+	}
+
+	w = get("account=1234@%25zz&handle=you.bsky.social")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("pair on a bad instance answered %v rather than %v: %v", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	/* How long the instance has to answer a health probe. */
+	HealthProbeTimeout = 10 * time.Second
+
+	/* Delays between probes of an instance that's down, longer than those
+	 * between polls, as maintenance tends to take a while. */
+	MaintenanceBaseDelay = 30 * time.Second
+	MaintenanceMaxDelay  = 30 * time.Minute
+)
+
+/* Checks on a Mastodon instance before it gets polled, so an instance that's
+ * down for maintenance gets waited on quietly, instead of every poll failing
+ * with the same error. A nil health checks on nothing. */
+type instanceHealth struct {
+	instance string
+	client   *http.Client
+
+	/* Probes in a row that found the instance down. */
+	failures int
+	/* Whether to tell being offline apart from the instance being down,
+	 * see offlineMode, and whether we are. */
+	offline bool
+	away    bool
+}
+
+func newInstanceHealth(instance string) *instanceHealth {
+	return &instanceHealth{
+		instance: instance,
+		client:   &http.Client{Timeout: HealthProbeTimeout},
+		offline:  offlineMode(),
+	}
+}
+
+/* Probes the instance, handing back how long to wait before trying again if
+ * it's down. Only changes between up and down get logged. */
+func (h *instanceHealth) Check(ctx context.Context) (time.Duration, bool) {
+	if h == nil {
+		return 0, true
+	}
+
+	err := h.probe(ctx)
+	if err == nil {
+		if h.away {
+			log.Printf("Mastodon: the network is back, catching up on %v", h.instance)
+		} else if h.failures > 0 {
+			log.Printf("Mastodon: %v is back after %v failed health probe(s)", h.instance, h.failures)
+		}
+		h.failures = 0
+		h.away = false
+		metrics.Set("vbc_instance_up", "Whether a Mastodon instance passed its last health probe.", 1,
+			"instance", h.instance)
+		return 0, true
+	}
+
+	/* The network coming back is worth noticing soon, unlike maintenance
+	 * being over. */
+	if h.offline && isOfflineError(err) {
+		if !h.away {
+			log.Printf("Mastodon: can't reach %v, holding crossposts until the network is back: %v", h.instance, err)
+		}
+		h.away = true
+		return OfflineProbeInterval, false
+	}
+
+	h.failures++
+	delay := backoffDelay(h.failures, MaintenanceBaseDelay, MaintenanceMaxDelay)
+	if h.failures == 1 {
+		log.Printf("Mastodon: %v seems to be down, waiting for it to come back: %v", h.instance, err)
+	}
+	metrics.Set("vbc_instance_up", "Whether a Mastodon instance passed its last health probe.", 0,
+		"instance", h.instance)
+	return delay, false
+}
+
+/* Asks for /health, which Mastodon answers with OK as long as it's up.
+ * Servers without one can't tell us anything, so they're taken to be up. */
+func (h *instanceHealth) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, HealthProbeTimeout)
+	defer cancel()
+
+	target := strings.TrimSuffix(h.instance, "/") + "/health"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/* How long a transform hook gets to run on a single status. */
+const HookTimeout = 5 * time.Second
+
+/* The post being crossposted, as seen by transform hooks. Hooks hand back
+ * a modified copy of it, which is what the post gets made from. */
+type hookPost struct {
+	Text        string      `json:"text"`
+	SpoilerText string      `json:"spoilerText"`
+	Tags        []string    `json:"tags"`
+	Media       []PostMedia `json:"media"`
+	Visibility  string      `json:"visibility"`
+	Sensitive   bool        `json:"sensitive"`
+	Language    string      `json:"language"`
+	URL         string      `json:"url"`
+}
+
+func newHookPost(post *Post) *hookPost {
+	return &hookPost{
+		Text:        post.Text(),
+		SpoilerText: post.ContentWarning,
+		Tags:        copySlice(post.Tags),
+		Media:       copySlice(post.Media),
+		Visibility:  post.Visibility,
+		Sensitive:   post.Sensitive,
+		Language:    post.Language,
+		URL:         post.URL,
+	}
+}
+
+/* Takes on whatever the hooks changed about the post. */
+func (p *Post) applyHooks(hooked *hookPost) {
+	/* Hooks only ever see the text, so where links shown as something
+	 * else go is only kept for as long as they leave it alone. */
+	if hooked.Text != p.Text() {
+		p.Segments = segmentText(hooked.Text)
+	}
+	p.ContentWarning = hooked.SpoilerText
+	p.Tags = hooked.Tags
+	p.Media = hooked.Media
+	p.Visibility = hooked.Visibility
+	p.Sensitive = hooked.Sensitive
+	p.Language = hooked.Language
+	p.URL = hooked.URL
+}
+
+/* Runs the post through the hooks in the configuration, in order. Hooks may
+ * reject the post, in which case a skipError comes back. */
+func runHooks(post *hookPost, config TransformConfig) (*hookPost, error) {
+	if config.Script != "" {
+		out, err := runStarlarkScript(config.Script, post)
+		if err != nil {
+			return nil, err
+		}
+		post = out
+	}
+	if len(config.Command) > 0 {
+		out, err := runHookCommand(config.Command, post)
+		if err != nil {
+			return nil, err
+		}
+		post = out
+	}
+	return post, nil
+}
+
+/* Pipes the post as JSON through an external command, whose output replaces
+ * it. Printing nothing or null skips the post, and failing fails it. */
+func runHookCommand(command []string, post *hookPost) (*hookPost, error) {
+	in, err := json.Marshal(post)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	name := strings.Join(command, " ")
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, permanent(errors.New(fmt.Sprintf("hook command %v failed: %v: %v",
+			name,
+			err,
+			strings.TrimSpace(stderr.String()))))
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 || string(out) == "null" {
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return nil, skipped("rejected by hook command %v: %v", name, reason)
+	}
+
+	result := &hookPost{}
+	if err := json.Unmarshal(out, result); err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("hook command %v returned a bad post: %v", name, err)))
+	}
+	return result, nil
+}
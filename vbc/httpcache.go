@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	/* How many responses are kept around to be asked about again. */
+	HTTPCacheEntries = 512
+	/* Responses bigger than this aren't kept, and go through as they are. */
+	HTTPCacheMaxBody = 1 << 20
+)
+
+/* Mastodon endpoints whose responses are worth asking about again rather
+ * than fetching again: accounts, their statuses and single statuses, which
+ * polling and checking on accounts keeps fetching unchanged. */
+var httpCachePaths = []string{"/api/v1/accounts/", "/api/v1/statuses/"}
+
+/* A response kept around, along with what to ask the server about it. */
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	header       http.Header
+	body         []byte
+}
+
+/* Sits above every HTTP client we use, asking Mastodon whether what it
+ * answered before has changed, with If-None-Match and If-Modified-Since,
+ * rather than fetching it again, and answering from what it answered then
+ * when it says it hasn't. Servers that don't say what version a response is
+ * get asked as usual. Nothing is ever answered without asking, so responses
+ * are kept, in memory only, even when the server says not to store them. */
+type cacheTransport struct {
+	base http.RoundTripper
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	/* Keys in the order they were kept, oldest first, for making room. */
+	order []string
+	/* Responses answered from the cache, by host. */
+	hits map[string]int
+}
+
+func newCacheTransport(base http.RoundTripper) *cacheTransport {
+	return &cacheTransport{
+		base:    base,
+		entries: make(map[string]*cachedResponse),
+		hits:    make(map[string]int),
+	}
+}
+
+/* Whether a request is one whose response is worth keeping. */
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	for _, prefix := range httpCachePaths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Responses depend on who's asking, so the token goes in the key, hashed so
+ * it isn't kept around as it is. */
+func cacheKey(req *http.Request) string {
+	h := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return req.URL.String() + " " + hex.EncodeToString(h[:8])
+}
+
+func (t *cacheTransport) get(key string) *cachedResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.entries[key]
+}
+
+func (t *cacheTransport) put(key string, entry *cachedResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, found := t.entries[key]; !found {
+		t.order = append(t.order, key)
+	}
+	t.entries[key] = entry
+	for len(t.order) > HTTPCacheEntries {
+		delete(t.entries, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (t *cacheTransport) hit(host string) {
+	t.mu.Lock()
+	t.hits[host]++
+	hits := t.hits[host]
+	t.mu.Unlock()
+	metrics.Set("vbc_http_cache_hits", "Responses answered from what Mastodon answered before, it saying they hadn't changed.", float64(hits),
+		"host", host)
+}
+
+func (t *cacheTransport) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, found := t.entries[key]; !found {
+		return
+	}
+	delete(t.entries, key)
+	for i, kept := range t.order {
+		if kept == key {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	cached := t.get(key)
+	ask := req
+	if cached != nil {
+		ask = req.Clone(req.Context())
+		if cached.etag != "" {
+			ask.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			ask.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	res, err := t.base.RoundTrip(ask)
+	if err != nil {
+		return res, err
+	}
+
+	/* Unchanged, so what it answered before still goes. */
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		res.Body.Close()
+		t.hit(req.URL.Host)
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			Header:        cached.header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || (etag == "" && lastModified == "") || res.ContentLength > HTTPCacheMaxBody {
+		t.forget(key)
+		return res, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, HTTPCacheMaxBody+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if len(body) > HTTPCacheMaxBody {
+		/* Too big to keep, so it goes on as it came, what's been read of
+		 * it first. */
+		t.forget(key)
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.put(key, &cachedResponse{
+		etag:         etag,
+		lastModified: lastModified,
+		header:       res.Header.Clone(),
+		body:         body,
+	})
+	return res, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* A status, and the post another crossposter made of it, as found in what it
+ * exported. */
+type importEntry struct {
+	Status string
+	Post   string
+}
+
+func importCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print what would be imported, without writing anything down")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc import [--dry-run] <file>\n\n")
+		fmt.Fprintf(fs.Output(), "Imports which statuses another crossposter already posted where, so vbc\n")
+		fmt.Fprintf(fs.Output(), "keeps them in sync instead of posting them again. The file can be a CSV or\n")
+		fmt.Fprintf(fs.Output(), "JSON export, as long as every row or object has both the URL of a status and\n")
+		fmt.Fprintf(fs.Output(), "the at:// URI or bsky.app URL of the post made of it. Posts go to\n")
+		fmt.Fprintf(fs.Output(), "VBC_BSKY_HANDLE, from the account it gets crossposted from. Can be done\n")
+		fmt.Fprintf(fs.Output(), "while vbc is running, which then does it, as long as it can read the file.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	handle := requireEnv("VBC_BSKY_HANDLE")
+	file, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("could not find %v: %v", fs.Arg(0), err)
+	}
+	if viaDaemon("import", []string{fmt.Sprintf("--dry-run=%v", *dryRun), handle, file}) {
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	if err := importFile(ctx, config, store, handle, file, *dryRun, os.Stdout); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+/* Imports the statuses and posts in file, going to handle, see
+ * importCommand. Only writes down what it would import with dryRun. */
+func importFile(ctx context.Context, config *Config, store Store, handle string, file string, dryRun bool, w io.Writer) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not read %v: %v", file, err))
+	}
+	entries, err := parseImport(data)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not parse %v: %v", file, err))
+	}
+	if len(entries) == 0 {
+		return errors.New(fmt.Sprintf("found no statuses along with posts in %v", file))
+	}
+
+	pair := config.PairFor(handle)
+	if pair.Instance == "" || pair.AccountID == 0 {
+		return errors.New(fmt.Sprintf("could not tell which account @%v gets crossposted from, set VBC_MASTODON_INSTANCE and VBC_MASTODON_ACCOUNT_ID", pair.Handle))
+	}
+
+	bs, err := newBlueskySession(ctx, store, pair.Server, pair.Handle, pair.AppKey, 0)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", pair.Handle, err))
+	}
+	profile, err := bs.FetchProfile(ctx, pair.Handle)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not fetch Bluesky profile of @%v: %v", pair.Handle, err))
+	}
+	if err := checkExpectedDID(pair.Handle, profile.DID); err != nil {
+		return err
+	}
+	key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: profile.DID}
+
+	/* Imported mappings go over those bootstrapping leaves, so anything the
+	 * export leaves out still gets ignored rather than crossposted. */
+	bootstrapped, err := store.HasAccount(key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not look up account: %v", err))
+	}
+	if !bootstrapped && !dryRun {
+		appId, appSecret := envAppCredentials(pair.Instance)
+		ms, err := newMastodonSession(store, pair.Instance, appId, appSecret)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not set up Mastodon client for %v: %v", pair.Instance, err))
+		}
+		var acct *madon.Account
+		err = ms.Do(func(mc *madon.Client) error {
+			a, err := mc.GetAccount(pair.AccountID)
+			acct = a
+			return err
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not query for Mastodon user: %v", err))
+		}
+		if err := bootstrapAccount(ctx, store, ms, bs, key, acct); err != nil {
+			return errors.New(fmt.Sprintf("could not bootstrap account @%v: %v", acct.Username, err))
+		}
+	}
+
+	imported, kept, ignored := 0, 0, 0
+	for _, entry := range entries {
+		instance, id, err := parseStatusURL(entry.Status)
+		if err != nil || instance != pair.Instance {
+			ignored++
+			continue
+		}
+		repo, rkey, _ := parseBlueskyPost(entry.Post)
+		if repo != profile.DID && repo != profile.Handle {
+			ignored++
+			continue
+		}
+		uri := fmt.Sprintf("at://%v/%v/%v", profile.DID, PostCollection, rkey)
+
+		value, err := store.Mapping(key, id)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not look up mapping of %v: %v", entry.Status, err))
+		}
+		if value != nil {
+			if mapping, err := decodeMapping(value); err == nil && mapping.Posted() {
+				kept++
+				continue
+			}
+		}
+
+		if dryRun {
+			fmt.Fprintf(w, "%v -> %v\n", entry.Status, uri)
+			imported++
+			continue
+		}
+
+		/* Also makes sure the post is still there. */
+		cid, err := recordCIDOf(ctx, bs, profile.DID, PostCollection, rkey)
+		if err != nil {
+			fmt.Fprintf(w, "WARNING: not importing %v, could not get %v: %v\n", entry.Status, uri, err)
+			ignored++
+			continue
+		}
+		mapping, err := encodeMapping(newPostedMapping(uri, cid))
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not encode mapping: %v", err))
+		}
+		if err := store.PutMapping(key, id, mapping); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", entry.Status, err))
+		}
+		if err := store.RemoveRetry(key, id); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", entry.Status, err))
+		}
+		imported++
+	}
+
+	verb := "imported"
+	if dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(w, "%v %v status(es), kept %v already crossposted by vbc, ignored %v not of @%v on %v\n",
+		verb, imported, kept, ignored, pair.Handle, pair.Instance)
+	return nil
+}
+
+/* Finds the statuses and posts in an export, either JSON or CSV. Every JSON
+ * object, however deep, and every CSV row holding a status URL and a post
+ * makes an entry, whatever the fields or columns are called. */
+func parseImport(data []byte) ([]importEntry, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("\xef\xbb\xbf"))
+
+	var entries []importEntry
+	if len(data) > 0 && (data[0] == '[' || data[0] == '{') {
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		walkImportJSON(value, &entries)
+		return entries, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Count(firstLine, []byte("\t")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = '\t'
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if entry, ok := importEntryOf(row); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func walkImportJSON(value interface{}, entries *[]importEntry) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			walkImportJSON(item, entries)
+		}
+	case map[string]interface{}:
+		var fields []string
+		for _, field := range v {
+			if s, ok := field.(string); ok {
+				fields = append(fields, s)
+			} else {
+				walkImportJSON(field, entries)
+			}
+		}
+		if entry, ok := importEntryOf(fields); ok {
+			*entries = append(*entries, entry)
+		}
+	}
+}
+
+/* Picks the status URL and the post out of a set of fields, if they're there. */
+func importEntryOf(fields []string) (importEntry, bool) {
+	var entry importEntry
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if _, _, ok := parseBlueskyPost(field); ok {
+			entry.Post = field
+		} else if isStatusURL(field) {
+			entry.Status = field
+		}
+	}
+	return entry, entry.Status != "" && entry.Post != ""
+}
+
+func isStatusURL(raw string) bool {
+	if !strings.HasPrefix(raw, "https://") && !strings.HasPrefix(raw, "http://") {
+		return false
+	}
+	_, _, err := parseStatusURL(raw)
+	return err == nil
+}
+
+/* Takes apart the at:// URI of a post, or its link on the Bluesky website,
+ * into the handle or DID of its repo and its rkey. */
+func parseBlueskyPost(raw string) (string, string, bool) {
+	if strings.HasPrefix(raw, "at://") {
+		parts := strings.Split(strings.TrimPrefix(raw, "at://"), "/")
+		if len(parts) == 3 && parts[1] == PostCollection && parts[2] != "" {
+			return parts[0], parts[2], true
+		}
+		return "", "", false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host != "bsky.app" {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) == 4 && parts[0] == "profile" && parts[2] == "post" && parts[3] != "" {
+		return parts[1], parts[3], true
+	}
+	return "", "", false
+}
+
+/* The CID a record currently has in a repo. */
+func recordCIDOf(ctx context.Context, bs *blueskySession, repo string, collection string, rkey string) (string, error) {
+	var out struct {
+		Cid string `json:"cid"`
+	}
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		params := map[string]interface{}{
+			"repo":       repo,
+			"collection": collection,
+			"rkey":       rkey,
+		}
+		return client.Do(ctx, xrpc.Query, "", "com.atproto.repo.getRecord", params, nil, &out)
+	})
+	return out.Cid, err
+}
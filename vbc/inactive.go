@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* How often to try crossposting to a Bluesky account again, while it's
+ * deactivated or taken down. */
+const TargetInactiveCheckInterval = 10 * time.Minute
+
+/* Errors Bluesky answers with once an account is no longer active, and what
+ * became of it. */
+var inactiveNames = map[string]string{
+	"AccountDeactivated": "deactivated",
+	"AccountTakedown":    "taken down",
+	"RepoDeactivated":    "deactivated",
+	"RepoTakendown":      "taken down",
+	"RepoSuspended":      "suspended",
+}
+
+/* What became of the Bluesky account an error says is no longer active, if
+ * that's what it says. Nothing is wrong with whatever was being crossposted
+ * then, it has to wait for the account to be back. */
+func targetInactiveReason(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	var xerr *xrpc.XRPCError
+	if errors.As(err, &xerr) {
+		reason, ok := inactiveNames[xerr.ErrStr]
+		return reason, ok
+	}
+	/* Logging in doesn't always hand the error back as it came. */
+	for name, reason := range inactiveNames {
+		if strings.Contains(err.Error(), name) {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+/* Keeps track of whether the Bluesky account crossposts go to is active.
+ * While it isn't, statuses wait in the retry queue, and only one of them
+ * gets a go every TargetInactiveCheckInterval, to find out whether it's
+ * back. */
+type targetStatus struct {
+	reason  string
+	checked time.Time
+}
+
+/* Marks the account as no longer active, saying whether it just stopped
+ * being. */
+func (t *targetStatus) Inactive(reason string) bool {
+	was := t.reason != ""
+	t.reason = reason
+	t.checked = time.Now()
+	return !was
+}
+
+/* Marks the account as active, handing back what it was before, if it
+ * wasn't. */
+func (t *targetStatus) Active() (string, bool) {
+	reason := t.reason
+	t.reason = ""
+	return reason, reason != ""
+}
+
+/* How long to hold the next status back for, 0 if it should go ahead. One
+ * status goes ahead every TargetInactiveCheckInterval while the account isn't
+ * active, to check on it. */
+func (t *targetStatus) Wait() time.Duration {
+	if t.reason == "" {
+		return 0
+	}
+	if wait := time.Until(t.checked.Add(TargetInactiveCheckInterval)); wait > 0 {
+		return wait
+	}
+	t.checked = time.Now()
+	return 0
+}
+
+/* What became of the account, while it isn't active. */
+func (t *targetStatus) Reason() string {
+	return t.reason
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+const (
+	/* How long what an instance says about itself is held on to before
+	 * being asked for again. */
+	InstanceInfoTTL = 24 * time.Hour
+	/* How long to wait before asking again when it couldn't be had. */
+	InstanceInfoRetry = 10 * time.Minute
+)
+
+/* What a Mastodon instance says about itself, as far as crossposting goes,
+ * kept in the store so it's only asked for every InstanceInfoTTL. Limits
+ * that weren't given are 0. */
+type instanceInfo struct {
+	MaxCharacters            int   `json:"maxCharacters,omitempty"`
+	CharactersReservedPerURL int   `json:"charactersReservedPerUrl,omitempty"`
+	ImageSizeLimit           int64 `json:"imageSizeLimit,omitempty"`
+	/* Shortcodes of the custom emoji of the instance, without the colons. */
+	CustomEmoji []string  `json:"customEmoji,omitempty"`
+	Fetched     time.Time `json:"fetched"`
+
+	emoji map[string]bool
+}
+
+/* As /api/v2/instance has it, and /api/v1/instance on older instances. */
+type instanceConfiguration struct {
+	Configuration struct {
+		Statuses struct {
+			MaxCharacters            int `json:"max_characters"`
+			CharactersReservedPerURL int `json:"characters_reserved_per_url"`
+		} `json:"statuses"`
+		MediaAttachments struct {
+			ImageSizeLimit int64 `json:"image_size_limit"`
+		} `json:"media_attachments"`
+	} `json:"configuration"`
+	/* What glitch-soc and Pleroma said before there was a configuration. */
+	MaxTootChars int `json:"max_toot_chars"`
+}
+
+/* Asks an instance about itself. Everything asked for is public. */
+func fetchInstanceInfo(ctx context.Context, instance string) (*instanceInfo, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	get := func(path string, out interface{}) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(instance, "/")+path, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.New(fmt.Sprintf("GET %v: bad server status code (%v)", path, res.StatusCode))
+		}
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+
+	var configuration instanceConfiguration
+	if err := get("/api/v2/instance", &configuration); err != nil {
+		if err := get("/api/v1/instance", &configuration); err != nil {
+			return nil, err
+		}
+	}
+	/* Instances may keep their custom emoji to themselves, which leaves
+	 * none to go by. */
+	var emoji []struct {
+		Shortcode string `json:"shortcode"`
+	}
+	_ = get("/api/v1/custom_emojis", &emoji)
+
+	info := &instanceInfo{
+		MaxCharacters:            configuration.Configuration.Statuses.MaxCharacters,
+		CharactersReservedPerURL: configuration.Configuration.Statuses.CharactersReservedPerURL,
+		ImageSizeLimit:           configuration.Configuration.MediaAttachments.ImageSizeLimit,
+		Fetched:                  time.Now(),
+	}
+	if info.MaxCharacters == 0 {
+		info.MaxCharacters = configuration.MaxTootChars
+	}
+	for _, e := range emoji {
+		info.CustomEmoji = append(info.CustomEmoji, e.Shortcode)
+	}
+	return info, nil
+}
+
+/* What's been read of every instance, so the store only gets read once. */
+type instanceInfoCache struct {
+	mu    sync.Mutex
+	infos map[string]*instanceInfo
+	/* When the store or the instance may be asked again, by instance. */
+	next map[string]time.Time
+}
+
+var instanceInfos = &instanceInfoCache{
+	infos: make(map[string]*instanceInfo),
+	next:  make(map[string]time.Time),
+}
+
+/* What instance says about itself, from the store while it's fresh, and
+ * from the instance otherwise. Should the instance not answer, what it said
+ * last time goes, or nothing, which leaves everything at its defaults. */
+func loadInstanceInfo(ctx context.Context, store Store, instance string) *instanceInfo {
+	c := instanceInfos
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.next[instance]) {
+		return c.infos[instance]
+	}
+
+	info := c.infos[instance]
+	if info == nil {
+		value, err := store.InstanceInfo(instance)
+		if err != nil {
+			log.Printf("WARNING: could not read what's known about %v from the store: %v", instance, err)
+		} else if value != nil {
+			var stored instanceInfo
+			if err := json.Unmarshal(value, &stored); err == nil {
+				info = stored.indexed()
+			}
+		}
+	}
+
+	if info == nil || time.Since(info.Fetched) > InstanceInfoTTL {
+		fetched, err := fetchInstanceInfo(ctx, instance)
+		if err != nil {
+			log.Printf("WARNING: could not ask %v about itself, going by what's known: %v", instance, err)
+			c.infos[instance] = info
+			c.next[instance] = time.Now().Add(InstanceInfoRetry)
+			return info
+		}
+		info = fetched.indexed()
+		if value, err := json.Marshal(info); err == nil {
+			if err := store.PutInstanceInfo(instance, value); err != nil {
+				log.Printf("WARNING: could not write what's known about %v to the store: %v", instance, err)
+			}
+		}
+		log.Printf("Mastodon: %v takes statuses of up to %v characters, and has %v custom emoji",
+			instance,
+			info.MaxCharacters,
+			len(info.CustomEmoji))
+	}
+
+	c.infos[instance] = info
+	c.next[instance] = info.Fetched.Add(InstanceInfoTTL)
+	return info
+}
+
+/* Sets up what looking the custom emoji up takes. */
+func (i *instanceInfo) indexed() *instanceInfo {
+	i.emoji = make(map[string]bool, len(i.CustomEmoji))
+	for _, shortcode := range i.CustomEmoji {
+		i.emoji[shortcode] = true
+	}
+	return i
+}
+
+/* How long statuses can be on the instance, MastodonLimits for what it
+ * didn't say. */
+func (i *instanceInfo) Limits() sinkLimits {
+	limits := MastodonLimits
+	if i == nil {
+		return limits
+	}
+	if i.MaxCharacters > 0 {
+		limits.Length = i.MaxCharacters
+	}
+	if i.CharactersReservedPerURL > 0 {
+		limits.LinkLength = i.CharactersReservedPerURL
+	}
+	return limits
+}
+
+var shortcodeRe = regexp.MustCompile(`:([a-zA-Z0-9_]+):`)
+
+/* Takes the custom emoji of the instance out of text, which show up as
+ * their shortcodes anywhere but on Mastodon. Anything else between colons
+ * is left alone. */
+func (i *instanceInfo) StripCustomEmoji(text string) string {
+	if i == nil || len(i.emoji) == 0 {
+		return text
+	}
+	return shortcodeRe.ReplaceAllStringFunc(text, func(shortcode string) string {
+		if i.emoji[strings.Trim(shortcode, ":")] {
+			return ""
+		}
+		return shortcode
+	})
+}
+
+/* A copy of status without the custom emoji of the instance, see
+ * TransformConfig.CustomEmoji. */
+func (i *instanceInfo) WithoutCustomEmoji(status *madon.Status) *madon.Status {
+	stripped := *status
+	stripped.Content = i.StripCustomEmoji(status.Content)
+	stripped.SpoilerText = strings.TrimSpace(i.StripCustomEmoji(status.SpoilerText))
+	return &stripped
+}
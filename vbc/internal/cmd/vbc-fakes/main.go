@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"lobisomem.gay/vbc/v2/internal/fakes"
+)
+
+/* Runs the fake Mastodon and Bluesky servers side by side, so vbc can be
+ * pointed at them and exercised end to end without live accounts. */
+func main() {
+	every := flag.Duration("every", 30*time.Second, "how often to post a new canned status, zero to never")
+	failBsky := flag.Int("fail-bsky", 0, "number of createRecord calls to fail with a 502 after startup")
+	flag.Parse()
+
+	mastodon := fakes.NewMastodon(109000000000000001, "vbc")
+	defer mastodon.Close()
+	bluesky := fakes.NewBluesky("did:plc:vbcfakevbcfakevbcfake", "vbc.test")
+	defer bluesky.Close()
+
+	/* Something for the bootstrap to ignore. */
+	mastodon.AddStatus(fakes.Status{Content: "<p>This one was here before vbc.</p>"})
+
+	if *failBsky > 0 {
+		bluesky.FailNext("com.atproto.repo.createRecord", 502, *failBsky)
+	}
+
+	fmt.Printf("export VBC_MASTODON_INSTANCE=%v\n", mastodon.URL())
+	fmt.Printf("export VBC_MASTODON_ACCOUNT_ID=%v\n", mastodon.AccountID)
+	fmt.Printf("export VBC_BSKY_SERVER=%v\n", bluesky.URL())
+	fmt.Printf("export VBC_BSKY_HANDLE=%v\n", bluesky.Handle)
+	fmt.Printf("export VBC_BSKY_APP_KEY=xxxx-xxxx-xxxx-xxxx\n")
+
+	var tick <-chan time.Time
+	if *every > 0 {
+		ticker := time.NewTicker(*every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	seen := 0
+	n := 0
+	for {
+		select {
+		case <-interrupt:
+			return
+		case <-tick:
+			n++
+			id := mastodon.AddStatus(fakes.Status{
+				Content: fmt.Sprintf("<p>Canned status number %v, <a href=\"https://example.com/%v\">with a link</a>.</p>", n, n),
+			})
+			log.Printf("mastodon: posted status %v", id)
+		case <-poll.C:
+			records := bluesky.Records()
+			if seen > len(records) {
+				seen = len(records)
+			}
+			for _, record := range records[seen:] {
+				log.Printf("bluesky: captured %v: %s", record.URI, record.Value)
+			}
+			seen = len(records)
+		}
+	}
+}
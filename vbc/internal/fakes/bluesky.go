@@ -0,0 +1,409 @@
+package fakes
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* A record written to the fake PDS. */
+type Record struct {
+	URI        string
+	CID        string
+	Collection string
+	Rkey       string
+	Value      json.RawMessage
+}
+
+/* Fake Bluesky PDS serving the XRPC calls vbc makes, for a single account.
+ * Every record written to it is captured and can be inspected afterwards. */
+type Bluesky struct {
+	Server *httptest.Server
+
+	DID    string
+	Handle string
+
+	faults faults
+
+	mu      sync.Mutex
+	records []Record
+	blobs   map[string][]byte
+	seq     int64
+}
+
+func NewBluesky(did string, handle string) *Bluesky {
+	b := &Bluesky{
+		DID:    did,
+		Handle: handle,
+		blobs:  make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.server.createSession", b.handleSession)
+	mux.HandleFunc("/xrpc/com.atproto.server.refreshSession", b.handleSession)
+	mux.HandleFunc("/xrpc/com.atproto.server.getSession", b.handleSession)
+	mux.HandleFunc("/xrpc/com.atproto.identity.resolveHandle", b.handleResolveHandle)
+	mux.HandleFunc("/xrpc/app.bsky.actor.getProfile", b.handleGetProfile)
+	mux.HandleFunc("/xrpc/com.atproto.repo.createRecord", b.handleCreateRecord)
+	mux.HandleFunc("/xrpc/com.atproto.repo.putRecord", b.handlePutRecord)
+	mux.HandleFunc("/xrpc/com.atproto.repo.deleteRecord", b.handleDeleteRecord)
+	mux.HandleFunc("/xrpc/com.atproto.repo.applyWrites", b.handleApplyWrites)
+	mux.HandleFunc("/xrpc/com.atproto.repo.getRecord", b.handleGetRecord)
+	mux.HandleFunc("/xrpc/com.atproto.repo.listRecords", b.handleListRecords)
+	mux.HandleFunc("/xrpc/com.atproto.repo.uploadBlob", b.handleUploadBlob)
+
+	b.Server = httptest.NewServer(b.wrap(mux))
+	return b
+}
+
+func (b *Bluesky) URL() string {
+	return b.Server.URL
+}
+
+func (b *Bluesky) Close() {
+	b.Server.Close()
+}
+
+/* Returns every record currently in the repo, in creation order. */
+func (b *Bluesky) Records() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := make([]Record, len(b.records))
+	copy(records, b.records)
+	return records
+}
+
+/* Makes the next n calls to the given XRPC method fail with the given HTTP
+ * status and XRPC error name. */
+func (b *Bluesky) FailNext(method string, status int, n int) {
+	b.faults.add("/xrpc/"+method, status, 0, n)
+}
+
+/* Makes the next n calls to the given XRPC method fail as being rate
+ * limited. */
+func (b *Bluesky) RateLimitNext(method string, retryAfter time.Duration, n int) {
+	b.faults.add("/xrpc/"+method, http.StatusTooManyRequests, retryAfter, n)
+}
+
+func (b *Bluesky) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		injected := b.faults.inject(w, r, func(status int) interface{} {
+			name := "InternalServerError"
+			switch status {
+			case http.StatusBadRequest:
+				name = "InvalidRequest"
+			case http.StatusUnauthorized:
+				name = "ExpiredToken"
+			case http.StatusTooManyRequests:
+				name = "RateLimitExceeded"
+			}
+			return xrpcError(name, http.StatusText(status))
+		})
+		if !injected {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func xrpcError(name string, message string) map[string]string {
+	return map[string]string{"error": name, "message": message}
+}
+
+/* Builds an unsigned JWT with the claims the clients look at. Nobody checks
+ * signatures on their own tokens, so this is enough to pass as a session. */
+func (b *Bluesky) token(scope string, ttl time.Duration) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"scope": scope,
+		"sub":   b.DID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(ttl).Unix(),
+	})
+	return enc.EncodeToString(header) + "." + enc.EncodeToString(claims) + "." + enc.EncodeToString([]byte("fake"))
+}
+
+func (b *Bluesky) handleSession(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"did":        b.DID,
+		"handle":     b.Handle,
+		"accessJwt":  b.token("com.atproto.appPass", 2*time.Hour),
+		"refreshJwt": b.token("com.atproto.refresh", 24*time.Hour),
+	})
+}
+
+func (b *Bluesky) handleResolveHandle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("handle") != b.Handle {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Unable to resolve handle"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"did": b.DID})
+}
+
+func (b *Bluesky) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	actor := r.URL.Query().Get("actor")
+	if actor != b.Handle && actor != b.DID {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Profile not found"))
+		return
+	}
+
+	b.mu.Lock()
+	posts := len(b.records)
+	b.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"did":            b.DID,
+		"handle":         b.Handle,
+		"displayName":    b.Handle,
+		"followersCount": 0,
+		"followsCount":   0,
+		"postsCount":     posts,
+	})
+}
+
+/* Record keys are timestamp-ish, same as the TIDs real PDSes generate. */
+func (b *Bluesky) nextRkey() string {
+	b.seq++
+	enc := base32.NewEncoding("234567abcdefghijklmnopqrstuvwxyz").WithPadding(base32.NoPadding)
+	raw := []byte(fmt.Sprintf("%016x", time.Now().UnixMicro()<<10|b.seq&0x3ff))
+	return enc.EncodeToString(raw)[:13]
+}
+
+func cidOf(value []byte) string {
+	sum := sha256.Sum256(value)
+	return "bafyrei" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))
+}
+
+type recordInput struct {
+	Repo       string          `json:"repo"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record"`
+}
+
+func (b *Bluesky) readRecordInput(w http.ResponseWriter, r *http.Request) (*recordInput, bool) {
+	var input recordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", err.Error()))
+		return nil, false
+	}
+	if input.Repo != b.DID && input.Repo != b.Handle {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Could not find repo"))
+		return nil, false
+	}
+	return &input, true
+}
+
+/* Stores a record, replacing any existing one under the same key. */
+func (b *Bluesky) put(collection string, rkey string, value []byte) Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if rkey == "" {
+		rkey = b.nextRkey()
+	}
+	record := Record{
+		URI:        fmt.Sprintf("at://%v/%v/%v", b.DID, collection, rkey),
+		CID:        cidOf(value),
+		Collection: collection,
+		Rkey:       rkey,
+		Value:      value,
+	}
+
+	for i := range b.records {
+		if b.records[i].URI == record.URI {
+			b.records[i] = record
+			return record
+		}
+	}
+	b.records = append(b.records, record)
+	return record
+}
+
+func (b *Bluesky) handleCreateRecord(w http.ResponseWriter, r *http.Request) {
+	input, ok := b.readRecordInput(w, r)
+	if !ok {
+		return
+	}
+
+	if input.Rkey != "" {
+		b.mu.Lock()
+		for _, record := range b.records {
+			if record.Collection == input.Collection && record.Rkey == input.Rkey {
+				b.mu.Unlock()
+				writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Record already exists"))
+				return
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	record := b.put(input.Collection, input.Rkey, input.Record)
+	writeJSON(w, http.StatusOK, map[string]string{"uri": record.URI, "cid": record.CID})
+}
+
+func (b *Bluesky) handlePutRecord(w http.ResponseWriter, r *http.Request) {
+	input, ok := b.readRecordInput(w, r)
+	if !ok {
+		return
+	}
+
+	record := b.put(input.Collection, input.Rkey, input.Record)
+	writeJSON(w, http.StatusOK, map[string]string{"uri": record.URI, "cid": record.CID})
+}
+
+func (b *Bluesky) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	input, ok := b.readRecordInput(w, r)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	for i, record := range b.records {
+		if record.Collection == input.Collection && record.Rkey == input.Rkey {
+			b.records = append(b.records[:i], b.records[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+/* Looks a record up, handing back its index in the repo, or -1. Needs mu
+ * held. */
+func (b *Bluesky) find(collection string, rkey string) int {
+	for i, record := range b.records {
+		if record.Collection == collection && record.Rkey == rkey {
+			return i
+		}
+	}
+	return -1
+}
+
+type repoWrite struct {
+	Type       string          `json:"$type"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Value      json.RawMessage `json:"value"`
+}
+
+/* Applies every write or none of them, same as the real thing, which fails
+ * the whole commit when a record to be created already exists. */
+func (b *Bluesky) handleApplyWrites(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Repo   string      `json:"repo"`
+		Writes []repoWrite `json:"writes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", err.Error()))
+		return
+	}
+	if input.Repo != b.DID && input.Repo != b.Handle {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Could not find repo"))
+		return
+	}
+
+	b.mu.Lock()
+	for _, write := range input.Writes {
+		if strings.HasSuffix(write.Type, "#create") && write.Rkey != "" && b.find(write.Collection, write.Rkey) >= 0 {
+			b.mu.Unlock()
+			writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", "Record already exists"))
+			return
+		}
+	}
+	b.mu.Unlock()
+
+	for _, write := range input.Writes {
+		if strings.HasSuffix(write.Type, "#delete") {
+			b.mu.Lock()
+			if i := b.find(write.Collection, write.Rkey); i >= 0 {
+				b.records = append(b.records[:i], b.records[i+1:]...)
+			}
+			b.mu.Unlock()
+			continue
+		}
+		b.put(write.Collection, write.Rkey, write.Value)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (b *Bluesky) handleGetRecord(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	b.mu.Lock()
+	i := b.find(query.Get("collection"), query.Get("rkey"))
+	var record Record
+	if i >= 0 {
+		record = b.records[i]
+	}
+	b.mu.Unlock()
+
+	if i < 0 {
+		writeJSON(w, http.StatusBadRequest, xrpcError("RecordNotFound", "Could not locate record"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uri":   record.URI,
+		"cid":   record.CID,
+		"value": record.Value,
+	})
+}
+
+/* Lists the records of a collection, newest first, all in a single page. */
+func (b *Bluesky) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	b.mu.Lock()
+	records := make([]interface{}, 0, limit)
+	for i := len(b.records) - 1; i >= 0 && len(records) < limit; i-- {
+		record := b.records[i]
+		if record.Collection != query.Get("collection") {
+			continue
+		}
+		records = append(records, map[string]interface{}{
+			"uri":   record.URI,
+			"cid":   record.CID,
+			"value": record.Value,
+		})
+	}
+	b.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"records": records})
+}
+
+func (b *Bluesky) handleUploadBlob(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, xrpcError("InvalidRequest", err.Error()))
+		return
+	}
+
+	cid := cidOf(data)
+	b.mu.Lock()
+	b.blobs[cid] = data
+	b.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"blob": map[string]interface{}{
+			"$type":    "blob",
+			"ref":      map[string]string{"$link": cid},
+			"mimeType": r.Header.Get("Content-Type"),
+			"size":     len(data),
+		},
+	})
+}
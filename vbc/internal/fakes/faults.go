@@ -0,0 +1,65 @@
+package fakes
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* A failure to be induced on requests to a given path. */
+type fault struct {
+	status     int
+	retryAfter time.Duration
+	remaining  int
+}
+
+/* Keeps track of the failures that should be induced on the fake servers, so
+ * retry and error handling paths can be exercised on purpose. */
+type faults struct {
+	mu     sync.Mutex
+	byPath map[string]*fault
+}
+
+func (f *faults) add(path string, status int, retryAfter time.Duration, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.byPath == nil {
+		f.byPath = make(map[string]*fault)
+	}
+	f.byPath[path] = &fault{
+		status:     status,
+		retryAfter: retryAfter,
+		remaining:  times,
+	}
+}
+
+/* Writes out an induced failure for the request, if there's one pending for
+ * its path, and reports whether it did so. */
+func (f *faults) inject(w http.ResponseWriter, r *http.Request, body func(status int) interface{}) bool {
+	f.mu.Lock()
+	ft, found := f.byPath[r.URL.Path]
+	if found {
+		ft.remaining--
+		if ft.remaining <= 0 {
+			delete(f.byPath, r.URL.Path)
+		}
+	}
+	f.mu.Unlock()
+
+	if !found {
+		return false
+	}
+
+	if ft.retryAfter > 0 {
+		seconds := int(ft.retryAfter.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", time.Now().Add(ft.retryAfter).UTC().Format(time.RFC3339))
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(ft.retryAfter).Unix(), 10))
+	}
+	writeJSON(w, ft.status, body(ft.status))
+	return true
+}
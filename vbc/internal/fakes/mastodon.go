@@ -0,0 +1,246 @@
+package fakes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* A canned status served by the fake Mastodon instance. Only the fields vbc
+ * looks at are modelled. */
+type Status struct {
+	ID          int64
+	Content     string
+	SpoilerText string
+	Visibility  string
+	Sensitive   bool
+	Language    string
+	InReplyTo   *int64
+	CreatedAt   time.Time
+	/* As glitch-soc and Hometown report it. */
+	LocalOnly bool
+}
+
+/* Fake Mastodon instance serving a single account, backed by httptest. */
+type Mastodon struct {
+	Server *httptest.Server
+
+	AccountID int64
+	Username  string
+
+	faults faults
+
+	mu       sync.Mutex
+	statuses map[int64]Status
+	nextID   int64
+}
+
+func NewMastodon(accountID int64, username string) *Mastodon {
+	m := &Mastodon{
+		AccountID: accountID,
+		Username:  username,
+		statuses:  make(map[int64]Status),
+		nextID:    100000,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/apps", m.handleApps)
+	mux.HandleFunc("/oauth/token", m.handleToken)
+	mux.HandleFunc("/api/v1/instance", m.handleInstance)
+	mux.HandleFunc("/api/v1/accounts/", m.handleAccounts)
+	mux.HandleFunc("/api/v1/statuses/", m.handleStatus)
+
+	m.Server = httptest.NewServer(m.wrap(mux))
+	return m
+}
+
+func (m *Mastodon) URL() string {
+	return m.Server.URL
+}
+
+func (m *Mastodon) Close() {
+	m.Server.Close()
+}
+
+/* Adds a status to the account and returns its ID. Zero IDs and timestamps
+ * are filled in automatically. */
+func (m *Mastodon) AddStatus(status Status) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if status.ID == 0 {
+		m.nextID++
+		status.ID = m.nextID
+	} else if status.ID > m.nextID {
+		m.nextID = status.ID
+	}
+	if status.CreatedAt.IsZero() {
+		status.CreatedAt = time.Now()
+	}
+	if status.Visibility == "" {
+		status.Visibility = "public"
+	}
+
+	m.statuses[status.ID] = status
+	return status.ID
+}
+
+func (m *Mastodon) RemoveStatus(id int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.statuses, id)
+}
+
+/* Makes the next n requests to path fail with the given HTTP status. */
+func (m *Mastodon) FailNext(path string, status int, n int) {
+	m.faults.add(path, status, 0, n)
+}
+
+/* Makes the next n requests to path fail as being rate limited. */
+func (m *Mastodon) RateLimitNext(path string, retryAfter time.Duration, n int) {
+	m.faults.add(path, http.StatusTooManyRequests, retryAfter, n)
+}
+
+func (m *Mastodon) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		injected := m.faults.inject(w, r, func(status int) interface{} {
+			return map[string]string{"error": http.StatusText(status)}
+		})
+		if !injected {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (m *Mastodon) handleApps(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"id":            "1",
+		"name":          r.FormValue("client_name"),
+		"redirect_uri":  r.FormValue("redirect_uris"),
+		"client_id":     "fake-client-id",
+		"client_secret": "fake-client-secret",
+	})
+}
+
+func (m *Mastodon) handleToken(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "fake-access-token",
+		"token_type":   "Bearer",
+		"scope":        r.FormValue("scope"),
+		"created_at":   time.Now().Unix(),
+	})
+}
+
+func (m *Mastodon) handleInstance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uri":     strings.TrimPrefix(m.Server.URL, "http://"),
+		"title":   "Fake Mastodon",
+		"version": "4.2.0",
+	})
+}
+
+func (m *Mastodon) account() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           strconv.FormatInt(m.AccountID, 10),
+		"username":     m.Username,
+		"acct":         m.Username,
+		"display_name": m.Username,
+		"url":          fmt.Sprintf("%v/@%v", m.Server.URL, m.Username),
+		"created_at":   time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+}
+
+func (m *Mastodon) status(status Status) map[string]interface{} {
+	var inReplyTo interface{}
+	if status.InReplyTo != nil {
+		inReplyTo = strconv.FormatInt(*status.InReplyTo, 10)
+	}
+
+	return map[string]interface{}{
+		"id":                strconv.FormatInt(status.ID, 10),
+		"uri":               fmt.Sprintf("%v/users/%v/statuses/%v", m.Server.URL, m.Username, status.ID),
+		"url":               fmt.Sprintf("%v/@%v/%v", m.Server.URL, m.Username, status.ID),
+		"account":           m.account(),
+		"in_reply_to_id":    inReplyTo,
+		"content":           status.Content,
+		"spoiler_text":      status.SpoilerText,
+		"visibility":        status.Visibility,
+		"sensitive":         status.Sensitive,
+		"language":          status.Language,
+		"local_only":        status.LocalOnly,
+		"created_at":        status.CreatedAt.UTC().Format(time.RFC3339Nano),
+		"media_attachments": []interface{}{},
+		"mentions":          []interface{}{},
+		"tags":              []interface{}{},
+	}
+}
+
+func (m *Mastodon) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/accounts/"), "/"), "/")
+	if parts[0] != strconv.FormatInt(m.AccountID, 10) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Record not found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, m.account())
+		return
+	}
+	if len(parts) != 2 || parts[1] != "statuses" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Not found"})
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	sinceID, _ := strconv.ParseInt(r.URL.Query().Get("since_id"), 10, 64)
+	maxID, _ := strconv.ParseInt(r.URL.Query().Get("max_id"), 10, 64)
+
+	m.mu.Lock()
+	statuses := make([]Status, 0, len(m.statuses))
+	for _, status := range m.statuses {
+		if status.ID <= sinceID || (maxID != 0 && status.ID >= maxID) {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	m.mu.Unlock()
+
+	/* Newest first, same as the real thing. */
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID > statuses[j].ID })
+	if len(statuses) > limit {
+		statuses = statuses[:limit]
+	}
+
+	body := make([]interface{}, 0, len(statuses))
+	for _, status := range statuses {
+		body = append(body, m.status(status))
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (m *Mastodon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/"), "/"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Record not found"})
+		return
+	}
+
+	m.mu.Lock()
+	status, found := m.statuses[id]
+	m.mu.Unlock()
+
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Record not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, m.status(status))
+}
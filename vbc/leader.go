@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Only extend or release the lock if we still hold it. */
+const (
+	leaderRenewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	leaderFreeScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+/* A lease on a Redis key, used so that several replicas of vbc can run side by
+ * side while only one of them publishes to Bluesky. Whoever holds the key is
+ * the leader, and the lease is renewed well before it expires. If the leader
+ * dies, the key times out and one of the standbys picks it up. */
+type leaderLock struct {
+	rc    *redisClient
+	key   string
+	token string
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	leading bool
+	/* When the lease we last got runs out, counting from when we asked for
+	 * it, as Redis may have started counting any time after. */
+	expires time.Time
+}
+
+func newLeaderLock(rc *redisClient, key string, ttl time.Duration) *leaderLock {
+	hostname, _ := os.Hostname()
+
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	return &leaderLock{
+		rc:    rc,
+		key:   key,
+		token: hostname + "-" + hex.EncodeToString(nonce),
+		ttl:   ttl,
+	}
+}
+
+/* Leading reports whether this process currently holds the lock. A nil lock
+ * means leader election is disabled, in which case we're always the leader.
+ * Should a renewal not have made it before the lease ran out, we're not, as
+ * someone else may be by then. */
+func (l *leaderLock) Leading() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading && time.Now().Before(l.expires)
+}
+
+/* WaitLeading blocks until this process becomes the leader. */
+func (l *leaderLock) WaitLeading(ctx context.Context) error {
+	for !l.Leading() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+	return nil
+}
+
+/* Run keeps trying to acquire or renew the lock until the context is done,
+ * at which point the lock is released if we hold it. */
+func (l *leaderLock) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		l.tick()
+
+		select {
+		case <-ctx.Done():
+			l.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *leaderLock) tick() {
+	ttl := l.ttl.Milliseconds()
+	l.mu.Lock()
+	leading := l.leading
+	l.mu.Unlock()
+
+	/* Each try gets until the next one, well before the lease runs out,
+	 * rather than as long as Redis may take to answer, which can be longer
+	 * than the lease. */
+	asked := time.Now()
+	deadline := asked.Add(l.ttl / 3)
+
+	var held bool
+	if leading {
+		reply, err := l.rc.DoBefore(deadline, "EVAL", leaderRenewScript, "1", l.key, l.token, strconv.FormatInt(ttl, 10))
+		if err != nil {
+			log.Printf("WARNING: could not renew leader lock %v: %v", l.key, err)
+		}
+		held = err == nil && reply == int64(1)
+	} else {
+		reply, err := l.rc.DoBefore(deadline, "SET", l.key, l.token, "NX", "PX", strconv.FormatInt(ttl, 10))
+		if err != nil {
+			log.Printf("WARNING: could not acquire leader lock %v: %v", l.key, err)
+		}
+		held = err == nil && reply == "OK"
+	}
+
+	if held != leading {
+		if held {
+			log.Printf("leader: acquired lock %v as %v, now publishing", l.key, l.token)
+		} else {
+			log.Printf("leader: lost lock %v, standing by", l.key)
+		}
+	}
+
+	l.mu.Lock()
+	l.leading = held
+	l.expires = asked.Add(l.ttl)
+	l.mu.Unlock()
+}
+
+func (l *leaderLock) release() {
+	if !l.Leading() {
+		return
+	}
+
+	_, err := l.rc.Do("EVAL", leaderFreeScript, "1", l.key, l.token)
+	if err != nil {
+		log.Printf("WARNING: could not release leader lock %v: %v", l.key, err)
+	}
+
+	l.mu.Lock()
+	l.leading = false
+	l.mu.Unlock()
+}
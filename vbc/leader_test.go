@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/* A leader whose Redis stops answering has to stand down before its lease
+ * runs out, rather than once Redis gets around to timing out, by which time
+ * someone else may have taken over. */
+func TestLeaderStandsDownBeforeLeaseRunsOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+	/* Takes connections, and never says a thing on them. */
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	rc, err := dialRedis("redis://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer rc.Close()
+
+	ttl := 3 * time.Second
+	l := newLeaderLock(rc, "vbc:leader", ttl)
+	l.leading, l.expires = true, time.Now().Add(ttl)
+
+	started := time.Now()
+	l.tick()
+	if took := time.Since(started); took >= ttl/2 {
+		t.Errorf("renewing took %v, with a lease of %v", took, ttl)
+	}
+	if l.Leading() {
+		t.Errorf("still leading without having renewed")
+	}
+
+	/* Nor does a lease that ran out without a word from Redis count. */
+	l.leading, l.expires = true, time.Now().Add(-time.Millisecond)
+	if l.Leading() {
+		t.Errorf("still leading once the lease ran out")
+	}
+}
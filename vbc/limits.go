@@ -0,0 +1,89 @@
+package main
+
+import (
+	"unicode/utf8"
+)
+
+/* How long posts can be on a sink, for texts to be fit into them. */
+type sinkLimits struct {
+	/* What the sink is called, for saying what a post is over the limit
+	 * of. */
+	Name string
+	/* How long a post can be, as Count counts. */
+	Length int
+	/* How long a link counts as, however long it is, on sinks that shorten
+	 * links themselves. 0 when links count as they are. */
+	LinkLength int
+}
+
+var (
+	/* Bluesky counts graphemes, we count runes, which is never less. */
+	BlueskyLimits = sinkLimits{Name: "Bluesky", Length: PostLengthLimit}
+	/* X puts every link through t.co. */
+	XLimits = sinkLimits{Name: "X", Length: 280, LinkLength: 23}
+	/* As long as statuses get on most instances, which count every link
+	 * the same as well. */
+	MastodonLimits = sinkLimits{Name: "Mastodon", Length: 500, LinkLength: 23}
+)
+
+/* How long text counts as, and how many of its runes fit in a post. Links
+ * are never cut in half, so they either fit whole or not at all. */
+func (l sinkLimits) measure(text string) (int, int) {
+	var links [][]int
+	if l.LinkLength > 0 {
+		links = linkRe.FindAllStringIndex(text, -1)
+	}
+
+	length, fit := 0, 0
+	fits := true
+	take := func(counts int, runes int) {
+		length += counts
+		if fits && length <= l.Length {
+			fit += runes
+		} else {
+			fits = false
+		}
+	}
+	for i := 0; i < len(text); {
+		if len(links) > 0 && links[0][0] == i {
+			take(l.LinkLength, utf8.RuneCountInString(text[i:links[0][1]]))
+			i = links[0][1]
+			links = links[1:]
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		take(1, 1)
+		i += size
+	}
+	return length, fit
+}
+
+/* How long text counts as on the sink. */
+func (l sinkLimits) Count(text string) int {
+	length, _ := l.measure(text)
+	return length
+}
+
+/* How many of the runes text starts with fit in a post, at least one, so
+ * anything split by it always gets somewhere. */
+func (l sinkLimits) Fit(text string) int {
+	_, fit := l.measure(text)
+	if fit < 1 {
+		return 1
+	}
+	return fit
+}
+
+/* The same limits, for posts only room long. */
+func (l sinkLimits) Within(room int) sinkLimits {
+	l.Length = room
+	return l
+}
+
+/* Cuts text down to fit in a post, ending it with an ellipsis. */
+func (l sinkLimits) Truncate(text string) string {
+	if l.Count(text) <= l.Length {
+		return text
+	}
+	return truncateText(text, l.Fit(text))
+}
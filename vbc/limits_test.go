@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/* Posts for X split at 280, with every link counted as the 23 of a t.co
+ * one, however long it really is. */
+func TestSplitTextX(t *testing.T) {
+	link := "https://example.com/" + strings.Repeat("a", 100)
+	short := strings.Repeat("word ", 50) + link
+	if length := XLimits.Count(short); length != 250+23 {
+		t.Fatalf("%q counts as %v rather than 273", short, length)
+	}
+	if parts := splitText(short, XLimits); len(parts) != 1 {
+		t.Errorf("text with a long link that fits split into %v parts", len(parts))
+	}
+
+	long := strings.Repeat("word ", 120) + link
+	parts := splitText(long, XLimits)
+	if len(parts) != 3 {
+		t.Fatalf("split into %v parts rather than 3: %q", len(parts), parts)
+	}
+	for i, part := range parts {
+		if length := XLimits.Count(part); length > 280 {
+			t.Errorf("part %v is %v long, over 280", i, length)
+		}
+	}
+	/* Split at the last space that fits, rather than anywhere earlier. */
+	if length := XLimits.Count(parts[0]); length != 279 {
+		t.Errorf("first part is %v long rather than 279", length)
+	}
+	if joined := strings.Join(parts, " "); joined != strings.TrimSpace(long) {
+		t.Errorf("parts don't add up to the text: %q", joined)
+	}
+}
+
+/* Replies on Mastodon split at 500, with every link counted as 23, however
+ * long it really is. */
+func TestSplitTextMastodon(t *testing.T) {
+	link := "https://example.com/" + strings.Repeat("a", 100)
+	short := strings.Repeat("word ", 95) + link
+	if length := MastodonLimits.Count(short); length != 475+23 {
+		t.Fatalf("%q counts as %v rather than 498", short, length)
+	}
+	if parts := splitText(short, MastodonLimits); len(parts) != 1 {
+		t.Errorf("text with a long link that fits split into %v parts", len(parts))
+	}
+
+	long := strings.Repeat("word ", 210) + link
+	parts := splitText(long, MastodonLimits)
+	if len(parts) != 3 {
+		t.Fatalf("split into %v parts rather than 3: %q", len(parts), parts)
+	}
+	for i, part := range parts {
+		if length := MastodonLimits.Count(part); length > 500 {
+			t.Errorf("part %v is %v long, over 500", i, length)
+		}
+	}
+	/* Split at the last space that fits, rather than anywhere earlier. */
+	if length := MastodonLimits.Count(parts[0]); length != 499 {
+		t.Errorf("first part is %v long rather than 499", length)
+	}
+	if joined := strings.Join(parts, " "); joined != strings.TrimSpace(long) {
+		t.Errorf("parts don't add up to the text: %q", joined)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	/* How much of a page gets read looking for what to put on its card. The
+	 * tags we want are in the head, which is never this big. */
+	LinkCardReadLimit = 512 << 10
+	LinkCardTimeout   = 10 * time.Second
+	/* Thumbnails bigger than this are left off, the card does fine without
+	 * one. */
+	LinkCardThumbLimit = 5 << 20
+
+	/* Bluesky doesn't show more than this much of either. */
+	LinkCardTitleLimit       = 300
+	LinkCardDescriptionLimit = 1000
+)
+
+var linkRe = regexp.MustCompile(`https?://[^\s<>"]+[^\s<>".,;:!?)\]'\x{201D}\x{2019}]`)
+
+/* A card showing what a link points to, see app.bsky.embed.external. */
+type linkCard struct {
+	URI         string `json:"uri"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	/* Filled in from thumb once it's been uploaded, see dropUnmirrored. */
+	Thumb json.RawMessage `json:"thumb,omitempty"`
+
+	thumb  *embedImage
+	source *cardSource
+}
+
+/* Where what's on a card came from, written down along with the mapping, so
+ * it can be told why a card came out the way it did, and it can be made
+ * again. The fields other than the link and page name the tags they were
+ * read from, such as og:title, with <title> for the title of the page. */
+type cardSource struct {
+	Link string `json:"link"`
+	/* Where the page ended up being fetched from, after redirects. */
+	Page        string    `json:"page"`
+	Fetched     time.Time `json:"fetched"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	/* Where the thumbnail came from, when the card has one. */
+	Thumb string `json:"thumb,omitempty"`
+}
+
+/* Gives every post that has a link and no images a card for its first link,
+ * the way the Bluesky app does when posting by hand. Pages that can't be
+ * fetched just don't get a card, they're never worth failing a post over. */
+func attachLinkCards(ctx context.Context, posts []*postRecord, config TransformConfig) {
+	if config.Links == LinksPlain {
+		return
+	}
+
+	timeout := LinkCardTimeout
+	if config.CardTimeout != "" {
+		if t, err := time.ParseDuration(config.CardTimeout); err == nil {
+			timeout = t
+		}
+	}
+	thumbLimit := int64(LinkCardThumbLimit)
+	if config.CardThumbSize != nil {
+		thumbLimit = int64(*config.CardThumbSize)
+	}
+
+	for _, post := range posts {
+		if post.Embed != nil {
+			continue
+		}
+		link := post.cardLink
+		if link == "" && len(post.Facets) > 0 {
+			link = post.Facets[0].Features[0].URI
+		}
+		if link == "" {
+			continue
+		}
+
+		card, err := fetchLinkCard(ctx, link, timeout)
+		if err != nil {
+			log.Printf("WARNING: no card for %v: %v", link, err)
+			/* Without its card, a post that was only going to be a card
+			 * needs the link as its text. */
+			if post.cardLink != "" && post.Text == "" {
+				post.Text = link
+				post.Facets = linkFacets(link, map[string]string{})
+			}
+			continue
+		}
+		if card.thumb != nil {
+			card.thumb.timeout = timeout
+			card.thumb.limit = thumbLimit
+		}
+		post.Embed = &postEmbed{
+			LexiconTypeID: "app.bsky.embed.external",
+			External:      card,
+		}
+	}
+}
+
+/* Reads the title, description and image of a page from its OpenGraph tags,
+ * falling back to its <title> and description when it has none. Pages with
+ * no description at all get their title as one, so the card always says
+ * something to those who can't see its thumbnail. */
+func fetchLinkCard(ctx context.Context, link string, timeout time.Duration) (*linkCard, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+	if mimeType, _, _ := strings.Cut(res.Header.Get("Content-Type"), ";"); strings.TrimSpace(mimeType) != "text/html" {
+		return nil, errors.New(fmt.Sprintf("not a page, but %q", mimeType))
+	}
+
+	meta, title := readPageMeta(io.LimitReader(res.Body, LinkCardReadLimit))
+	if _, found := meta[PageTitleTag]; !found {
+		meta[PageTitleTag] = title
+	}
+	source := &cardSource{
+		Link:    link,
+		Page:    res.Request.URL.String(),
+		Fetched: time.Now().UTC(),
+	}
+	card := &linkCard{URI: link, source: source}
+	card.Title, source.Title = firstMeta(meta, "og:title", "twitter:title", PageTitleTag)
+	card.Description, source.Description = firstMeta(meta,
+		"og:description", "twitter:description", "description",
+		"og:title", "twitter:title", PageTitleTag)
+	card.Title = truncateText(strings.TrimSpace(card.Title), LinkCardTitleLimit)
+	card.Description = truncateText(strings.TrimSpace(card.Description), LinkCardDescriptionLimit)
+	if card.Title == "" && card.Description == "" {
+		return nil, errors.New("page has no title or description")
+	}
+
+	/* Relative image URLs are relative to wherever we ended up. */
+	if image, _ := firstMeta(meta, "og:image", "twitter:image"); image != "" {
+		if ref, err := res.Request.URL.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			card.thumb = &embedImage{
+				source:    ref.String(),
+				thumbnail: true,
+			}
+			source.Thumb = ref.String()
+		}
+	}
+	return card, nil
+}
+
+/* Where the cards of the posts came from, leaving out thumbnails that didn't
+ * make it. */
+func cardSources(posts []*postRecord) []cardSource {
+	var sources []cardSource
+	for _, post := range posts {
+		if post.Embed == nil || post.Embed.External == nil || post.Embed.External.source == nil {
+			continue
+		}
+		source := *post.Embed.External.source
+		if post.Embed.External.Thumb == nil {
+			source.Thumb = ""
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+/* What the title of a page goes by among its tags, see readPageMeta. */
+const PageTitleTag = "<title>"
+
+/* The first of the tags of a page that has something in it, along with which
+ * one it was. */
+func firstMeta(meta map[string]string, tags ...string) (string, string) {
+	for _, tag := range tags {
+		if value := meta[tag]; strings.TrimSpace(value) != "" {
+			return value, tag
+		}
+	}
+	return "", ""
+}
+
+/* Picks the <meta> tags and <title> out of the head of a page. */
+func readPageMeta(r io.Reader) (map[string]string, string) {
+	meta := make(map[string]string)
+	title := ""
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta, title
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.Data {
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = attr.Val
+					}
+				}
+				if _, found := meta[key]; key != "" && !found {
+					meta[key] = content
+				}
+			case "title":
+				inTitle = title == ""
+			case "body":
+				return meta, title
+			}
+		case html.TextToken:
+			if inTitle {
+				title += z.Token().Data
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
+
+/* Hosts whose links only ever redirect somewhere else. */
+var LinkShorteners = []string{
+	"t.co", "bit.ly", "buff.ly", "ow.ly", "tinyurl.com", "is.gd", "goo.gl",
+	"dlvr.it", "trib.al", "lnkd.in", "amzn.to", "shorturl.at", "rebrand.ly",
+}
+
+/* Query parameters that only tell a site where people came from. Anything
+ * starting with utm_ goes too. */
+var TrackingParams = []string{
+	"fbclid", "gclid", "dclid", "msclkid", "igshid", "mc_cid", "mc_eid",
+	"ref_src", "_hsenc", "_hsmi", "yclid",
+}
+
+/* How many redirects a short link may go through before we give up on it. */
+const UnshortenMaxHops = 5
+
+/* Resolves short links and strips tracking parameters from the links in
+ * text, as far as the config asks for either. Links that can't be resolved
+ * are left as they were. */
+func cleanLinks(text string, config TransformConfig) string {
+	unshorten := config.Unshorten != nil && *config.Unshorten
+	strip := config.StripTracking != nil && *config.StripTracking
+	if !unshorten && !strip {
+		return text
+	}
+
+	return linkRe.ReplaceAllStringFunc(text, func(link string) string {
+		if unshorten {
+			link = unshortenLink(link)
+		}
+		if strip {
+			link = stripTracking(link)
+		}
+		return link
+	})
+}
+
+/* Same as cleanLinks, for where segments link to. Those shown as where they
+ * go are shown as where they go once cleaned up. */
+func cleanSegmentLinks(segments []TextSegment, config TransformConfig) {
+	for i, segment := range segments {
+		if segment.Link == "" {
+			continue
+		}
+		link := cleanLinks(segment.Link, config)
+		if segment.Text == segment.Link {
+			segments[i].Text = link
+		}
+		segments[i].Link = link
+	}
+}
+
+func isShortener(host string) bool {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	for _, shortener := range LinkShorteners {
+		if host == shortener {
+			return true
+		}
+	}
+	return false
+}
+
+/* Follows the redirects of a short link for as long as they lead to other
+ * short links. */
+func unshortenLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || !isShortener(u.Host) {
+		return link
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), LinkCardTimeout)
+	defer cancel()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for hop := 0; hop < UnshortenMaxHops && isShortener(u.Host); hop++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+		if err != nil {
+			break
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			log.Printf("WARNING: could not resolve %v: %v", link, err)
+			break
+		}
+		res.Body.Close()
+
+		next, err := res.Location()
+		if err != nil {
+			break
+		}
+		u = next
+	}
+	return u.String()
+}
+
+func stripTracking(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery == "" {
+		return link
+	}
+
+	query := u.Query()
+	changed := false
+	for key := range query {
+		tracking := strings.HasPrefix(strings.ToLower(key), "utm_")
+		for _, param := range TrackingParams {
+			tracking = tracking || strings.EqualFold(key, param)
+		}
+		if tracking {
+			query.Del(key)
+			changed = true
+		}
+	}
+	if !changed {
+		return link
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+/* How much of the path of a link gets shown before it's cut short. */
+const LinkDisplayPathLimit = 15
+
+/* Shortens a link the way the Bluesky app shows it, with no scheme and only
+ * the start of the path. */
+func linkDisplayText(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+
+	rest := strings.TrimPrefix(link, u.Scheme+"://"+u.Host)
+	if rest == "/" {
+		rest = ""
+	}
+	if runes := []rune(rest); len(runes) > LinkDisplayPathLimit {
+		rest = string(runes[:LinkDisplayPathLimit-2]) + "…"
+	}
+	return u.Host + rest
+}
+
+/* Puts segments together into text, with links that are shown as something
+ * other than where they go put in links, so linkFacets can point them back
+ * to where they go. With shorten, links written out in full get shown as
+ * shorter text, unless that text is taken by another link. */
+func segmentsText(segments []TextSegment, links map[string]string, shorten bool) string {
+	var text strings.Builder
+	for _, segment := range segments {
+		shown := segment.Text
+		if segment.Link != "" && shorten && shown == segment.Link {
+			shown = linkDisplayText(segment.Link)
+		}
+		if segment.Link != "" && shown != segment.Link {
+			if uri, found := links[shown]; found && uri != segment.Link {
+				shown = segment.Link
+			} else {
+				links[shown] = segment.Link
+			}
+		}
+		text.WriteString(shown)
+	}
+	return text.String()
+}
+
+/* Finds the links in the text of a post, both those written out in full and
+ * those shortened by shortenLinks, and makes facets for them in order. */
+func linkFacets(text string, links map[string]string) []*richtextFacet {
+	var facets []*richtextFacet
+	taken := make([]bool, len(text))
+	mark := func(start int, end int, uri string) {
+		for i := start; i < end; i++ {
+			if taken[i] {
+				return
+			}
+		}
+		for i := start; i < end; i++ {
+			taken[i] = true
+		}
+		facets = append(facets, newLinkFacet(start, end, uri))
+	}
+
+	for _, match := range linkRe.FindAllStringIndex(text, -1) {
+		mark(match[0], match[1], text[match[0]:match[1]])
+	}
+	for display, uri := range links {
+		for offset := 0; ; {
+			i := strings.Index(text[offset:], display)
+			if i < 0 {
+				break
+			}
+			mark(offset+i, offset+i+len(display), uri)
+			offset += i + len(display)
+		}
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		return facets[i].Index.ByteStart < facets[j].Index.ByteStart
+	})
+	return facets
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Defaults for rotating the log file, when VBC_LOG_MAX_SIZE, VBC_LOG_MAX_AGE
+ * and VBC_LOG_KEEP aren't set. */
+const (
+	LogMaxSizeDefault = 10
+	LogMaxAgeDefault  = 24 * time.Hour
+	LogKeepDefault    = 7
+)
+
+/* Sends the log to VBC_LOG_FILE, when it's set, rather than to stderr. */
+func setupLogFile() error {
+	path := envOrNil("VBC_LOG_FILE")
+	if path == nil {
+		return nil
+	}
+
+	maxSize, err := strconv.ParseInt(envOrDefault("VBC_LOG_MAX_SIZE", strconv.Itoa(LogMaxSizeDefault)), 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("VBC_LOG_MAX_SIZE is not a number: %v", err))
+	}
+	maxAge, err := time.ParseDuration(envOrDefault("VBC_LOG_MAX_AGE", LogMaxAgeDefault.String()))
+	if err != nil {
+		return errors.New(fmt.Sprintf("VBC_LOG_MAX_AGE is not a valid duration: %v", err))
+	}
+	keep, err := strconv.Atoi(envOrDefault("VBC_LOG_KEEP", strconv.Itoa(LogKeepDefault)))
+	if err != nil {
+		return errors.New(fmt.Sprintf("VBC_LOG_KEEP is not a number: %v", err))
+	}
+
+	out, err := openRotatingLog(*path, maxSize<<20, maxAge, keep)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(out)
+	return nil
+}
+
+/* A log file that gets rotated once it grows past maxSize bytes, or once it's
+ * been written to for longer than maxAge, whichever comes first. Rotated
+ * files get a timestamp after their name and are compressed, with only the
+ * latest keep of them kept around. A maxSize or maxAge of 0 never rotates
+ * for that reason. */
+type rotatingLog struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	/* Compressing and pruning happen in the background, one at a time. */
+	cleanupMu sync.Mutex
+}
+
+func openRotatingLog(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingLog, error) {
+	l := &rotatingLog{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	/* Whatever was left uncompressed by an earlier run being stopped halfway
+	 * through gets taken care of now. */
+	go l.cleanup()
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize
+	old := l.maxAge > 0 && l.size > 0 && time.Since(l.opened) >= l.maxAge
+	if full || old {
+		/* Not being able to rotate is no reason to lose the log, so it
+		 * keeps going to the file it was going to. */
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: could not rotate %v: %v\n", l.path, err)
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *rotatingLog) rotate() error {
+	rotated := l.path + "." + time.Now().UTC().Format("20060102-150405.000")
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	renamed := os.Rename(l.path, rotated)
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renamed != nil {
+		return renamed
+	}
+
+	go l.cleanup()
+	return nil
+}
+
+/* The rotated files of the log, oldest first. */
+func (l *rotatingLog) rotatedFiles() ([]string, error) {
+	files, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := files[:0]
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".tmp") {
+			rotated = append(rotated, file)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+/* Compresses every rotated file that isn't yet, then removes all but the
+ * latest keep of them. */
+func (l *rotatingLog) cleanup() {
+	l.cleanupMu.Lock()
+	defer l.cleanupMu.Unlock()
+
+	files, err := l.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: could not list the rotated logs of %v: %v\n", l.path, err)
+		return
+	}
+	for i, file := range files {
+		if strings.HasSuffix(file, ".gz") {
+			continue
+		}
+		if err := compressFile(file); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: could not compress %v: %v\n", file, err)
+			continue
+		}
+		files[i] = file + ".gz"
+	}
+
+	if l.keep > 0 && len(files) > l.keep {
+		for _, file := range files[:len(files)-l.keep] {
+			if err := os.Remove(file); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: could not remove %v: %v\n", file, err)
+			}
+		}
+	}
+}
+
+/* Replaces file with a gzip compressed copy of it, named after it with .gz
+ * added. */
+func compressFile(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := file + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, file+".gz"); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(file)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* The key the state of a pair is under, that of its target, or the one from
+ * before there could be more than one when that's all there is, along with
+ * whether it's been bootstrapped at all. */
+func storedPairKey(ctx context.Context, store Store, pair accountPair) (AccountKey, bool, error) {
+	did, err := resolveHandle(ctx, http.DefaultClient, pair.Handle)
+	if err != nil {
+		return AccountKey{}, false, err
+	}
+	key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: did}
+	bootstrapped, err := store.HasAccount(key)
+	if err != nil || bootstrapped {
+		return key, bootstrapped, err
+	}
+
+	legacy := AccountKey{Instance: pair.Instance, ID: pair.AccountID}
+	if bootstrapped, err := store.HasAccount(legacy); err != nil {
+		return key, false, err
+	} else if bootstrapped {
+		return legacy, true, nil
+	}
+	return key, false, nil
+}
+
+/* Finds the status a post is part of through the index of the account,
+ * handing back which of its posts it is. */
+func findPostStatus(store Store, key AccountKey, uri string) (int64, *StatusMapping, int, error) {
+	id, err := store.PostStatus(key, uri)
+	if err != nil || id == 0 {
+		return 0, nil, 0, err
+	}
+	value, err := store.Mapping(key, id)
+	if err != nil || value == nil {
+		return 0, nil, 0, err
+	}
+	mapping, err := decodeMapping(value)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	for part, posted := range mappingPostURIs(value) {
+		if posted == uri {
+			return id, mapping, part, nil
+		}
+	}
+	return id, mapping, 0, nil
+}
+
+/* Prints what the store has on a status crossposted to a pair. */
+func printLookup(pair accountPair, id int64, mapping *StatusMapping, part int) {
+	fmt.Printf("%v on %v to @%v\n", pair.AccountID, pair.Instance, pair.Handle)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  mastodon\t%v/web/statuses/%v\n", pair.Instance, id)
+	if mapping.Uri != "" {
+		fmt.Fprintf(w, "  bluesky\t%v\n", blueskyPostURL(pair.Handle, mapping.Uri))
+		fmt.Fprintf(w, "  uri\t%v\n", mapping.Uri)
+	}
+	if part > 0 {
+		fmt.Fprintf(w, "  part\t%v of the thread\n", part+1)
+	}
+	fmt.Fprintf(w, "  state\t%v\n", mapping.State)
+	if mapping.Error != "" {
+		fmt.Fprintf(w, "  reason\t%v\n", mapping.Error)
+	}
+	if mapping.Parts > 0 {
+		fmt.Fprintf(w, "  posts\t%v\n", mapping.Parts)
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "  created\t%v\n", timestamp(mapping.Created))
+	fmt.Fprintf(w, "  updated\t%v\n", timestamp(mapping.Updated))
+	if mapping.Edited != nil {
+		fmt.Fprintf(w, "  edited\t%v\n", timestamp(*mapping.Edited))
+	}
+	if mapping.Revision != "" {
+		fmt.Fprintf(w, "  revision\t%v\n", mapping.Revision)
+	}
+	for _, card := range mapping.Cards {
+		fmt.Fprintf(w, "  card\t%v\n", card.Link)
+	}
+	for _, text := range mapping.Shadow {
+		fmt.Fprintf(w, "  would post\t%q\n", text)
+	}
+	_ = w.Flush()
+}
+
+func lookupCommand(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc lookup <status url or id | post url or at:// uri>\n\n")
+		fmt.Fprintf(fs.Output(), "Finds the other side of a crosspost: the post a status became on\n")
+		fmt.Fprintf(fs.Output(), "Bluesky, or the status a post on Bluesky was made from, printing the\n")
+		fmt.Fprintf(fs.Output(), "URLs of both and what the store has on it. Only the store is looked at,\n")
+		fmt.Fprintf(fs.Output(), "and it can be done while vbc is running.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	raw := fs.Arg(0)
+
+	var instance, repo, rkey string
+	var id int64
+	if r, k, ok := parseBlueskyPost(raw); ok {
+		repo, rkey = r, k
+	} else {
+		i, s, err := parseStatusURL(raw)
+		if err != nil {
+			log.Fatalf("%v is neither a status nor a post: %v", raw, err)
+		}
+		instance, id = i, s
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	found := 0
+	for _, pair := range config.Pairs() {
+		if rkey == "" && pair.Instance != instance {
+			continue
+		}
+		key, bootstrapped, err := storedPairKey(ctx, store, pair)
+		if err != nil {
+			log.Fatalf("could not look up account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err)
+		}
+		if !bootstrapped {
+			continue
+		}
+
+		var mapping *StatusMapping
+		part := 0
+		if rkey != "" {
+			/* Only state from before there could be more than one target
+			 * is kept without the DID. */
+			did := key.Target
+			if did == "" {
+				if did, err = resolveHandle(ctx, http.DefaultClient, pair.Handle); err != nil {
+					log.Fatalf("could not resolve @%v: %v", pair.Handle, err)
+				}
+			}
+			if !strings.EqualFold(repo, pair.Handle) && repo != did {
+				continue
+			}
+			uri := fmt.Sprintf("at://%v/%v/%v", did, PostCollection, rkey)
+			id, mapping, part, err = findPostStatus(store, key, uri)
+			if err != nil {
+				log.Fatalf("could not look up %v in the store of @%v: %v", uri, pair.Handle, err)
+			}
+		} else {
+			value, err := store.Mapping(key, id)
+			if err != nil {
+				log.Fatalf("could not look up mapping of %v: %v", raw, err)
+			}
+			if value != nil {
+				if mapping, err = decodeMapping(value); err != nil {
+					log.Fatalf("could not decode mapping of %v: %v", raw, err)
+				}
+			}
+		}
+		if mapping == nil {
+			continue
+		}
+
+		if found > 0 {
+			fmt.Println()
+		}
+		found++
+		printLookup(pair, id, mapping, part)
+	}
+
+	if found == 0 {
+		log.Fatalf("the store has nothing on %v", raw)
+	}
+}
@@ -3,252 +3,639 @@ package main
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/McKael/madon"
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
-	butil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/karalabe/go-bluesky"
-	bolt "go.etcd.io/bbolt"
-	"jaytaylor.com/html2text"
 )
 
 const (
 	AppName    = "@mbr@tiggi.es's Very Bad Crossposter"
 	AppWebsite = "https://lobisomem.gay"
+)
 
-	AppIdKey     = "`appId"
-	AppSecretKey = "`appSecret"
+const (
+	/* Statuses looked at on every poll, newest first. */
+	PollLimit = 20
+
+	/* How long after the time it was scheduled for a scheduled status may
+	 * show up. Mastodon publishes them in batches every few minutes, with
+	 * IDs going by the time they were scheduled for, so they can turn up
+	 * behind statuses that were posted in the meantime. */
+	ScheduledGrace = 15 * time.Minute
 )
 
 func main() {
-	ctx := context.Background()
+	ephemeral := flag.Bool("ephemeral", false,
+		"keep all state in memory, crossposting only what gets posted from now on")
+	flag.BoolVar(&pollOnce, "once", false,
+		"poll every account once, crosspost what turns up, then exit with a JSON status line")
+	registerSettingFlags(flag.CommandLine)
+	registerChaosFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	applySettingFlags(flag.CommandLine)
+
+	/* Settings kept in a secret manager go in the environment along with
+	 * the rest, for every command to find. */
+	if err := loadSecrets(); err != nil {
+		log.Fatalf("could not load secrets: %v", err)
+	}
+
+	/* Every client we use goes through the default transport, madon and
+	 * go-bluesky included. */
+	transport, err := bindTransport(http.DefaultTransport)
+	if err != nil {
+		log.Fatalf("could not connect from VBC_BIND_ADDR: %v", err)
+	}
+	if value := envOrNil("VBC_HOST_RATE_LIMIT"); value != nil {
+		limits, err := parseHostRateLimits(*value)
+		if err != nil {
+			log.Fatalf("VBC_HOST_RATE_LIMIT is not valid: %v", err)
+		}
+		transport = newBudgetTransport(transport, limits)
+	}
+	if chaos.Enabled() {
+		transport = newChaosTransport(transport)
+	}
+	http.DefaultTransport = newCacheTransport(newBreakerTransport(transport))
+
+	switch flag.Arg(0) {
+	case "":
+	case "run":
+		runCommand(flag.Args()[1:], *ephemeral)
+		return
+	case "render":
+		renderCommand(flag.Args()[1:])
+		return
+	case "preview":
+		previewCommand(flag.Args()[1:])
+		return
+	case "store":
+		storeCommand(flag.Args()[1:])
+		return
+	case "config":
+		configCommand(flag.Args()[1:])
+		return
+	case "setup":
+		setupCommand(flag.Args()[1:])
+		return
+	case "bsky-login":
+		blueskyLoginCommand(flag.Args()[1:])
+		return
+	case "bsky-client-metadata":
+		blueskyClientMetadataCommand(flag.Args()[1:])
+		return
+	case "import":
+		importCommand(flag.Args()[1:])
+		return
+	case "test-post":
+		testPostCommand(flag.Args()[1:])
+		return
+	case "repost":
+		repostCommand(flag.Args()[1:])
+		return
+	case "retry":
+		retryCommand(flag.Args()[1:])
+		return
+	case "pause":
+		pauseCommand(flag.Args()[1:])
+		return
+	case "backfill":
+		backfillCommand(flag.Args()[1:])
+		return
+	case "replay":
+		replayCommand(flag.Args()[1:])
+		return
+	case "delete":
+		deleteCommand(flag.Args()[1:])
+		return
+	case "export":
+		exportCommand(flag.Args()[1:])
+		return
+	case "lookup":
+		lookupCommand(flag.Args()[1:])
+		return
+	case "status":
+		statusCommand(flag.Args()[1:])
+		return
+	case "log":
+		logCommand(flag.Args()[1:])
+		return
+	case "audit":
+		auditCommand(flag.Args()[1:])
+		return
+	case "stats":
+		statsCommand(flag.Args()[1:])
+		return
+	case "debug":
+		debugCommand(flag.Args()[1:])
+		return
+	case "service":
+		serviceCommand(flag.Args()[1:])
+		return
+	case "version":
+		versionCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("unknown command %v", flag.Arg(0))
+	}
+
+	runDaemon(context.Background(), *ephemeral)
+}
+
+/* Runs the crossposter until every account has stopped, or until ctx is done,
+ * which is how a service gets stopped. */
+func runDaemon(ctx context.Context, ephemeral bool) {
+	if err := setupLogFile(); err != nil {
+		fatalf(ExitConfig, "could not open the log file: %v", err)
+	}
+	log.Printf("vbc %v", readBuildInfo())
 
-	instanceName := requireEnv("VBC_MASTODON_INSTANCE")
-	instanceName = canonicalizeInstanceName(instanceName)
-	log.Printf("Mastodon: using instance name %v", instanceName)
+	if problems := validateSettings(ephemeral); len(problems) > 0 {
+		log.Printf("found %v problem(s) with the configuration:", len(problems))
+		for _, problem := range problems {
+			log.Printf("    - %v", problem)
+		}
+		fatalf(ExitConfig, "fix the above and try again, see --help for the settings there are")
+	}
 
-	storeName := envOrDefault("VBC_STORE_FILE", "vbc.bolt")
-	db, err := bolt.Open(storeName, 0600, nil)
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		fatalf(ExitConfig, "could not load configuration: %v", err)
+	}
+	if err := setupTracing(ctx); err != nil {
+		fatalf(ExitConfig, "could not set up tracing: %v", err)
+	}
+	reporter, err := newErrorReporter()
 	if err != nil {
-		log.Fatalf("could not open store at %v: %v", storeName, err)
+		fatalf(ExitConfig, "could not set up error reporting: %v", err)
 	}
-	log.Printf("using bolt store at %v", storeName)
 
-	mastodonAppId := envOrNil("VBC_MASTODON_APP_ID")
-	mastodonAppSecret := envOrNil("VBC_MASTODON_APP_SECRET")
-	mc := initMastodonClient(db, instanceName, mastodonAppId, mastodonAppSecret)
+	verbose, _ = strconv.ParseBool(envOrDefault("VBC_VERBOSE", "false"))
+
+	if err := setupMediaCache(); err != nil {
+		fatalf(ExitConfig, "could not set up the media cache: %v", err)
+	}
 
-	bskyHandle := requireEnv("VBC_BSKY_HANDLE")
-	bskyAppKey := requireEnv("VBC_BSKY_APP_KEY")
-	bc := initBlueskyClient(ctx, bskyHandle, bskyAppKey)
+	if addr := envOrNil("VBC_METRICS_LISTEN"); addr != nil {
+		go serveMetrics(*addr)
+	}
 
-	/* Query for the account on Mastodon. */
-	mastodonAccountIdStr := requireEnv("VBC_MASTODON_ACCOUNT_ID")
-	mastodonAccountId, err := strconv.Atoi(mastodonAccountIdStr)
+	pollInterval, err := time.ParseDuration(envOrDefault("VBC_POLL_INTERVAL", "1s"))
 	if err != nil {
-		log.Fatalf("mastodon account ID is not an integer: %v", err)
+		fatalf(ExitConfig, "VBC_POLL_INTERVAL is not a valid duration: %v", err)
 	}
-	log.Printf("Mastodon: querying for user with ID %v", mastodonAccountId)
 
-	account, err := mc.GetAccount(int64(mastodonAccountId))
+	pauseAfter, err := strconv.Atoi(envOrDefault("VBC_PAUSE_AFTER", strconv.Itoa(PauseAfterDefault)))
 	if err != nil {
-		log.Fatalf("could not query for user with ID %v: %v", mastodonAccountId, err)
+		fatalf(ExitConfig, "VBC_PAUSE_AFTER is not a number: %v", err)
 	}
-	log.Printf("Mastodon: found account with handle @%v", account.Username)
 
-	/* Query for the user profile on Bluesky. */
-	log.Printf("Bluesky: fetching profile with handle @%v", bskyHandle)
-	bskyProfile, err := bc.FetchProfile(ctx, bskyHandle)
+	blueskyRateLimit, err := strconv.ParseFloat(envOrDefault("VBC_BSKY_RATE_LIMIT", strconv.Itoa(BlueskyRateLimitDefault)), 64)
 	if err != nil {
-		log.Fatalf("could not fetch profile with handle @%v: %v", bskyHandle, err)
+		fatalf(ExitConfig, "VBC_BSKY_RATE_LIMIT is not a number: %v", err)
 	}
 
-	err = handleAccount(ctx, db, mc, bc, instanceName, account, bskyProfile)
+	compactInterval, err := storeCompactInterval()
 	if err != nil {
-		log.Fatalf("account loop failed: %v", err)
+		fatalf(ExitConfig, "%v", err)
 	}
-}
 
-func handleAccount(
-	ctx context.Context,
-	db *bolt.DB,
-	mc *madon.Client,
-	bc *bluesky.Client,
-	instanceName string,
-	acct *madon.Account,
-	bskyProfile *bluesky.Profile) error {
-
-	userPostsKey := intToBoltKV(acct.ID)
-	transactWithUserPosts := func(
-		fn func(instance *bolt.Bucket, userPosts *bolt.Bucket) error,
-		update bool) error {
-
-		callback := func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(instanceName))
-			if bucket == nil {
-				log.Panicf("bucket with instance name should exist at this point")
+	var store Store
+	if ephemeral {
+		store = withChaos(newMemoryStore())
+	} else {
+		storeName := storeSpec()
+		var s Store
+		err := retryStartup(ctx, "open store", func() error {
+			opened, err := openStore(storeName)
+			s = opened
+			return err
+		})
+		if err != nil {
+			fatalf(ExitStore, "could not open store: %v", err)
+		}
+		store = withChaos(s)
+
+		/* Let `vbc store backup` and the commands that only look at the
+		 * store take snapshots while we're running, of the file of each
+		 * account too when they have their own, and keep them from
+		 * growing without end. */
+		var bs *boltStore
+		switch opened := s.(type) {
+		case *boltStore:
+			bs = opened
+		case *shardedStore:
+			bs = opened.boltStore
+			opened.opened = func(path string, shard *boltStore) {
+				go serveSnapshots(ctx, shard, backupSocketPath(path))
+				if compactInterval > 0 {
+					go compactStore(ctx, shard, compactInterval)
+				}
 			}
-
-			userPosts := bucket.Bucket(userPostsKey)
-			return fn(bucket, userPosts)
 		}
+		if bs != nil {
+			go serveSnapshots(ctx, bs, backupSocketPath(storeName))
+			go watchStoreStats(ctx, bs)
+			if compactInterval > 0 {
+				go compactStore(ctx, bs, compactInterval)
+			}
 
-		if update {
-			return db.Update(callback)
-		} else {
-			return db.View(callback)
+			/* Nothing else can write to a bolt file while we have it open,
+			 * so what we've read from it stays true until we write. */
+			store = newCachedStore(withChaos(s))
 		}
 	}
+	defer store.Close()
 
-	/* Check to see if we're bootstrapping this account. */
-	err := transactWithUserPosts(func(instance *bolt.Bucket, userPosts *bolt.Bucket) error {
-		if userPosts == nil {
-			log.Printf("bootstrapping account @%v", acct.Username)
-			userPosts, err := instance.CreateBucket(userPostsKey)
-			if err != nil {
-				return err
-			}
+	if addr := envOrNil("VBC_ADMIN_LISTEN"); addr != nil {
+		go serveAdmin(*addr, envOrDefault("VBC_ADMIN_TOKEN", ""), store)
+	}
 
-			statuses, err := mc.GetAccountStatuses(
-				acct.ID,
-				false,
-				false,
-				false,
-				&madon.LimitParams{All: true})
-			if err != nil {
-				return err
+	leader := initLeaderLock(ctx)
+
+	/* Let `vbc debug dump` and SIGUSR1 show what every account is up to. */
+	debugState.SetLeader(leader)
+	go serveDebugDumps(ctx, debugSocketPath())
+	watchDumpSignal(ctx)
+
+	/* Let commands that would otherwise need us stopped go through us. */
+	go serveControl(ctx, controlSocketPath(), store, config)
+
+	/* Every pair runs on its own, so one failing doesn't take the others
+	 * down with it. */
+	pairs := config.Pairs()
+	sessions := newSessionPool(store, blueskyRateLimit)
+	watchReloadSignal(ctx, sessions)
+	var wg sync.WaitGroup
+	var paused atomic.Int32
+	results := &pairResults{}
+	startPair := func(ctx context.Context, pair accountPair) {
+		wg.Add(1)
+		state := debugState.Pair(pair)
+		pairCtx, stop := context.WithCancel(ctx)
+		state.SetStop(stop)
+		go func() {
+			defer wg.Done()
+			defer stop()
+
+			err := runPair(pairCtx, store, sessions, leader, reporter, config, pair, pollInterval, pauseAfter, state)
+			if pairCtx.Err() != nil && ctx.Err() == nil && state.Paused() {
+				/* Paused with vbc pause. */
+				state.SetStatus("paused until vbc is restarted")
+				paused.Add(1)
+				log.Printf("paused crossposting account %v on %v to @%v until vbc is restarted, as asked to",
+					pair.AccountID,
+					pair.Instance,
+					pair.Handle)
+				metrics.Set("vbc_account_paused", "Whether crossposting an account has been paused.", 1,
+					"account", fmt.Sprintf("%v@%v", pair.AccountID, pair.Instance), "handle", pair.Handle)
+				return
 			}
-
-			for _, status := range statuses {
-				log.Printf("    ignore: post %v made in %v", status.URL, status.CreatedAt)
-				err = userPosts.Put(intToBoltKV(status.ID), []byte(`{ "cid": "", "uri": "" }`))
-				if err != nil {
-					return err
-				}
+			if pairCtx.Err() != nil && ctx.Err() == nil {
+				/* Handed off to another node, see serveAdmin. */
+				state.SetStatus("handed off until vbc is restarted")
+				return
 			}
-		}
+			results.Add(pair, err)
+			if err == nil && pollOnce {
+				state.SetStatus("done")
+				return
+			} else if err != nil && ctx.Err() != nil {
+				/* Asked to stop, rather than having failed. */
+				state.SetStatus("stopped")
+				return
+			} else if err != nil {
+				state.Failed(err)
+			}
+			var perr pausedError
+			if errors.As(err, &perr) {
+				state.SetStatus("paused until vbc is restarted")
+				paused.Add(1)
+				log.Printf("ERROR: paused crossposting account %v on %v to @%v until vbc is restarted: %v",
+					pair.AccountID,
+					pair.Instance,
+					pair.Handle,
+					err)
+				metrics.Set("vbc_account_paused", "Whether crossposting an account has been paused.", 1,
+					"account", fmt.Sprintf("%v@%v", pair.AccountID, pair.Instance), "handle", pair.Handle)
+				reporter.Report(err, "", fmt.Sprintf("%v@%v", pair.AccountID, pair.Instance))
+			} else if err != nil {
+				state.SetStatus("stopped")
+				log.Printf("ERROR: stopped crossposting account %v on %v to @%v: %v",
+					pair.AccountID,
+					pair.Instance,
+					pair.Handle,
+					err)
+				reporter.Report(err, "", fmt.Sprintf("%v@%v", pair.AccountID, pair.Instance))
+			}
+		}()
+	}
+	for _, pair := range pairs {
+		log.Printf("crossposting account %v on %v to @%v", pair.AccountID, pair.Instance, pair.Handle)
+		startPair(ctx, pair)
+	}
 
-		return nil
-	}, true)
-	if err != nil {
-		return err
+	/* Members come and go, so there's always something to crosspost as long
+	 * as there's a community. */
+	if config.Community != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchCommunity(ctx, config, store, startPair)
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("stopping")
+		return
 	}
 
-	/* Enter the loop handling user new posts. */
-	for {
-		statuses, err := mc.GetAccountStatuses(
-			acct.ID,
-			false,
-			false,
-			false,
-			&madon.LimitParams{Limit: 1})
-		if err != nil {
-			return err
-		}
+	if pollOnce {
+		code := results.Code()
+		printOnceStatus(onceStatus{Code: code, Accounts: results.Accounts()})
+		os.Exit(code)
+	}
 
-		for _, status := range statuses {
-			ignore := false
-			err = transactWithUserPosts(func(_ *bolt.Bucket, userPosts *bolt.Bucket) error {
-				ignore = userPosts.Get(intToBoltKV(status.ID)) != nil
-				return nil
-			}, false)
-			if err != nil {
-				return err
-			}
+	/* Paused accounts are waiting on someone to have a look, and exiting
+	 * would only have them restarted into failing again, same as handed off
+	 * ones would be into crossposting what's now crossposted elsewhere.
+	 * Whatever else is running, such as metrics, might still be of use in
+	 * the meantime. */
+	if paused.Load() > 0 || debugState.HandedOff() > 0 {
+		log.Printf("every account left is paused or handed off, waiting to be restarted")
+		<-ctx.Done()
+		log.Printf("stopping")
+		return
+	}
+	fatalf(results.Code(), "no accounts left to crosspost")
+}
 
-			if ignore {
-				continue
-			}
-			log.Printf("Mastodon: @%v has new status to repost: %v",
-				acct.Username,
-				status.URL)
+func repost(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	status *madon.Status,
+	extras *statusExtras,
+	bs *blueskySession,
+	bskyProfile *bluesky.Profile,
+	transform TransformConfig) (*StatusMapping, error) {
 
-			bskyPostId, err := repost(ctx, db, &status, bc, bskyProfile)
-			if err != nil {
-				log.Printf("ERROR: failed to repost %v to Bluesky: %v", status.URL, err)
-				break
-			}
+	posts, err := prepareRepost(ctx, store, key, status, extras, bskyProfile, transform)
+	if err != nil {
+		return nil, err
+	}
+	return publishRepost(ctx, store, key, status, posts, bs, bskyProfile, transform)
+}
 
-			err = transactWithUserPosts(func(_ *bolt.Bucket, userPosts *bolt.Bucket) error {
-				return userPosts.Put(intToBoltKV(status.ID), bskyPostId)
-			}, true)
-			if err != nil {
-				return err
+/* Turns a status into the posts it'll go up as, fetching whatever they link
+ * to along the way, but leaving Bluesky alone. */
+func prepareRepost(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	status *madon.Status,
+	extras *statusExtras,
+	bskyProfile *bluesky.Profile,
+	transform TransformConfig) ([]*postRecord, error) {
+
+	/* Going by what the instance says it allows, rather than what most
+	 * instances do. */
+	info := loadInstanceInfo(ctx, store, key.Instance)
+	if transform.CustomEmoji == CustomEmojiStrip {
+		status = info.WithoutCustomEmoji(status)
+	}
+
+	_, span := startSpan(ctx, "transform")
+	posts, err := transformStatus(status, extras, transform)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && info.ImageSizeLimit > MediaDownloadLimit {
+		for _, post := range posts {
+			if post.Embed == nil {
+				continue
+			}
+			for _, img := range post.Embed.Images {
+				if img.limit == 0 {
+					img.limit = info.ImageSizeLimit
+				}
 			}
 		}
+	}
 
-		time.Sleep(1000000000)
+	err = resolveSelfLinks(store, key, bskyProfile.Handle, posts, transform)
+	if err != nil {
+		return nil, err
 	}
+	attachLinkCards(ctx, posts, transform)
+	return posts, nil
+}
 
-	return nil
+/* What the posts prepareRepost made of a status would have been, for
+ * accounts in shadow mode. Self boosts come out with no posts at all, their
+ * crossposts being reposted rather than posted. */
+func shadowRepost(posts []*postRecord) *StatusMapping {
+	mapping := newMapping(MappingShadowed)
+	for _, post := range posts {
+		mapping.Shadow = append(mapping.Shadow, post.Text)
+	}
+	return &mapping
 }
 
-func repost(
+/* Puts the posts prepareRepost made of a status up on Bluesky, images first,
+ * handing back the mapping saying where they went. */
+func publishRepost(
 	ctx context.Context,
-	db *bolt.DB,
+	store Store,
+	key AccountKey,
 	status *madon.Status,
-	bc *bluesky.Client,
-	bskyProfile *bluesky.Profile) ([]byte, error) {
-
-	if status.InReplyToID != nil {
-		return nil, errors.New("statuses with replies are not supported")
+	posts []*postRecord,
+	bs *blueskySession,
+	bskyProfile *bluesky.Profile,
+	transform TransformConfig) (*StatusMapping, error) {
+
+	/* After losing the store, statuses crossposted before it was lost
+	 * would go up again, so look for them first. Edits, which have
+	 * mappings of their own, are past that. */
+	if transform.MatchExisting != nil && *transform.MatchExisting {
+		if existing, err := findExistingPost(ctx, store, key, bs, bskyProfile.DID, status); err != nil {
+			log.Printf("WARNING: Bluesky: could not look for a post of %v already up, posting it: %v", status.URL, err)
+		} else if existing != nil {
+			log.Printf("Bluesky: %v is up already as %v, not posting it again", status.URL, existing.Uri)
+			mapping := newPostedMapping(existing.Uri, existing.Cid)
+			mapping.Revision = statusRevision(status)
+			return &mapping, nil
+		}
 	}
-	if len(status.MediaAttachments) != 0 {
-		return nil, errors.New("statuses with attachments are not supported")
+
+	/* Upload the images before any of the posts that show them go up. */
+	err := uploadImages(ctx, store, bs, bskyProfile.DID, posts, transform.Crop)
+	if err != nil {
+		return nil, err
 	}
+	posts = dropUnmirrored(posts, status.URL)
 
-	/* Try to render out the HTML we get from Mastodon into plain text. */
-	text := status.Content
-	pretty, err := html2text.FromString(text, html2text.Options{PrettyTables: true})
-	if err == nil {
-		text = pretty
+	/* Replies go under what they reply to, which is only ever up by now,
+	 * the publisher going one status at a time, in order. Gates only go on
+	 * posts that start threads. */
+	threadgate := transform.Threadgate
+	reply, err := replyRef(ctx, store, key, bs, bskyProfile.DID, status)
+	if err != nil {
+		return nil, err
+	}
+	if reply != nil && len(posts) > 0 {
+		posts[0].Reply = reply
+		threadgate = nil
+	}
+	if verbose {
+		log.Printf("%v: %v", status.URL, summarizeTransform(status, posts))
 	}
 
-	/* Build the post. */
-	timestamp := status.CreatedAt
-	post := bsky.FeedPost{
-		Text:      text,
-		CreatedAt: timestamp.Format(time.RFC3339),
+	/* Threads go up all at once, so a failure halfway through doesn't leave
+	 * half of one behind, and so do posts with gates, so none of them is
+	 * ever up without the reply and quote settings it was meant to have. */
+	var root *atproto.RepoPutRecord_Output
+	if len(posts) > 1 || threadgate != nil || hasPostgate(transform.Quotes) {
+		root, err = putThread(ctx, bs, bskyProfile.DID, status, posts, recordShapeFor(transform), threadgate, transform.Quotes)
+		if errors.Is(err, errThreadExists) {
+			log.Printf("Bluesky: %v is up already, putting it over post by post", status.URL)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if root == nil {
+		root, err = putPosts(ctx, bs, bskyProfile.DID, status, posts, recordShapeFor(transform), threadgate, transform.Quotes)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	/* Pick the collection we're gonna post to. */
-	collection := "app.bsky.feed.post"
+	/* The posts are up either way, so this isn't worth failing over. */
+	if err := rememberBlobs(store, bskyProfile.DID, posts); err != nil {
+		log.Printf("WARNING: could not remember uploaded images: %v", err)
+	}
 
-	/* Post to Bluesky. */
-	input := atproto.RepoCreateRecord_Input{
-		Collection: collection,
-		Record:     &butil.LexiconTypeDecoder{Val: &post},
-		Repo:       bskyProfile.DID,
+	mapping := newPostedMapping(root.Uri, root.Cid)
+	mapping.Cards = cardSources(posts)
+	mapping.Parts = len(posts)
+	mapping.Revision = statusRevision(status)
+	if reply != nil {
+		mapping.Root = reply.Root.Uri
+		mapping.RootCid = reply.Root.Cid
 	}
-	var output *atproto.RepoCreateRecord_Output
-	err = bc.CustomCall(func(client *xrpc.Client) error {
-		o, err := atproto.RepoCreateRecord(ctx, client, &input)
+	return &mapping, nil
+}
+
+/* Puts the posts of a status one after the other. Anything after the first
+ * post goes in as a reply to the one before it, with the first one as the
+ * root of the thread, unless it replies to a thread of its own already. */
+func putPosts(
+	ctx context.Context,
+	bs *blueskySession,
+	did string,
+	status *madon.Status,
+	posts []*postRecord,
+	shape recordShape,
+	threadgate []string,
+	quotes string) (*atproto.RepoPutRecord_Output, error) {
+
+	var root *atproto.RepoPutRecord_Output
+	var parent *atproto.RepoPutRecord_Output
+	for i, post := range posts {
+		if root != nil {
+			threadRoot := &atproto.RepoStrongRef{Cid: root.Cid, Uri: root.Uri}
+			if posts[0].Reply != nil {
+				threadRoot = posts[0].Reply.Root
+			}
+			post.Reply = &bsky.FeedPost_ReplyRef{
+				Root:   threadRoot,
+				Parent: &atproto.RepoStrongRef{Cid: parent.Cid, Uri: parent.Uri},
+			}
+		}
+
+		record, err := shape.Record(post)
+		if err != nil {
+			return nil, err
+		}
+
+		/* Put rather than create, so posting the same status twice lands on
+		 * the same record. */
+		var output *atproto.RepoPutRecord_Output
+		rkey := statusRkey(status, i)
+		ctx, span := startSpan(ctx, "put-record", "bluesky.rkey", rkey)
+		err = bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			o, err := putRawRecord(ctx, client, did, shape.Collection, rkey, record)
+			if err != nil {
+				return err
+			}
+			output = o
+			return nil
+		})
+		span.End(err)
 		if err != nil {
+			return nil, err
+		}
+		log.Printf("Bluesky: reposted to %v", output.Uri)
+
+		if root == nil {
+			root = output
+		}
+		parent = output
+	}
+
+	/* Gate replies to the whole thread, if we were asked to. */
+	if threadgate != nil {
+		gate := threadgateRecord(root.Uri, threadgate, posts[0].CreatedAt)
+		ctx, span := startSpan(ctx, "threadgate")
+		err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			_, err := putRawRecord(ctx, client, did, ThreadgateCollection, statusRkey(status, 0), gate)
 			return err
+		})
+		span.End(err)
+		if err != nil {
+			return nil, err
 		}
-		output = o
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	log.Printf("Bluesky: reposted to %v", output.Uri)
 
-	record, err := json.Marshal(output)
-	if err != nil {
-		return nil, err
+	/* Keep it from being quoted, if we were asked to. */
+	if hasPostgate(quotes) {
+		gate := postgateRecord(root.Uri, posts[0].CreatedAt)
+		ctx, span := startSpan(ctx, "postgate")
+		err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			_, err := putRawRecord(ctx, client, did, PostgateCollection, statusRkey(status, 0), gate)
+			return err
+		})
+		span.End(err)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return record, nil
+	return root, nil
 }
 
 func intToBoltKV(val int64) []byte {
@@ -268,144 +655,84 @@ func boltKVToInt(kv []byte) (int64, error) {
 }
 
 func canonicalizeInstanceName(name string) string {
+	instance, err := parseInstanceName(name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return instance
+}
+
+/* Same as canonicalizeInstanceName, but for names given to us while running,
+ * which shouldn't take vbc down with them when they're wrong. Bare hosts, such
+ * as mastodon.social, are taken to be on HTTPS. */
+func parseInstanceName(name string) (string, error) {
+	if !strings.Contains(name, "://") {
+		name = "https://" + name
+	}
 	u, err := url.ParseRequestURI(name)
 	if err != nil {
-		log.Fatalf("could not parse instance name %v as a URL: %v", name, err)
+		return "", errors.New(fmt.Sprintf("could not parse instance name %v as a URL: %v", name, err))
 	}
 	if u.Opaque != "" {
-		log.Fatalf("no support for opaque URL: %v", u)
+		return "", errors.New(fmt.Sprintf("no support for opaque URL: %v", u))
+	}
+	if u.Host == "" {
+		return "", errors.New(fmt.Sprintf("instance name %v has no host", name))
+	}
+	/* Plain HTTP is only ever fine when talking to ourselves, such as when
+	 * running against the fakes in internal/fakes. */
+	if u.Scheme != "http" || !isLoopbackHost(u.Hostname()) {
+		u.Scheme = "https"
 	}
-	u.Scheme = "https"
 	u.Path = "/"
 	u.RawQuery = ""
 	u.RawFragment = ""
-	return u.String()
+	return u.String(), nil
 }
 
-func initBlueskyClient(ctx context.Context, handle string, appKey string) *bluesky.Client {
-	log.Printf("Bluesky: connecting to %v", bluesky.ServerBskySocial)
-	bc, err := bluesky.Dial(ctx, bluesky.ServerBskySocial)
-	if err != nil {
-		log.Fatalf("could not connect to %v: %v", bluesky.ServerBskySocial, err)
+func initLeaderLock(ctx context.Context) *leaderLock {
+	lockURL := envOrNil("VBC_LEADER_LOCK")
+	if lockURL == nil {
+		return nil
 	}
 
-	log.Printf("Bluesky: logging in as @%v", handle)
-	err = bc.Login(ctx, handle, appKey)
+	lockKey := envOrDefault("VBC_LEADER_KEY", "vbc:leader")
+	lockTTL, err := time.ParseDuration(envOrDefault("VBC_LEADER_TTL", "30s"))
 	if err != nil {
-		log.Fatalf("could not login to %v: %v", bluesky.ServerBskySocial, err)
+		log.Fatalf("VBC_LEADER_TTL is not a valid duration: %v", err)
 	}
-
-	return bc
-}
-
-func initMastodonClient(db *bolt.DB, instanceName string, appId, appSecret *string) *madon.Client {
-	var client *madon.Client
-
-	if appId != nil && appSecret != nil {
-		log.Printf("Mastodon: restoring client from environment variables")
-		mc, err := madon.RestoreApp(
-			AppName,
-			instanceName,
-			*appId,
-			*appSecret,
-			nil)
-		if err != nil {
-			log.Fatalf("could not restore client: %v", err)
-		}
-		client = mc
-	} else {
-		if appId != nil && appSecret == nil {
-			log.Printf("WARNING: VBC_MASTODON_APP_SECRET is not set when VCB_MASTODON_APP_ID is, ignoring.")
-		} else if appSecret != nil && appId == nil {
-			log.Printf("WARNING: VBC_MASTODON_APP_ID is not set when VCB_MASTODON_APP_SECRET is, ignoring.")
-		}
-
-		/* If we're already registered, don't register again. */
-		err := db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(instanceName))
-			if bucket == nil {
-				return nil
-			}
-
-			var appId []byte
-			var appSecret []byte
-
-			storedAppId := bucket.Get([]byte(AppIdKey))
-			storedAppSecret := bucket.Get([]byte(AppSecretKey))
-
-			if storedAppId != nil {
-				appId = copySlice[byte](storedAppId)
-			}
-			if storedAppSecret != nil {
-				appSecret = copySlice[byte](storedAppSecret)
-			}
-
-			if appId == nil || storedAppId == nil {
-				return nil
-			}
-
-			log.Printf("Mastodon: restoring client from store")
-			mc, err := madon.RestoreApp(
-				AppName,
-				instanceName,
-				string(appId),
-				string(appSecret),
-				nil)
-			if err != nil {
-				return err
-			}
-
-			client = mc
-			return nil
-		})
-		if err != nil {
-			log.Fatalf("could not restore client info from store: %v", err)
-		}
+	if lockTTL < 3*time.Second {
+		log.Fatalf("VBC_LEADER_TTL must be at least 3s, got %v", lockTTL)
 	}
 
-	/* We're gonna have to register our app. */
-	if client == nil {
-		log.Printf("Mastodon: creating client from new app")
-		mc, err := madon.NewApp(
-			AppName,
-			AppWebsite,
-			[]string{"read:statuses"},
-			madon.NoRedirect,
-			instanceName)
-		if err != nil {
-			log.Fatalf("could not register new app: %v", err)
-		}
+	var rc *redisClient
+	err = retryStartup(ctx, "connect to leader lock", func() error {
+		c, err := dialRedis(*lockURL)
+		rc = c
+		return err
+	})
+	if err != nil {
+		log.Fatalf("could not connect to leader lock: %v", err)
+	}
+	log.Printf("leader: using lock %v with a TTL of %v", lockKey, lockTTL)
 
-		/* Save it to the store. */
-		err = db.Update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte(instanceName))
-			if err != nil {
-				return err
-			}
+	leader := newLeaderLock(rc, lockKey, lockTTL)
+	go leader.Run(ctx)
 
-			err = bucket.Put([]byte(AppIdKey), []byte(mc.ID))
-			if err != nil {
-				return err
-			}
+	return leader
+}
 
-			err = bucket.Put([]byte(AppSecretKey), []byte(mc.Secret))
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-		if err != nil {
-			log.Printf("WARNING: App ID and secret could not be saved to the s-")
-			log.Printf("WARNING: tore. Please, use the following environment va-")
-			log.Printf("WARNING: riables going forward:")
-			log.Printf("WARNING:")
-			log.Printf("WARNING: VBC_MASTODON_APP_ID=\"%v\"", mc.ID)
-			log.Printf("WARNING: VBC_MASTODON_APP_SECRET=\"%v\"", mc.Secret)
-		}
-		client = mc
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	return client
+/* Where the store lives, as given by VBC_STORE or VBC_STORE_FILE. */
+func storeSpec() string {
+	return envOrDefault("VBC_STORE", envOrDefault("VBC_STORE_FILE", "vbc.bolt"))
 }
 
 func requireEnv(name string) string {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* Version of the mapping format below. Bump it whenever the format changes,
+ * and teach decodeMapping how to read the older one. */
+const MappingVersion = 1
+
+/* What became of a status. */
+const (
+	/* Crossposted, the post being where Uri points. */
+	MappingPosted = "posted"
+	/* Posted before the account was bootstrapped, so left alone. */
+	MappingIgnored = "ignored"
+	/* Not meant to be crossposted, for the reason in Error. */
+	MappingSkipped = "skipped"
+	/* Given up on after failing to be crossposted, see Error. */
+	MappingFailed = "failed"
+	/* Turned down by Bluesky over what's in it, for the reason in Error. */
+	MappingRejected = "rejected"
+	/* Crossposted, and since taken down on Bluesky. */
+	MappingDeleted = "deleted"
+	/* A boost of a status of our own, whose crosspost got reposted, the
+	 * repost being where Uri points. See publishSelfBoost. */
+	MappingReposted = "reposted"
+	/* Would have been crossposted, as the posts in Shadow, had the account
+	 * not been in shadow mode. See TransformConfig.Shadow. */
+	MappingShadowed = "shadowed"
+)
+
+/* What we did with a status, as kept in the store. Uri and Cid keep the names
+ * they had in the unversioned format, which was the raw output of putting
+ * the root post, or an empty one for statuses that never made it over. */
+type StatusMapping struct {
+	Version int       `json:"version"`
+	State   string    `json:"state"`
+	Uri     string    `json:"uri,omitempty"`
+	Cid     string    `json:"cid,omitempty"`
+	Rkey    string    `json:"rkey,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"`
+	/* Where the link cards of the posts came from, see cardSource. */
+	Cards []cardSource `json:"cards,omitempty"`
+	/* How many posts the status became, 0 when unknown. */
+	Parts int `json:"parts,omitempty"`
+	/* The version of the status last crossposted, see statusRevision, and
+	 * when an edit of it last made it over. */
+	Revision string     `json:"revision,omitempty"`
+	Edited   *time.Time `json:"edited,omitempty"`
+	/* The post the thread a crosspost replies in starts with, when it's a
+	 * reply of the author's to themselves, see replyRef. */
+	Root    string `json:"root,omitempty"`
+	RootCid string `json:"rootCid,omitempty"`
+	/* The text of every post a shadowed status would have become. */
+	Shadow []string `json:"shadow,omitempty"`
+}
+
+func newMapping(state string) StatusMapping {
+	now := time.Now().UTC()
+	return StatusMapping{
+		Version: MappingVersion,
+		State:   state,
+		Created: now,
+		Updated: now,
+	}
+}
+
+/* A mapping of a status that made it over, to the post at uri. */
+func newPostedMapping(uri string, cid string) StatusMapping {
+	m := newMapping(MappingPosted)
+	m.Uri = uri
+	m.Cid = cid
+	m.Rkey = uri[strings.LastIndex(uri, "/")+1:]
+	return m
+}
+
+/* Whether the status made it over, and is still there as far as we know. */
+func (m *StatusMapping) Posted() bool {
+	return m.State == MappingPosted && m.Uri != ""
+}
+
+func encodeMapping(m StatusMapping) ([]byte, error) {
+	m.Version = MappingVersion
+	return json.Marshal(m)
+}
+
+/* Reads a mapping in any of the formats there have been, the unversioned one
+ * included, always handing back the current one. */
+func decodeMapping(value []byte) (*StatusMapping, error) {
+	var probe struct {
+		Version int     `json:"version"`
+		Uri     string  `json:"uri"`
+		Cid     string  `json:"cid"`
+		Skipped *string `json:"skipped"`
+	}
+	if err := json.Unmarshal(value, &probe); err != nil {
+		return nil, errors.New(fmt.Sprintf("bad mapping: %v", err))
+	}
+
+	switch {
+	case probe.Version > MappingVersion:
+		return nil, errors.New(fmt.Sprintf("mapping has version %v, which is newer than this vbc knows about", probe.Version))
+	case probe.Version == MappingVersion:
+		m := &StatusMapping{}
+		if err := json.Unmarshal(value, m); err != nil {
+			return nil, errors.New(fmt.Sprintf("bad mapping: %v", err))
+		}
+		return m, nil
+	}
+
+	/* The unversioned format doesn't say when things happened, so we go
+	 * with the zero time, which says as much. */
+	var m StatusMapping
+	switch {
+	case probe.Skipped != nil:
+		m = StatusMapping{State: MappingSkipped, Error: *probe.Skipped}
+	case probe.Uri == "":
+		m = StatusMapping{State: MappingIgnored}
+	default:
+		m = newPostedMapping(probe.Uri, probe.Cid)
+		m.Created = time.Time{}
+		m.Updated = time.Time{}
+	}
+	m.Version = MappingVersion
+	return &m, nil
+}
+
+/* The at:// URIs of the posts a stored mapping points to, the root post along
+ * with the rest of its thread, which stores index by so they can tell what
+ * status is behind a post, see Store.PostStatus. */
+func mappingPostURIs(value []byte) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	m, err := decodeMapping(value)
+	if err != nil || m.Uri == "" {
+		return nil
+	}
+
+	/* Threads go up with a record key after the other, see
+	 * nextStatusRkey. */
+	prefix := m.Uri[:strings.LastIndex(m.Uri, "/")+1]
+	rkey := m.Uri[len(prefix):]
+	uris := []string{m.Uri}
+	for i := 1; i < m.Parts; i++ {
+		if rkey = nextStatusRkey(rkey); rkey == "" {
+			break
+		}
+		uris = append(uris, prefix+rkey)
+	}
+	return uris
+}
+
+/* Brings a stored mapping up to the current format, handing back nil if it
+ * already is. */
+func migrateMapping(value []byte) ([]byte, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if json.Unmarshal(value, &probe) == nil && probe.Version == MappingVersion {
+		return nil, nil
+	}
+
+	m, err := decodeMapping(value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMapping(*m)
+}
+
+/* Writes down that we gave up on a status, along with why. */
+func putFailedMapping(store Store, key AccountKey, entry RetryEntry) error {
+	m := newMapping(MappingFailed)
+	m.Error = entry.LastError
+	value, err := encodeMapping(m)
+	if err != nil {
+		return err
+	}
+	return store.PutMapping(key, entry.Status, value)
+}
+
+/* Writes down that Bluesky turned a status down, along with why. */
+func putRejectedMapping(store Store, key AccountKey, status int64, reason string) error {
+	m := newMapping(MappingRejected)
+	m.Error = reason
+	value, err := encodeMapping(m)
+	if err != nil {
+		return err
+	}
+	return store.PutMapping(key, status, value)
+}
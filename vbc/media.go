@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* How many images Bluesky lets a post have. */
+const ImagesPerPost = 4
+
+/* How many images get downloaded and uploaded at the same time. */
+const MediaConcurrency = 4
+
+/* Images bigger than this don't get downloaded, let alone uploaded, unless
+ * the instance they're from takes bigger ones, see instanceInfo. */
+const MediaDownloadLimit = 50 << 20
+
+/* What Bluesky takes for images in posts. */
+const ImageSizeLimit = 1000000
+
+var ImageTypes = []string{"image/jpeg", "image/png", "image/webp", "image/gif"}
+
+/* What gets put at the end of the post when some of the media of a status
+ * couldn't be brought over. */
+const MediaLinkFormat = "Media: %v"
+
+/* What the card standing in for the media of a status says, see
+ * mediaLinkEmbed. */
+const (
+	MediaCardTitleFormat = "%v attachment(s) on Mastodon"
+	MediaCardDescription = "Open the status to see them."
+)
+
+/* What a post shows under its text, either images, see
+ * app.bsky.embed.images, a link card, see app.bsky.embed.external, or a
+ * quoted post, see app.bsky.embed.record. */
+type postEmbed struct {
+	LexiconTypeID string        `json:"$type"`
+	Images        []*embedImage `json:"images,omitempty"`
+	External      *linkCard     `json:"external,omitempty"`
+	Record        *strongRef    `json:"record,omitempty"`
+}
+
+/* Every image that has to be uploaded for the embed, the thumbnail of a
+ * link card included. */
+func (e *postEmbed) uploads() []*embedImage {
+	if e.External != nil && e.External.thumb != nil {
+		return []*embedImage{e.External.thumb}
+	}
+	return e.Images
+}
+
+type embedImage struct {
+	Alt string `json:"alt"`
+	/* The uploaded blob, left unset until the image gets uploaded. */
+	Image       json.RawMessage `json:"image,omitempty"`
+	AspectRatio *aspectRatio    `json:"aspectRatio,omitempty"`
+
+	/* Where the image comes from, and what to keep in view if it gets
+	 * cropped. */
+	source string
+	focus  *focusPoint
+	/* Whether it's the thumbnail of a link card, which never get cropped. */
+	thumbnail bool
+	/* How long downloading it may take, and how big it may be, when not
+	 * left to downloadMedia. */
+	timeout time.Duration
+	limit   int64
+	/* Whether the image couldn't be mirrored, see dropUnmirrored. */
+	dropped bool
+
+	/* What goes in the blob cache once the post is up, see rememberBlobs. */
+	cache     *cachedBlob
+	cacheKeys []string
+}
+
+/* Bluesky needs this to lay images out before it has loaded them. */
+type aspectRatio struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+/* Parses an aspect ratio written like 16:9. */
+func parseAspectRatio(text string) (int, int, error) {
+	w, h, ok := strings.Cut(text, ":")
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("%q is not of the form width:height", text))
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, err
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, errors.New(fmt.Sprintf("%q has a side that isn't positive", text))
+	}
+	return width, height, nil
+}
+
+/* Works out the largest box of the given aspect ratio that fits in the
+ * bounds, placed as close to centered on the focal point as it can be. */
+func cropBox(bounds image.Rectangle, focus *focusPoint, rw int, rh int) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	cw, ch := width, height
+	if width*rh > height*rw {
+		cw = height * rw / rh
+	} else {
+		ch = width * rh / rw
+	}
+	if cw < 1 || ch < 1 {
+		return bounds
+	}
+
+	/* Mastodon has the focal point go from -1 to 1, with y going up. */
+	fx, fy := 0.0, 0.0
+	if focus != nil {
+		fx, fy = focus.X, focus.Y
+	}
+	cx := int(math.Round((fx + 1) / 2 * float64(width)))
+	cy := int(math.Round((1 - fy) / 2 * float64(height)))
+
+	clamp := func(v int, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	x := clamp(cx-cw/2, width-cw)
+	y := clamp(cy-ch/2, height-ch)
+	return image.Rect(x, y, x+cw, y+ch).Add(bounds.Min)
+}
+
+/* Groups the images of a post into embeds, as many as it takes to fit them
+ * all. Media that isn't an image gets left out, and counted. */
+func imageEmbeds(media []PostMedia, crop string) ([]*postEmbed, int) {
+	var embeds []*postEmbed
+	left := 0
+	for _, m := range media {
+		if m.Type != "image" {
+			left++
+			continue
+		}
+
+		img := &embedImage{
+			Alt:    m.Description,
+			source: m.URL,
+			focus:  m.Focus,
+		}
+		if m.Width > 0 && m.Height > 0 {
+			img.AspectRatio = &aspectRatio{Width: m.Width, Height: m.Height}
+		}
+		if crop != "" && img.AspectRatio != nil {
+			rw, rh, err := parseAspectRatio(crop)
+			if err == nil {
+				box := cropBox(image.Rect(0, 0, m.Width, m.Height), m.Focus, rw, rh)
+				img.AspectRatio = &aspectRatio{Width: box.Dx(), Height: box.Dy()}
+			}
+		}
+
+		if len(embeds) == 0 || len(embeds[len(embeds)-1].Images) == ImagesPerPost {
+			embeds = append(embeds, &postEmbed{LexiconTypeID: "app.bsky.embed.images"})
+		}
+		last := embeds[len(embeds)-1]
+		last.Images = append(last.Images, img)
+	}
+	return embeds, left
+}
+
+/* A card pointing to the status on Mastodon for its media, in place of
+ * uploading it, for accounts short on bandwidth or room. Its description is
+ * what the media shows, as far as the alt text says. */
+func mediaLinkEmbed(post *Post) *postEmbed {
+	var alts []string
+	for _, m := range post.Media {
+		if alt := strings.TrimSpace(m.Description); alt != "" {
+			alts = append(alts, alt)
+		}
+	}
+	description := strings.Join(alts, "\n\n")
+	if description == "" {
+		description = MediaCardDescription
+	}
+	return &postEmbed{
+		LexiconTypeID: "app.bsky.embed.external",
+		External: &linkCard{
+			URI:         post.URL,
+			Title:       fmt.Sprintf(MediaCardTitleFormat, len(post.Media)),
+			Description: description,
+		},
+	}
+}
+
+/* Points people to the status on Mastodon for the media that couldn't come
+ * along, at the end of the thread. Gets a post of its own if it has to. */
+func linkOriginal(posts []*postRecord, url string) []*postRecord {
+	for _, post := range posts {
+		if strings.Contains(post.Text, url) {
+			return posts
+		}
+		for _, facet := range post.Facets {
+			if facet.Features[0].URI == url {
+				return posts
+			}
+		}
+	}
+
+	link := fmt.Sprintf(MediaLinkFormat, url)
+	last := posts[len(posts)-1]
+	text := link
+	if last.Text != "" {
+		text = appendFooter(last.Text, link)
+	}
+	if utf8.RuneCountInString(text) <= PostLengthLimit {
+		last.Text = text
+		last.Facets = append(last.Facets, newLinkFacet(len(text)-len(url), len(text), url))
+		return posts
+	}
+
+	return append(posts, &postRecord{
+		FeedPost: &bsky.FeedPost{
+			LexiconTypeID: PostCollection,
+			Text:          link,
+			CreatedAt:     last.CreatedAt,
+		},
+		Labels: last.Labels,
+		Facets: []*richtextFacet{newLinkFacet(len(link)-len(url), len(link), url)},
+	})
+}
+
+/* Takes the images that couldn't be mirrored out of the posts, along with
+ * any posts that are left with nothing in them, and links to the status in
+ * their place. */
+func dropUnmirrored(posts []*postRecord, url string) []*postRecord {
+	dropped := false
+	kept := make([]*postRecord, 0, len(posts))
+	for i, post := range posts {
+		/* A card does fine without its thumbnail. */
+		if post.Embed != nil && post.Embed.External != nil {
+			card := post.Embed.External
+			if card.thumb != nil && !card.thumb.dropped {
+				card.Thumb = card.thumb.Image
+			}
+		} else if post.Embed != nil && post.Embed.Record == nil {
+			images := make([]*embedImage, 0, len(post.Embed.Images))
+			for _, img := range post.Embed.Images {
+				if img.dropped {
+					dropped = true
+					continue
+				}
+				images = append(images, img)
+			}
+			post.Embed.Images = images
+			if len(images) == 0 {
+				post.Embed = nil
+			}
+		}
+
+		/* The first post stays no matter what, it's the root. */
+		if i > 0 && post.Text == "" && post.Embed == nil {
+			continue
+		}
+		kept = append(kept, post)
+	}
+
+	if !dropped {
+		return posts
+	}
+	return linkOriginal(kept, url)
+}
+
+/* Marks media that can't be brought over to Bluesky, which gets linked to
+ * rather than failing the whole status. */
+type unmirrorableError struct {
+	reason string
+	kind   error
+}
+
+func (e unmirrorableError) Error() string {
+	return e.reason
+}
+
+func (e unmirrorableError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+/* Makes sure an image is something Bluesky takes, recompressing it, and
+ * scaling it down if that's not enough, until it's small enough. */
+func fitImage(data []byte, mimeType string) ([]byte, string, error) {
+	supported := false
+	for _, t := range ImageTypes {
+		supported = supported || t == mimeType
+	}
+	if !supported {
+		return nil, "", unmirrorableError{
+			reason: fmt.Sprintf("%v is not a type of image Bluesky takes", mimeType),
+			kind:   ErrUnsupportedMedia,
+		}
+	}
+	if len(data) <= ImageSizeLimit {
+		return data, mimeType, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", unmirrorableError{reason: fmt.Sprintf("%v bytes is too large, and it can't be recompressed: %v", len(data), err)}
+	}
+
+	/* JPEG has no transparency, so lay the image on white. */
+	var img image.Image = flattenImage(src)
+	for tries := 0; tries < 4; tries++ {
+		for _, quality := range []int{85, 70, 55} {
+			var out bytes.Buffer
+			if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, "", err
+			}
+			if out.Len() <= ImageSizeLimit {
+				return out.Bytes(), "image/jpeg", nil
+			}
+		}
+		img = halveImage(img)
+	}
+	return nil, "", unmirrorableError{reason: fmt.Sprintf("%v bytes is too large, even after recompression", len(data))}
+}
+
+func flattenImage(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Over)
+	return dst
+}
+
+/* Scales an image down to half its size, averaging every 2x2 block. */
+func halveImage(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			var r, g, b, a uint32
+			for _, d := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				cr, cg, cb, ca := src.At(bounds.Min.X+2*x+d.X, bounds.Min.Y+2*y+d.Y).RGBA()
+				r, g, b, a = r+cr, g+cg, b+cb, a+ca
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / 4),
+				G: uint16(g / 4),
+				B: uint16(b / 4),
+				A: uint16(a / 4),
+			})
+		}
+	}
+	return dst
+}
+
+/* Downloads media, handing back its contents and type. What's in the media
+ * cache doesn't get downloaded again, see setupMediaCache. */
+func downloadMedia(ctx context.Context, url string, limit int64) ([]byte, string, error) {
+	if limit <= 0 {
+		limit = MediaDownloadLimit
+	}
+	if downloadedMedia != nil {
+		if data, mimeType, found := downloadedMedia.Get(url); found && int64(len(data)) <= limit {
+			return data, mimeType, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := errors.New(fmt.Sprintf("could not download %v: bad server status code (%v)", url, res.StatusCode))
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return nil, "", permanent(err)
+		}
+		delay, _ := retryAfter(res)
+		return nil, "", rateLimited(err, delay)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", permanent(errors.New(fmt.Sprintf("%v is over %v bytes", url, limit)))
+	}
+
+	mimeType, _, _ := strings.Cut(res.Header.Get("Content-Type"), ";")
+	mimeType = strings.TrimSpace(mimeType)
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(data)
+	}
+	if downloadedMedia != nil {
+		downloadedMedia.Put(url, data, mimeType)
+	}
+	return data, mimeType, nil
+}
+
+/* Crops an image to the given aspect ratio around its focal point. Only
+ * JPEG and PNG get cropped, anything else comes back as it was, with empty
+ * bounds. */
+func cropImage(data []byte, mimeType string, focus *focusPoint, rw int, rh int) ([]byte, image.Rectangle, error) {
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		return data, image.Rectangle{}, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	box := cropBox(src.Bounds(), focus, rw, rh)
+	if box == src.Bounds() {
+		return data, box, nil
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, box.Dx(), box.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, box.Min, draw.Src)
+
+	var out bytes.Buffer
+	if mimeType == "image/png" {
+		err = png.Encode(&out, dst)
+	} else {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return out.Bytes(), dst.Bounds(), nil
+}
+
+/* What we know about a blob we've uploaded before. */
+type cachedBlob struct {
+	Blob        json.RawMessage `json:"blob"`
+	AspectRatio *aspectRatio    `json:"aspectRatio,omitempty"`
+	SHA256      string          `json:"sha256"`
+}
+
+/* Uploads the images of all the posts at once, a few at a time. */
+func uploadImages(
+	ctx context.Context,
+	store Store,
+	bs *blueskySession,
+	did string,
+	posts []*postRecord,
+	crop string) error {
+
+	var images []*embedImage
+	for _, post := range posts {
+		if post.Embed != nil {
+			images = append(images, post.Embed.uploads()...)
+		}
+	}
+
+	if len(images) == 0 {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "upload-images")
+	var wg sync.WaitGroup
+	errs := make([]error, len(images))
+	slots := make(chan struct{}, MediaConcurrency)
+	for i, img := range images {
+		wg.Add(1)
+		go func(i int, img *embedImage) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			ctx, span := startSpan(ctx, "upload-image", "media.url", img.source)
+			crop := crop
+			if img.thumbnail {
+				crop = ""
+			}
+			errs[i] = uploadEmbedImage(ctx, store, bs, did, img, crop)
+			span.End(errs[i])
+		}(i, img)
+	}
+	wg.Wait()
+
+	var failed error
+	for i, err := range errs {
+		var unmirrorable unmirrorableError
+		if errors.As(err, &unmirrorable) {
+			log.Printf("WARNING: not mirroring %v: %v", images[i].source, err)
+			images[i].dropped = true
+		} else if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	span.End(failed)
+	return failed
+}
+
+/* Puts the blobs of the posts in the cache. Only done once the posts are up,
+ * as Bluesky throws away blobs no record ends up using. */
+func rememberBlobs(store Store, did string, posts []*postRecord) error {
+	for _, post := range posts {
+		if post.Embed == nil {
+			continue
+		}
+		for _, img := range post.Embed.uploads() {
+			if img.cache == nil {
+				continue
+			}
+
+			value, err := json.Marshal(img.cache)
+			if err != nil {
+				return err
+			}
+			for _, key := range img.cacheKeys {
+				if err := store.PutBlob(did, key, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func cachedBlobFor(store Store, did string, key string) (*cachedBlob, error) {
+	value, err := store.Blob(did, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	cached := &cachedBlob{}
+	if err := json.Unmarshal(value, cached); err != nil {
+		return nil, err
+	}
+	return cached, nil
+}
+
+/* Downloads an image and uploads it to Bluesky, cropping it first if we
+ * were asked to, and fills in the blob it became. Images we've uploaded
+ * before, either from the same URL or with the same contents, are not
+ * uploaded again. */
+func uploadEmbedImage(
+	ctx context.Context,
+	store Store,
+	bs *blueskySession,
+	did string,
+	img *embedImage,
+	crop string) error {
+
+	urlKey := fmt.Sprintf("url:%v:%v", crop, img.source)
+	cached, err := cachedBlobFor(store, did, urlKey)
+	if err != nil {
+		return err
+	}
+	if cached != nil {
+		img.Image = cached.Blob
+		if cached.AspectRatio != nil {
+			img.AspectRatio = cached.AspectRatio
+		}
+		return nil
+	}
+
+	download := ctx
+	if img.timeout > 0 {
+		var cancel context.CancelFunc
+		download, cancel = context.WithTimeout(ctx, img.timeout)
+		defer cancel()
+	}
+	data, mimeType, err := downloadMedia(download, img.source, img.limit)
+	if err != nil {
+		/* A card does fine without its thumbnail, so it's not worth
+		 * trying again over. */
+		if classifyError(err) == errorPermanent || (img.thumbnail && ctx.Err() == nil) {
+			return unmirrorableError{reason: err.Error()}
+		}
+		return err
+	}
+
+	if crop != "" {
+		rw, rh, err := parseAspectRatio(crop)
+		if err != nil {
+			return permanent(err)
+		}
+		cropped, bounds, err := cropImage(data, mimeType, img.focus, rw, rh)
+		if err != nil {
+			/* Not being able to crop isn't worth losing the image over. */
+			log.Printf("WARNING: could not crop %v: %v", img.source, err)
+		} else {
+			data = cropped
+			if bounds.Dx() > 0 && bounds.Dy() > 0 {
+				img.AspectRatio = &aspectRatio{Width: bounds.Dx(), Height: bounds.Dy()}
+			}
+		}
+	}
+
+	data, mimeType, err = fitImage(data, mimeType)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	hashKey := "sha256:" + hash
+	img.cacheKeys = []string{urlKey, hashKey}
+
+	cached, err = cachedBlobFor(store, did, hashKey)
+	if err != nil {
+		return err
+	}
+	if cached == nil {
+		var output struct {
+			Blob json.RawMessage `json:"blob"`
+		}
+		err = bs.CustomCall(ctx, func(client *xrpc.Client) error {
+			return client.Do(ctx, xrpc.Procedure, mimeType, "com.atproto.repo.uploadBlob", nil, bytes.NewReader(data), &output)
+		})
+		if err != nil {
+			return err
+		}
+		cached = &cachedBlob{Blob: output.Blob}
+	}
+
+	img.Image = cached.Blob
+	img.cache = &cachedBlob{
+		Blob:        cached.Blob,
+		AspectRatio: img.AspectRatio,
+		SHA256:      hash,
+	}
+	return nil
+}
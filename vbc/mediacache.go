@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* How big the media cache gets, in megabytes, when VBC_MEDIA_CACHE_SIZE isn't
+ * set. */
+const MediaCacheSizeDefault = 512
+
+/* Keeps media that was downloaded, so retries and statuses crossposted to
+ * more than one account don't download it from the instance again. */
+type mediaCache interface {
+	/* The contents and type of media, and whether it was there at all. */
+	Get(url string) ([]byte, string, bool)
+	Put(url string, data []byte, mimeType string)
+}
+
+/* Where downloadMedia keeps what it downloads, nil for nowhere. */
+var downloadedMedia mediaCache
+
+/* Sets up the media cache in VBC_MEDIA_CACHE_DIR, when it's set. */
+func setupMediaCache() error {
+	dir := envOrNil("VBC_MEDIA_CACHE_DIR")
+	if dir == nil {
+		return nil
+	}
+	size, err := strconv.ParseInt(envOrDefault("VBC_MEDIA_CACHE_SIZE", strconv.Itoa(MediaCacheSizeDefault)), 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("VBC_MEDIA_CACHE_SIZE is not a number: %v", err))
+	}
+	cache, err := openDiskMediaCache(*dir, size<<20)
+	if err != nil {
+		return err
+	}
+	downloadedMedia = cache
+	return nil
+}
+
+/* Media cache in a directory, a file for each URL, named after its hash,
+ * with the type on the first line and the contents after it. Once it's over
+ * its size, the files used least recently go first, their modification time
+ * being when they were last used. */
+type diskMediaCache struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func openDiskMediaCache(dir string, maxSize int64) (*diskMediaCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create media cache in %v: %v", dir, err))
+	}
+	cache := &diskMediaCache{dir: dir, maxSize: maxSize}
+	files, err := cache.files()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read media cache in %v: %v", dir, err))
+	}
+	for _, file := range files {
+		cache.size += file.Size()
+	}
+	log.Printf("caching media in %v, up to %v", dir, formatBytes(maxSize))
+	return cache, nil
+}
+
+func (c *diskMediaCache) path(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
+
+/* What's in the cache, least recently used first. */
+func (c *diskMediaCache) files() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	return files, nil
+}
+
+func (c *diskMediaCache) Get(url string) ([]byte, string, bool) {
+	path := c.path(url)
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", false
+	}
+	mimeType, data, found := bytes.Cut(contents, []byte("\n"))
+	if !found {
+		return nil, "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return data, string(mimeType), true
+}
+
+func (c *diskMediaCache) Put(url string, data []byte, mimeType string) {
+	size := int64(len(mimeType) + 1 + len(data))
+	if size > c.maxSize {
+		return
+	}
+
+	/* Written elsewhere first, so it's never read half written. */
+	path := c.path(url)
+	temp, err := os.CreateTemp(c.dir, ".download-*")
+	if err != nil {
+		log.Printf("WARNING: could not cache %v: %v", url, err)
+		return
+	}
+	_, err = temp.Write(append([]byte(mimeType+"\n"), data...))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		log.Printf("WARNING: could not cache %v: %v", url, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += size
+	if c.size <= c.maxSize {
+		return
+	}
+
+	/* Make room, going by what's really there, as files of the same URL
+	 * get written over, and other copies of vbc may share the directory. */
+	files, err := c.files()
+	if err != nil {
+		log.Printf("WARNING: could not make room in the media cache: %v", err)
+		return
+	}
+	c.size = 0
+	for _, file := range files {
+		c.size += file.Size()
+	}
+	for _, file := range files {
+		if c.size <= c.maxSize {
+			break
+		}
+		if file.Name() == filepath.Base(path) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, file.Name())); err == nil {
+			c.size -= file.Size()
+		}
+	}
+}
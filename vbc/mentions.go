@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/McKael/madon"
+)
+
+/* What to do with statuses that open by mentioning other people. */
+const (
+	MentionsKeep  = "keep"
+	MentionsSkip  = "skip"
+	MentionsStrip = "strip"
+	MentionsLink  = "link"
+)
+
+var (
+	/* Mastodon marks both mentions and hashtags with the mention class. */
+	mentionAnchorRe = regexp.MustCompile(`(?s)<a\s[^>]*class="[^"]*\bmention\b[^"]*"[^>]*>.*?</a>`)
+	hrefRe          = regexp.MustCompile(`href="([^"]*)"`)
+	htmlTagRe       = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+/* Finds who a mention anchor points to, nil if it's a hashtag or someone
+ * that isn't in the mentions of the status. */
+func anchorMention(status *madon.Status, anchor string) *madon.Mention {
+	if strings.Contains(anchor, "hashtag") {
+		return nil
+	}
+	match := hrefRe.FindStringSubmatch(anchor)
+	if match == nil {
+		return nil
+	}
+
+	href := html.UnescapeString(match[1])
+	for i := range status.Mentions {
+		if status.Mentions[i].URL == href {
+			return &status.Mentions[i]
+		}
+	}
+	return nil
+}
+
+/* Whether the status opens by mentioning someone other than its author. */
+func opensWithMention(status *madon.Status, content string) bool {
+	text := strings.TrimSpace(html.UnescapeString(htmlTagRe.ReplaceAllString(content, "")))
+	if !strings.HasPrefix(text, "@") {
+		return false
+	}
+
+	for _, mention := range status.Mentions {
+		if status.Account == nil || mention.ID != status.Account.ID {
+			return true
+		}
+	}
+	return false
+}
+
+/* Applies the mentions policy to the HTML content of a status, handing back
+ * the content to render. */
+func applyMentionsPolicy(status *madon.Status, content string, policy string) (string, error) {
+	if policy == "" || policy == MentionsKeep || !opensWithMention(status, content) {
+		return content, nil
+	}
+
+	switch policy {
+	case MentionsSkip:
+		return "", skipped("status opens by mentioning other people")
+	case MentionsStrip:
+		content = mentionAnchorRe.ReplaceAllStringFunc(content, func(anchor string) string {
+			if anchorMention(status, anchor) == nil {
+				return anchor
+			}
+			return ""
+		})
+	case MentionsLink:
+		content = mentionAnchorRe.ReplaceAllStringFunc(content, func(anchor string) string {
+			mention := anchorMention(status, anchor)
+			if mention == nil {
+				return anchor
+			}
+			return html.EscapeString(mention.URL)
+		})
+	}
+	return content, nil
+}
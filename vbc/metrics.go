@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* Numbers about how vbc is doing, served in the Prometheus text format at
+ * /metrics on VBC_METRICS_LISTEN. Only gauges, which is all we need so far. */
+type metricsRegistry struct {
+	mu     sync.Mutex
+	help   map[string]string
+	values map[string]map[string]float64
+}
+
+var metrics = &metricsRegistry{
+	help:   make(map[string]string),
+	values: make(map[string]map[string]float64),
+}
+
+/* Sets a gauge, with labels given as name and value pairs. */
+func (m *metricsRegistry) Set(name string, help string, value float64, labels ...string) {
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, labels[i], escaped))
+	}
+	key := ""
+	if len(parts) > 0 {
+		key = "{" + strings.Join(parts, ",") + "}"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.help[name] = help
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][key] = value
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %v %v\n", name, m.help[name])
+		fmt.Fprintf(w, "# TYPE %v gauge\n", name)
+
+		keys := make([]string, 0, len(m.values[name]))
+		for key := range m.values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%v%v %v\n", name, key, m.values[name][key])
+		}
+	}
+}
+
+/* Serves the metrics on addr for as long as we're running. */
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	log.Printf("serving metrics on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("ERROR: could not serve metrics: %v", err)
+	}
+}
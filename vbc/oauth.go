@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* We only ever need to write posts, which the generic scope covers. */
+	OAuthScope = "atproto transition:generic"
+	/* Refresh access tokens this long before they expire. */
+	OAuthRefreshMargin = time.Minute
+
+	OAuthTimeout      = 30 * time.Second
+	OAuthLoginTimeout = 10 * time.Minute
+)
+
+/* What we keep in the store for an OAuth session. */
+type oauthTokens struct {
+	DID           string    `json:"did"`
+	Handle        string    `json:"handle"`
+	PDS           string    `json:"pds"`
+	Issuer        string    `json:"issuer"`
+	TokenEndpoint string    `json:"tokenEndpoint"`
+	ClientID      string    `json:"clientId"`
+	AccessToken   string    `json:"accessToken"`
+	RefreshToken  string    `json:"refreshToken"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	/* The DPoP key the tokens are bound to, as a base64 SEC 1 key. */
+	DPoPKey string `json:"dpopKey"`
+}
+
+/* Parts of the authorization server metadata we care about. */
+type oauthServerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	ParEndpoint           string `json:"pushed_authorization_request_endpoint"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+/* Error responses from the authorization server. */
+type oauthError struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	return fmt.Sprintf("oauth: %v (%v): %v", e.Code, e.StatusCode, e.Description)
+}
+
+/* An OAuth session with a PDS, holding DPoP-bound tokens that are refreshed
+ * as they get close to expiring. Refreshed tokens are written back to the
+ * store right away, since the old refresh token stops working. */
+type oauthSession struct {
+	store Store
+	httpc *http.Client
+
+	mu        sync.Mutex
+	tokens    oauthTokens
+	key       *ecdsa.PrivateKey
+	authNonce string
+	pdsNonce  string
+}
+
+func loadOAuthSession(store Store, handle string) (*oauthSession, error) {
+	value, err := store.BlueskySession(handle)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	var tokens oauthTokens
+	if err := json.Unmarshal(value, &tokens); err != nil {
+		return nil, err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(tokens.DPoPKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauthSession{
+		store:  store,
+		httpc:  &http.Client{Timeout: OAuthTimeout},
+		tokens: tokens,
+		key:    key,
+	}, nil
+}
+
+func (s *oauthSession) save() error {
+	der, err := x509.MarshalECPrivateKey(s.key)
+	if err != nil {
+		return err
+	}
+	s.tokens.DPoPKey = base64.StdEncoding.EncodeToString(der)
+
+	value, err := json.Marshal(s.tokens)
+	if err != nil {
+		return err
+	}
+	return s.store.PutBlueskySession(s.tokens.Handle, value)
+}
+
+func (s *oauthSession) DID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens.DID
+}
+
+/* An XRPC client talking to the PDS with our tokens. */
+func (s *oauthSession) XRPC() *xrpc.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &xrpc.Client{
+		Client: &http.Client{
+			Timeout:   OAuthTimeout,
+			Transport: &dpopTransport{session: s, base: http.DefaultTransport},
+		},
+		Host: s.tokens.PDS,
+		Auth: &xrpc.AuthInfo{
+			Did:    s.tokens.DID,
+			Handle: s.tokens.Handle,
+		},
+	}
+}
+
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+/* Builds a DPoP proof for a request, as described in RFC 9449. */
+func (s *oauthSession) dpopProof(method string, target string, nonce string, accessToken string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	s.key.PublicKey.X.FillBytes(x)
+	s.key.PublicKey.Y.FillBytes(y)
+
+	header := map[string]interface{}{
+		"typ": "dpop+jwt",
+		"alg": "ES256",
+		"jwk": map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		},
+	}
+	claims := map[string]interface{}{
+		"jti": randomToken(16),
+		"htm": method,
+		"htu": u.String(),
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	return signES256(s.key, header, claims)
+}
+
+func signES256(key *ecdsa.PrivateKey, header interface{}, claims interface{}) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signing := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signing))
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	/* JWS wants the raw, fixed size concatenation of r and s. */
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	sig.FillBytes(out[32:])
+	return signing + "." + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+/* Posts a form to the authorization server, dealing with the DPoP nonce
+ * dance along the way. Must be called with the lock held. */
+func (s *oauthSession) postAuthServer(endpoint string, form url.Values, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		proof, err := s.dpopProof(http.MethodPost, endpoint, s.authNonce, "")
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", proof)
+
+		res, err := s.httpc.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if nonce := res.Header.Get("DPoP-Nonce"); nonce != "" {
+			s.authNonce = nonce
+		}
+		if res.StatusCode >= 400 {
+			oerr := &oauthError{StatusCode: res.StatusCode}
+			_ = json.Unmarshal(body, oerr)
+			if oerr.Code == "use_dpop_nonce" && attempt == 0 {
+				continue
+			}
+			return oerr
+		}
+
+		return json.Unmarshal(body, out)
+	}
+}
+
+func (s *oauthSession) applyTokens(res *oauthTokenResponse) error {
+	if res.Sub != s.tokens.DID {
+		return errors.New(fmt.Sprintf("tokens were issued for %v instead of %v", res.Sub, s.tokens.DID))
+	}
+	if !strings.EqualFold(res.TokenType, "DPoP") {
+		return errors.New(fmt.Sprintf("expected DPoP tokens, got %v", res.TokenType))
+	}
+
+	s.tokens.AccessToken = res.AccessToken
+	s.tokens.RefreshToken = res.RefreshToken
+	s.tokens.ExpiresAt = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	return s.save()
+}
+
+/* Trades the refresh token in for new tokens. Must be called with the lock
+ * held. */
+func (s *oauthSession) refreshLocked() error {
+	log.Printf("Bluesky: refreshing OAuth tokens of @%v", s.tokens.Handle)
+
+	var res oauthTokenResponse
+	err := s.postAuthServer(s.tokens.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.tokens.RefreshToken},
+		"client_id":     {s.tokens.ClientID},
+	}, &res)
+	if err != nil {
+		var oerr *oauthError
+		if errors.As(err, &oerr) && oerr.Code == "invalid_grant" {
+			log.Printf("ERROR: the OAuth session of @%v is no longer valid, run", s.tokens.Handle)
+			log.Printf("ERROR: `vbc bsky-login %v` to log in again.", s.tokens.Handle)
+			return permanent(err)
+		}
+		return err
+	}
+
+	return s.applyTokens(&res)
+}
+
+func (s *oauthSession) Refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.refreshLocked()
+}
+
+/* Hands out a valid access token, refreshing it first if need be. */
+func (s *oauthSession) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Until(s.tokens.ExpiresAt) < OAuthRefreshMargin {
+		if err := s.refreshLocked(); err != nil {
+			return "", err
+		}
+	}
+	return s.tokens.AccessToken, nil
+}
+
+/* Round tripper that authenticates requests to the PDS with our DPoP-bound
+ * access token, retrying once when the PDS hands us a new nonce. */
+type dpopTransport struct {
+	session *oauthSession
+	base    http.RoundTripper
+}
+
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.session.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(req.Context())
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		t.session.mu.Lock()
+		nonce := t.session.pdsNonce
+		t.session.mu.Unlock()
+
+		proof, err := t.session.dpopProof(r.Method, r.URL.String(), nonce, token)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "DPoP "+token)
+		r.Header.Set("DPoP", proof)
+
+		res, err := t.base.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if nonce := res.Header.Get("DPoP-Nonce"); nonce != "" {
+			t.session.mu.Lock()
+			t.session.pdsNonce = nonce
+			t.session.mu.Unlock()
+		}
+
+		retryable := attempt == 0 && (req.Body == nil || req.GetBody != nil)
+		if retryable && res.StatusCode == http.StatusUnauthorized &&
+			strings.Contains(res.Header.Get("WWW-Authenticate"), "use_dpop_nonce") {
+			_ = res.Body.Close()
+			continue
+		}
+		return res, nil
+	}
+}
+
+/* Resolves a handle to its DID and the PDS hosting its repo. */
+func resolveIdentity(ctx context.Context, httpc *http.Client, handle string) (string, string, error) {
+	did, err := resolveHandle(ctx, httpc, handle)
+	if err != nil {
+		return "", "", err
+	}
+
+	var docURL string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		docURL = "https://plc.directory/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		docURL = "https://" + strings.TrimPrefix(did, "did:web:") + "/.well-known/did.json"
+	default:
+		return "", "", errors.New(fmt.Sprintf("unsupported DID method in %v", did))
+	}
+
+	var doc struct {
+		Service []struct {
+			ID              string `json:"id"`
+			Type            string `json:"type"`
+			ServiceEndpoint string `json:"serviceEndpoint"`
+		} `json:"service"`
+	}
+	if err := getJSON(ctx, httpc, docURL, &doc); err != nil {
+		return "", "", err
+	}
+	for _, service := range doc.Service {
+		if service.ID == "#atproto_pds" || service.ID == did+"#atproto_pds" {
+			return did, strings.TrimSuffix(service.ServiceEndpoint, "/"), nil
+		}
+	}
+	return "", "", errors.New(fmt.Sprintf("%v has no PDS in its DID document", did))
+}
+
+func resolveHandle(ctx context.Context, httpc *http.Client, handle string) (string, error) {
+	/* DNS first, then the well-known file, same as everyone else does. */
+	if records, err := net.DefaultResolver.LookupTXT(ctx, "_atproto."+handle); err == nil {
+		for _, record := range records {
+			if strings.HasPrefix(record, "did=") {
+				return strings.TrimPrefix(record, "did="), nil
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+handle+"/.well-known/atproto-did", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := httpc.Do(req)
+	if err == nil {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		_ = res.Body.Close()
+
+		did := strings.TrimSpace(string(body))
+		if res.StatusCode == http.StatusOK && strings.HasPrefix(did, "did:") {
+			return did, nil
+		}
+	}
+
+	return "", errors.New(fmt.Sprintf("could not resolve handle @%v", handle))
+}
+
+func getJSON(ctx context.Context, httpc *http.Client, target string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("GET %v: %v", target, res.Status))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+/* Client ID for when no hosted client metadata was configured. ATProto lets
+ * loopback clients describe themselves right in the ID. */
+func loopbackClientID(redirectURI string) string {
+	return "http://localhost?" + url.Values{
+		"redirect_uri": {redirectURI},
+		"scope":        {OAuthScope},
+	}.Encode()
+}
+
+/* Metadata to be hosted at the client ID URL, when using one. */
+func oauthClientMetadata(clientID string, redirectURI string) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id":                  clientID,
+		"client_name":                AppName,
+		"client_uri":                 AppWebsite,
+		"application_type":           "native",
+		"grant_types":                []string{"authorization_code", "refresh_token"},
+		"response_types":             []string{"code"},
+		"redirect_uris":              []string{redirectURI},
+		"scope":                      OAuthScope,
+		"token_endpoint_auth_method": "none",
+		"dpop_bound_access_tokens":   true,
+	}
+}
+
+/* Runs the whole authorization code flow for a handle: resolves where its
+ * authorization server is, pushes the request, hands authorize the URL the
+ * user has to open to approve it, waits for them to, and trades the code in
+ * for tokens. The resulting session is saved to the store. */
+func oauthLogin(ctx context.Context, store Store, handle string, clientID string, listen string, authorize func(authURL string)) (*oauthSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, OAuthLoginTimeout)
+	defer cancel()
+
+	httpc := &http.Client{Timeout: OAuthTimeout}
+
+	did, pds, err := resolveIdentity(ctx, httpc, handle)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Bluesky: @%v is %v, hosted at %v", handle, did, pds)
+
+	var resource struct {
+		AuthorizationServers []string `json:"authorization_servers"`
+	}
+	err = getJSON(ctx, httpc, pds+"/.well-known/oauth-protected-resource", &resource)
+	if err != nil {
+		return nil, err
+	}
+	if len(resource.AuthorizationServers) == 0 {
+		return nil, errors.New(fmt.Sprintf("%v lists no authorization servers", pds))
+	}
+
+	issuer := strings.TrimSuffix(resource.AuthorizationServers[0], "/")
+	var meta oauthServerMetadata
+	err = getJSON(ctx, httpc, issuer+"/.well-known/oauth-authorization-server", &meta)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Issuer != issuer {
+		return nil, errors.New(fmt.Sprintf("authorization server claims to be %v rather than %v", meta.Issuer, issuer))
+	}
+
+	/* Listen for the redirect before anything else, so we know where the
+	 * user is going to be sent back to. */
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	redirectURI := fmt.Sprintf("http://%v/callback", listener.Addr())
+	if clientID == "" {
+		clientID = loopbackClientID(redirectURI)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	session := &oauthSession{
+		store: store,
+		httpc: httpc,
+		key:   key,
+		tokens: oauthTokens{
+			DID:           did,
+			Handle:        handle,
+			PDS:           pds,
+			Issuer:        issuer,
+			TokenEndpoint: meta.TokenEndpoint,
+			ClientID:      clientID,
+		},
+	}
+
+	verifierBytes := make([]byte, 32)
+	_, _ = rand.Read(verifierBytes)
+	verifier := hex.EncodeToString(verifierBytes)
+	challenge := sha256.Sum256([]byte(verifier))
+	state := randomToken(16)
+
+	var par struct {
+		RequestURI string `json:"request_uri"`
+	}
+	session.mu.Lock()
+	err = session.postAuthServer(meta.ParEndpoint, url.Values{
+		"client_id":             {clientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {OAuthScope},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {handle},
+	}, &par)
+	session.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	authURL := meta.AuthorizationEndpoint + "?" + url.Values{
+		"client_id":   {clientID},
+		"request_uri": {par.RequestURI},
+	}.Encode()
+	authorize(authURL)
+
+	/* Wait for the authorization server to send the user back to us. */
+	type callback struct {
+		code string
+		err  error
+	}
+	done := make(chan callback, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		var result callback
+		switch {
+		case query.Get("error") != "":
+			result.err = errors.New(fmt.Sprintf("authorization failed: %v: %v", query.Get("error"), query.Get("error_description")))
+		case query.Get("state") != state:
+			result.err = errors.New("authorization came back with the wrong state")
+		case query.Get("iss") != "" && query.Get("iss") != issuer:
+			result.err = errors.New(fmt.Sprintf("authorization came back from %v rather than %v", query.Get("iss"), issuer))
+		default:
+			result.code = query.Get("code")
+		}
+
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintf(w, "All done! You can close this page and go back to vbc.\n")
+		}
+		select {
+		case done <- result:
+		default:
+		}
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	var result callback
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		return nil, errors.New("timed out waiting for the authorization to go through")
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	var res oauthTokenResponse
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	err = session.postAuthServer(meta.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {result.code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {clientID},
+		"code_verifier": {verifier},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.applyTokens(&res); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func blueskyLoginCommand(args []string) {
+	fs := flag.NewFlagSet("bsky-login", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:0", "address to wait for the authorization server to redirect back to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc bsky-login [--listen <addr>] [handle]\n\n")
+		fmt.Fprintf(fs.Output(), "Logs into Bluesky with OAuth and saves the session to the store, so no app\n")
+		fmt.Fprintf(fs.Output(), "password is needed. The handle defaults to VBC_BSKY_HANDLE. Set\n")
+		fmt.Fprintf(fs.Output(), "VBC_BSKY_OAUTH_CLIENT_ID to use hosted client metadata.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var handle string
+	switch fs.NArg() {
+	case 0:
+		handle = requireEnv("VBC_BSKY_HANDLE")
+	case 1:
+		handle = strings.TrimPrefix(fs.Arg(0), "@")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer store.Close()
+
+	clientID := envOrDefault("VBC_BSKY_OAUTH_CLIENT_ID", "")
+	session, err := oauthLogin(context.Background(), store, handle, clientID, *listen, func(authURL string) {
+		fmt.Printf("Open the following URL in your browser to let vbc post as @%v:\n\n    %v\n\n", handle, authURL)
+	})
+	if err != nil {
+		log.Fatalf("could not log into Bluesky as @%v: %v", handle, err)
+	}
+	log.Printf("Bluesky: logged in as @%v (%v), session saved to the store", handle, session.DID())
+}
+
+func blueskyClientMetadataCommand(args []string) {
+	fs := flag.NewFlagSet("bsky-client-metadata", flag.ExitOnError)
+	redirect := fs.String("redirect-uri", "http://127.0.0.1:7734/callback", "loopback URI to be redirected back to after logging in")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc bsky-client-metadata [--redirect-uri <uri>] <client-id>\n\n")
+		fmt.Fprintf(fs.Output(), "Prints the OAuth client metadata to host at <client-id>, for use with\n")
+		fmt.Fprintf(fs.Output(), "VBC_BSKY_OAUTH_CLIENT_ID. Log in with a --listen address matching the\n")
+		fmt.Fprintf(fs.Output(), "redirect URI.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	out, err := json.MarshalIndent(oauthClientMetadata(fs.Arg(0), *redirect), "", "  ")
+	if err != nil {
+		log.Fatalf("could not encode client metadata: %v", err)
+	}
+	fmt.Println(string(out))
+}
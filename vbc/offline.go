@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/* How often to check whether the network is back while we're offline, see
+ * offlineMode. */
+const OfflineProbeInterval = 15 * time.Second
+
+/* Whether VBC_OFFLINE_MODE says vbc runs somewhere that's often offline, such
+ * as a laptop. Crossposts that fail for want of a network then wait in the
+ * retry queue for it to come back, however long that takes, rather than
+ * being retried and eventually given up on, and the network gets checked on
+ * often enough that they go out soon after it does. */
+func offlineMode() bool {
+	offline, _ := strconv.ParseBool(envOrDefault("VBC_OFFLINE_MODE", "false"))
+	return offline
+}
+
+/* Whether an error came from not being able to reach the network at all,
+ * rather than from whatever is on the other end of it. */
+func isOfflineError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETDOWN) {
+		return true
+	}
+	/* A server refusing the connection is a server that's there. */
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !errors.Is(err, syscall.ECONNREFUSED)
+}
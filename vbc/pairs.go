@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* A Mastodon account, and the Bluesky account it gets crossposted to. */
+type accountPair struct {
+	Instance  string
+	AccountID int64
+	Handle    string
+	Server    string
+	AppKey    *string
+	/* Access token of the Mastodon account, see mastodonWriter. */
+	MastodonToken *string
+}
+
+/* Works out every pair of accounts to crosspost between: the one in the
+ * environment, if there is one, those in the configuration that name a
+ * Bluesky handle, and those their routes name. */
+func (c *Config) Pairs() []accountPair {
+	server := envOrDefault("VBC_BSKY_SERVER", bluesky.ServerBskySocial)
+	envHandle := envOrDefault("VBC_BSKY_HANDLE", "")
+
+	var pairs []accountPair
+	seen := make(map[accountPair]bool)
+	add := func(pair accountPair) {
+		key := accountPair{Instance: pair.Instance, AccountID: pair.AccountID, Handle: pair.Handle}
+		if !seen[key] {
+			seen[key] = true
+			pairs = append(pairs, pair)
+		}
+	}
+
+	if pair, ok := envPair(); ok {
+		add(pair)
+	}
+	for _, account := range c.Accounts {
+		if account.Bluesky == "" {
+			continue
+		}
+
+		pair := accountPair{
+			Instance:  account.Mastodon,
+			AccountID: account.AccountID,
+			Handle:    account.Bluesky,
+			Server:    server,
+		}
+		if account.BlueskyServer != "" {
+			pair.Server = account.BlueskyServer
+		}
+		if account.MastodonTokenEnv != "" {
+			pair.MastodonToken = envOrNil(account.MastodonTokenEnv)
+		}
+		if account.BlueskyAppKeyEnv != "" {
+			pair.AppKey = envOrNil(account.BlueskyAppKeyEnv)
+		} else if account.Bluesky == envHandle {
+			pair.AppKey = envOrNil("VBC_BSKY_APP_KEY")
+		}
+		add(pair)
+	}
+
+	/* Accounts with routes also get crossposted to where they route to. */
+	for _, pair := range copySlice(pairs) {
+		var targets []string
+		for _, target := range c.routesFor(pair.Instance, pair.AccountID) {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			routed := pair
+			routed.Handle = target
+			routed.AppKey = nil
+			for _, account := range c.Accounts {
+				if account.Bluesky == target && account.BlueskyAppKeyEnv != "" {
+					routed.AppKey = envOrNil(account.BlueskyAppKeyEnv)
+				}
+			}
+			if routed.AppKey == nil && target == envHandle {
+				routed.AppKey = envOrNil("VBC_BSKY_APP_KEY")
+			}
+			add(routed)
+		}
+	}
+	return pairs
+}
+
+/* Makes sure the handle still points to the account VBC_BSKY_DID says it
+ * should, when it says anything about it. Handles can be pointed at another
+ * account at any time, which would then get crossposted to instead. */
+func checkExpectedDID(handle string, did string) error {
+	expected := envOrDefault("VBC_BSKY_DID", "")
+	if expected == "" || handle != envOrDefault("VBC_BSKY_HANDLE", "") || did == expected {
+		return nil
+	}
+	log.Printf("WARNING: @%v points to %v now, rather than to %v as VBC_BSKY_DID says, refusing to crosspost to it",
+		handle,
+		did,
+		expected)
+	return permanent(errors.New(fmt.Sprintf("@%v is %v rather than %v, the DID in VBC_BSKY_DID", handle, did, expected)))
+}
+
+/* The pair given through VBC_MASTODON_INSTANCE, VBC_MASTODON_ACCOUNT_ID and
+ * VBC_BSKY_HANDLE, if they're all set. */
+func envPair() (accountPair, bool) {
+	instance := envOrNil("VBC_MASTODON_INSTANCE")
+	accountID := envOrNil("VBC_MASTODON_ACCOUNT_ID")
+	handle := envOrNil("VBC_BSKY_HANDLE")
+	if instance == nil || accountID == nil || handle == nil {
+		return accountPair{}, false
+	}
+
+	id, err := strconv.ParseInt(*accountID, 10, 64)
+	if err != nil {
+		log.Fatalf("mastodon account ID is not an integer: %v", err)
+	}
+	return accountPair{
+		Instance:  canonicalizeInstanceName(*instance),
+		AccountID: id,
+		Handle:    *handle,
+		Server:    envOrDefault("VBC_BSKY_SERVER", bluesky.ServerBskySocial),
+		AppKey:    envOrNil("VBC_BSKY_APP_KEY"),
+
+		MastodonToken: envOrNil("VBC_MASTODON_TOKEN"),
+	}, true
+}
+
+/* The pair crossposting to handle, for commands that act on a single Bluesky
+ * account. Should it be in neither the configuration nor the environment,
+ * it's put together from whatever is in the environment. */
+func (c *Config) PairFor(handle string) accountPair {
+	for _, pair := range c.Pairs() {
+		if pair.Handle == handle {
+			return pair
+		}
+	}
+
+	pair := accountPair{
+		Handle: handle,
+		Server: envOrDefault("VBC_BSKY_SERVER", bluesky.ServerBskySocial),
+		AppKey: envOrNil("VBC_BSKY_APP_KEY"),
+	}
+	if instance := envOrNil("VBC_MASTODON_INSTANCE"); instance != nil {
+		pair.Instance = canonicalizeInstanceName(*instance)
+	}
+	pair.AccountID, _ = strconv.ParseInt(envOrDefault("VBC_MASTODON_ACCOUNT_ID", "0"), 10, 64)
+	return pair
+}
+
+/* Sessions shared between the pairs, one per Mastodon instance and one per
+ * Bluesky account. Each gets set up the first time a pair needs it. */
+type sessionPool struct {
+	store Store
+	/* Requests per second each Bluesky session may make. */
+	blueskyRateLimit float64
+
+	mu       sync.Mutex
+	mastodon map[string]*pooledSession[*mastodonSession]
+	bluesky  map[string]*pooledSession[*blueskySession]
+	/* Keyed by the pair without its credentials. */
+	writers map[accountPair]*mastodonWriter
+}
+
+type pooledSession[T any] struct {
+	once    sync.Once
+	session T
+	err     error
+}
+
+func newSessionPool(store Store, blueskyRateLimit float64) *sessionPool {
+	return &sessionPool{
+		store:            store,
+		blueskyRateLimit: blueskyRateLimit,
+		mastodon:         make(map[string]*pooledSession[*mastodonSession]),
+		bluesky:          make(map[string]*pooledSession[*blueskySession]),
+		writers:          make(map[accountPair]*mastodonWriter),
+	}
+}
+
+func (p *sessionPool) Mastodon(ctx context.Context, instance string) (*mastodonSession, error) {
+	p.mu.Lock()
+	entry, found := p.mastodon[instance]
+	if !found {
+		entry = &pooledSession[*mastodonSession]{}
+		p.mastodon[instance] = entry
+	}
+	p.mu.Unlock()
+
+	entry.once.Do(func() {
+		appId, appSecret := envAppCredentials(instance)
+
+		entry.err = retryStartup(ctx, "set up Mastodon client for "+instance, func() error {
+			ms, err := newMastodonSession(p.store, instance, appId, appSecret)
+			entry.session = ms
+			return err
+		})
+	})
+	return entry.session, entry.err
+}
+
+func (p *sessionPool) Bluesky(ctx context.Context, pair accountPair) (*blueskySession, error) {
+	p.mu.Lock()
+	entry, found := p.bluesky[pair.Handle]
+	if !found {
+		entry = &pooledSession[*blueskySession]{}
+		p.bluesky[pair.Handle] = entry
+	}
+	p.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.err = retryStartup(ctx, "log into Bluesky as @"+pair.Handle, func() error {
+			bs, err := newBlueskySession(ctx, p.store, pair.Server, pair.Handle, pair.AppKey, p.blueskyRateLimit)
+			entry.session = bs
+			return err
+		})
+	})
+	return entry.session, entry.err
+}
+
+/* The writer of the Mastodon account of a pair, nil without a token, see
+ * newMastodonWriter. Kept around so its token can be rotated. */
+func (p *sessionPool) Writer(pair accountPair) *mastodonWriter {
+	key := accountPair{Instance: pair.Instance, AccountID: pair.AccountID, Handle: pair.Handle}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	writer, found := p.writers[key]
+	if !found {
+		writer = newMastodonWriter(pair.Instance, pair.MastodonToken)
+		p.writers[key] = writer
+	}
+	return writer
+}
+
+/* Gets a pair going and crossposts between it for as long as it can. */
+func runPair(
+	ctx context.Context,
+	store Store,
+	sessions *sessionPool,
+	leader *leaderLock,
+	reporter *errorReporter,
+	config *Config,
+	pair accountPair,
+	pollInterval time.Duration,
+	pauseAfter int,
+	state *pairState) error {
+
+	ms, err := sessions.Mastodon(ctx, pair.Instance)
+	if err != nil {
+		return err
+	}
+	bs, err := sessions.Bluesky(ctx, pair)
+	if err != nil {
+		return authFailed(err, err)
+	}
+	bs.publishes.Join()
+	defer bs.publishes.Leave()
+
+	/* Wait out accounts that went away, rather than failing to start. */
+	var gone string
+	err = retryStartup(ctx, "check on Mastodon user", func() error {
+		g, err := ms.AccountGone(pair.AccountID)
+		gone = g
+		return err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not check on user with ID %v: %v", pair.AccountID, err))
+	}
+	if gone != "" {
+		mode := config.TransformFor(pair.Instance, pair.AccountID, pair.Handle).AccountGone
+		name := fmt.Sprintf("%v on %v", pair.AccountID, pair.Instance)
+		if err := watchAccount(ctx, ms, pair.AccountID, name, gone, mode, reporter, state); err != nil {
+			return err
+		}
+	}
+
+	/* Query for the account on Mastodon. */
+	log.Printf("Mastodon: querying for user with ID %v on %v", pair.AccountID, pair.Instance)
+	var account *madon.Account
+	err = retryStartup(ctx, "query for Mastodon user", func() error {
+		return ms.Do(func(mc *madon.Client) error {
+			a, err := mc.GetAccount(pair.AccountID)
+			account = a
+			return err
+		})
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not query for user with ID %v: %v", pair.AccountID, err))
+	}
+	log.Printf("Mastodon: found account with handle @%v", account.Username)
+	state.SetUsername(account.Username)
+
+	/* Query for the user profile on Bluesky. */
+	log.Printf("Bluesky: fetching profile with handle @%v", pair.Handle)
+	var bskyProfile *bluesky.Profile
+	err = retryStartup(ctx, "fetch Bluesky profile", func() error {
+		p, err := bs.FetchProfile(ctx, pair.Handle)
+		bskyProfile = p
+		return err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not fetch profile with handle @%v: %v", pair.Handle, err))
+	}
+	log.Printf("Bluesky: @%v is %v", pair.Handle, bskyProfile.DID)
+
+	if err := checkExpectedDID(pair.Handle, bskyProfile.DID); err != nil {
+		return err
+	}
+
+	transform := config.TransformFor(pair.Instance, account.ID, pair.Handle)
+	if held := config.PrivateHeldBack(pair.Instance, account.ID, pair.Handle); len(held) > 0 {
+		log.Printf("WARNING: visibility has %v statuses of @%v crossposted, but @%v is not in allowPrivate, leaving them out",
+			strings.Join(held, " and "), account.Username, pair.Handle)
+	}
+	var private []string
+	for _, visibility := range transform.Visibility {
+		if isPrivateVisibility(visibility) {
+			private = append(private, visibility)
+		}
+	}
+	if len(private) > 0 {
+		log.Printf("WARNING: %v statuses of @%v get crossposted to @%v, where ANYONE can see them",
+			strings.Join(private, " and "), account.Username, pair.Handle)
+	}
+	writer := sessions.Writer(pair)
+	if writer != nil {
+		writer.SetLimits(loadInstanceInfo(ctx, store, pair.Instance).Limits())
+	}
+	if transform.CrossLink != "" && writer == nil {
+		log.Printf("WARNING: crossLink needs an access token for @%v, not linking to crossposts", account.Username)
+	}
+	if transform.Filters != nil && transform.Filters.MastodonFilters && writer == nil {
+		log.Printf("WARNING: mastodonFilters needs an access token for @%v, not going by its filters", account.Username)
+	}
+	/* Better to find out about missing permissions now than halfway
+	 * through crossposting something. */
+	if writer != nil {
+		digestTo := ""
+		if envOrNil("VBC_DIGEST_INTERVAL") != nil {
+			digestTo = envOrDefault("VBC_DIGEST", DigestToLog)
+		}
+		err = retryStartup(ctx, "verify Mastodon token", func() error {
+			return writer.VerifyScopes(ctx, requiredMastodonScopes(transform, digestTo))
+		})
+		if err != nil {
+			return authFailed(errors.New(fmt.Sprintf("could not verify the Mastodon token of @%v: %v", account.Username, err)), err)
+		}
+	}
+	err = retryStartup(ctx, "verify Bluesky session", func() error {
+		return verifyBlueskyWrite(ctx, bs, bskyProfile.DID)
+	})
+	if err != nil {
+		return authFailed(errors.New(fmt.Sprintf("could not verify the Bluesky session of @%v: %v", pair.Handle, err)), err)
+	}
+
+	/* Nothing goes up on Bluesky in shadow mode, likes and labels included. */
+	shadow := transform.Shadow != nil && *transform.Shadow
+	if shadow {
+		log.Printf("Bluesky: @%v is in shadow mode, writing down what would be crossposted to it instead", pair.Handle)
+	}
+
+	if transform.MirrorPrivacy != nil && *transform.MirrorPrivacy && !shadow {
+		mirrored, err := mirrorPrivacy(ctx, ms, bs, account, bskyProfile.DID, transform)
+		if err != nil {
+			log.Printf("WARNING: could not bring the privacy settings of @%v over: %v", account.Username, err)
+		}
+		transform = mirrored
+	}
+
+	if transform.MirrorFavorites != nil && *transform.MirrorFavorites && !shadow {
+		if writer == nil {
+			log.Printf("WARNING: mirrorFavorites needs an access token for @%v, not mirroring favourites", account.Username)
+		} else {
+			go mirrorFavourites(ctx, store, writer, bs, leader, config.Handles, pair.Instance, account, bskyProfile.DID)
+		}
+	}
+
+	go collectEngagement(ctx, store, bs, leader, bskyProfile.DID)
+
+	if value := envOrNil("VBC_DIGEST_INTERVAL"); value != nil {
+		interval, err := time.ParseDuration(*value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("VBC_DIGEST_INTERVAL is not a valid duration: %v", err))
+		}
+		to := envOrDefault("VBC_DIGEST", DigestToLog)
+		go sendDigests(ctx, store, writer, bs, leader, pair.Handle, bskyProfile.DID, account.Username, to, interval)
+	}
+
+	reconcileLast, err := strconv.Atoi(envOrDefault("VBC_RECONCILE_LAST", strconv.Itoa(ReconcileLastDefault)))
+	if err != nil {
+		return errors.New(fmt.Sprintf("VBC_RECONCILE_LAST is not a number: %v", err))
+	}
+
+	/* Offline, the instance is how we find out the network is back. */
+	var health *instanceHealth
+	if probe, _ := strconv.ParseBool(envOrDefault("VBC_HEALTH_PROBE", "false")); probe || offlineMode() {
+		health = newInstanceHealth(pair.Instance)
+	}
+
+	err = newAccountPipeline(accountDeps{
+		store:         store,
+		ms:            ms,
+		writer:        writer,
+		bs:            bs,
+		leader:        leader,
+		reporter:      reporter,
+		health:        health,
+		state:         state,
+		instance:      pair.Instance,
+		acct:          account,
+		bskyProfile:   bskyProfile,
+		transform:     transform,
+		pollInterval:  pollInterval,
+		pauseAfter:    pauseAfter,
+		reconcileLast: reconcileLast,
+	}).Run(ctx)
+	var paused pausedError
+	if errors.As(err, &paused) {
+		return paused
+	} else if err != nil {
+		return errors.New(fmt.Sprintf("account loop failed: %v", err))
+	}
+	return nil
+}
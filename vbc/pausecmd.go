@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+func pauseCommand(args []string) {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc pause <bluesky handle>\n\n")
+		fmt.Fprintf(fs.Output(), "Has the running vbc stop crossposting to a Bluesky handle until it's\n")
+		fmt.Fprintf(fs.Output(), "restarted, every account going to it included, between two statuses, so\n")
+		fmt.Fprintf(fs.Output(), "none gets left halfway. Whatever's new in the meantime goes over once it\n")
+		fmt.Fprintf(fs.Output(), "is. Needs vbc to be running, as there's nothing to pause otherwise.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !viaDaemon("pause", fs.Args()) {
+		log.Fatalf("vbc is not running, so there's nothing to pause")
+	}
+}
+
+/* Pauses every pair crossposting to handle, see pauseCommand. */
+func pauseHandle(config *Config, handle string, w io.Writer) error {
+	handle = strings.TrimPrefix(handle, "@")
+
+	found := false
+	for _, pair := range config.Pairs() {
+		if pair.Handle != handle {
+			continue
+		}
+		state := debugState.Find(pair.Instance, pair.AccountID, pair.Handle)
+		if state == nil {
+			continue
+		}
+		found = true
+		if err := state.Pause(); err != nil {
+			return errors.New(fmt.Sprintf("could not pause account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err))
+		}
+		fmt.Fprintf(w, "paused account %v on %v to @%v until vbc is restarted\n", pair.AccountID, pair.Instance, pair.Handle)
+	}
+
+	if !found {
+		return errors.New(fmt.Sprintf("no account is crossposted to @%v", handle))
+	}
+	return nil
+}
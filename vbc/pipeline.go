@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/McKael/madon"
+)
+
+/* How many statuses may wait between two stages of the pipeline of an
+ * account, before the stage feeding them has to wait in turn. */
+const PipelineDepth = PollLimit
+
+/* A status making its way through the pipeline of an account, which has it
+ * found by the fetcher, turned into posts by the transformer, and put up on
+ * Bluesky by the publisher, each running on its own. That way, slow uploads
+ * don't keep new statuses from being noticed, and the pipeline filling up
+ * shows in vbc_pipeline_queued. */
+type pipelineItem struct {
+	status *madon.Status
+	entry  RetryEntry
+	/* Why the status couldn't be fetched, for the publisher to handle. */
+	err error
+	/* The mapping of a crossposted status that got edited, see syncEdit. */
+	edited []byte
+
+	/* Filled in by the transformer. The context carries the span of the
+	 * whole crosspost, which the publisher ends. */
+	ctx    context.Context
+	span   traceSpan
+	extras *statusExtras
+	posts  []*postRecord
+}
+
+/* IDs of the statuses in the pipeline, so the fetcher doesn't send the same
+ * one down it twice while it's still on its way. */
+type inflightSet struct {
+	mu  sync.Mutex
+	ids map[int64]bool
+}
+
+func newInflightSet() *inflightSet {
+	return &inflightSet{ids: make(map[int64]bool)}
+}
+
+/* Adds the status, handing back false if it was in already. */
+func (s *inflightSet) Add(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	return true
+}
+
+func (s *inflightSet) Has(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+func (s *inflightSet) Remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
+
+/* Sends an item on to the next stage, waiting for there to be room. */
+func sendItem(ctx context.Context, ch chan<- *pipelineItem, item *pipelineItem) error {
+	select {
+	case ch <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Says how many statuses are waiting on each stage of the pipeline. */
+func reportPipeline(acct AccountKey, state *pairState, transforming int, publishing int) {
+	account := fmt.Sprintf("%v@%v", acct.ID, acct.Instance)
+	help := "Statuses waiting on a stage of the pipeline of an account."
+	metrics.Set("vbc_pipeline_queued", help, float64(transforming), "account", account, "did", acct.Target, "stage", "transform")
+	metrics.Set("vbc_pipeline_queued", help, float64(publishing), "account", account, "did", acct.Target, "stage", "publish")
+	state.Pipeline(transforming, publishing)
+}
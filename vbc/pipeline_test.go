@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+	"lobisomem.gay/vbc/v2/internal/fakes"
+)
+
+/* End to end tests of the pipeline, running the pipeline of an account against the fake
+ * servers in internal/fakes, with a memory store. */
+
+const (
+	/* How often the pipeline polls the fake instance. */
+	PipelineTestPoll = 100 * time.Millisecond
+	/* How long to wait on the pipeline before giving up on it. */
+	PipelineTestTimeout = 20 * time.Second
+)
+
+var pipelineTransport sync.Once
+
+/* A pipeline running against fresh fakes, stopped when the test is over. */
+type pipelineHarness struct {
+	t        *testing.T
+	mastodon *fakes.Mastodon
+	bluesky  *fakes.Bluesky
+	store    *memoryStore
+	key      AccountKey
+	/* Closed once the pipeline stops, with what it stopped with in err. */
+	done chan struct{}
+	err  error
+}
+
+/* A post on the fake PDS, as far as the tests look at it. */
+type pipelinePost struct {
+	URI   string
+	Text  string `json:"text"`
+	Reply *struct {
+		Root struct {
+			Uri string `json:"uri"`
+		} `json:"root"`
+		Parent struct {
+			Uri string `json:"uri"`
+		} `json:"parent"`
+	} `json:"reply"`
+	Facets []richtextFacet `json:"facets"`
+}
+
+/* Starts an accountPipeline on a new pair of fakes, with transform over the
+ * defaults, and waits for it to bootstrap. */
+func startPipeline(t *testing.T, transform TransformConfig) *pipelineHarness {
+	t.Helper()
+	return startPipelineWith(t, transform, false, 0)
+}
+
+/* Same as startPipeline, but with a cachedStore in front of the memory store,
+ * as there is in front of a bolt file, so h.store only has what'd be left of
+ * the store after a crash. */
+func startCachedPipeline(t *testing.T, transform TransformConfig) *pipelineHarness {
+	t.Helper()
+	return startPipelineWith(t, transform, true, 0)
+}
+
+/* Same as startPipeline, but pausing after pauseAfter failures in a row, as
+ * VBC_PAUSE_AFTER has it. */
+func startPausingPipeline(t *testing.T, transform TransformConfig, pauseAfter int) *pipelineHarness {
+	t.Helper()
+	return startPipelineWith(t, transform, false, pauseAfter)
+}
+
+func startPipelineWith(t *testing.T, transform TransformConfig, cached bool, pauseAfter int) *pipelineHarness {
+	t.Helper()
+
+	/* Failures get retried the way they would for real, see main. */
+	pipelineTransport.Do(func() {
+		http.DefaultTransport = newBreakerTransport(http.DefaultTransport)
+	})
+
+	h := &pipelineHarness{
+		t:        t,
+		mastodon: fakes.NewMastodon(109000000000000001, "vbc"),
+		bluesky:  fakes.NewBluesky("did:plc:vbcfakevbcfakevbcfake", "vbc.test"),
+		store:    newMemoryStore(),
+		done:     make(chan struct{}),
+	}
+	/* Something for the bootstrap to ignore. */
+	h.mastodon.AddStatus(fakes.Status{Content: "<p>This one was here before vbc.</p>"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		h.mastodon.Close()
+		h.bluesky.Close()
+	})
+
+	instance := canonicalizeInstanceName(h.mastodon.URL())
+	appId, appSecret := "fake-client-id", "fake-client-secret"
+	ms, err := newMastodonSession(h.store, instance, &appId, &appSecret)
+	if err != nil {
+		t.Fatalf("could not set up Mastodon session: %v", err)
+	}
+	appKey := "xxxx-xxxx-xxxx-xxxx"
+	bs, err := newBlueskySession(ctx, h.store, h.bluesky.URL(), h.bluesky.Handle, &appKey, 0)
+	if err != nil {
+		t.Fatalf("could not set up Bluesky session: %v", err)
+	}
+
+	var account *madon.Account
+	err = ms.Do(func(mc *madon.Client) error {
+		a, err := mc.GetAccount(h.mastodon.AccountID)
+		account = a
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not query for Mastodon user: %v", err)
+	}
+	profile, err := bs.FetchProfile(ctx, h.bluesky.Handle)
+	if err != nil {
+		t.Fatalf("could not fetch Bluesky profile: %v", err)
+	}
+	h.key = AccountKey{Instance: instance, ID: account.ID, Target: profile.DID}
+
+	transform = DefaultTransformConfig.Merge(transform)
+	if err := transform.Validate(); err != nil {
+		t.Fatalf("bad transform: %v", err)
+	}
+	var store Store = h.store
+	if cached {
+		store = newCachedStore(h.store)
+	}
+	go func() {
+		h.err = newAccountPipeline(accountDeps{
+			store:        store,
+			ms:           ms,
+			bs:           bs,
+			instance:     instance,
+			acct:         account,
+			bskyProfile:  profile,
+			transform:    transform,
+			pollInterval: PipelineTestPoll,
+			pauseAfter:   pauseAfter,
+		}).Run(ctx)
+		close(h.done)
+	}()
+	/* Runs before the cleanup above, which closes the fakes, so the
+	 * pipeline gets to stop before they're gone. */
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-h.done:
+		case <-time.After(PipelineTestTimeout):
+			t.Errorf("pipeline did not stop")
+		}
+	})
+
+	h.waitFor("bootstrap", func() bool {
+		found, err := h.store.HasAccount(h.key)
+		return err == nil && found
+	})
+	return h
+}
+
+/* Waits for cond to hold, failing the test if it doesn't in time, or if the
+ * pipeline stops. */
+func (h *pipelineHarness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(PipelineTestTimeout)
+	for !cond() {
+		select {
+		case <-h.done:
+			h.t.Fatalf("pipeline stopped waiting for %v: %v", what, h.err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(PipelineTestPoll / 2)
+	}
+}
+
+/* The posts on the fake PDS, oldest first. */
+func (h *pipelineHarness) posts() []pipelinePost {
+	h.t.Helper()
+	var posts []pipelinePost
+	for _, record := range h.bluesky.Records() {
+		if record.Collection != PostCollection {
+			continue
+		}
+		post := pipelinePost{URI: record.URI}
+		if err := json.Unmarshal(record.Value, &post); err != nil {
+			h.t.Fatalf("could not decode %v: %v", record.URI, err)
+		}
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+/* Waits for there to be at least n posts. */
+func (h *pipelineHarness) waitForPosts(n int) []pipelinePost {
+	h.t.Helper()
+	h.waitFor(fmt.Sprintf("%v posts", n), func() bool {
+		return len(h.posts()) >= n
+	})
+	return h.posts()
+}
+
+/* What the store says became of a status. */
+func (h *pipelineHarness) mapping(status int64) *StatusMapping {
+	h.t.Helper()
+	value, err := h.store.Mapping(h.key, status)
+	if err != nil {
+		h.t.Fatalf("could not read mapping of %v: %v", status, err)
+	}
+	if value == nil {
+		return nil
+	}
+	mapping, err := decodeMapping(value)
+	if err != nil {
+		h.t.Fatalf("could not decode mapping of %v: %v", status, err)
+	}
+	return mapping
+}
+
+func TestPipelineCrossposts(t *testing.T) {
+	h := startPipeline(t, TransformConfig{})
+	id := h.mastodon.AddStatus(fakes.Status{Content: "<p>Hello from the fakes.</p>"})
+
+	posts := h.waitForPosts(1)
+	if len(posts) != 1 || posts[0].Text != "Hello from the fakes." {
+		t.Fatalf("expected a single post saying hello, got %+v", posts)
+	}
+	h.waitFor("mapping", func() bool {
+		mapping := h.mapping(id)
+		return mapping != nil && mapping.Posted()
+	})
+	if mapping := h.mapping(id); mapping.Uri != posts[0].URI {
+		t.Errorf("mapping points to %v rather than %v", mapping.Uri, posts[0].URI)
+	}
+}
+
+func TestPipelineSplitsLongStatuses(t *testing.T) {
+	h := startPipeline(t, TransformConfig{})
+	sentence := "This sentence is here to make the status longer than a single post can be. "
+	id := h.mastodon.AddStatus(fakes.Status{Content: "<p>" + strings.Repeat(sentence, 10) + "</p>"})
+
+	h.waitFor("mapping", func() bool {
+		mapping := h.mapping(id)
+		return mapping != nil && mapping.Posted()
+	})
+	posts := h.posts()
+	if len(posts) < 2 {
+		t.Fatalf("expected the status to be split into a thread, got %v posts", len(posts))
+	}
+	if mapping := h.mapping(id); mapping.Parts != len(posts) {
+		t.Errorf("mapping has %v parts, but %v posts went up", mapping.Parts, len(posts))
+	}
+
+	root := posts[0]
+	if root.Reply != nil {
+		t.Errorf("root of the thread replies to %v", root.Reply.Parent.Uri)
+	}
+	for i, post := range posts {
+		if length := BlueskyLimits.Count(post.Text); length > BlueskyLimits.Length {
+			t.Errorf("post %v is %v long, over the limit of %v", i, length, BlueskyLimits.Length)
+		}
+		if i == 0 {
+			continue
+		}
+		if post.Reply == nil {
+			t.Fatalf("post %v of the thread is not a reply", i)
+		}
+		if post.Reply.Root.Uri != root.URI {
+			t.Errorf("post %v has %v as its root rather than %v", i, post.Reply.Root.Uri, root.URI)
+		}
+		if post.Reply.Parent.Uri != posts[i-1].URI {
+			t.Errorf("post %v replies to %v rather than %v", i, post.Reply.Parent.Uri, posts[i-1].URI)
+		}
+	}
+}
+
+/* Replies to someone else are skipped, not failed, so however many of them
+ * there are in a row they don't get the account paused. */
+func TestPipelineSkipsRepliesToOthers(t *testing.T) {
+	h := startPausingPipeline(t, TransformConfig{}, 1)
+	other := int64(109000000000000999)
+	var replies []int64
+	for i := 0; i < 3; i++ {
+		replies = append(replies, h.mastodon.AddStatus(fakes.Status{
+			Content:   fmt.Sprintf("<p>@someone Reply number %v.</p>", i),
+			InReplyTo: &other,
+		}))
+	}
+	id := h.mastodon.AddStatus(fakes.Status{Content: "<p>Not a reply.</p>"})
+
+	h.waitFor("mapping", func() bool {
+		mapping := h.mapping(id)
+		return mapping != nil && mapping.Posted()
+	})
+	if posts := h.posts(); len(posts) != 1 || posts[0].Text != "Not a reply." {
+		t.Errorf("expected only the status that isn't a reply to go up, got %+v", posts)
+	}
+	for _, reply := range replies {
+		if mapping := h.mapping(reply); mapping == nil || mapping.State != MappingSkipped {
+			t.Errorf("reply %v was not skipped: %+v", reply, mapping)
+		}
+	}
+	dead, err := h.store.DeadLetters(h.key)
+	if err != nil {
+		t.Fatalf("could not read dead letters: %v", err)
+	}
+	if len(dead) != 0 {
+		t.Errorf("replies went to the dead letters: %+v", dead)
+	}
+}
+
+/* Links and mentions come in the HTML Mastodon makes for them, with most of
+ * their text in spans only there to hide it, and go out as what they're shown
+ * as, with facets pointing them to where they go. */
+func TestPipelineLinkFacets(t *testing.T) {
+	h := startPipeline(t, TransformConfig{Links: LinksPlain})
+	h.mastodon.AddStatus(fakes.Status{
+		Content: `<p>Have a look at <a href="https://example.com/some/post" rel="nofollow noopener noreferrer" target="_blank" translate="no"><span class="invisible">https://</span><span class="">example.com/some/post</span><span class="invisible"></span></a> by <span class="h-card" translate="no"><a href="https://tiggi.es/@mbr" class="u-url mention">@<span>mbr</span></a></span> today.</p>`,
+	})
+
+	posts := h.waitForPosts(1)
+	post := posts[0]
+	if text := "Have a look at https://example.com/some/post by @mbr today."; post.Text != text {
+		t.Fatalf("posted %q rather than %q", post.Text, text)
+	}
+
+	expected := []struct {
+		start, end int
+		uri        string
+	}{
+		{15, 44, "https://example.com/some/post"},
+		{48, 52, "https://tiggi.es/@mbr"},
+	}
+	if len(post.Facets) != len(expected) {
+		t.Fatalf("expected %v facets, got %+v", len(expected), post.Facets)
+	}
+	for i, want := range expected {
+		facet := post.Facets[i]
+		if facet.Index.ByteStart != want.start || facet.Index.ByteEnd != want.end {
+			t.Errorf("facet %v covers %v to %v rather than %v to %v", i, facet.Index.ByteStart, facet.Index.ByteEnd, want.start, want.end)
+		}
+		if len(facet.Features) != 1 || facet.Features[0].URI != want.uri {
+			t.Errorf("facet %v links to %+v rather than %v", i, facet.Features, want.uri)
+		}
+	}
+}
+
+func TestPipelineMastodonServerErrors(t *testing.T) {
+	h := startPipeline(t, TransformConfig{})
+	h.mastodon.FailNext(fmt.Sprintf("/api/v1/accounts/%v/statuses", h.mastodon.AccountID), http.StatusServiceUnavailable, 1)
+	h.mastodon.AddStatus(fakes.Status{Content: "<p>Made it through a 503.</p>"})
+
+	posts := h.waitForPosts(1)
+	if len(posts) != 1 {
+		t.Fatalf("expected a single post, got %v", len(posts))
+	}
+}
+
+func TestPipelineBlueskyServerErrors(t *testing.T) {
+	h := startPipeline(t, TransformConfig{})
+	h.bluesky.FailNext("com.atproto.repo.putRecord", http.StatusBadGateway, 1)
+	id := h.mastodon.AddStatus(fakes.Status{Content: "<p>Held back by a 502.</p>"})
+
+	/* Writes don't get retried on the spot, as they may have gone through,
+	 * so the status has to end up queued rather than lost. */
+	h.waitFor("retry entry", func() bool {
+		queue, err := h.store.RetryQueue(h.key)
+		if err != nil {
+			t.Fatalf("could not read retry queue: %v", err)
+		}
+		for _, entry := range queue {
+			if entry.Status == id {
+				return true
+			}
+		}
+		return false
+	})
+	if posts := h.posts(); len(posts) != 0 {
+		t.Errorf("expected nothing to go up, got %+v", posts)
+	}
+	if mapping := h.mapping(id); mapping != nil && mapping.Posted() {
+		t.Errorf("status is mapped as posted: %+v", mapping)
+	}
+}
+
+func TestPipelineRateLimited(t *testing.T) {
+	h := startPipeline(t, TransformConfig{})
+	h.bluesky.RateLimitNext("com.atproto.repo.putRecord", time.Second, 1)
+	h.mastodon.AddStatus(fakes.Status{Content: "<p>Waited out a 429.</p>"})
+
+	posts := h.waitForPosts(1)
+	if len(posts) != 1 {
+		t.Fatalf("expected the status to go up once, got %v posts", len(posts))
+	}
+}
+
+func TestPipelineDeletions(t *testing.T) {
+	h := startPipeline(t, TransformConfig{Deletions: DeletionsPropagate, DeleteGrace: "1ms"})
+	var ids []int64
+	for i := 1; i <= 3; i++ {
+		ids = append(ids, h.mastodon.AddStatus(fakes.Status{Content: fmt.Sprintf("<p>Status number %v.</p>", i)}))
+	}
+	h.waitForPosts(3)
+
+	/* Only statuses missing from between others count as deleted. */
+	deleted := ids[1]
+	gone := h.mapping(deleted).Uri
+	h.mastodon.RemoveStatus(deleted)
+
+	h.waitFor("deletion", func() bool {
+		mapping := h.mapping(deleted)
+		return mapping != nil && mapping.State == MappingDeleted
+	})
+	posts := h.posts()
+	if len(posts) != 2 {
+		t.Fatalf("expected 2 posts to be left, got %v", len(posts))
+	}
+	for _, post := range posts {
+		if post.URI == gone {
+			t.Errorf("%v is still up", gone)
+		}
+	}
+}
+
+/* A crash halfway through a batch of crossposts loses whatever the cache was
+ * holding back, so by the time the webhook hears of a crosspost its mapping
+ * has to have made it past the cache, or it'd hear of it again. */
+func TestPipelineFlushesBeforeWebhook(t *testing.T) {
+	var mu sync.Mutex
+	heard := 0
+	var h *pipelineHarness
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event crosspostEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("could not decode webhook event: %v", err)
+			return
+		}
+		if status, err := h.store.PostStatus(h.key, event.Uri); err != nil || status == 0 {
+			t.Errorf("webhook heard of %v before its mapping was written down: %v", event.Uri, err)
+		}
+		mu.Lock()
+		heard++
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	h = startCachedPipeline(t, TransformConfig{Webhook: webhook.URL})
+	const batch = 5
+	for i := 1; i <= batch; i++ {
+		h.mastodon.AddStatus(fakes.Status{Content: fmt.Sprintf("<p>Status number %v of the batch.</p>", i)})
+	}
+
+	h.waitForPosts(batch)
+	h.waitFor("webhook", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return heard >= batch
+	})
+}
+
+/* A pipeline with nothing under it but a memory store, for its stages to be
+ * run on their own, with what they'd be handed sent to them by hand. */
+func newStagePipeline(t *testing.T) *accountPipeline {
+	t.Helper()
+	store := newMemoryStore()
+	p := newAccountPipeline(accountDeps{
+		store:       store,
+		instance:    canonicalizeInstanceName("https://mastodon.example"),
+		acct:        &madon.Account{ID: 109000000000000001, Username: "vbc"},
+		bskyProfile: &bluesky.Profile{DID: "did:plc:vbcfakevbcfakevbcfake", Handle: "vbc.test"},
+		transform:   DefaultTransformConfig,
+	})
+	if err := store.BootstrapAccount(p.key, map[int64][]byte{}); err != nil {
+		t.Fatalf("could not bootstrap: %v", err)
+	}
+	return p
+}
+
+/* Statuses that couldn't be fetched have nothing to prepare, and go straight
+ * through to the publisher. */
+func TestPipelinePreparePassesFailuresOn(t *testing.T) {
+	p := newStagePipeline(t)
+	item := &pipelineItem{entry: RetryEntry{Status: 1234}, err: errors.New("could not fetch")}
+	p.fetched <- item
+	close(p.fetched)
+
+	if err := p.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	prepared, ok := <-p.prepared
+	if !ok || prepared != item {
+		t.Fatalf("expected the item to come through as it was, got %+v", prepared)
+	}
+	if prepared.posts != nil || prepared.err != item.err {
+		t.Errorf("item was changed on the way through: %+v", prepared)
+	}
+	if _, ok := <-p.prepared; ok {
+		t.Errorf("prepare sent more than it was given")
+	}
+}
+
+/* Skipped statuses get a mapping saying why, and count as seen. */
+func TestPipelinePublishRecordsSkips(t *testing.T) {
+	p := newStagePipeline(t)
+	status := &madon.Status{ID: 1234, URL: "https://mastodon.example/@vbc/1234"}
+	item := &pipelineItem{status: status, entry: RetryEntry{Status: status.ID}, err: skipped("not today")}
+	item.ctx, item.span = startSpan(context.Background(), "crosspost")
+	p.inflight.Add(status.ID)
+	p.prepared <- item
+	close(p.prepared)
+
+	if err := p.publish(context.Background()); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	value, err := p.store.Mapping(p.key, status.ID)
+	if err != nil || value == nil {
+		t.Fatalf("no mapping for the status: %v", err)
+	}
+	mapping, err := decodeMapping(value)
+	if err != nil {
+		t.Fatalf("could not decode mapping: %v", err)
+	}
+	if mapping.State != MappingSkipped || mapping.Error != "not today" {
+		t.Errorf("mapping says %v (%q) rather than skipped", mapping.State, mapping.Error)
+	}
+	if cursor, _ := p.store.Cursor(p.key); cursor != status.ID {
+		t.Errorf("cursor is at %v rather than %v", cursor, status.ID)
+	}
+	if p.inflight.Has(status.ID) {
+		t.Errorf("status is still in the pipeline")
+	}
+}
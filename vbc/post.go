@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* A post on its way from one network to another, with whatever is particular
+ * to either of them taken out. Sources turn what they read into one, and sinks
+ * turn one into what they write, so everything in between only ever has to
+ * deal with this. */
+type Post struct {
+	/* The text, in the runs of plain text and links it's made of. */
+	Segments       []TextSegment
+	Media          []PostMedia
+	ContentWarning string
+	Sensitive      bool
+	Language       string
+	Visibility     string
+	/* Without the #. */
+	Tags []string
+	/* What the post replies to, empty when it doesn't reply to anything. */
+	ReplyTo string
+	/* Whether what it replies to is by the same author, making it part of
+	 * a thread of theirs. */
+	ReplyToSelf bool
+	/* Where the original is. */
+	URL       string
+	CreatedAt time.Time
+	/* Who posted it, as user@instance, and their display name. */
+	Author     string
+	AuthorName string
+}
+
+/* A run of text, either plain or a link. */
+type TextSegment struct {
+	Text string
+	/* Where the text links to, when it's a link. */
+	Link string
+}
+
+/* A media attachment. Also what transform hooks see of one. */
+type PostMedia struct {
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	/* Size of the original, if the source knows it. */
+	Width  int         `json:"width,omitempty"`
+	Height int         `json:"height,omitempty"`
+	Focus  *focusPoint `json:"focus,omitempty"`
+}
+
+/* Splits plain text into segments, with the links in it written out in full
+ * as segments of their own. */
+func segmentText(text string) []TextSegment {
+	var segments []TextSegment
+	last := 0
+	for _, match := range linkRe.FindAllStringIndex(text, -1) {
+		if match[0] > last {
+			segments = append(segments, TextSegment{Text: text[last:match[0]]})
+		}
+		link := text[match[0]:match[1]]
+		segments = append(segments, TextSegment{Text: link, Link: link})
+		last = match[1]
+	}
+	if last < len(text) {
+		segments = append(segments, TextSegment{Text: text[last:]})
+	}
+	return segments
+}
+
+/* The text of the post, as plain text. */
+func (p *Post) Text() string {
+	return joinSegments(p.Segments)
+}
+
+/* Puts segments back together into plain text. */
+func joinSegments(segments []TextSegment) string {
+	var text strings.Builder
+	for _, segment := range segments {
+		text.WriteString(segment.Text)
+	}
+	return text.String()
+}
+
+/* The text of a status that's a single paragraph of nothing but text, the
+ * way most short ones and emoji-only ones are, which is the same rendered
+ * out as it is in HTML. Anything else hands back false, and goes through
+ * renderStatusText. */
+func plainStatusText(status *madon.Status) (string, bool) {
+	if len(status.Mentions) > 0 || len(status.Content) > PostLengthLimit*4 {
+		return "", false
+	}
+	text, found := strings.CutPrefix(status.Content, "<p>")
+	if !found {
+		return "", false
+	}
+	text, found = strings.CutSuffix(text, "</p>")
+	if !found || strings.TrimSpace(text) != text {
+		return "", false
+	}
+	/* No markup, entities or runs of whitespace for html2text to deal
+	 * with, and no links for anything else to. */
+	if strings.ContainsAny(text, "<>&\n\r\t") || strings.Contains(text, "  ") || strings.Contains(text, "://") {
+		return "", false
+	}
+	return text, true
+}
+
+/* Turns a Mastodon status into a post. Its HTML is rendered out to plain
+ * text, after mentions and links have been dealt with as configured. */
+func postFromStatus(status *madon.Status, extras *statusExtras, config TransformConfig) (*Post, error) {
+	var segments []TextSegment
+	if text, ok := plainStatusText(status); ok {
+		/* Rendering the HTML is most of what turning a status into a post
+		 * costs, and there's nothing to render here. */
+		segments = []TextSegment{{Text: text}}
+	} else {
+		content, err := applyMentionsPolicy(status, status.Content, config.Mentions)
+		if err != nil {
+			return nil, err
+		}
+		segments, err = renderStatusSegments(content, config.HTMLFallback)
+		if err != nil {
+			return nil, err
+		}
+		cleanSegmentLinks(segments, config)
+	}
+
+	post := &Post{
+		Segments:       segments,
+		Media:          make([]PostMedia, 0, len(status.MediaAttachments)),
+		ContentWarning: status.SpoilerText,
+		Sensitive:      status.Sensitive,
+		Language:       status.Language,
+		Visibility:     status.Visibility,
+		Tags:           make([]string, 0, len(status.Tags)),
+		URL:            status.URL,
+		CreatedAt:      status.CreatedAt,
+	}
+	if status.InReplyToID != nil {
+		post.ReplyTo = strconv.FormatInt(*status.InReplyToID, 10)
+		post.ReplyToSelf = status.Account != nil && status.InReplyToAccountID != nil && *status.InReplyToAccountID == status.Account.ID
+	}
+	if status.Account != nil {
+		post.Author = accountHandle(status.Account)
+		post.AuthorName = status.Account.DisplayName
+	}
+	for _, tag := range status.Tags {
+		post.Tags = append(post.Tags, tag.Name)
+	}
+	for _, attachment := range status.MediaAttachments {
+		media := PostMedia{Type: attachment.Type, URL: attachment.URL}
+		if attachment.Description != nil {
+			media.Description = *attachment.Description
+		}
+		if attachment.Meta != nil {
+			media.Width = attachment.Meta.Original.Width
+			media.Height = attachment.Meta.Original.Height
+		}
+		if extras != nil {
+			if focus, ok := extras.Focus[attachment.ID]; ok {
+				media.Focus = &focus
+			}
+		}
+		post.Media = append(post.Media, media)
+	}
+	return post, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* Statuses that take the fast path through postFromStatus, and those that
+ * have their HTML rendered out. */
+var (
+	plainContents = []string{
+		"<p>Good morning! Coffee first, then wolves.</p>",
+		"<p>🐺☀️☕</p>",
+	}
+	renderedContents = []string{
+		`<p>New blog post: <a href="https://example.com/posts/hello-world" rel="nofollow noopener noreferrer"><span class="invisible">https://</span><span class="">example.com/posts/hello-world</span></a></p>`,
+		"<p>Line one<br />Line two</p><p>Fish &amp; chips</p>",
+		"<p> Padded </p>",
+		"Not in a paragraph",
+	}
+)
+
+/* The fast path has to come out the same as rendering would have. */
+func TestPlainStatusText(t *testing.T) {
+	for _, content := range plainContents {
+		text, ok := plainStatusText(&madon.Status{Content: content})
+		if !ok {
+			t.Errorf("%q doesn't take the fast path", content)
+			continue
+		}
+		if rendered := renderStatusText(content); text != rendered {
+			t.Errorf("%q comes out as %q, but renders to %q", content, text, rendered)
+		}
+	}
+	for _, content := range renderedContents {
+		if text, ok := plainStatusText(&madon.Status{Content: content}); ok {
+			t.Errorf("%q takes the fast path, coming out as %q", content, text)
+		}
+	}
+}
+
+func benchmarkTransformStatus(b *testing.B, content string) {
+	status := &madon.Status{
+		ID:         110000000000000001,
+		URL:        "https://tiggi.es/@vbc/110000000000000001",
+		Content:    content,
+		CreatedAt:  time.Date(2023, 5, 6, 12, 0, 0, 0, time.UTC),
+		Visibility: "public",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := transformStatus(status, nil, DefaultTransformConfig); err != nil {
+			b.Fatalf("could not transform status: %v", err)
+		}
+	}
+}
+
+/* What turning a status into posts costs, on the fast path and off it, see
+ * plainStatusText. */
+func BenchmarkTransformStatus(b *testing.B) {
+	b.Run("Plain", func(b *testing.B) {
+		benchmarkTransformStatus(b, plainContents[0])
+	})
+	b.Run("Rendered", func(b *testing.B) {
+		benchmarkTransformStatus(b, renderedContents[0])
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/McKael/madon"
+)
+
+/* What would get created on Bluesky for a status, as printed by preview. */
+type previewOutput struct {
+	Status  string          `json:"status"`
+	Records []previewRecord `json:"records"`
+	Skipped string          `json:"skipped,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type previewRecord struct {
+	Collection string      `json:"collection"`
+	Rkey       string      `json:"rkey"`
+	ReplyTo    *int        `json:"replyTo,omitempty"`
+	Record     interface{} `json:"record"`
+}
+
+func previewCommand(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc preview <status-url>\n\n")
+		fmt.Fprintf(fs.Output(), "Runs a status through the whole pipeline and prints the records that would\n")
+		fmt.Fprintf(fs.Output(), "be created on Bluesky as JSON, without posting anything. The configuration\n")
+		fmt.Fprintf(fs.Output(), "in VBC_CONFIG is applied as it would be for VBC_BSKY_HANDLE.\n")
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	status, err := fetchStatusByURL(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("could not fetch status %v: %v", fs.Arg(0), err)
+	}
+
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	instance, _, _ := parseStatusURL(fs.Arg(0))
+	var accountID int64
+	if status.Account != nil {
+		accountID = status.Account.ID
+	}
+	transform := config.TransformFor(instance, accountID, envOrDefault("VBC_BSKY_HANDLE", ""))
+
+	output := previewOutput{
+		Status:  status.URL,
+		Records: make([]previewRecord, 0),
+	}
+
+	var posts []*postRecord
+	extras, err := fetchStatusExtras(&madon.Client{InstanceURL: instance}, status.ID)
+	if err == nil && extras.LocalOnly {
+		err = skipped("status is local-only")
+	} else if err == nil {
+		posts, err = transformStatus(status, extras, transform)
+		if err == nil {
+			attachLinkCards(context.Background(), posts, transform)
+		}
+	}
+	var skip skipError
+	if errors.As(err, &skip) {
+		output.Skipped = skip.reason
+	} else if err != nil {
+		output.Error = err.Error()
+	}
+	shape := recordShapeFor(transform)
+	for i, post := range posts {
+		shaped, err := shape.Record(post)
+		if err != nil {
+			output.Error = err.Error()
+			break
+		}
+		record := previewRecord{
+			Collection: shape.Collection,
+			Rkey:       statusRkey(status, i),
+			Record:     shaped,
+		}
+
+		/* Threads are posted in order, each post replying to the last. */
+		if i > 0 {
+			parent := i - 1
+			record.ReplyTo = &parent
+		}
+		output.Records = append(output.Records, record)
+	}
+	if len(posts) > 0 && transform.Threadgate != nil {
+		output.Records = append(output.Records, previewRecord{
+			Collection: ThreadgateCollection,
+			Rkey:       statusRkey(status, 0),
+			Record:     threadgateRecord("<uri of the first post>", transform.Threadgate, posts[0].CreatedAt),
+		})
+	}
+	if len(posts) > 0 && hasPostgate(transform.Quotes) {
+		output.Records = append(output.Records, previewRecord{
+			Collection: PostgateCollection,
+			Rkey:       statusRkey(status, 0),
+			Record:     postgateRecord("<uri of the first post>", posts[0].CreatedAt),
+		})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(output); err != nil {
+		log.Fatalf("could not encode preview: %v", err)
+	}
+	if output.Error != "" {
+		os.Exit(1)
+	}
+}
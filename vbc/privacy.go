@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* The collection of the profile record, which always has the rkey
+	 * self. */
+	ProfileCollection = "app.bsky.actor.profile"
+	/* Self-label on a profile asking for it to be kept from people who
+	 * aren't logged in, which is the closest Bluesky has to noindex. */
+	NoUnauthenticatedLabel = "!no-unauthenticated"
+)
+
+/* How private a Mastodon account wants to be, see mirrorPrivacy. */
+type accountPrivacy struct {
+	/* Whether the account is in the directory and suggestions. Accounts
+	 * that never said are taken to be. */
+	Discoverable bool
+	/* Whether the account asked search engines to leave it out. */
+	NoIndex bool
+}
+
+func fetchAccountPrivacy(mc *madon.Client, id int64) (accountPrivacy, error) {
+	var raw struct {
+		Discoverable *bool `json:"discoverable"`
+		NoIndex      bool  `json:"noindex"`
+	}
+	code, err := fetchRawAccount(mc, id, &raw)
+	if err != nil {
+		return accountPrivacy{}, err
+	}
+	if code != http.StatusOK {
+		return accountPrivacy{}, errors.New(fmt.Sprintf("bad server status code (%v)", code))
+	}
+	return accountPrivacy{
+		Discoverable: raw.Discoverable == nil || *raw.Discoverable,
+		NoIndex:      raw.NoIndex,
+	}, nil
+}
+
+func (s *mastodonSession) AccountPrivacy(id int64) (accountPrivacy, error) {
+	var privacy accountPrivacy
+	err := s.Do(func(mc *madon.Client) error {
+		p, err := fetchAccountPrivacy(mc, id)
+		privacy = p
+		return err
+	})
+	return privacy, err
+}
+
+/* Puts the !no-unauthenticated self-label on the Bluesky profile, or takes
+ * it off, leaving the rest of the profile as it is. */
+func setNoUnauthenticated(ctx context.Context, bs *blueskySession, did string, wanted bool) error {
+	var current struct {
+		Cid   string                 `json:"cid"`
+		Value map[string]interface{} `json:"value"`
+	}
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		params := map[string]interface{}{
+			"repo":       did,
+			"collection": ProfileCollection,
+			"rkey":       "self",
+		}
+		return client.Do(ctx, xrpc.Query, "", "com.atproto.repo.getRecord", params, nil, &current)
+	})
+	var xerr *xrpc.XRPCError
+	if errors.As(err, &xerr) && xerr.ErrStr == "RecordNotFound" {
+		current.Value = map[string]interface{}{"$type": ProfileCollection}
+	} else if err != nil {
+		return err
+	}
+
+	/* Labels other than ours stay where they are. */
+	var values []interface{}
+	labeled := false
+	if labels, ok := current.Value["labels"].(map[string]interface{}); ok {
+		if existing, ok := labels["values"].([]interface{}); ok {
+			for _, value := range existing {
+				if label, ok := value.(map[string]interface{}); ok && label["val"] == NoUnauthenticatedLabel {
+					labeled = true
+					continue
+				}
+				values = append(values, value)
+			}
+		}
+	}
+	if labeled == wanted {
+		return nil
+	}
+	if wanted {
+		values = append(values, map[string]interface{}{"val": NoUnauthenticatedLabel})
+	}
+	if len(values) > 0 {
+		current.Value["labels"] = map[string]interface{}{
+			"$type":  "com.atproto.label.defs#selfLabels",
+			"values": values,
+		}
+	} else {
+		delete(current.Value, "labels")
+	}
+
+	input := map[string]interface{}{
+		"repo":       did,
+		"collection": ProfileCollection,
+		"rkey":       "self",
+		"record":     current.Value,
+	}
+	/* Don't write over changes made to the profile in the meantime. */
+	if current.Cid != "" {
+		input["swapRecord"] = current.Cid
+	}
+	return bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		return client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.putRecord", nil, input, nil)
+	})
+}
+
+/* Brings how private the Mastodon account is over to Bluesky: accounts that
+ * asked search engines to leave them out get their Bluesky profile kept from
+ * people who aren't logged in, and crossposts of accounts that aren't
+ * discoverable only take replies from people they follow, unless there's a
+ * threadgate set already. Hands back the transform to crosspost with. */
+func mirrorPrivacy(
+	ctx context.Context,
+	ms *mastodonSession,
+	bs *blueskySession,
+	acct *madon.Account,
+	did string,
+	transform TransformConfig) (TransformConfig, error) {
+
+	privacy, err := ms.AccountPrivacy(acct.ID)
+	if err != nil {
+		return transform, errors.New(fmt.Sprintf("could not fetch the privacy settings of @%v: %v", acct.Username, err))
+	}
+
+	if err := setNoUnauthenticated(ctx, bs, did, privacy.NoIndex); err != nil {
+		return transform, errors.New(fmt.Sprintf("could not update the Bluesky profile: %v", err))
+	}
+	if privacy.NoIndex {
+		log.Printf("Bluesky: @%v asked search engines to leave it out, keeping the profile from logged out people", acct.Username)
+	}
+
+	if !privacy.Discoverable && transform.Threadgate == nil {
+		log.Printf("Bluesky: @%v isn't discoverable, only taking replies from people it follows", acct.Username)
+		transform.Threadgate = []string{ThreadgateFollowing}
+	}
+	return transform, nil
+}
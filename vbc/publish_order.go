@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/* How long statuses of different Mastodon accounts on their way to the same
+ * Bluesky account get to gather before the first of them goes up, so they
+ * can be put up in the order they were posted in. */
+const PublishWindow = 2 * time.Second
+
+/* Takes turns publishing to a Bluesky account among the Mastodon accounts
+ * crossposted to it. Only one of them publishes at a time, and those that
+ * come in within PublishWindow of each other go up oldest status first, so
+ * catching up on several accounts at once doesn't shuffle their statuses.
+ * An account with nobody else publishing to its Bluesky account never
+ * waits. The zero value is ready to use. */
+type publishOrder struct {
+	mu sync.Mutex
+	/* How many accounts publish here, see Join. */
+	sources int
+	busy    bool
+	waiting []*publishTurn
+	/* When the window of the statuses that are waiting closes. */
+	closes time.Time
+	timer  *time.Timer
+}
+
+type publishTurn struct {
+	created time.Time
+	ready   chan struct{}
+}
+
+/* Counts an account in as publishing here, until it Leaves. */
+func (o *publishOrder) Join() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sources++
+}
+
+func (o *publishOrder) Leave() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sources--
+	o.next()
+}
+
+/* Waits for the turn of a status posted at created, handing back what ends
+ * it once its posts are up. */
+func (o *publishOrder) Wait(ctx context.Context, created time.Time) (func(), error) {
+	o.mu.Lock()
+	if o.sources <= 1 && !o.busy && len(o.waiting) == 0 {
+		o.busy = true
+		o.mu.Unlock()
+		return o.done, nil
+	}
+
+	turn := &publishTurn{created: created, ready: make(chan struct{})}
+	if len(o.waiting) == 0 {
+		o.closes = time.Now().Add(PublishWindow)
+	}
+	o.waiting = append(o.waiting, turn)
+	o.next()
+	o.mu.Unlock()
+
+	select {
+	case <-turn.ready:
+		return o.done, nil
+	case <-ctx.Done():
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	select {
+	case <-turn.ready:
+		/* It came anyway, and someone else can have it. */
+		o.busy = false
+	default:
+		for i, waiting := range o.waiting {
+			if waiting == turn {
+				o.waiting = append(o.waiting[:i], o.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	o.next()
+	return nil, ctx.Err()
+}
+
+func (o *publishOrder) done() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.busy = false
+	o.next()
+}
+
+/* Hands the turn to the oldest status waiting, once their window closes.
+ * Called with mu held. */
+func (o *publishOrder) next() {
+	if o.busy || len(o.waiting) == 0 {
+		return
+	}
+	if wait := time.Until(o.closes); wait > 0 {
+		if o.timer == nil {
+			o.timer = time.AfterFunc(wait, func() {
+				o.mu.Lock()
+				defer o.mu.Unlock()
+				o.timer = nil
+				o.next()
+			})
+		}
+		return
+	}
+
+	oldest := 0
+	for i, turn := range o.waiting {
+		if turn.created.Before(o.waiting[oldest].created) {
+			oldest = i
+		}
+	}
+	turn := o.waiting[oldest]
+	o.waiting = append(o.waiting[:oldest], o.waiting[oldest+1:]...)
+	o.busy = true
+	close(turn.ready)
+}
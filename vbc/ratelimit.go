@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+/* Requests per second each Bluesky account may make, when
+ * VBC_BSKY_RATE_LIMIT isn't set. Well under what Bluesky lets through, as
+ * everything crossposting to the account goes through the same limit. */
+const BlueskyRateLimitDefault = 5
+
+/* A token bucket, letting through bursts of up to a second worth of requests,
+ * or one request when that's less, and then rate requests every second. A
+ * nil limiter lets everything through. */
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(rate, 1)
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+/* Waits for a request to be let through, or for ctx to be done. */
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+/* Keeps an account from crossposting more than limit statuses in any one
+ * hour, so a backfill doesn't flood its followers. Once the limit is hit,
+ * statuses held back go out one at a time, spread out over the hour, rather
+ * than all at once as soon as there's room. A nil limiter never holds back. */
+type postLimiter struct {
+	limit  int
+	window time.Duration
+
+	/* When the last crossposts went out, oldest first. */
+	sent []time.Time
+	/* Until when crossposts get spread out, which is for as long as there
+	 * may be some being held back. */
+	dripUntil time.Time
+}
+
+func newPostLimiter(limit int) *postLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &postLimiter{limit: limit, window: time.Hour}
+}
+
+/* How long to hold back the next crosspost for, if at all. */
+func (l *postLimiter) Wait() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	now := time.Now()
+	for len(l.sent) > 0 && now.Sub(l.sent[0]) >= l.window {
+		l.sent = l.sent[1:]
+	}
+
+	var next time.Time
+	if len(l.sent) >= l.limit {
+		next = l.sent[len(l.sent)-l.limit].Add(l.window)
+	}
+	if len(l.sent) > 0 && now.Before(l.dripUntil) {
+		if spaced := l.sent[len(l.sent)-1].Add(l.window / time.Duration(l.limit)); spaced.After(next) {
+			next = spaced
+		}
+	}
+	if !next.After(now) {
+		return 0
+	}
+	l.dripUntil = now.Add(l.window)
+	return next.Sub(now)
+}
+
+/* Notes down a crosspost having gone out. */
+func (l *postLimiter) Sent() {
+	if l == nil {
+		return
+	}
+	l.sent = append(l.sent, time.Now())
+}
+
+/* Spaces crossposts out by at least gap, so catching up on a backlog doesn't
+ * land on followers' feeds as a wall of posts. Crossposts that are further
+ * apart than that anyway never wait, and a nil spacer never holds back. */
+type postSpacer struct {
+	gap  time.Duration
+	last time.Time
+}
+
+/* The spacer for the postDelay of config, nil when there's none. */
+func newPostSpacer(config TransformConfig) *postSpacer {
+	gap, err := time.ParseDuration(config.PostDelay)
+	if err != nil || gap <= 0 {
+		return nil
+	}
+	return &postSpacer{gap: gap}
+}
+
+/* How long to hold off on the next crosspost for, if at all. */
+func (s *postSpacer) Wait() time.Duration {
+	if s == nil || s.last.IsZero() {
+		return 0
+	}
+	wait := time.Until(s.last.Add(s.gap))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+/* Notes down a crosspost having gone out. */
+func (s *postSpacer) Sent() {
+	if s == nil {
+		return
+	}
+	s.last = time.Now()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	/* Statuses looked at on startup, when VBC_RECONCILE_LAST isn't set. */
+	ReconcileLastDefault = 20
+	/* As many as Mastodon hands out in one page. */
+	ReconcileLastMax = 40
+	/* Records looked at on Bluesky, which has the posts of threads and
+	 * whatever was posted there directly mixed in with the crossposts. */
+	ReconcileRecords = 100
+)
+
+/* Compares the last statuses of an account against the store and the last
+ * records on Bluesky, repairing what a crash between putting records and
+ * writing down where they went leaves behind:
+ *
+ *   - Statuses that made it over without a mapping get one.
+ *   - Statuses that never made it over, because we weren't running when the
+ *     next one came along, get queued to be tried again.
+ *   - Statuses that made it over twice, first under a random rkey and then
+ *     under the one they get now, lose the one nothing points to.
+ *
+ * Posts that were taken down on Bluesky are left that way, and their mappings
+ * say so. Statuses are fetched with query, the same one polling uses, so
+ * those the config leaves out never get queued. */
+func reconcileAccount(
+	ctx context.Context,
+	store Store,
+	ms *mastodonSession,
+	bs *blueskySession,
+	key AccountKey,
+	acct *madon.Account,
+	did string,
+	query statusQuery,
+	last int) error {
+
+	statuses, err := ms.AccountStatuses(acct.ID, query, &madon.LimitParams{Limit: last})
+	if err != nil {
+		return err
+	}
+
+	records, oldest, err := listRecentPosts(ctx, bs, did)
+	if err != nil {
+		return err
+	}
+
+	queued := make(map[int64]bool)
+	queue, err := store.RetryQueue(key)
+	if err != nil {
+		return err
+	}
+	dead, err := store.DeadLetters(key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range append(queue, dead...) {
+		queued[entry.Status] = true
+	}
+
+	/* Oldest first, the same order they'd have been crossposted in. */
+	for i := len(statuses) - 1; i >= 0; i-- {
+		status := &statuses[i]
+		rkey := statusRkey(status, 0)
+		root, posted := records[rkey]
+		if !posted {
+			rkey = legacyStatusRkey(status, 0)
+			root, posted = records[rkey]
+		}
+
+		value, err := store.Mapping(key, status.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case value == nil && posted:
+			log.Printf("reconcile: %v made it to %v, but wasn't written down", status.URL, root.Uri)
+			mapping, err := encodeMapping(newPostedMapping(root.Uri, root.Cid))
+			if err != nil {
+				return err
+			}
+			if err := store.PutMapping(key, status.ID, mapping); err != nil {
+				return err
+			}
+			if err := store.RemoveRetry(key, status.ID); err != nil {
+				return err
+			}
+
+		case value == nil && !queued[status.ID]:
+			log.Printf("reconcile: %v never made it over, queueing it", status.URL)
+			if err := store.PutRetry(key, RetryEntry{Status: status.ID}); err != nil {
+				return err
+			}
+
+		case value != nil && posted:
+			mapped, err := decodeMapping(value)
+			if err != nil || !mapped.Posted() || mapped.Uri == root.Uri {
+				continue
+			}
+			log.Printf("reconcile: %v made it over twice, keeping %v and deleting %v",
+				status.URL,
+				mapped.Uri,
+				root.Uri)
+			for ; ; rkey = nextStatusRkey(rkey) {
+				if _, found := records[rkey]; !found {
+					break
+				}
+				if err := deleteRecord(ctx, bs, did, PostCollection, rkey); err != nil {
+					return err
+				}
+			}
+
+		case value != nil:
+			/* Only posts newer than the oldest one listed would have been
+			 * listed, were they still there. */
+			mapped, err := decodeMapping(value)
+			if err != nil || !mapped.Posted() || mapped.Rkey < oldest {
+				continue
+			}
+			if _, found := records[mapped.Rkey]; found {
+				continue
+			}
+			log.Printf("reconcile: %v was taken down from %v", status.URL, mapped.Uri)
+			mapped.State = MappingDeleted
+			mapped.Updated = time.Now().UTC()
+			updated, err := encodeMapping(*mapped)
+			if err != nil {
+				return err
+			}
+			if err := store.PutMapping(key, status.ID, updated); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* The most recent posts of a repo, keyed by rkey, along with the oldest rkey
+ * among them. */
+func listRecentPosts(ctx context.Context, bs *blueskySession, did string) (map[string]mappedPost, string, error) {
+	var out struct {
+		Records []mappedPost `json:"records"`
+	}
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		params := map[string]interface{}{
+			"repo":       did,
+			"collection": PostCollection,
+			"limit":      ReconcileRecords,
+		}
+		return client.Do(ctx, xrpc.Query, "", "com.atproto.repo.listRecords", params, nil, &out)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	/* A repo with fewer posts than were asked for has them all listed. */
+	oldest := ""
+	records := make(map[string]mappedPost, len(out.Records))
+	for _, record := range out.Records {
+		rkey := record.Uri[strings.LastIndex(record.Uri, "/")+1:]
+		records[rkey] = record
+		if len(out.Records) == ReconcileRecords && (oldest == "" || rkey < oldest) {
+			oldest = rkey
+		}
+	}
+	return records, oldest, nil
+}
+
+func deleteRecord(ctx context.Context, bs *blueskySession, repo string, collection string, rkey string) error {
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		input := map[string]interface{}{
+			"repo":       repo,
+			"collection": collection,
+			"rkey":       rkey,
+		}
+		return client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.deleteRecord", nil, input, nil)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not delete %v/%v: %v", collection, rkey, err))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+/* An app.bsky.feed.post record, along with the fields the version of indigo
+ * we're on doesn't know about yet. Gets published as plain JSON. */
+type postRecord struct {
+	*bsky.FeedPost
+	Labels *selfLabels `json:"labels,omitempty"`
+	/* Takes the place of the embed in FeedPost, see postEmbed. */
+	Embed *postEmbed `json:"embed,omitempty"`
+	/* Takes the place of the facets in FeedPost, see linkFacets. */
+	Facets []*richtextFacet `json:"facets,omitempty"`
+	/* Tags that don't show up in the text, see TransformConfig.MirrorTags. */
+	Tags []string `json:"tags,omitempty"`
+
+	/* The link the card of a post without text is for, see onlyLink. */
+	cardLink string
+}
+
+/* Marks a range of the text of a post, see app.bsky.richtext.facet. Only
+ * ever used for links. */
+type richtextFacet struct {
+	Index    facetIndex     `json:"index"`
+	Features []facetFeature `json:"features"`
+}
+
+/* Byte offsets into the UTF-8 text, end not included. */
+type facetIndex struct {
+	ByteStart int `json:"byteStart"`
+	ByteEnd   int `json:"byteEnd"`
+}
+
+type facetFeature struct {
+	LexiconTypeID string `json:"$type"`
+	URI           string `json:"uri"`
+}
+
+func newLinkFacet(start int, end int, uri string) *richtextFacet {
+	return &richtextFacet{
+		Index: facetIndex{ByteStart: start, ByteEnd: end},
+		Features: []facetFeature{{
+			LexiconTypeID: "app.bsky.richtext.facet#link",
+			URI:           uri,
+		}},
+	}
+}
+
+/* Labels the author puts on their own record, see com.atproto.label.defs. */
+type selfLabels struct {
+	LexiconTypeID string      `json:"$type"`
+	Values        []selfLabel `json:"values"`
+}
+
+type selfLabel struct {
+	Val string `json:"val"`
+}
+
+func newSelfLabels(values []string) *selfLabels {
+	if len(values) == 0 {
+		return nil
+	}
+
+	labels := &selfLabels{
+		LexiconTypeID: "com.atproto.label.defs#selfLabels",
+		Values:        make([]selfLabel, 0, len(values)),
+	}
+	for _, value := range values {
+		labels.Values = append(labels.Values, selfLabel{Val: value})
+	}
+	return labels
+}
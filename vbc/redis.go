@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RedisDialTimeout = 5 * time.Second
+	RedisIOTimeout   = 10 * time.Second
+)
+
+/* Error replies sent back by the Redis server, as opposed to I/O errors. */
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+/* A very small client speaking just enough RESP for what we need. It holds a
+ * single connection guarded by a mutex, and reconnects lazily whenever the
+ * connection breaks. */
+type redisClient struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func dialRedis(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisClient{}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.useTLS = true
+	default:
+		return nil, errors.New(fmt.Sprintf(
+			"unsupported redis URL scheme %q, expected redis:// or rediss://",
+			u.Scheme))
+	}
+
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			c.username = u.User.Username()
+			c.password = password
+		} else {
+			c.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("redis database %q is not an integer", db))
+		}
+	}
+
+	/* Connect right away, so that bad URLs are caught at startup. */
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(time.Time{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/* Connects, giving up once deadline has passed, if there is one. */
+func (c *redisClient) connect(deadline time.Time) error {
+	dialer := &net.Dialer{Timeout: RedisDialTimeout, Deadline: deadline}
+
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := c.roundTrip(args, deadline); err != nil {
+			c.disconnect()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)}, deadline); err != nil {
+			c.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) disconnect() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.conn = nil
+	c.rd = nil
+}
+
+/* Do sends a single command and waits for its reply. Replies are decoded to
+ * string (simple and bulk strings), int64, nil (null bulk strings and arrays),
+ * []interface{} or redisError. */
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	return c.DoBefore(time.Time{}, args...)
+}
+
+/* Same as Do, but giving up once deadline has passed, connecting included,
+ * for when a reply that comes any later is no use. A zero deadline leaves it
+ * at the usual timeouts. */
+func (c *redisClient) DoBefore(deadline time.Time, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args, deadline)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		/* The connection is in an unknown state, start over next time. */
+		c.disconnect()
+	}
+	return reply, err
+}
+
+func (c *redisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disconnect()
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string, deadline time.Time) (interface{}, error) {
+	if limit := time.Now().Add(RedisIOTimeout); deadline.IsZero() || limit.Before(deadline) {
+		deadline = limit
+	}
+	_ = c.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := c.readReply()
+			var rerr redisError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			if err != nil {
+				items[i] = rerr
+			} else {
+				items[i] = item
+			}
+		}
+		return items, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("redis: unknown reply type %q", line[0]))
+	}
+}
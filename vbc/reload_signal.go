@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/* Rotates credentials on SIGHUP, see reloadCredentials. */
+func watchReloadSignal(ctx context.Context, sessions *sessionPool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				log.Printf("rotating credentials on SIGHUP")
+				reloadCredentials(ctx, sessions)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
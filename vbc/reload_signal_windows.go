@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "context"
+
+/* There's no SIGHUP on Windows, so credentials only change on a restart. */
+func watchReloadSignal(ctx context.Context, sessions *sessionPool) {}
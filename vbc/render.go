@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/McKael/madon"
+	"golang.org/x/net/html"
+	"jaytaylor.com/html2text"
+)
+
+/* Renders the HTML we get from Mastodon into the plain text we post, links
+ * shown the way the status shows them. Should the HTML fail to render, its
+ * tags get stripped out instead. */
+func renderStatusText(content string) string {
+	content, links := takeOutLinks(content)
+	pretty, err := html2text.FromString(content, html2text.Options{PrettyTables: true})
+	if err != nil {
+		pretty = stripTags(content)
+	}
+	return joinSegments(putBackLinks(pretty, links))
+}
+
+/* Same as renderStatusText, for the text that gets posted, split into the
+ * segments it's made of, with what happens when the HTML fails to render up
+ * to fallback, one of the htmlFallback modes. */
+func renderStatusSegments(content string, fallback string) ([]TextSegment, error) {
+	content, links := takeOutLinks(content)
+	pretty, err := html2text.FromString(content, html2text.Options{PrettyTables: true})
+	if err == nil {
+		return putBackLinks(pretty, links), nil
+	}
+
+	switch fallback {
+	case HTMLFallbackSkip:
+		return nil, skipped("its HTML could not be rendered: %v", err)
+	case HTMLFallbackDeadLetter:
+		return nil, permanent(errors.New(fmt.Sprintf("could not render HTML: %v", err)))
+	}
+	log.Printf("WARNING: could not render HTML, stripping its tags instead: %v", err)
+	return putBackLinks(stripTags(content), links), nil
+}
+
+/* Stands in for a link while the HTML around it gets rendered, see
+ * takeOutLinks. Made of private use characters, which statuses have no
+ * business having. */
+var linkMarkerRe = regexp.MustCompile(`\x{E000}(\d+)\x{E001}`)
+
+func linkMarker(n int) string {
+	return fmt.Sprintf("\uE000%v\uE001", n)
+}
+
+/* Whether a tag has the given class. */
+func hasClass(token html.Token, class string) bool {
+	for _, attr := range token.Attr {
+		if attr.Key == "class" {
+			for _, name := range strings.Fields(attr.Val) {
+				if name == class {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+/* Takes the links out of the HTML of a status, leaving markers in their
+ * place, for putBackLinks to put them back once it's been rendered. Left in,
+ * html2text would write each one out as its text followed by where it goes,
+ * and the text of a link on Mastodon is mostly in spans only there to hide
+ * it, which html2text knows nothing about. The links come back as what the
+ * status shows them as, which for links Mastodon shows as where they go, cut
+ * short or not, is where they go in full, so shortenLinks gets the last word
+ * on how they come out. */
+func takeOutLinks(content string) (string, []TextSegment) {
+	var out strings.Builder
+	var links []TextSegment
+
+	/* The link we're in, if any, with all the text in it, and the text in
+	 * it that isn't hidden. */
+	var link *TextSegment
+	var full, shown strings.Builder
+	/* Which of the spans we're in inside of it hide their text, and which
+	 * end in an ellipsis. */
+	var hides, ellipses []bool
+	hidden := 0
+	end := func() {
+		link.Text = strings.TrimSpace(shown.String())
+		if link.Text == "" || strings.TrimSpace(full.String()) == link.Link {
+			link.Text = link.Link
+		}
+		out.WriteString(linkMarker(len(links)))
+		links = append(links, *link)
+		link = nil
+	}
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		kind := z.Next()
+		if kind == html.ErrorToken {
+			if link != nil {
+				end()
+			}
+			return out.String(), links
+		}
+		if link == nil {
+			raw := string(z.Raw())
+			token := z.Token()
+			href := ""
+			if kind == html.StartTagToken && token.Data == "a" {
+				for _, attr := range token.Attr {
+					if attr.Key == "href" {
+						href = strings.TrimSpace(attr.Val)
+					}
+				}
+			}
+			if href == "" {
+				out.WriteString(raw)
+				continue
+			}
+			link = &TextSegment{Link: href}
+			full.Reset()
+			shown.Reset()
+			hides, ellipses, hidden = nil, nil, 0
+			continue
+		}
+
+		token := z.Token()
+		switch {
+		case kind == html.TextToken:
+			full.WriteString(token.Data)
+			if hidden == 0 {
+				shown.WriteString(token.Data)
+			}
+		case kind == html.StartTagToken && token.Data == "span":
+			hide := hasClass(token, "invisible")
+			hides = append(hides, hide)
+			ellipses = append(ellipses, hasClass(token, "ellipsis"))
+			if hide {
+				hidden++
+			}
+		case kind == html.EndTagToken && token.Data == "span" && len(hides) > 0:
+			last := len(hides) - 1
+			if hides[last] {
+				hidden--
+			}
+			if ellipses[last] && hidden == 0 {
+				shown.WriteString("…")
+			}
+			hides, ellipses = hides[:last], ellipses[:last]
+		case kind == html.EndTagToken && token.Data == "a":
+			end()
+		}
+	}
+}
+
+/* Puts the links takeOutLinks took out of the HTML of a status back into
+ * what it was rendered to, splitting it into the segments it's made of. */
+func putBackLinks(text string, links []TextSegment) []TextSegment {
+	var segments []TextSegment
+	last := 0
+	for _, match := range linkMarkerRe.FindAllStringSubmatchIndex(text, -1) {
+		n, err := strconv.Atoi(text[match[2]:match[3]])
+		if err != nil || n >= len(links) {
+			continue
+		}
+		segments = append(segments, segmentText(text[last:match[0]])...)
+		segments = append(segments, links[n])
+		last = match[1]
+	}
+	return append(segments, segmentText(text[last:])...)
+}
+
+/* Tags that end a line of text, and those whose contents aren't text. */
+var (
+	lineBreakTags = map[string]bool{
+		"p": true, "div": true, "li": true, "blockquote": true,
+		"pre": true, "h1": true, "h2": true, "h3": true, "h4": true,
+		"h5": true, "h6": true, "tr": true,
+	}
+	hiddenTags = map[string]bool{"script": true, "style": true}
+)
+
+/* The bare minimum of rendering HTML out to text, for when html2text can't:
+ * the text of it, entities and all, with lines broken where blocks end and
+ * nothing of the tags left. */
+func stripTags(content string) string {
+	var text strings.Builder
+	hidden := 0
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			/* No more than a blank line between paragraphs. */
+			var lines []string
+			for _, line := range strings.Split(text.String(), "\n") {
+				line = strings.Join(strings.Fields(line), " ")
+				if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+					continue
+				}
+				lines = append(lines, line)
+			}
+			return strings.TrimSpace(strings.Join(lines, "\n"))
+		case html.TextToken:
+			if hidden == 0 {
+				text.WriteString(z.Token().Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if hiddenTags[token.Data] {
+				hidden++
+			} else if token.Data == "br" {
+				text.WriteString("\n")
+			}
+		case html.EndTagToken:
+			token := z.Token()
+			if hiddenTags[token.Data] && hidden > 0 {
+				hidden--
+			} else if lineBreakTags[token.Data] {
+				text.WriteString("\n\n")
+			}
+		}
+	}
+}
+
+/* Figures out which instance a status URL points to, along with the ID of
+ * the status. Bare IDs are taken to be on VBC_MASTODON_INSTANCE. */
+func parseStatusURL(raw string) (string, int64, error) {
+	if id, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		instance := envOrNil("VBC_MASTODON_INSTANCE")
+		if instance == nil {
+			return "", 0, errors.New("bare status IDs need VBC_MASTODON_INSTANCE to be set")
+		}
+		canonical, err := parseInstanceName(*instance)
+		if err != nil {
+			return "", 0, err
+		}
+		return canonical, id, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	if u.Host == "" {
+		return "", 0, errors.New(fmt.Sprintf("%v is neither a status URL nor a status ID", raw))
+	}
+
+	/* All of /@user/<id>, /users/user/statuses/<id> and /web/statuses/<id>
+	 * end with the ID of the status. */
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	id, err := strconv.ParseInt(segments[len(segments)-1], 10, 64)
+	if err != nil {
+		return "", 0, errors.New(fmt.Sprintf("could not find a status ID in %v", raw))
+	}
+
+	instance, err := parseInstanceName(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return "", 0, errors.New(fmt.Sprintf("%v is not a status URL: %v", raw, err))
+	}
+	return instance, id, nil
+}
+
+/* Fetches a status given its URL, without needing a registered app. */
+func fetchStatusByURL(raw string) (*madon.Status, error) {
+	instance, id, err := parseStatusURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	mc, err := madon.RestoreApp(AppName, instance, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return mc.GetStatus(id)
+}
+
+/* Writes out the posts a status turns into the way they read on Bluesky, one
+ * after the other, each followed by what in it links where. */
+func renderPosts(posts []*postRecord) string {
+	var out strings.Builder
+	for i, post := range posts {
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		out.WriteString(post.Text + "\n")
+		for _, facet := range post.Facets {
+			for _, feature := range facet.Features {
+				fmt.Fprintf(&out, "  %v -> %v\n", post.Text[facet.Index.ByteStart:facet.Index.ByteEnd], feature.URI)
+			}
+		}
+	}
+	return out.String()
+}
+
+func renderCommand(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc render <status-url>\n\n")
+		fmt.Fprintf(fs.Output(), "Prints the text vbc would post for a status, and where its links go, so\n")
+		fmt.Fprintf(fs.Output(), "conversion bugs can be reported along with exactly what came out. The\n")
+		fmt.Fprintf(fs.Output(), "configuration in VBC_CONFIG is applied as it would be for VBC_BSKY_HANDLE.\n")
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	status, err := fetchStatusByURL(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("could not fetch status %v: %v", fs.Arg(0), err)
+	}
+
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	instance, _, _ := parseStatusURL(fs.Arg(0))
+	var accountID int64
+	if status.Account != nil {
+		accountID = status.Account.ID
+	}
+	transform := config.TransformFor(instance, accountID, envOrDefault("VBC_BSKY_HANDLE", ""))
+
+	/* Same as prepareRepost does it, with nothing stored about the
+	 * instance to go by. */
+	if transform.CustomEmoji == CustomEmojiStrip {
+		status = loadInstanceInfo(context.Background(), newMemoryStore(), instance).WithoutCustomEmoji(status)
+	}
+	extras, err := fetchStatusExtras(&madon.Client{InstanceURL: instance}, status.ID)
+	if err == nil && extras.LocalOnly {
+		err = skipped("status is local-only")
+	}
+	var posts []*postRecord
+	if err == nil {
+		posts, err = transformStatus(status, extras, transform)
+	}
+	var skip skipError
+	if errors.As(err, &skip) {
+		log.Fatalf("status would not be crossposted: %v", skip.reason)
+	} else if err != nil {
+		log.Fatalf("could not convert status: %v", err)
+	}
+	fmt.Print(renderPosts(posts))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/McKael/madon"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata instead of comparing against them")
+
+/* Renders every sample in testdata/render the way vbc render does, with the
+ * default configuration, and compares it to its golden output, the .txt file
+ * of the same name. Run with -update when a change in the output is on
+ * purpose. */
+func TestRenderGolden(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "render", "*.html"))
+	if err != nil {
+		t.Fatalf("could not list samples: %v", err)
+	}
+	if len(samples) == 0 {
+		t.Fatalf("no .html samples in testdata/render")
+	}
+
+	for _, sample := range samples {
+		sample := sample
+		name := strings.TrimSuffix(filepath.Base(sample), ".html")
+		t.Run(name, func(t *testing.T) {
+			html, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatalf("could not read sample: %v", err)
+			}
+			posts, err := transformStatus(&madon.Status{Content: string(html), Visibility: "public"}, nil, DefaultTransformConfig)
+			if err != nil {
+				t.Fatalf("could not convert sample: %v", err)
+			}
+			rendered := renderPosts(posts)
+
+			golden := strings.TrimSuffix(sample, ".html") + ".txt"
+			if *update {
+				if err := os.WriteFile(golden, []byte(rendered), 0644); err != nil {
+					t.Fatalf("could not write golden file: %v", err)
+				}
+				return
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("could not read golden file: %v", err)
+			}
+			if string(expected) != rendered {
+				t.Errorf("rendered differently than %v\n--- expected\n%s--- got\n%s", golden, expected, rendered)
+			}
+		})
+	}
+}
+
+/* Status URLs come from the command line, and through it the daemon, so a
+ * malformed one has to come back as an error rather than stop vbc. */
+func TestParseStatusURL(t *testing.T) {
+	instance, id, err := parseStatusURL("https://tiggi.es/@mbr/109000000000000001")
+	if err != nil {
+		t.Fatalf("could not parse a status URL: %v", err)
+	}
+	if instance != "https://tiggi.es/" || id != 109000000000000001 {
+		t.Errorf("status URL came back as %v on %v", id, instance)
+	}
+
+	if _, _, err := parseStatusURL("//tiggi.es/1"); err == nil {
+		t.Errorf("parsed a status URL with no scheme")
+	}
+}
+
+/* Links come out as segments going where their anchor does, shown in full
+ * when Mastodon shows them as where they go, however cut short, and as what
+ * they say otherwise. */
+func TestRenderLinkSegments(t *testing.T) {
+	content := `<p>Read <a href="https://example.com/a/rather/long/path/to/a/post" rel="nofollow noopener noreferrer" target="_blank"><span class="invisible">https://</span><span class="ellipsis">example.com/a/rather/long/path</span><span class="invisible">/to/a/post</span></a> by <span class="h-card"><a href="https://tiggi.es/@mbr" class="u-url mention">@<span>mbr</span></a></span>.</p>`
+	segments, err := renderStatusSegments(content, HTMLFallbackStrip)
+	if err != nil {
+		t.Fatalf("could not render: %v", err)
+	}
+
+	expected := []TextSegment{
+		{Text: "Read "},
+		{Text: "https://example.com/a/rather/long/path/to/a/post", Link: "https://example.com/a/rather/long/path/to/a/post"},
+		{Text: " by "},
+		{Text: "@mbr", Link: "https://tiggi.es/@mbr"},
+		{Text: "."},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, segments)
+	}
+	for i := range expected {
+		if segments[i] != expected[i] {
+			t.Errorf("segment %v is %+v rather than %+v", i, segments[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* What media in an archive is taken to be, by the extension of its URL, the
+ * archive not saying. Anything else is left out, as media that isn't an image
+ * always is. */
+var archivedMediaTypes = map[string]string{
+	".jpg":  "image",
+	".jpeg": "image",
+	".png":  "image",
+	".gif":  "image",
+	".webp": "image",
+	".mp4":  "video",
+	".webm": "video",
+	".mov":  "video",
+}
+
+/* Reads what `vbc export` wrote as JSONL. */
+func readExport(file string) ([]exportItem, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []exportItem
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var item exportItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %v: %v", line, err))
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+/* A status as it was when it was exported, for those no longer on Mastodon.
+ * The archive doesn't say who could see it, nor what it replied to, but it
+ * was crossposted, so it went out to everyone, and it goes up on its own. */
+func archivedStatus(item exportItem) madon.Status {
+	status := madon.Status{
+		ID:         item.Status,
+		URL:        item.StatusURL,
+		Content:    item.HTML,
+		Visibility: "public",
+	}
+	if item.StatusCreated != nil {
+		status.CreatedAt = *item.StatusCreated
+	}
+	for _, media := range item.Media {
+		kind, found := archivedMediaTypes[strings.ToLower(path.Ext(media))]
+		if !found {
+			kind = "unknown"
+		}
+		status.MediaAttachments = append(status.MediaAttachments, madon.Attachment{Type: kind, URL: media})
+	}
+	return status
+}
+
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	from := fs.String("from", "", "JSONL file written by vbc export")
+	target := fs.String("target", "", "Bluesky handle to crosspost everything in it to")
+	dryRun := fs.Bool("dry-run", false, "print the plan and stop there")
+	yes := fs.Bool("yes", false, "go ahead without asking")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc replay --from <export.jsonl> --target <handle> [--dry-run] [--yes]\n\n")
+		fmt.Fprintf(fs.Output(), "Crossposts every status in an archive written by vbc export again, oldest\n")
+		fmt.Fprintf(fs.Output(), "first, to another Bluesky account, such as a fresh one after starting\n")
+		fmt.Fprintf(fs.Output(), "over. Statuses still on Mastodon go over as they are now, those that\n")
+		fmt.Fprintf(fs.Output(), "aren't as they are in the archive. Goes as slowly as a backfill, and like\n")
+		fmt.Fprintf(fs.Output(), "one, picks up where it left off when run again. Needs vbc stopped.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || *from == "" || *target == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	items, err := readExport(*from)
+	if err != nil {
+		log.Fatalf("could not read %v: %v", *from, err)
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	pair := config.PairFor(strings.TrimPrefix(*target, "@"))
+
+	/* A fresh account might not be in the configuration yet, in which case
+	 * the archive says whose statuses they are, as long as they're all of
+	 * one account. */
+	if pair.Instance == "" || pair.AccountID == 0 {
+		accounts := make(map[string]exportItem)
+		for _, item := range items {
+			accounts[fmt.Sprintf("%v@%v", item.Account, item.Instance)] = item
+		}
+		if len(accounts) != 1 {
+			log.Fatalf("could not tell which account @%v gets crossposted from, add it to the configuration", pair.Handle)
+		}
+		for _, item := range accounts {
+			pair.Instance, pair.AccountID = item.Instance, item.Account
+		}
+	}
+
+	/* The same status may be in there more than once, exported for every
+	 * account it went to. */
+	seen := make(map[int64]bool)
+	var archived []exportItem
+	for _, item := range items {
+		if item.Instance != pair.Instance || item.Account != pair.AccountID || seen[item.Status] {
+			continue
+		}
+		seen[item.Status] = true
+		archived = append(archived, item)
+	}
+	sort.Slice(archived, func(i, j int) bool { return archived[i].Status < archived[j].Status })
+	if len(archived) == 0 {
+		log.Fatalf("%v has no statuses of account %v on %v", *from, pair.AccountID, pair.Instance)
+	}
+
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	appId, appSecret := envAppCredentials(pair.Instance)
+	ms, err := newMastodonSession(store, pair.Instance, appId, appSecret)
+	if err != nil {
+		log.Fatalf("could not set up Mastodon client for %v: %v", pair.Instance, err)
+	}
+	plan, err := newBackfillPlan(ctx, store, config, pair, ms)
+	if err != nil {
+		log.Fatalf("could not plan replay to @%v: %v", pair.Handle, err)
+	}
+
+	/* Mappings only go in accounts that have been bootstrapped, and
+	 * bootstrapping later on would have what's replayed ignored. What
+	 * bootstrapping ignores gets written over as it's replayed. */
+	bootstrapped, err := store.HasAccount(plan.key)
+	if err != nil {
+		log.Fatalf("could not look up account: %v", err)
+	}
+	if !bootstrapped && !*dryRun {
+		var acct *madon.Account
+		err = ms.Do(func(mc *madon.Client) error {
+			a, err := mc.GetAccount(pair.AccountID)
+			acct = a
+			return err
+		})
+		if err != nil {
+			log.Fatalf("could not query for Mastodon user: %v", err)
+		}
+		if err := bootstrapAccount(ctx, store, ms, plan.bs, plan.key, acct); err != nil {
+			log.Fatalf("could not bootstrap account @%v: %v", acct.Username, err)
+		}
+	}
+
+	replayed := 0
+	for _, item := range archived {
+		value, err := store.Mapping(plan.key, item.Status)
+		if err != nil {
+			log.Fatalf("could not look up mapping of %v: %v", item.StatusURL, err)
+		}
+		if value != nil {
+			if mapping, err := decodeMapping(value); err == nil && mapping.Posted() {
+				replayed++
+				continue
+			}
+		}
+
+		var status *madon.Status
+		err = ms.Do(func(mc *madon.Client) error {
+			s, err := mc.GetStatus(item.Status)
+			status = s
+			return err
+		})
+		if code, _ := errorStatusCode(err); err != nil && (code == http.StatusNotFound || code == http.StatusGone) {
+			if item.HTML == "" && len(item.Media) == 0 {
+				log.Printf("WARNING: not replaying %v, it's no longer on Mastodon and the archive doesn't have it either", item.StatusURL)
+				continue
+			}
+			plan.Add(archivedStatus(item), true)
+			continue
+		} else if err != nil {
+			log.Fatalf("could not fetch %v: %v", item.StatusURL, err)
+		}
+		plan.Add(*status, false)
+	}
+
+	fmt.Printf("%v status(es) in %v, %v already replayed to @%v.\n", len(archived), *from, replayed, pair.Handle)
+	if len(plan.items) == 0 {
+		fmt.Printf("Nothing to replay.\n")
+		return
+	}
+	posts, uploads := plan.Totals()
+	gone := 0
+	for _, item := range plan.items {
+		if item.archived {
+			gone++
+		}
+	}
+	fmt.Printf("%v to replay, %v of them from the archive, in %v post(s) and %v upload(s), about %v.\n",
+		len(plan.items),
+		gone,
+		posts,
+		uploads,
+		plan.Estimate(backfillRateLimit()).Round(time.Minute))
+	if *dryRun {
+		return
+	}
+	if !*yes && !askToGoAhead() {
+		return
+	}
+
+	stop := stopOnInterrupt()
+	done, err := runBackfill(ctx, store, plan, stop)
+	log.Printf("replayed %v of %v status(es) to @%v", done, len(plan.items), pair.Handle)
+	if err != nil {
+		log.Fatalf("replay stopped, run it again to pick up where it left off: %v", err)
+	}
+	select {
+	case <-stop:
+		log.Printf("replay stopped, run it again to pick up where it left off")
+	default:
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+/* The status a reply of the author's to themselves replies to hasn't made it
+ * over yet, so the reply has to wait for it, having nothing to go under. */
+var errParentPending = errors.New("status replied to is not crossposted yet")
+
+/* Where the crosspost of a reply of the author's to themselves goes: under
+ * the last post the status it replies to became, in the thread that one is
+ * in. Nil for statuses that aren't replies, and for replies to statuses that
+ * were never crossposted, such as those from before bootstrapping, which go
+ * up on their own. */
+func replyRef(
+	ctx context.Context,
+	store Store,
+	key AccountKey,
+	bs *blueskySession,
+	did string,
+	status *madon.Status) (*bsky.FeedPost_ReplyRef, error) {
+
+	if status.InReplyToID == nil {
+		return nil, nil
+	}
+	value, err := store.Mapping(key, *status.InReplyToID)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, errParentPending
+	}
+	parent, err := decodeMapping(value)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.Posted() {
+		return nil, nil
+	}
+
+	/* Threads go up with a record key after the other, see
+	 * nextStatusRkey. */
+	last := atproto.RepoStrongRef{Uri: parent.Uri, Cid: parent.Cid}
+	if parent.Parts > 1 {
+		base := strings.TrimSuffix(parent.Uri, parent.Rkey)
+		rkey := parent.Rkey
+		for i := 1; i < parent.Parts; i++ {
+			next := nextStatusRkey(rkey)
+			if next == "" {
+				break
+			}
+			rkey = next
+		}
+		cid, err := recordCIDOf(ctx, bs, did, uriCollection(parent.Uri), rkey)
+		if err != nil {
+			return nil, err
+		}
+		last = atproto.RepoStrongRef{Uri: base + rkey, Cid: cid}
+	}
+
+	root := atproto.RepoStrongRef{Uri: parent.Uri, Cid: parent.Cid}
+	if parent.Root != "" {
+		root = atproto.RepoStrongRef{Uri: parent.Root, Cid: parent.RootCid}
+	}
+	return &bsky.FeedPost_ReplyRef{Root: &root, Parent: &last}, nil
+}
+
+/* Puts statuses in the order they have to be crossposted in: oldest first,
+ * but with replies always after what they reply to, whatever their IDs say,
+ * so the crosspost of a reply has its parent to go under. */
+func threadOrder(statuses []madon.Status) []madon.Status {
+	sorted := copySlice(statuses)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	index := make(map[int64]int, len(sorted))
+	for i, status := range sorted {
+		index[status.ID] = i
+	}
+	ordered := make([]madon.Status, 0, len(sorted))
+	placed := make(map[int64]bool, len(sorted))
+	var place func(i int, depth int)
+	place = func(i int, depth int) {
+		status := sorted[i]
+		if placed[status.ID] {
+			return
+		}
+		/* Depth stops loops, which Mastodon never makes, from going on
+		 * forever. */
+		if status.InReplyToID != nil && depth < len(sorted) {
+			if parent, found := index[*status.InReplyToID]; found {
+				place(parent, depth+1)
+			}
+		}
+		placed[status.ID] = true
+		ordered = append(ordered, status)
+	}
+	for i := range sorted {
+		place(i, 0)
+	}
+	return ordered
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+/* How long sending a report may take before we give up on it. */
+const ReportTimeout = 10 * time.Second
+
+/* Environment variables whose values must never make it into a report. */
+var reportSecretEnvs = []string{
+	"VBC_BSKY_APP_KEY",
+	"VBC_MASTODON_APP_SECRET",
+	"VBC_MASTODON_TOKEN",
+	"VBC_BACKUP_PASSPHRASE",
+	"VBC_SENTRY_DSN",
+	"VBC_ERROR_WEBHOOK",
+}
+
+/* Things that look like credentials, wherever they come from. */
+var reportSecretRe = regexp.MustCompile(
+	`(?i)(bearer|dpop)\s+[A-Za-z0-9._~+/=-]+` +
+		`|((access|refresh)_?token|password|secret|code)(["']?\s*[:=]\s*["']?)[^\s"'&,]+` +
+		`|://[^/\s:@]*:[^/\s@]+@`)
+
+/* An error worth someone's attention, along with where it came from. */
+type errorReport struct {
+	Message string    `json:"message"`
+	Status  string    `json:"status,omitempty"`
+	Account string    `json:"account,omitempty"`
+	Stack   string    `json:"stack"`
+	Time    time.Time `json:"time"`
+}
+
+/* Sends unexpected errors to Sentry, a webhook, or both, so failures don't
+ * go unnoticed in a log nobody reads. A nil reporter reports nothing. */
+type errorReporter struct {
+	webhook string
+	sentry  *sentryDSN
+	secrets []string
+	client  *http.Client
+}
+
+/* Where Sentry wants events sent, and how to authenticate them. */
+type sentryDSN struct {
+	storeURL  string
+	publicKey string
+}
+
+func parseSentryDSN(dsn string) (*sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("DSN has no public key")
+	}
+
+	/* The project ID is the last bit of the path, anything before it is
+	 * where Sentry lives on the host. */
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || path[i+1:] == "" {
+		return nil, errors.New("DSN has no project ID")
+	}
+	prefix, project := path[:i], path[i+1:]
+
+	return &sentryDSN{
+		storeURL:  fmt.Sprintf("%v://%v%v/api/%v/store/", u.Scheme, u.Host, prefix, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+/* Sets up reporting from VBC_SENTRY_DSN and VBC_ERROR_WEBHOOK, giving back
+ * nil when neither is set. */
+func newErrorReporter() (*errorReporter, error) {
+	dsn := envOrDefault("VBC_SENTRY_DSN", "")
+	webhook := envOrDefault("VBC_ERROR_WEBHOOK", "")
+	if dsn == "" && webhook == "" {
+		return nil, nil
+	}
+
+	r := &errorReporter{
+		webhook: webhook,
+		client:  &http.Client{Timeout: ReportTimeout},
+	}
+	if dsn != "" {
+		sentry, err := parseSentryDSN(dsn)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("bad Sentry DSN: %v", err))
+		}
+		r.sentry = sentry
+	}
+	for _, name := range reportSecretEnvs {
+		if value := os.Getenv(name); len(value) >= 4 {
+			r.secrets = append(r.secrets, value)
+		}
+	}
+	return r, nil
+}
+
+/* Takes anything that looks like a secret out of text. */
+func (r *errorReporter) scrub(text string) string {
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, "[scrubbed]")
+	}
+	return reportSecretRe.ReplaceAllStringFunc(text, func(match string) string {
+		sub := reportSecretRe.FindStringSubmatch(match)
+		switch {
+		case sub[1] != "":
+			return sub[1] + " [scrubbed]"
+		case sub[2] != "":
+			return sub[2] + sub[4] + "[scrubbed]"
+		default:
+			return "://[scrubbed]@"
+		}
+	})
+}
+
+/* Reports an error, along with the status and account it's about, if any.
+ * Failing to report is only ever logged. */
+func (r *errorReporter) Report(err error, status string, account string) {
+	if r == nil || err == nil {
+		return
+	}
+
+	report := errorReport{
+		Message: r.scrub(err.Error()),
+		Status:  status,
+		Account: account,
+		Stack:   r.scrub(string(debug.Stack())),
+		Time:    time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReportTimeout)
+	defer cancel()
+
+	if r.webhook != "" {
+		if err := r.post(ctx, r.webhook, nil, report); err != nil {
+			log.Printf("WARNING: could not send error report to webhook: %v", err)
+		}
+	}
+	if r.sentry != nil {
+		if err := r.sendSentry(ctx, report); err != nil {
+			log.Printf("WARNING: could not send error report to Sentry: %v", err)
+		}
+	}
+}
+
+func (r *errorReporter) sendSentry(ctx context.Context, report errorReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	tags := map[string]string{}
+	if report.Account != "" {
+		tags["account"] = report.Account
+	}
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": report.Time.Format(time.RFC3339),
+		"platform":  "go",
+		"level":     "error",
+		"logger":    "vbc",
+		"message":   report.Message,
+		"tags":      tags,
+		"extra": map[string]string{
+			"status": report.Status,
+			"stack":  report.Stack,
+		},
+	}
+
+	headers := map[string]string{
+		"X-Sentry-Auth": fmt.Sprintf("Sentry sentry_version=7, sentry_client=vbc/2, sentry_key=%v",
+			r.sentry.publicKey),
+	}
+	return r.post(ctx, r.sentry.storeURL, headers, event)
+}
+
+func (r *errorReporter) post(ctx context.Context, target string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+	return nil
+}
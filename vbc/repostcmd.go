@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/McKael/madon"
+)
+
+func repostCommand(args []string) {
+	fs := flag.NewFlagSet("repost", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc repost <status url or id>\n\n")
+		fmt.Fprintf(fs.Output(), "Crossposts a single status, whether it was crossposted before, ignored when\n")
+		fmt.Fprintf(fs.Output(), "its account was bootstrapped, or given up on. Useful for bringing older\n")
+		fmt.Fprintf(fs.Output(), "statuses over, or sending one again once what kept it from going over has\n")
+		fmt.Fprintf(fs.Output(), "been fixed. Crossposts that are already up get written over rather than\n")
+		fmt.Fprintf(fs.Output(), "posted twice. Goes to every account the status would get crossposted to.\n")
+		fmt.Fprintf(fs.Output(), "Can be done while vbc is running, which then does it.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if viaDaemon("repost", fs.Args()) {
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	if err := repostStatus(ctx, config, store, fs.Arg(0)); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+/* Crossposts a single status, given by its URL or ID, to every account it
+ * would get crossposted to, see repostCommand. */
+func repostStatus(ctx context.Context, config *Config, store Store, raw string) error {
+	instance, id, err := parseStatusURL(raw)
+	if err != nil {
+		return err
+	}
+
+	appId, appSecret := envAppCredentials(instance)
+	ms, err := newMastodonSession(store, instance, appId, appSecret)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not set up Mastodon client for %v: %v", instance, err))
+	}
+	var status *madon.Status
+	err = ms.Do(func(mc *madon.Client) error {
+		s, err := mc.GetStatus(id)
+		status = s
+		return err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not fetch %v: %v", raw, err))
+	}
+	extras, err := ms.StatusExtras(id)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not fetch %v: %v", raw, err))
+	}
+
+	found := false
+	for _, pair := range config.Pairs() {
+		if pair.Instance != instance || status.Account == nil || pair.AccountID != status.Account.ID {
+			continue
+		}
+		found = true
+
+		bs, err := newBlueskySession(ctx, store, pair.Server, pair.Handle, pair.AppKey, 0)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", pair.Handle, err))
+		}
+		profile, err := bs.FetchProfile(ctx, pair.Handle)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not fetch Bluesky profile of @%v: %v", pair.Handle, err))
+		}
+		if err := checkExpectedDID(pair.Handle, profile.DID); err != nil {
+			return err
+		}
+		key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: profile.DID}
+
+		/* Mappings only go in accounts that have been bootstrapped, and
+		 * bootstrapping later on would have this one ignored. */
+		bootstrapped, err := store.HasAccount(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not look up account: %v", err))
+		}
+		if !bootstrapped {
+			if err := bootstrapAccount(ctx, store, ms, bs, key, status.Account); err != nil {
+				return errors.New(fmt.Sprintf("could not bootstrap account @%v: %v", status.Account.Username, err))
+			}
+		}
+
+		transform := config.TransformFor(pair.Instance, pair.AccountID, pair.Handle)
+		mapping, err := repost(ctx, store, key, status, extras, bs, profile, transform)
+		var skip skipError
+		if errors.As(err, &skip) {
+			fmt.Printf("not reposting %v to @%v: %v\n", status.URL, pair.Handle, skip.reason)
+			continue
+		} else if err != nil {
+			return errors.New(fmt.Sprintf("could not repost %v to @%v: %v", status.URL, pair.Handle, err))
+		}
+
+		value, err := encodeMapping(*mapping)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not encode mapping: %v", err))
+		}
+		if err := store.PutMapping(key, id, value); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", status.URL, err))
+		}
+		if err := store.RemoveRetry(key, id); err != nil {
+			return errors.New(fmt.Sprintf("could not write down mapping of %v: %v", status.URL, err))
+		}
+		fmt.Printf("reposted %v to %v\n", status.URL, blueskyPostURL(pair.Handle, mapping.Uri))
+	}
+
+	if !found {
+		return errors.New(fmt.Sprintf("%v is not of any account that gets crossposted", raw))
+	}
+	return nil
+}
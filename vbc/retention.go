@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+/* How far back edits and deletions on Mastodon still make it over to the
+ * crossposts of a pair. Both are only noticed among the statuses fetched on
+ * every poll, the last PollLimit of the account, so anything older than
+ * those is out of reach, however long its mapping is kept. */
+type pairRetention struct {
+	pair         accountPair
+	bootstrapped bool
+	/* Every mapping in the store, and how many of those made it over. */
+	mappings int
+	posted   int
+	/* The oldest status within reach, and how many crossposts are. */
+	oldest        int64
+	oldestMapping *StatusMapping
+	reachable     int
+}
+
+func readPairRetention(ctx context.Context, store Store, pair accountPair) (*pairRetention, error) {
+	key, bootstrapped, err := storedPairKey(ctx, store, pair)
+	if err != nil {
+		return nil, err
+	}
+	retention := &pairRetention{pair: pair, bootstrapped: bootstrapped}
+	if !bootstrapped {
+		return retention, nil
+	}
+
+	mappings, err := store.Mappings(key)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(mappings))
+	for id := range mappings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	retention.mappings = len(ids)
+	for i, id := range ids {
+		mapping, err := decodeMapping(mappings[id])
+		if err != nil {
+			continue
+		}
+		if !mapping.Posted() {
+			continue
+		}
+		retention.posted++
+		if i < PollLimit {
+			retention.reachable++
+		}
+	}
+	if len(ids) > 0 {
+		last := len(ids) - 1
+		if last >= PollLimit {
+			last = PollLimit - 1
+		}
+		retention.oldest = ids[last]
+		if mapping, err := decodeMapping(mappings[ids[last]]); err == nil {
+			retention.oldestMapping = mapping
+		}
+	}
+	return retention, nil
+}
+
+/* Prints how far back edits and deletions reach for every pair, so it's
+ * clear what still makes it over before anything gets cleaned up. */
+func printRetention(ctx context.Context, store Store, config *Config) error {
+	for i, pair := range config.Pairs() {
+		retention, err := readPairRetention(ctx, store, pair)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("Retention of %v on %v to @%v:\n", pair.AccountID, pair.Instance, pair.Handle)
+		if !retention.bootstrapped {
+			fmt.Printf("  not bootstrapped yet\n")
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "  mappings\t%v, %v of them crossposts, none pruned\n", retention.mappings, retention.posted)
+
+		transform := config.TransformFor(pair.Instance, pair.AccountID, pair.Handle)
+		deletions := "kept, see deletions"
+		if transform.Deletions == DeletionsPropagate {
+			deletions = fmt.Sprintf("propagated after %v", deleteGrace(transform))
+		}
+		fmt.Fprintf(w, "  deletions\t%v\n", deletions)
+
+		reach := "nothing yet"
+		if retention.oldest != 0 {
+			reach = fmt.Sprintf("status %v", retention.oldest)
+			if m := retention.oldestMapping; m != nil && !m.Created.IsZero() {
+				reach += fmt.Sprintf(", written down %v", m.Created.Local().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprintf(w, "  edits and deletions\treach back to %v, the last %v status(es)\n", reach, PollLimit)
+		fmt.Fprintf(w, "  in reach\t%v of %v crosspost(s)\n", retention.reachable, retention.posted)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
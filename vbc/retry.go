@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	/* Delays between attempts at crossposting a status that failed. */
+	RetryBaseDelay = 30 * time.Second
+	RetryMaxDelay  = 6 * time.Hour
+	/* Attempts after which a status is dead-lettered, no matter the error. */
+	RetryMaxAttempts = 12
+
+	/* Crossposts and polls in a row failing on the account after which
+	 * an account gets paused, when VBC_PAUSE_AFTER isn't set. */
+	PauseAfterDefault = 5
+
+	/* Delays between polls of an account while Mastodon is failing. */
+	PollBaseDelay = 2 * time.Second
+	PollMaxDelay  = 5 * time.Minute
+
+	/* Delays between attempts at getting going, while either side is down. */
+	StartupBaseDelay = 2 * time.Second
+	StartupMaxDelay  = 5 * time.Minute
+)
+
+/* A status waiting to be crossposted again, or one we gave up on. */
+type RetryEntry struct {
+	Status      int64     `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+/* Exponential backoff with some jitter, so replicas and accounts that failed
+ * together don't all come back at the same time. Attempts start at one. */
+func backoffDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	/* Somewhere between 80% and 120% of the delay. */
+	jitter := time.Duration(rand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+/* Keeps trying something we can't get going without, for as long as what
+ * stops it might go away on its own. Anything else, like bad credentials,
+ * is handed right back. */
+func retryStartup(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		/* A Bluesky account that's no longer active may well be back,
+		 * statuses posted meanwhile being picked up once it is. */
+		reason, inactive := targetInactiveReason(err)
+		if err == nil || (classifyError(err) != errorRetryable && !inactive) {
+			return err
+		}
+
+		if pollOnce && attempt >= OnceStartupAttempts {
+			return err
+		}
+
+		delay := backoffDelay(attempt, StartupBaseDelay, StartupMaxDelay)
+		if inactive {
+			log.Printf("ERROR: could not %v, the Bluesky account is %v, trying again in %v: %v", what, reason, TargetInactiveCheckInterval, err)
+			select {
+			case <-time.After(TargetInactiveCheckInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if offlineMode() && isOfflineError(err) && delay > OfflineProbeInterval {
+			delay = OfflineProbeInterval
+		}
+		log.Printf("ERROR: could not %v, trying again in %v: %v", what, delay.Round(time.Second), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+func retryCommand(args []string) {
+	fs := flag.NewFlagSet("retry", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc retry <status url or id>\n\n")
+		fmt.Fprintf(fs.Output(), "Gives a status vbc gave up on, or is still waiting to try again, another\n")
+		fmt.Fprintf(fs.Output(), "go right away, with as many attempts as a new one. It stays in the dead\n")
+		fmt.Fprintf(fs.Output(), "letters, for the record. Goes for every account it failed to go to. Can\n")
+		fmt.Fprintf(fs.Output(), "be done while vbc is running, which then does it.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if viaDaemon("retry", fs.Args()) {
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	if err := retryStatus(ctx, config, store, fs.Arg(0), os.Stdout); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+/* Puts a status from the dead letters or the retry queue of every account it
+ * failed to go to back in the retry queue, due right away, see
+ * retryCommand. */
+func retryStatus(ctx context.Context, config *Config, store Store, raw string, w io.Writer) error {
+	instance, id, err := parseStatusURL(raw)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, pair := range config.Pairs() {
+		if pair.Instance != instance {
+			continue
+		}
+		key, bootstrapped, err := storedPairKey(ctx, store, pair)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not look up account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err))
+		}
+		if !bootstrapped {
+			continue
+		}
+
+		queue, err := store.RetryQueue(key)
+		if err != nil {
+			return err
+		}
+		dead, err := store.DeadLetters(key)
+		if err != nil {
+			return err
+		}
+		for _, entry := range append(queue, dead...) {
+			if entry.Status != id {
+				continue
+			}
+			entry.Attempts = 0
+			entry.NextAttempt = time.Time{}
+			if err := store.PutRetry(key, entry); err != nil {
+				return errors.New(fmt.Sprintf("could not queue %v to be retried: %v", raw, err))
+			}
+			fmt.Fprintf(w, "queued %v to be retried to @%v\n", raw, pair.Handle)
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return errors.New(fmt.Sprintf("%v is in neither the retry queue nor the dead letters of any account", raw))
+	}
+	return nil
+}
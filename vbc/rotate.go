@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+/* Rotates the credentials of the sessions of every pair that has some of its
+ * own, see blueskySession.Rotate and mastodonWriter.Rotate. Pairs that haven't
+ * got going yet pick them up when they do. */
+func (p *sessionPool) Rotate(ctx context.Context, pairs []accountPair) {
+	for _, pair := range pairs {
+		p.mu.Lock()
+		entry := p.bluesky[pair.Handle]
+		writer := p.writers[accountPair{Instance: pair.Instance, AccountID: pair.AccountID, Handle: pair.Handle}]
+		p.mu.Unlock()
+
+		if entry != nil {
+			/* Waits for the session, should it still be logging in. */
+			bs, err := p.Bluesky(ctx, pair)
+			rotated := false
+			if err == nil {
+				rotated, err = bs.Rotate(ctx, pair.AppKey)
+			}
+			if err != nil {
+				log.Printf("ERROR: could not rotate the app key of @%v, going on with the old one: %v", pair.Handle, err)
+			} else if rotated {
+				log.Printf("Bluesky: rotated the app key of @%v", pair.Handle)
+			}
+		}
+
+		if writer != nil && pair.MastodonToken != nil {
+			rotated, err := writer.Rotate(ctx, *pair.MastodonToken)
+			if err != nil {
+				log.Printf("ERROR: Mastodon turned the new token of account %v on %v down, going on with the old one: %v", pair.AccountID, pair.Instance, err)
+			} else if rotated {
+				log.Printf("Mastodon: rotated the token of account %v on %v", pair.AccountID, pair.Instance)
+			}
+		}
+	}
+}
+
+/* Picks up new credentials, from the secret manager and the configuration,
+ * and rotates every session over to them. */
+func reloadCredentials(ctx context.Context, sessions *sessionPool) {
+	if err := loadSecrets(); err != nil {
+		log.Printf("ERROR: could not load secrets again, keeping the credentials we have: %v", err)
+		return
+	}
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Printf("ERROR: could not load configuration again, keeping the credentials we have: %v", err)
+		return
+	}
+	sessions.Rotate(ctx, config.Pairs())
+}
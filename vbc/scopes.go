@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* A scope the Mastodon token has to grant, and what needs it. */
+type requiredScope struct {
+	Scope string
+	For   string
+}
+
+/* The scopes the Mastodon token of an account needs, going by what it's
+ * been set up to do. */
+func requiredMastodonScopes(transform TransformConfig, digestTo string) []requiredScope {
+	scopes := []requiredScope{{"read:statuses", "reading statuses"}}
+	if transform.CrossLink != "" {
+		scopes = append(scopes, requiredScope{"write:statuses", "crossLink"})
+	}
+	if transform.MirrorFavorites != nil && *transform.MirrorFavorites {
+		scopes = append(scopes, requiredScope{"read:favourites", "mirrorFavorites"})
+	}
+	if transform.Filters != nil && transform.Filters.MastodonFilters {
+		scopes = append(scopes, requiredScope{"read:filters", "mastodonFilters"})
+	}
+	if digestTo == DigestToDM {
+		scopes = append(scopes, requiredScope{"write:statuses", "digests as direct messages"})
+	}
+	return scopes
+}
+
+/* Checks that the token grants every one of scopes, handing back an error
+ * naming the first one it doesn't, along with what needs it. */
+func (w *mastodonWriter) VerifyScopes(ctx context.Context, scopes []requiredScope) error {
+	granted, err := w.grantedScopes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, required := range scopes {
+		ok, err := w.hasScope(ctx, granted, required.Scope)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not check for the %v scope: %v", required.Scope, err))
+		}
+		if !ok {
+			return permanent(errors.New(fmt.Sprintf(
+				"the Mastodon token doesn't grant the %v scope, which %v needs", required.Scope, required.For)))
+		}
+	}
+	return nil
+}
+
+/* The scopes the token grants, as the instance tells us. Instances older
+ * than Mastodon 4.3 don't, and then we get nil back. */
+func (w *mastodonWriter) grantedScopes(ctx context.Context) ([]string, error) {
+	var app struct {
+		Scopes []string `json:"scopes"`
+	}
+	err := w.call(ctx, http.MethodGet, "/api/v1/apps/verify_credentials", nil, &app)
+	if err != nil {
+		if code, ok := errorStatusCode(err); ok && code == http.StatusUnauthorized {
+			return nil, permanent(errors.New("the Mastodon token was rejected, it may have been revoked"))
+		}
+		return nil, err
+	}
+	return app.Scopes, nil
+}
+
+func (w *mastodonWriter) hasScope(ctx context.Context, granted []string, scope string) (bool, error) {
+	if granted != nil {
+		/* Scopes such as read grant every one under them. */
+		parent, _, _ := strings.Cut(scope, ":")
+		for _, g := range granted {
+			if g == scope || g == parent {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	/* Without a list, try something that needs the scope and see whether
+	 * it gets turned down for the lack of it. Posting an empty status fails
+	 * either way, but only after the scope is checked. */
+	var err error
+	switch scope {
+	case "read:statuses":
+		err = w.call(ctx, http.MethodGet, "/api/v1/timelines/home?limit=1", nil, nil)
+	case "read:favourites":
+		err = w.call(ctx, http.MethodGet, "/api/v1/favourites?limit=1", nil, nil)
+	case "read:filters":
+		err = w.call(ctx, http.MethodGet, "/api/v2/filters", nil, nil)
+	case "write:statuses":
+		err = w.call(ctx, http.MethodPost, "/api/v1/statuses", map[string]interface{}{}, nil)
+	default:
+		return true, nil
+	}
+	if err == nil {
+		return true, nil
+	}
+	code, ok := errorStatusCode(err)
+	switch {
+	case ok && code == http.StatusForbidden:
+		return false, nil
+	case ok && code == http.StatusUnprocessableEntity:
+		return true, nil
+	}
+	return false, err
+}
+
+/* Checks that the session can write to the repo of did, by asking to delete a
+ * record with a swap that can never match. Nothing gets deleted, and the PDS
+ * only gets as far as turning down the swap once it knows we may write. */
+func verifyBlueskyWrite(ctx context.Context, bs *blueskySession, did string) error {
+	swap, err := recordCID(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	err = bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		input := map[string]interface{}{
+			"repo":       did,
+			"collection": PostCollection,
+			"rkey":       encodeTID(0, 0),
+			"swapRecord": swap,
+		}
+		return client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.deleteRecord", nil, input, nil)
+	})
+
+	var xerr *xrpc.XRPCError
+	switch {
+	case err == nil, errors.As(err, &xerr) && xerr.ErrStr == "InvalidSwap":
+		return nil
+	case classifyError(err) == errorRetryable:
+		return err
+	}
+	return permanent(errors.New(fmt.Sprintf("the Bluesky session can't write to %v: %v", did, err)))
+}
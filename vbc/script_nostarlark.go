@@ -0,0 +1,13 @@
+//go:build !starlark
+
+package main
+
+import (
+	"errors"
+)
+
+const StarlarkSupported = false
+
+func runStarlarkScript(path string, post *hookPost) (*hookPost, error) {
+	return nil, permanent(errors.New("vbc was built without Starlark support, rebuild it with -tags starlark"))
+}
@@ -0,0 +1,178 @@
+//go:build starlark
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const StarlarkSupported = true
+
+/* Runs the transform function of the Starlark script at path on a post. The
+ * function gets the post as a dict, and returns either the post to publish or
+ * None to skip it. The script is loaded again every time, so it can be edited
+ * without restarting vbc. */
+func runStarlarkScript(path string, post *hookPost) (*hookPost, error) {
+	thread := &starlark.Thread{
+		Name: "vbc",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("script: %v", msg)
+		},
+	}
+	timer := time.AfterFunc(HookTimeout, func() { thread.Cancel("timed out") })
+	defer timer.Stop()
+
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("could not load script %v: %v", path, err)))
+	}
+	fn, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, permanent(errors.New(fmt.Sprintf("script %v does not define a transform function", path)))
+	}
+
+	/* Going through JSON keeps the dict and the struct in sync for free. */
+	var in interface{}
+	data, err := json.Marshal(post)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	arg, err := toStarlark(in)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := starlark.Call(thread, fn, starlark.Tuple{arg}, nil)
+	if err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("script %v failed: %v", path, err)))
+	}
+	if res == starlark.None {
+		return nil, skipped("rejected by script %v", path)
+	}
+
+	out, err := fromStarlark(res)
+	if err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("script %v returned a bad post: %v", path, err)))
+	}
+	data, err = json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &hookPost{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("script %v returned a bad post: %v", path, err)))
+	}
+	return result, nil
+}
+
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case string:
+		return starlark.String(v), nil
+	case []interface{}:
+		elems := make([]starlark.Value, 0, len(v))
+		for _, elem := range v {
+			value, err := toStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, value)
+		}
+		return starlark.NewList(elems), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		dict := starlark.NewDict(len(v))
+		for _, key := range keys {
+			value, err := toStarlark(v[key])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(key), value); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("can't hand %T to a script", v))
+	}
+}
+
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%v is too large", v))
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case *starlark.List:
+		elems := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			elem, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	case starlark.Tuple:
+		elems := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			value, err := fromStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, value)
+		}
+		return elems, nil
+	case *starlark.Dict:
+		dict := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("dict key %v is not a string", item[0]))
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = value
+		}
+		return dict, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("can't make sense of a %v", v.Type()))
+	}
+}
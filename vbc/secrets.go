@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Secret managers settings can be fetched from, see loadSecrets. */
+const (
+	SecretsBackendVault = "vault"
+	SecretsBackendAWS   = "aws"
+	SecretsBackendGCP   = "gcp"
+)
+
+/* How long fetching the secret may take. */
+const SecretsTimeout = 30 * time.Second
+
+/* Where GCP hands out tokens for the service account a machine runs as. */
+const GCPMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+var secretsClient = &http.Client{Timeout: SecretsTimeout}
+
+/* Settings that came from the secret manager, which loading the secret again
+ * writes over, unlike the ones that were there to begin with. */
+var loadedSecrets = make(map[string]bool)
+
+/* Fetches the secret at VBC_SECRETS_PATH from VBC_SECRETS_BACKEND, which
+ * holds a JSON object of settings, such as VBC_BSKY_APP_KEY, and puts them in
+ * the environment. Settings that are in the environment already, or given as
+ * flags, are left as they are. Does nothing without a backend set. Called
+ * again on SIGHUP, to pick up rotated secrets. */
+func loadSecrets() error {
+	backend := envOrNil("VBC_SECRETS_BACKEND")
+	if backend == nil {
+		return nil
+	}
+	path := envOrDefault("VBC_SECRETS_PATH", "")
+	if path == "" {
+		return errors.New("VBC_SECRETS_PATH is not set")
+	}
+
+	var raw []byte
+	var err error
+	switch *backend {
+	case SecretsBackendVault:
+		raw, err = fetchVaultSecret(path)
+	case SecretsBackendAWS:
+		raw, err = fetchAWSSecret(path)
+	case SecretsBackendGCP:
+		raw, err = fetchGCPSecret(path)
+	default:
+		return errors.New(fmt.Sprintf("unknown secrets backend %v", *backend))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not fetch %v from %v: %v", path, *backend, err))
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(raw, &secrets); err != nil {
+		return errors.New(fmt.Sprintf("%v should be a JSON object of settings: %v", path, err))
+	}
+	names := make([]string, 0, len(secrets))
+	for name, value := range secrets {
+		if _, found := os.LookupEnv(name); found && !loadedSecrets[name] {
+			continue
+		}
+		os.Setenv(name, value)
+		loadedSecrets[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		log.Printf("WARNING: every setting in %v is set already, nothing was loaded from it", path)
+		return nil
+	}
+	sort.Strings(names)
+	log.Printf("loaded %v from %v", strings.Join(names, ", "), *backend)
+	return nil
+}
+
+/* Does a request, handing back the body when it went fine. */
+func fetchSecretBody(req *http.Request) ([]byte, error) {
+	res, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("bad server status code (%v): %v", res.StatusCode, strings.TrimSpace(string(body))))
+	}
+	return body, nil
+}
+
+/* Reads a secret from Vault, at VAULT_ADDR with VAULT_TOKEN, the same as the
+ * vault command does. The path is that of the API, such as secret/data/vbc
+ * for version 2 of the key value engine. */
+func fetchVaultSecret(path string) ([]byte, error) {
+	addr := envOrDefault("VAULT_ADDR", "https://127.0.0.1:8200")
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := envOrNil("VAULT_TOKEN"); token != nil {
+		req.Header.Set("X-Vault-Token", *token)
+	}
+	if namespace := envOrNil("VAULT_NAMESPACE"); namespace != nil {
+		req.Header.Set("X-Vault-Namespace", *namespace)
+	}
+
+	body, err := fetchSecretBody(req)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	/* Version 2 of the key value engine nests the secret one level down. */
+	if inner, found := res.Data["data"]; found {
+		if _, versioned := res.Data["metadata"]; versioned {
+			return inner, nil
+		}
+	}
+	return json.Marshal(res.Data)
+}
+
+/* Reads a secret from AWS Secrets Manager, with the credentials and region
+ * in the usual AWS_* environment variables. */
+func fetchAWSSecret(id string) ([]byte, error) {
+	region := envOrDefault("AWS_REGION", envOrDefault("AWS_DEFAULT_REGION", ""))
+	if region == "" {
+		return nil, errors.New("AWS_REGION is not set")
+	}
+	accessKey := envOrDefault("AWS_ACCESS_KEY_ID", "")
+	secretKey := envOrDefault("AWS_SECRET_ACCESS_KEY", "")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("https://secretsmanager.%v.amazonaws.com/", region)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := envOrNil("AWS_SESSION_TOKEN"); token != nil {
+		req.Header.Set("X-Amz-Security-Token", *token)
+	}
+	signAWSRequest(req, payload, "secretsmanager", region, accessKey, secretKey, time.Now())
+
+	body, err := fetchSecretBody(req)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	if res.SecretString == nil {
+		return nil, errors.New("secret is binary, rather than a string")
+	}
+	return []byte(*res.SecretString), nil
+}
+
+/* Signs a request with version 4 of the AWS signature, going by every header
+ * set on it so far. */
+func signAWSRequest(req *http.Request, payload []byte, service string, region string, accessKey string, secretKey string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	hash := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hash(payload),
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", date, region, service)
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", stamp, scope, hash([]byte(canonical))}, "\n")
+
+	key := mac([]byte("AWS4"+secretKey), date)
+	key = mac(key, region)
+	key = mac(key, service)
+	key = mac(key, "aws4_request")
+	signature := hex.EncodeToString(mac(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey,
+		scope,
+		signedHeaders,
+		signature))
+}
+
+/* Reads a secret from GCP Secret Manager, named as projects/<project>/
+ * secrets/<secret>, optionally followed by /versions/<version>. Without a
+ * version, the latest one is read. The token comes from
+ * GOOGLE_OAUTH_ACCESS_TOKEN, or from the metadata server of the machine. */
+func fetchGCPSecret(name string) ([]byte, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	token := envOrDefault("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+	if token == "" {
+		req, err := http.NewRequest(http.MethodGet, GCPMetadataTokenURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		body, err := fetchSecretBody(req)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not get a token from the metadata server: %v", err))
+		}
+		var res struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			return nil, err
+		}
+		token = res.AccessToken
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := fetchSecretBody(req)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Payload.Data)
+}
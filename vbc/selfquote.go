@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/* What to do with links to our own statuses that were crossposted before. */
+const (
+	/* Quote the post the status became, when the post has room for it. */
+	SelfLinksQuote = "quote"
+	/* Link to the post the status became instead. */
+	SelfLinksLink = "link"
+	/* Leave the link to Mastodon alone. */
+	SelfLinksKeep = "keep"
+)
+
+/* A post on Bluesky, as we keep it in the mappings. */
+type mappedPost struct {
+	Cid string `json:"cid"`
+	Uri string `json:"uri"`
+}
+
+/* Points to a record as it was at some point, see
+ * com.atproto.repo.strongRef. */
+type strongRef struct {
+	Cid string `json:"cid"`
+	Uri string `json:"uri"`
+}
+
+/* The post a link to one of the statuses of the account became, if it's a
+ * link to one and the status made it over. */
+func selfLinkTarget(store Store, key AccountKey, link string) (*mappedPost, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, nil
+	}
+	instance, err := url.Parse(key.Instance)
+	if err != nil || !strings.EqualFold(u.Host, instance.Host) {
+		return nil, nil
+	}
+
+	/* Same as parseStatusURL, every kind of status URL ends with the ID. */
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	id, err := strconv.ParseInt(segments[len(segments)-1], 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	value, err := store.Mapping(key, id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	mapping, err := decodeMapping(value)
+	if err != nil || !mapping.Posted() {
+		/* Never made it over, so there's nothing to point to. */
+		return nil, nil
+	}
+	return &mappedPost{Cid: mapping.Cid, Uri: mapping.Uri}, nil
+}
+
+/* The link to a post on the Bluesky website. */
+func blueskyPostURL(handle string, uri string) string {
+	rkey := uri[strings.LastIndex(uri, "/")+1:]
+	return fmt.Sprintf("https://bsky.app/profile/%v/post/%v", handle, rkey)
+}
+
+/* Points links to statuses we crossposted before to where they went on
+ * Bluesky, either by quoting them or by linking to them. */
+func resolveSelfLinks(store Store, key AccountKey, handle string, posts []*postRecord, config TransformConfig) error {
+	if config.SelfLinks == SelfLinksKeep {
+		return nil
+	}
+
+	for _, post := range posts {
+		for i := 0; i < len(post.Facets); i++ {
+			facet := post.Facets[i]
+			target, err := selfLinkTarget(store, key, facet.Features[0].URI)
+			if err != nil {
+				return err
+			}
+			if target == nil {
+				continue
+			}
+
+			/* Posts only get one embed, so those with one already get a link
+			 * instead. */
+			if config.SelfLinks == SelfLinksQuote && post.Embed == nil {
+				post.Embed = &postEmbed{
+					LexiconTypeID: "app.bsky.embed.record",
+					Record:        &strongRef{Cid: target.Cid, Uri: target.Uri},
+				}
+				continue
+			}
+			relinkFacet(post, i, blueskyPostURL(handle, target.Uri))
+		}
+	}
+	return nil
+}
+
+/* Points a facet to another link, showing the new link in place of the old
+ * one, as long as the post has room for it. */
+func relinkFacet(post *postRecord, i int, link string) {
+	facet := post.Facets[i]
+	start, end := facet.Index.ByteStart, facet.Index.ByteEnd
+
+	display := link
+	if post.Text[start:end] != facet.Features[0].URI {
+		/* It was shortened, so the new one is too. */
+		display = linkDisplayText(link)
+	}
+	text := post.Text[:start] + display + post.Text[end:]
+	if utf8.RuneCountInString(text) > PostLengthLimit {
+		log.Printf("WARNING: no room to link to %v in place of %v", link, facet.Features[0].URI)
+		return
+	}
+
+	shift := len(display) - (end - start)
+	post.Text = text
+	facet.Index.ByteEnd = start + len(display)
+	facet.Features[0].URI = link
+	for _, after := range post.Facets[i+1:] {
+		after.Index.ByteStart += shift
+		after.Index.ByteEnd += shift
+	}
+}
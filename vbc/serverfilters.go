@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* How long the filters of an account are held on to before being fetched
+ * again, so changes to them make it over without asking for them with every
+ * status. */
+const ServerFiltersRefresh = 5 * time.Minute
+
+/* See the Filter entity of the Mastodon API. */
+type serverFilter struct {
+	Title        string     `json:"title"`
+	FilterAction string     `json:"filter_action"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Keywords     []struct {
+		Keyword   string `json:"keyword"`
+		WholeWord bool   `json:"whole_word"`
+	} `json:"keywords"`
+	Statuses []struct {
+		StatusID string `json:"status_id"`
+	} `json:"statuses"`
+}
+
+/* Filters the account has set up on its server, see
+ * FilterConfig.MastodonFilters. */
+func (w *mastodonWriter) Filters(ctx context.Context) ([]serverFilter, error) {
+	var filters []serverFilter
+	err := w.call(ctx, http.MethodGet, "/api/v2/filters", nil, &filters)
+	return filters, err
+}
+
+/* Holds on to the hide filters of an account, fetching them again once
+ * they're older than ServerFiltersRefresh. */
+type serverFilters struct {
+	writer *mastodonWriter
+
+	mu      sync.Mutex
+	fetched time.Time
+	filters []serverFilter
+}
+
+func newServerFilters(writer *mastodonWriter) *serverFilters {
+	return &serverFilters{writer: writer}
+}
+
+/* The title of the first hide filter status matches, if any does. Filters
+ * hide statuses in any context they're set for, and a mirror is seen in all
+ * of them, so which ones they're set for doesn't matter. Nil matches
+ * nothing. */
+func (f *serverFilters) Match(ctx context.Context, status *madon.Status) (string, bool, error) {
+	if f == nil {
+		return "", false, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.filters == nil || time.Since(f.fetched) > ServerFiltersRefresh {
+		filters, err := f.writer.Filters(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		if filters == nil {
+			filters = []serverFilter{}
+		}
+		f.filters = filters
+		f.fetched = time.Now()
+	}
+
+	/* Mastodon matches filters against media descriptions as well. */
+	text := status.SpoilerText + "\n" + renderStatusText(status.Content)
+	for _, attachment := range status.MediaAttachments {
+		if attachment.Description != nil {
+			text += "\n" + *attachment.Description
+		}
+	}
+	id := strconv.FormatInt(status.ID, 10)
+
+	for _, filter := range f.filters {
+		if filter.FilterAction != "hide" {
+			continue
+		}
+		if filter.ExpiresAt != nil && filter.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		for _, keyword := range filter.Keywords {
+			if matchesKeyword(text, keyword.Keyword, keyword.WholeWord) {
+				return filter.Title, true, nil
+			}
+		}
+		for _, filtered := range filter.Statuses {
+			if filtered.StatusID == id {
+				return filter.Title, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+/* Whether text has keyword in it, ignoring case, the way Mastodon goes about
+ * it: whole word keywords only match with no letters or digits on either
+ * side of them. */
+func matchesKeyword(text string, keyword string, wholeWord bool) bool {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return false
+	}
+	if !wholeWord {
+		return strings.Contains(strings.ToLower(text), strings.ToLower(keyword))
+	}
+	re, err := regexp.Compile(`(?i)(^|[^\pL\pN_])` + regexp.QuoteMeta(keyword) + `($|[^\pL\pN_])`)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/* What vbc gets registered as with the service manager. */
+const (
+	ServiceName        = "vbc"
+	ServiceDisplayName = "Very Bad Crossposter"
+	ServiceDescription = "Crossposts from Mastodon to Bluesky."
+)
+
+func serviceCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: vbc [flags] service install\n")
+		fmt.Fprintf(os.Stderr, "       vbc service uninstall\n")
+		fmt.Fprintf(os.Stderr, "       vbc service run [dir]\n\n")
+		fmt.Fprintf(os.Stderr, "Registers vbc to run in the background as a Windows service, or as a\n")
+		fmt.Fprintf(os.Stderr, "launchd agent on macOS, starting along with the computer. Installing takes\n")
+		fmt.Fprintf(os.Stderr, "along every setting given to it, and runs vbc from the current directory,\n")
+		fmt.Fprintf(os.Stderr, "so relative paths keep working. Run is what the service manager starts.\n")
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "install" && len(args) == 1:
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("could not find the vbc executable: %v", err)
+		}
+		exe, err = filepath.Abs(exe)
+		if err != nil {
+			log.Fatalf("could not find the vbc executable: %v", err)
+		}
+		dir, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("could not find the current directory: %v", err)
+		}
+
+		if problems := validateSettings(false); len(problems) > 0 {
+			log.Printf("found %v problem(s) with the configuration:", len(problems))
+			for _, problem := range problems {
+				log.Printf("    - %v", problem)
+			}
+			log.Fatalf("fix the above and try again, see --help for the settings there are")
+		}
+
+		/* Services have nowhere for their output to go. */
+		if envOrNil("VBC_LOG_FILE") == nil {
+			os.Setenv("VBC_LOG_FILE", "vbc.log")
+		}
+
+		if err := installService(exe, dir, serviceEnvironment()); err != nil {
+			log.Fatalf("could not install the service: %v", err)
+		}
+		log.Printf("installed %v, running from %v", ServiceName, dir)
+	case args[0] == "uninstall" && len(args) == 1:
+		if err := uninstallService(); err != nil {
+			log.Fatalf("could not uninstall the service: %v", err)
+		}
+		log.Printf("uninstalled %v", ServiceName)
+	case args[0] == "run" && len(args) <= 2:
+		if len(args) == 2 {
+			if err := os.Chdir(args[1]); err != nil {
+				log.Fatalf("could not change to %v: %v", args[1], err)
+			}
+		}
+		if err := runService(); err != nil {
+			log.Fatalf("could not run as a service: %v", err)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+/* The settings to run the service with, as NAME=value, being every one that
+ * is set right now. Service managers start vbc with next to nothing in its
+ * environment, so whatever it was given here wouldn't otherwise make it. */
+func serviceEnvironment() []string {
+	var env []string
+	for _, s := range Settings {
+		if value, found := os.LookupEnv(s.Env); found {
+			env = append(env, s.Env+"="+value)
+		}
+	}
+	return env
+}
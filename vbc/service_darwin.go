@@ -0,0 +1,126 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/* The label of the launchd agent, and the name of its property list. */
+const LaunchdLabel = "gay.lobisomem.vbc"
+
+func launchdPlistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", LaunchdLabel+".plist"), nil
+}
+
+/* Writes a launchd agent that starts vbc when the user logs in and restarts it
+ * whenever it exits, and loads it. The property list holds the settings, so
+ * only the user may read it. */
+func installService(exe string, dir string, env []string) error {
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var plist strings.Builder
+	plist.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	plist.WriteString("<!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n")
+	plist.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&plist, "\t<key>Label</key>\n\t<string>%v</string>\n", LaunchdLabel)
+	plist.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range []string{exe, "service", "run", dir} {
+		fmt.Fprintf(&plist, "\t\t<string>%v</string>\n", escapeXML(arg))
+	}
+	plist.WriteString("\t</array>\n")
+	fmt.Fprintf(&plist, "\t<key>WorkingDirectory</key>\n\t<string>%v</string>\n", escapeXML(dir))
+	plist.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		fmt.Fprintf(&plist, "\t\t<key>%v</key>\n\t\t<string>%v</string>\n", escapeXML(name), escapeXML(value))
+	}
+	plist.WriteString("\t</dict>\n")
+	plist.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	plist.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	plist.WriteString("\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+
+	/* The log goes to VBC_LOG_FILE, so all that's left for these is what
+	 * comes out before it's opened, or on a crash. */
+	outFile := escapeXML(filepath.Join(dir, "vbc.out"))
+	fmt.Fprintf(&plist, "\t<key>StandardOutPath</key>\n\t<string>%v</string>\n", outFile)
+	fmt.Fprintf(&plist, "\t<key>StandardErrorPath</key>\n\t<string>%v</string>\n", outFile)
+	plist.WriteString("</dict>\n</plist>\n")
+
+	/* Loading over an agent that's already loaded fails, so reinstalling
+	 * unloads the old one first. */
+	if _, err := os.Stat(path); err == nil {
+		_ = launchctl("unload", path)
+	}
+	if err := writeFileAtomic(path, []byte(plist.String())); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	return launchctl("load", "-w", path)
+}
+
+func uninstallService() error {
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return errors.New(fmt.Sprintf("%v is not installed", LaunchdLabel))
+	}
+	if err := launchctl("unload", "-w", path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+/* Runs the crossposter until launchd stops it, which it does with SIGTERM. */
+func runService() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	runDaemon(ctx, false)
+	return nil
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("launchctl %v failed: %v: %v",
+			strings.Join(args, " "), err, strings.TrimSpace(string(out))))
+	}
+	if len(out) > 0 {
+		log.Printf("launchctl: %v", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+/* Escapes text to go into an XML document. */
+func escapeXML(text string) string {
+	return strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+		"\"", "&quot;",
+		"'", "&apos;",
+	).Replace(text)
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNoServiceManager = errors.New("vbc only knows how to install itself on Windows and macOS, use your init system here, such as a systemd unit")
+
+func installService(exe string, dir string, env []string) error {
+	return errNoServiceManager
+}
+
+func uninstallService() error {
+	return errNoServiceManager
+}
+
+func runService() error {
+	runDaemon(context.Background(), false)
+	return nil
+}
@@ -0,0 +1,141 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+/* How long vbc gets to wind down once the service is stopped, before it tells
+ * the service manager it has stopped regardless. */
+const ServiceStopTimeout = 20 * time.Second
+
+/* Registers vbc as a service starting along with Windows, that the service
+ * manager restarts whenever it exits on a failure. Needs an administrator. */
+func installService(exe string, dir string, env []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(ServiceName); err == nil {
+		s.Close()
+		return errors.New(fmt.Sprintf("%v is already installed, uninstall it first", ServiceName))
+	}
+
+	s, err := m.CreateService(ServiceName, exe, mgr.Config{
+		DisplayName:      ServiceDisplayName,
+		Description:      ServiceDescription,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, "service", "run", dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	restart := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+	}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return err
+	}
+
+	/* The service manager hands services the environment kept under their
+	 * key, which is how the settings make it over. */
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE,
+		`SYSTEM\CurrentControlSet\Services\`+ServiceName, registry.SET_VALUE)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Environment", env); err != nil {
+		s.Delete()
+		return err
+	}
+
+	return s.Start()
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ServiceName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v is not installed", ServiceName))
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err != nil {
+			log.Printf("WARNING: could not stop %v: %v", ServiceName, err)
+		}
+	}
+	return s.Delete()
+}
+
+/* Runs the crossposter under the service manager. Started from a console, it
+ * runs as it would without a command. */
+func runService() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		runDaemon(context.Background(), false)
+		return nil
+	}
+
+	return svc.Run(ServiceName, windowsService{})
+}
+
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runDaemon(ctx, false)
+		close(done)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		/* Failures exit the process on their own, for the service
+		 * manager to restart it, so all that's left is stopping. */
+		request := <-requests
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(ServiceStopTimeout):
+				log.Printf("WARNING: took longer than %v to stop, stopping anyway", ServiceStopTimeout)
+			}
+			return false, 0
+		}
+	}
+}
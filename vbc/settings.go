@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* A setting that can be given either as an environment variable or as a
+ * flag named after it, VBC_STORE_FILE being --store-file. Flags take
+ * precedence over the environment, which takes precedence over defaults. */
+type setting struct {
+	Env   string
+	Usage string
+}
+
+var Settings = []setting{
+	{"VBC_MASTODON_INSTANCE", "URL of the Mastodon instance"},
+	{"VBC_MASTODON_ACCOUNT_ID", "ID of the Mastodon account to crosspost from"},
+	{"VBC_MASTODON_APP_ID", "client ID of an app already registered with the instance"},
+	{"VBC_MASTODON_APP_SECRET", "client secret of an app already registered with the instance"},
+	{"VBC_MASTODON_TOKEN", "access token of the Mastodon account, for crossLink"},
+	{"VBC_BSKY_HANDLE", "Bluesky handle to crosspost to, without the @"},
+	{"VBC_BSKY_APP_KEY", "Bluesky app password, when not logging in with OAuth"},
+	{"VBC_BSKY_DID", "DID VBC_BSKY_HANDLE is expected to point to, refusing to crosspost to any other"},
+	{"VBC_BSKY_SERVER", "Bluesky server to log into (default https://bsky.social)"},
+	{"VBC_BSKY_RATE_LIMIT", "requests per second each Bluesky account may make, 0 for no limit (default 5)"},
+	{"VBC_BSKY_OAUTH_CLIENT_ID", "OAuth client ID to log into Bluesky with"},
+	{"VBC_HOST_RATE_LIMIT", "requests a minute each host may get from every account put together, such as 120,mastodon.social=60"},
+	{"VBC_BIND_ADDR", "local IP address or network interface to make HTTP connections from"},
+	{"VBC_STORE", "path to a bolt file, or a redis:// URL, to keep state in"},
+	{"VBC_STORE_FILE", "path to the bolt file to keep state in (default vbc.bolt)"},
+	{"VBC_STORE_PER_ACCOUNT", "set to true to keep each account in a bolt file of its own"},
+	{"VBC_STORE_COMPACT_INTERVAL", "how often to compact bolt files that are mostly free room, 0 for never (default 24h)"},
+	{"VBC_CONFIG", "path to a JSON file controlling how statuses are turned into posts"},
+	{"VBC_POLL_INTERVAL", "how long to wait between checks for new statuses (default 1s)"},
+	{"VBC_HEALTH_PROBE", "set to true to check on instances before polling them, waiting out maintenance"},
+	{"VBC_OFFLINE_MODE", "set to true on machines that are often offline, holding crossposts until the network is back"},
+	{"VBC_PAUSE_AFTER", "crossposts and polls in a row failing for good on the account after which an account is paused, 0 for never (default 5)"},
+	{"VBC_RECONCILE_LAST", "statuses to check against Bluesky on startup, up to 40, 0 for none (default 20)"},
+	{"VBC_LOG_FILE", "file to log to instead of stderr, rotated as it grows"},
+	{"VBC_LOG_MAX_SIZE", "megabytes the log file grows to before it's rotated, 0 for no limit (default 10)"},
+	{"VBC_LOG_MAX_AGE", "how long the log file is written to before it's rotated, 0 for no limit (default 24h)"},
+	{"VBC_LOG_KEEP", "rotated log files to keep, 0 to keep them all (default 7)"},
+	{"VBC_VERBOSE", "set to true to log what was done to every status on its way over"},
+	{"VBC_LEADER_LOCK", "redis:// URL of a lock shared by several copies of vbc"},
+	{"VBC_LEADER_KEY", "Redis key of the leader lock (default vbc:leader)"},
+	{"VBC_LEADER_TTL", "how long the leader lock lives without being renewed (default 30s)"},
+	{"VBC_BACKUP_PASSPHRASE", "passphrase backups are encrypted with"},
+	{"VBC_MEDIA_CACHE_DIR", "directory to keep downloaded media in, so it isn't downloaded again"},
+	{"VBC_MEDIA_CACHE_SIZE", "megabytes the media cache grows to before the least used media goes (default 512)"},
+	{"VBC_DIGEST_INTERVAL", "how often to send a digest of replies to crossposts, unset for never"},
+	{"VBC_DIGEST", "where digests go: log, dm, or a URL to post them to (default log)"},
+	{"VBC_METRICS_LISTEN", "address to serve Prometheus metrics on, such as 127.0.0.1:9734"},
+	{"VBC_ADMIN_LISTEN", "address to serve the admin API on, such as 127.0.0.1:9735"},
+	{"VBC_ADMIN_TOKEN", "bearer token the admin API asks for"},
+	{"VBC_SENTRY_DSN", "Sentry DSN to report errors to"},
+	{"VBC_ERROR_WEBHOOK", "URL to post error reports to"},
+	{"VBC_SECRETS_BACKEND", "secret manager to fetch settings from: vault, aws or gcp"},
+	{"VBC_SECRETS_PATH", "secret holding the settings, as a JSON object"},
+}
+
+func settingFlagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(env, "VBC_")), "_", "-")
+}
+
+/* Adds a flag for every setting to fs. */
+func registerSettingFlags(fs *flag.FlagSet) {
+	for _, s := range Settings {
+		fs.String(settingFlagName(s.Env), "", fmt.Sprintf("%v (%v)", s.Usage, s.Env))
+	}
+}
+
+/* Puts the settings given as flags in the environment, over whatever was
+ * there, so everything else only ever has to look at the environment. */
+func applySettingFlags(fs *flag.FlagSet) {
+	byFlag := make(map[string]string)
+	for _, s := range Settings {
+		byFlag[settingFlagName(s.Env)] = s.Env
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if env, found := byFlag[f.Name]; found {
+			os.Setenv(env, f.Value.String())
+		}
+	})
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: vbc [flags] [command]\n\n")
+	fmt.Fprintf(out, "Crossposts from Mastodon to Bluesky. Without a command, runs the crossposter.\n\n")
+	fmt.Fprintf(out, "Commands:\n")
+	fmt.Fprintf(out, "  run                   run the crossposter, or try it on one status with --canary\n")
+	fmt.Fprintf(out, "  render                print the text vbc would post for a status\n")
+	fmt.Fprintf(out, "  preview               print the records vbc would create for a status\n")
+	fmt.Fprintf(out, "  test-post             crosspost a made up status, to check everything works\n")
+	fmt.Fprintf(out, "  import                import what another crossposter already posted\n")
+	fmt.Fprintf(out, "  repost                crosspost a single status, whatever became of it before\n")
+	fmt.Fprintf(out, "  retry                 try a status vbc gave up on again\n")
+	fmt.Fprintf(out, "  pause                 stop crossposting to a handle until vbc is restarted\n")
+	fmt.Fprintf(out, "  backfill              crosspost older statuses, after showing what it'll take\n")
+	fmt.Fprintf(out, "  replay                crosspost an exported archive again, to another account\n")
+	fmt.Fprintf(out, "  delete                delete the crosspost of a status from Bluesky\n")
+	fmt.Fprintf(out, "  store                 back up, restore, upgrade and import into the store\n")
+	fmt.Fprintf(out, "  config                check the configuration file, or print its schema\n")
+	fmt.Fprintf(out, "  status                print what the store has on every account\n")
+	fmt.Fprintf(out, "  log                   print what vbc did with the latest statuses of an account\n")
+	fmt.Fprintf(out, "  audit                 find crossposted images that went out without alt text\n")
+	fmt.Fprintf(out, "  lookup                find the other side of a crosspost, by either URL\n")
+	fmt.Fprintf(out, "  stats                 print how crossposts have been doing\n")
+	fmt.Fprintf(out, "  export                write out every crosspost, as JSON lines or CSV\n")
+	fmt.Fprintf(out, "  debug                 print what the running vbc is up to\n")
+	fmt.Fprintf(out, "  service               run vbc as a Windows service or launchd agent\n")
+	fmt.Fprintf(out, "  setup                 walk through logging into both in the browser\n")
+	fmt.Fprintf(out, "  bsky-login            log into Bluesky with OAuth\n")
+	fmt.Fprintf(out, "  bsky-client-metadata  print the OAuth client metadata to host\n")
+	fmt.Fprintf(out, "  version               print the version of vbc\n\n")
+	fmt.Fprintf(out, "Every setting can be given either as a flag or as the environment variable\n")
+	fmt.Fprintf(out, "in parentheses, with flags taking precedence.\n\n")
+	fmt.Fprintf(out, "Flags:\n")
+	printVisibleDefaults(flag.CommandLine)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/McKael/madon"
+	"github.com/karalabe/go-bluesky"
+)
+
+/* How long `vbc setup --web` waits for the whole thing to be gone through. */
+const SetupTimeout = 30 * time.Minute
+
+/* What the Mastodon token `vbc setup` gets may do, being everything any of
+ * the options need, see requiredMastodonScopes. */
+var SetupMastodonScopes = []string{"read:statuses", "read:favourites", "read:filters", "write:statuses"}
+
+var setupTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Setting up vbc</title>
+{{if .Waiting}}<meta http-equiv="refresh" content="3">{{end}}
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 2em auto; padding: 0 1em; color: #222; }
+label { display: block; margin: 1em 0 .25em; }
+input[type=text], input[type=password], input[type=url] { width: 100%; padding: .4em; box-sizing: border-box; }
+button { margin-top: 1em; padding: .4em 1em; }
+.error { color: #b00; }
+.done { color: #070; }
+code { background: #eee; padding: 0 .2em; }
+</style>
+</head>
+<body>
+<h1>Setting up vbc</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}
+{{if not .Username}}<h2>1. Mastodon</h2>
+<form method="post" action="{{.Base}}/mastodon">
+<label for="instance">The URL of your instance</label>
+<input type="url" id="instance" name="instance" placeholder="https://tiggi.es" required>
+<button>Log in with Mastodon</button>
+</form>
+<p>You'll be sent to your instance to let vbc read your statuses, and post
+replies and direct messages for the options that need them.</p>
+{{else}}<p class="done">Crossposting @{{.Username}} on {{.Instance}}.</p>
+{{if .Waiting}}<h2>2. Bluesky</h2>
+<p><a href="{{.AuthURL}}" target="_blank">Let vbc post as @{{.Handle}} on Bluesky</a>, in a new tab. This page
+moves on by itself once you have.</p>
+{{else if not .DID}}<h2>2. Bluesky</h2>
+<form method="post" action="{{.Base}}/bluesky">
+<label for="handle">Your Bluesky handle</label>
+<input type="text" id="handle" name="handle" placeholder="alice.bsky.social" required>
+<label for="appkey">An app password, or leave it empty to log in with OAuth</label>
+<input type="password" id="appkey" name="appkey" autocomplete="off">
+<button>Log in with Bluesky</button>
+</form>
+{{else}}<p class="done">Crossposting to @{{.Handle}}.</p>
+<h2>All done</h2>
+<p>The settings went to <code>{{.Output}}</code>. Load them and start vbc with:</p>
+<p><code>set -a; . {{.Output}}; set +a; vbc</code></p>
+<p>You can close this page.</p>
+{{end}}{{end}}</body>
+</html>
+`))
+
+/* How far `vbc setup --web` has gotten, which is also what its page shows. */
+type setupState struct {
+	mu sync.Mutex
+
+	Base   string
+	Output string
+	Error  string
+
+	Instance  string
+	AccountID int64
+	Username  string
+	token     string
+	/* The app registered with the instance, and the state it has to send
+	 * people back with. */
+	app   AppCredentials
+	state string
+
+	Handle string
+	appKey string
+	DID    string
+	/* Set while waiting for the user to approve vbc on Bluesky. */
+	Waiting bool
+	AuthURL string
+}
+
+/* Registers an app with the instance that sends people back to redirectURI
+ * once they've let it in. */
+func registerSetupApp(ctx context.Context, httpc *http.Client, instance string, redirectURI string) (AppCredentials, error) {
+	var app struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	err := postSetupForm(ctx, httpc, instance+"/api/v1/apps", url.Values{
+		"client_name":   {AppName},
+		"redirect_uris": {redirectURI},
+		"scopes":        {strings.Join(SetupMastodonScopes, " ")},
+		"website":       {AppWebsite},
+	}, &app)
+	if err != nil {
+		return AppCredentials{}, err
+	}
+	return AppCredentials{ID: app.ClientID, Secret: app.ClientSecret}, nil
+}
+
+func postSetupForm(ctx context.Context, httpc *http.Client, target string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.New(fmt.Sprintf("bad server status code (%v): %v", res.StatusCode, strings.TrimSpace(string(body))))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+/* Writes the settings setup came up with to path, as NAME=value lines a
+ * shell or service manager can load. Holds secrets, so only the owner may
+ * read it. */
+func writeSetupSettings(path string, settings [][2]string) error {
+	var out strings.Builder
+	for _, setting := range settings {
+		fmt.Fprintf(&out, "%v=%v\n", setting[0], setting[1])
+	}
+	return os.WriteFile(path, []byte(out.String()), 0600)
+}
+
+func setupCommand(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	web := fs.Bool("web", false, "walk through setting up in the browser")
+	listen := fs.String("listen", "127.0.0.1:0", "address to serve the setup page on")
+	output := fs.String("output", "vbc.env", "file to write the settings to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc setup --web [--listen <addr>] [--output <file>]\n\n")
+		fmt.Fprintf(fs.Output(), "Serves a page that walks through logging into Mastodon and Bluesky, then\n")
+		fmt.Fprintf(fs.Output(), "writes the settings vbc needs to a file, and the app and OAuth session to\n")
+		fmt.Fprintf(fs.Output(), "the store. Stops once done.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || !*web {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), SetupTimeout)
+	defer cancel()
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("could not listen on %v: %v", *listen, err)
+	}
+	defer listener.Close()
+
+	httpc := &http.Client{Timeout: OAuthTimeout}
+	state := &setupState{
+		/* Only whoever was shown the URL knows where the page is. */
+		Base:   "/" + randomToken(16),
+		Output: *output,
+	}
+	origin := fmt.Sprintf("http://%v", listener.Addr())
+	redirectURI := origin + state.Base + "/mastodon/callback"
+	done := make(chan struct{})
+	var finished sync.Once
+
+	/* Shows the page as things stand, along with whatever went wrong since
+	 * it was last shown. */
+	show := func(w http.ResponseWriter, problem error) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if problem != nil {
+			state.Error = problem.Error()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := setupTemplate.Execute(w, state); err != nil {
+			log.Printf("WARNING: could not show the setup page: %v", err)
+		}
+		state.Error = ""
+	}
+	/* Writes everything out once both accounts are in. */
+	finish := func() error {
+		settings := [][2]string{
+			{"VBC_MASTODON_INSTANCE", state.Instance},
+			{"VBC_MASTODON_ACCOUNT_ID", strconv.FormatInt(state.AccountID, 10)},
+			{"VBC_MASTODON_TOKEN", state.token},
+			{"VBC_BSKY_HANDLE", state.Handle},
+		}
+		if state.appKey != "" {
+			settings = append(settings, [2]string{"VBC_BSKY_APP_KEY", state.appKey})
+		}
+		settings = append(settings, [2]string{"VBC_STORE", storeSpec()})
+		return writeSetupSettings(state.Output, settings)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(state.Base+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != state.Base+"/" {
+			http.NotFound(w, r)
+			return
+		}
+		show(w, nil)
+
+		state.mu.Lock()
+		over := state.DID != ""
+		state.mu.Unlock()
+		if over {
+			finished.Do(func() { close(done) })
+		}
+	})
+
+	mux.HandleFunc(state.Base+"/mastodon", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Redirect(w, r, state.Base+"/", http.StatusSeeOther)
+			return
+		}
+		instance := strings.TrimSpace(r.FormValue("instance"))
+		if !strings.Contains(instance, "://") {
+			instance = "https://" + instance
+		}
+		if err := checkServerURL(instance); err != nil {
+			show(w, errors.New(fmt.Sprintf("%v is not a valid URL: %v", instance, err)))
+			return
+		}
+		if u, _ := url.Parse(instance); u.Scheme != "https" && !isLoopbackHost(u.Hostname()) {
+			show(w, errors.New(fmt.Sprintf("%v should start with https://", instance)))
+			return
+		}
+		instance = canonicalizeInstanceName(instance)
+
+		app, err := registerSetupApp(r.Context(), httpc, instance, redirectURI)
+		if err != nil {
+			show(w, errors.New(fmt.Sprintf("could not register vbc with %v: %v", instance, err)))
+			return
+		}
+		state.mu.Lock()
+		state.Instance = instance
+		state.app = app
+		state.state = randomToken(16)
+		authURL := instance + "/oauth/authorize?" + url.Values{
+			"client_id":     {app.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {strings.Join(SetupMastodonScopes, " ")},
+			"state":         {state.state},
+		}.Encode()
+		state.mu.Unlock()
+		http.Redirect(w, r, authURL, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc(state.Base+"/mastodon/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		state.mu.Lock()
+		instance, app, expected := state.Instance, state.app, state.state
+		state.mu.Unlock()
+		switch {
+		case query.Get("error") != "":
+			show(w, errors.New(fmt.Sprintf("%v did not let vbc in: %v", instance, query.Get("error_description"))))
+			return
+		case expected == "" || query.Get("state") != expected:
+			show(w, errors.New("the instance came back with the wrong state, try again"))
+			return
+		}
+
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		err := postSetupForm(r.Context(), httpc, instance+"/oauth/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {query.Get("code")},
+			"client_id":     {app.ID},
+			"client_secret": {app.Secret},
+			"redirect_uri":  {redirectURI},
+			"scope":         {strings.Join(SetupMastodonScopes, " ")},
+		}, &token)
+		if err != nil {
+			show(w, errors.New(fmt.Sprintf("could not get a token from %v: %v", instance, err)))
+			return
+		}
+
+		var account madon.Account
+		writer := newMastodonWriter(instance, &token.AccessToken)
+		err = writer.call(r.Context(), http.MethodGet, "/api/v1/accounts/verify_credentials", nil, &account)
+		if err != nil {
+			show(w, errors.New(fmt.Sprintf("could not look up who logged in on %v: %v", instance, err)))
+			return
+		}
+		/* The app is good for reading statuses too, so vbc doesn't register
+		 * one more. */
+		if err := store.PutAppCredentials(instance, app); err != nil {
+			show(w, errors.New(fmt.Sprintf("could not write down the app: %v", err)))
+			return
+		}
+
+		state.mu.Lock()
+		state.AccountID = account.ID
+		state.Username = account.Username
+		state.token = token.AccessToken
+		state.mu.Unlock()
+		log.Printf("Mastodon: logged in as @%v (%v) on %v", account.Username, account.ID, instance)
+		http.Redirect(w, r, state.Base+"/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc(state.Base+"/bluesky", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Redirect(w, r, state.Base+"/", http.StatusSeeOther)
+			return
+		}
+		handle := strings.TrimPrefix(strings.TrimSpace(r.FormValue("handle")), "@")
+		appKey := strings.TrimSpace(r.FormValue("appkey"))
+		if handle == "" {
+			show(w, errors.New("the handle is missing"))
+			return
+		}
+
+		if appKey != "" {
+			server := envOrDefault("VBC_BSKY_SERVER", bluesky.ServerBskySocial)
+			bs, err := newBlueskySession(r.Context(), store, server, handle, &appKey, 0)
+			if err != nil {
+				show(w, errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", handle, err)))
+				return
+			}
+			profile, err := bs.FetchProfile(r.Context(), handle)
+			if err != nil {
+				show(w, errors.New(fmt.Sprintf("could not fetch Bluesky profile of @%v: %v", handle, err)))
+				return
+			}
+			state.mu.Lock()
+			state.Handle = handle
+			state.appKey = appKey
+			state.DID = profile.DID
+			err = finish()
+			state.mu.Unlock()
+			if err != nil {
+				show(w, errors.New(fmt.Sprintf("could not write %v: %v", *output, err)))
+				return
+			}
+			log.Printf("Bluesky: logged in as @%v (%v) with an app password", handle, profile.DID)
+			http.Redirect(w, r, state.Base+"/", http.StatusSeeOther)
+			return
+		}
+
+		/* The login waits on the user to approve it, in a tab of its own,
+		 * while this page keeps checking on it. */
+		authorized := make(chan string, 1)
+		failed := make(chan error, 1)
+		go func() {
+			clientID := envOrDefault("VBC_BSKY_OAUTH_CLIENT_ID", "")
+			session, err := oauthLogin(ctx, store, handle, clientID, "127.0.0.1:0", func(authURL string) {
+				authorized <- authURL
+			})
+
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			state.Waiting = false
+			if err != nil {
+				state.Error = fmt.Sprintf("could not log into Bluesky as @%v: %v", handle, err)
+				failed <- err
+				return
+			}
+			state.DID = session.DID()
+			if err := finish(); err != nil {
+				state.DID = ""
+				state.Error = fmt.Sprintf("could not write %v: %v", *output, err)
+				return
+			}
+			log.Printf("Bluesky: logged in as @%v (%v), session saved to the store", handle, session.DID())
+		}()
+
+		select {
+		case authURL := <-authorized:
+			state.mu.Lock()
+			state.Handle = handle
+			state.Waiting = true
+			state.AuthURL = authURL
+			state.mu.Unlock()
+			http.Redirect(w, r, state.Base+"/", http.StatusSeeOther)
+		case err := <-failed:
+			show(w, errors.New(fmt.Sprintf("could not log into Bluesky as @%v: %v", handle, err)))
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	fmt.Printf("Open the following URL in your browser to set vbc up:\n\n    %v%v/\n\n", origin, state.Base)
+
+	select {
+	case <-done:
+		/* Let the last page make it to the browser. */
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+		log.Printf("wrote the settings to %v", *output)
+	case <-ctx.Done():
+		log.Fatalf("timed out waiting for setup to be gone through")
+	}
+}
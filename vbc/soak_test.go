@@ -0,0 +1,145 @@
+//go:build soak
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"lobisomem.gay/vbc/v2/internal/fakes"
+)
+
+var (
+	soakDuration      = flag.Duration("soak.duration", 5*time.Minute, "how long to post statuses for with failures injected")
+	soakSettle        = flag.Duration("soak.settle", time.Minute, "how long to give vbc afterwards to catch up, without failures")
+	soakEvery         = flag.Duration("soak.every", 2*time.Second, "how often to post a new status")
+	soakRestartEvery  = flag.Duration("soak.restart-every", time.Minute, "how often to kill vbc and start it again, zero to never")
+	soakBlueskyErrors = flag.Float64("soak.bsky-5xx", 0.05, "fraction of Bluesky requests to fail with a 5xx")
+	soakMastodonDelay = flag.Duration("soak.mastodon-delay", 2*time.Second, "longest to hold up Mastodon requests by")
+	soakStoreErrors   = flag.Float64("soak.store-errors", 0.01, "fraction of store writes to fail")
+)
+
+/* What every status the soak test posts says, so its crossposts can be told
+ * apart and counted. */
+const soakStatusFormat = "<p>Soak status number %v.</p>"
+
+var soakTextRe = regexp.MustCompile(`Soak status number (\d+)\.`)
+
+/* Runs vbc against the fake servers for a good while, with failures injected
+ * and vbc killed and started again every so often, then lets it settle
+ * without any, and checks that every status made it over exactly once. */
+func TestSoak(t *testing.T) {
+	dir := t.TempDir()
+	vbc := filepath.Join(dir, "vbc")
+	build := exec.Command("go", "build", "-o", vbc, ".")
+	build.Stdout = os.Stderr
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("could not build vbc: %v", err)
+	}
+
+	mastodon := fakes.NewMastodon(109000000000000001, "vbc")
+	defer mastodon.Close()
+	bluesky := fakes.NewBluesky("did:plc:vbcfakevbcfakevbcfake", "vbc.test")
+	defer bluesky.Close()
+
+	/* Something for the bootstrap to ignore. */
+	mastodon.AddStatus(fakes.Status{Content: "<p>This one was here before vbc.</p>"})
+
+	env := append(os.Environ(),
+		"VBC_MASTODON_INSTANCE="+mastodon.URL(),
+		"VBC_MASTODON_ACCOUNT_ID="+strconv.FormatInt(mastodon.AccountID, 10),
+		"VBC_BSKY_SERVER="+bluesky.URL(),
+		"VBC_BSKY_HANDLE="+bluesky.Handle,
+		"VBC_BSKY_APP_KEY=xxxx-xxxx-xxxx-xxxx",
+		"VBC_STORE="+filepath.Join(dir, "soak.bolt"))
+	chaos := []string{
+		"--chaos-bsky-5xx", strconv.FormatFloat(*soakBlueskyErrors, 'f', -1, 64),
+		"--chaos-mastodon-delay", soakMastodonDelay.String(),
+		"--chaos-store-errors", strconv.FormatFloat(*soakStoreErrors, 'f', -1, 64),
+	}
+	start := func(args []string) *exec.Cmd {
+		cmd := exec.Command(vbc, args...)
+		cmd.Env = env
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("could not start vbc: %v", err)
+		}
+		t.Logf("started vbc %v", args)
+		return cmd
+	}
+	stop := func(cmd *exec.Cmd) {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		t.Logf("killed vbc")
+	}
+
+	cmd := start(chaos)
+	defer func() { stop(cmd) }()
+	posted := 0
+	deadline := time.After(*soakDuration)
+	tick := time.NewTicker(*soakEvery)
+	defer tick.Stop()
+	var restart <-chan time.Time
+	if *soakRestartEvery > 0 {
+		ticker := time.NewTicker(*soakRestartEvery)
+		defer ticker.Stop()
+		restart = ticker.C
+	}
+
+soak:
+	for {
+		select {
+		case <-deadline:
+			break soak
+		case <-tick.C:
+			posted++
+			mastodon.AddStatus(fakes.Status{Content: fmt.Sprintf(soakStatusFormat, posted)})
+		case <-restart:
+			stop(cmd)
+			cmd = start(chaos)
+		}
+	}
+
+	/* Whatever got left behind gets a chance to go over, as it would once
+	 * whatever was failing is back. */
+	stop(cmd)
+	cmd = start(nil)
+	time.Sleep(*soakSettle)
+
+	crossposts := make(map[int]int)
+	for _, record := range bluesky.Records() {
+		var value struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			continue
+		}
+		if match := soakTextRe.FindStringSubmatch(value.Text); match != nil {
+			n, _ := strconv.Atoi(match[1])
+			crossposts[n]++
+		}
+	}
+
+	missing, duplicated := 0, 0
+	for n := 1; n <= posted; n++ {
+		switch count := crossposts[n]; {
+		case count == 0:
+			missing++
+			t.Errorf("status %v was never crossposted", n)
+		case count > 1:
+			duplicated++
+			t.Errorf("status %v was crossposted %v times", n, count)
+		}
+	}
+	t.Logf("%v statuses posted, %v never crossposted, %v crossposted more than once", posted, missing, duplicated)
+}
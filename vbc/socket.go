@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+/* The umask is the whole process's, so only one socket gets made under it at
+ * a time. */
+var umaskMu sync.Mutex
+
+/* Listens on a unix socket at path only we can connect to, made that way from
+ * the start rather than chmod'ed after, which would leave a moment for others
+ * to connect. */
+func listenPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	previous := syscall.Umask(0077)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+)
+
+/* Listens on a unix socket at path. Windows has no umask, and sockets get
+ * the permissions of the directory they're in. */
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
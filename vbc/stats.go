@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* Opens the store for the commands that only ever look at it. A bolt store
+ * in use by a running vbc is locked, so those get looked at through a
+ * snapshot of it instead, and so do the files of each account, see
+ * shardedStore. */
+func openStoreForReading() (Store, func(), error) {
+	spec := storeSpec()
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		store, err := openStore(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() { store.Close() }, nil
+	}
+
+	root, cleanup, err := openBoltSnapshot(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !storePerAccount() {
+		return root, func() {
+			root.Close()
+			cleanup()
+		}, nil
+	}
+
+	store := &shardedStore{
+		boltStore: root,
+		path:      spec,
+		shards:    make(map[AccountKey]*boltStore),
+		snapshots: true,
+	}
+	return store, func() {
+		store.Close()
+		cleanup()
+	}, nil
+}
+
+/* Opens a copy of a snapshot of the bolt file at path, see snapshotStore,
+ * handing back what removes the copy once it's closed. */
+func openBoltSnapshot(path string) (*boltStore, func(), error) {
+	snapshot, err := snapshotStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.CreateTemp("", "vbc-stats-*.bolt")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	tmp.Close()
+
+	store, err := openBoltStoreWith(tmp.Name(), &bolt.Options{ReadOnly: true})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return store, cleanup, nil
+}
+
+func statsCommand(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	engagement := fs.Bool("engagement", false, "print how crossposts have been doing on Bluesky")
+	storeSize := fs.Bool("store", false, "print how big the store is, and what's taking up the room")
+	retention := fs.Bool("retention", false, "print how far back edits and deletions still make it over")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc stats [--engagement] [--store] [--retention]\n\n")
+		fmt.Fprintf(fs.Output(), "Prints what vbc knows about how things have been going, out of the store.\n")
+		fmt.Fprintf(fs.Output(), "Without flags, prints everything there is.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	all := fs.NFlag() == 0
+
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	if all || *engagement {
+		if err := printEngagement(store); err != nil {
+			log.Fatalf("could not read engagement: %v", err)
+		}
+	}
+	if all || *storeSize {
+		if all {
+			fmt.Println()
+		}
+		if err := printStoreStats(store); err != nil {
+			log.Fatalf("could not measure the store: %v", err)
+		}
+	}
+	if all || *retention {
+		if all {
+			fmt.Println()
+		}
+		config, err := loadConfigFromEnv()
+		if err != nil {
+			log.Fatalf("could not load configuration: %v", err)
+		}
+		if err := printRetention(context.Background(), store, config); err != nil {
+			log.Fatalf("could not read retention: %v", err)
+		}
+	}
+}
+
+/* Prints the latest numbers of every crosspost, newest first. */
+func printEngagement(store Store) error {
+	values, err := store.Engagement()
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		did    string
+		record engagementRecord
+	}
+	rows := make([]row, 0, len(values))
+	for key, value := range values {
+		var record engagementRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		rows = append(rows, row{did: key[0], record: record})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].record.Posted.After(rows[j].record.Posted)
+	})
+
+	fmt.Printf("Engagement of %v crosspost(s):\n", len(rows))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "POSTED\tLIKES\tREPOSTS\tREPLIES\tSTATUS\tBLUESKY\n")
+
+	var likes, reposts, replies int
+	for _, r := range rows {
+		latest := r.record.Latest()
+		likes += latest.Likes
+		reposts += latest.Reposts
+		replies += latest.Replies
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			r.record.Posted.Format("2006-01-02 15:04"),
+			latest.Likes,
+			latest.Reposts,
+			latest.Replies,
+			r.record.Status,
+			r.did)
+	}
+	fmt.Fprintf(w, "total\t%v\t%v\t%v\t\t\n", likes, reposts, replies)
+	return w.Flush()
+}
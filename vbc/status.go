@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* What the store says about a pair of accounts. */
+type pairStatus struct {
+	pair         accountPair
+	bootstrapped bool
+	cursor       int64
+	/* How many statuses are in each state, see StatusMapping. */
+	states map[string]int
+	queued []RetryEntry
+	dead   []RetryEntry
+}
+
+/* Reads what the store has on a pair, see storedPairKey. */
+func readPairStatus(ctx context.Context, store Store, pair accountPair) (*pairStatus, error) {
+	key, bootstrapped, err := storedPairKey(ctx, store, pair)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &pairStatus{pair: pair, bootstrapped: bootstrapped, states: make(map[string]int)}
+	if !bootstrapped {
+		return status, nil
+	}
+	if status.cursor, err = store.Cursor(key); err != nil {
+		return nil, err
+	}
+	mappings, err := store.Mappings(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range mappings {
+		mapping, err := decodeMapping(value)
+		if err != nil {
+			status.states["unreadable"]++
+			continue
+		}
+		status.states[mapping.State]++
+	}
+	if status.queued, err = store.RetryQueue(key); err != nil {
+		return nil, err
+	}
+	if status.dead, err = store.DeadLetters(key); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc status\n\n")
+		fmt.Fprintf(fs.Output(), "Prints what the store has on every account: whether it's been\n")
+		fmt.Fprintf(fs.Output(), "bootstrapped, its cursor, what became of its statuses, and what's in its\n")
+		fmt.Fprintf(fs.Output(), "retry queue and dead letters. Can be done while vbc is running, which\n")
+		fmt.Fprintf(fs.Output(), "then gets asked for it.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if viaDaemon("status", fs.Args()) {
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	store, closeStore, err := openStoreForReading()
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	defer closeStore()
+
+	if err := printStatus(ctx, store, config, os.Stdout); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+/* Writes what the store has on every account to out, see statusCommand. */
+func printStatus(ctx context.Context, store Store, config *Config, out io.Writer) error {
+	for i, pair := range config.Pairs() {
+		status, err := readPairStatus(ctx, store, pair)
+		if err != nil {
+			return errors.New(fmt.Sprintf("could not read state of account %v on %v to @%v: %v", pair.AccountID, pair.Instance, pair.Handle, err))
+		}
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+
+		fmt.Fprintf(out, "%v on %v to @%v\n", pair.AccountID, pair.Instance, pair.Handle)
+		if !status.bootstrapped {
+			fmt.Fprintf(out, "  not bootstrapped yet\n")
+			continue
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "  cursor\t%v\n", status.cursor)
+
+		states := make([]string, 0, len(status.states))
+		for state := range status.states {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		counts := make([]string, 0, len(states))
+		for _, state := range states {
+			counts = append(counts, fmt.Sprintf("%v %v", status.states[state], state))
+		}
+		if len(counts) == 0 {
+			counts = append(counts, "none")
+		}
+		fmt.Fprintf(w, "  statuses\t%v\n", strings.Join(counts, ", "))
+
+		retry := fmt.Sprintf("%v status(es)", len(status.queued))
+		if len(status.queued) > 0 {
+			next := status.queued[0].NextAttempt
+			for _, entry := range status.queued[1:] {
+				if entry.NextAttempt.Before(next) {
+					next = entry.NextAttempt
+				}
+			}
+			retry += fmt.Sprintf(", next one at %v", next.Local().Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "  retry queue\t%v\n", retry)
+		fmt.Fprintf(w, "  dead letters\t%v status(es)\n", len(status.dead))
+		_ = w.Flush()
+	}
+	return nil
+}
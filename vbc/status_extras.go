@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* Glitch-soc and Hometown let statuses be kept to the instance they were
+ * posted on, which means they must never be crossposted. Before there was a
+ * flag for it, glitch-soc marked them by ending them with an eye. */
+const LocalOnlyMarker = "👁"
+
+func hasLocalOnlyMarker(text string) bool {
+	text = strings.TrimSuffix(strings.TrimSpace(text), "\uFE0F")
+	return strings.HasSuffix(text, LocalOnlyMarker)
+}
+
+/* Where the interesting part of an image is, from -1 to 1 left to right and
+ * bottom to top, as Mastodon has it. */
+type focusPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+/* What there is to a status that madon doesn't know about. */
+type statusExtras struct {
+	LocalOnly bool
+	/* Focal points of the attachments, by attachment ID. */
+	Focus map[int64]focusPoint
+}
+
+/* Fetches the status ourselves, to get at what madon leaves out. Instances
+ * that don't support local-only statuses just leave the flag out. */
+func fetchStatusExtras(mc *madon.Client, id int64) (*statusExtras, error) {
+	url := fmt.Sprintf("%v/api/v1/statuses/%v", strings.TrimSuffix(mc.InstanceURL, "/"), id)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mc.UserToken != nil {
+		req.Header.Set("Authorization", "Bearer "+mc.UserToken.AccessToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	/* Same wording as madon, so classifyError picks it up. */
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+	}
+
+	var raw struct {
+		LocalOnly        bool `json:"local_only"`
+		MediaAttachments []struct {
+			ID   int64 `json:"id,string"`
+			Meta *struct {
+				Focus *focusPoint `json:"focus"`
+			} `json:"meta"`
+		} `json:"media_attachments"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	extras := &statusExtras{
+		LocalOnly: raw.LocalOnly,
+		Focus:     make(map[int64]focusPoint),
+	}
+	for _, attachment := range raw.MediaAttachments {
+		if attachment.Meta != nil && attachment.Meta.Focus != nil {
+			extras.Focus[attachment.ID] = *attachment.Meta.Focus
+		}
+	}
+	return extras, nil
+}
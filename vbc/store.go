@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrAccountNotBootstrapped = errors.New("account has not been bootstrapped")
+
+/* Identifies a Mastodon account across all the instances we know about,
+ * along with the DID of the Bluesky account it gets crossposted to. The
+ * same Mastodon account keeps separate state for each of its targets. */
+type AccountKey struct {
+	Instance string
+	ID       int64
+	/* Empty for state kept from before there could be more than one. */
+	Target string
+}
+
+/* Client credentials of the app we registered with a Mastodon instance. */
+type AppCredentials struct {
+	ID     string
+	Secret string
+}
+
+/* Persistent state of the crossposter. Lookups of things that aren't there
+ * return their zero value and a nil error, rather than failing. */
+type Store interface {
+	AppCredentials(instance string) (*AppCredentials, error)
+	PutAppCredentials(instance string, creds AppCredentials) error
+
+	/* Whether the account has been bootstrapped. Bootstrapping creates the
+	 * account along with its initial mappings, all at once. */
+	HasAccount(acct AccountKey) (bool, error)
+	BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error
+	/* Bootstraps an account with a copy of everything in another one. */
+	CopyAccount(from AccountKey, to AccountKey) error
+
+	/* Mappings from Mastodon status IDs to what we did with them. */
+	Mapping(acct AccountKey, status int64) ([]byte, error)
+	PutMapping(acct AccountKey, status int64, value []byte) error
+	/* Every mapping of the account, keyed by status ID. */
+	Mappings(acct AccountKey) (map[int64][]byte, error)
+	/* The ID of the status crossposted to the post at the given at:// URI,
+	 * kept in an index next to the mappings, see mappingPostURIs. */
+	PostStatus(acct AccountKey, uri string) (int64, error)
+
+	/* The ID of the newest status we've seen for the account. */
+	Cursor(acct AccountKey) (int64, error)
+	PutCursor(acct AccountKey, status int64) error
+
+	/* Statuses that failed to be crossposted and should be tried again,
+	 * oldest first. Putting an entry replaces the one for the same status. */
+	RetryQueue(acct AccountKey) ([]RetryEntry, error)
+	PutRetry(acct AccountKey, entry RetryEntry) error
+	RemoveRetry(acct AccountKey, status int64) error
+
+	/* Statuses we gave up on crossposting, oldest first. */
+	DeadLetters(acct AccountKey) ([]RetryEntry, error)
+	PutDeadLetter(acct AccountKey, entry RetryEntry) error
+
+	/* OAuth sessions with Bluesky, keyed by handle. */
+	BlueskySession(handle string) ([]byte, error)
+	PutBlueskySession(handle string, value []byte) error
+
+	/* Blobs we've uploaded to a Bluesky repo, keyed by the DID of the repo
+	 * and whatever identifies the media they were made from. */
+	Blob(did string, key string) ([]byte, error)
+	PutBlob(did string, key string, value []byte) error
+
+	/* Likes we've made on Bluesky to mirror favourites on Mastodon, keyed by
+	 * the DID of the repo and the URI of the favourited status. */
+	Like(did string, status string) ([]byte, error)
+	PutLike(did string, status string, value []byte) error
+
+	/* When the last digest of what happened on a Bluesky account was sent,
+	 * see sendDigests. */
+	DigestCursor(did string) ([]byte, error)
+	PutDigestCursor(did string, value []byte) error
+
+	/* What a Mastodon instance says about itself, see instanceInfo. */
+	InstanceInfo(instance string) ([]byte, error)
+	PutInstanceInfo(instance string, value []byte) error
+
+	/* How crossposts are doing on Bluesky over time, keyed by the DID of
+	 * the repo and the URI of the post, see collectEngagement. */
+	Engagement() (map[[2]string][]byte, error)
+	PutEngagement(did string, uri string, value []byte) error
+
+	/* What was done with the statuses of an account, oldest first, see
+	 * recordEvent. Putting one in drops the oldest ones past keep. */
+	Events(acct AccountKey) ([][]byte, error)
+	PutEvent(acct AccountKey, value []byte, keep int) error
+
+	Close() error
+}
+
+/* Opens the store described by spec, which is either a redis:// URL or the
+ * path to a bolt file. */
+func openStore(spec string) (Store, error) {
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		return openRedisStore(spec)
+	}
+
+	/* Nothing wrong with a local file goes away by trying again. */
+	if storePerAccount() {
+		s, err := openShardedStore(spec)
+		if err != nil {
+			return nil, permanent(err)
+		}
+		return s, nil
+	}
+	s, err := openBoltStore(spec)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	return s, nil
+}
+
+/* Writes to an account that were held back to go in all at once, see
+ * cachedStore.Hold. */
+type accountWrites struct {
+	mappings map[int64][]byte
+	/* Statuses whose retry entries are done with. */
+	done   map[int64]bool
+	cursor *int64
+}
+
+func (w *accountWrites) empty() bool {
+	return len(w.mappings) == 0 && len(w.done) == 0 && w.cursor == nil
+}
+
+/* Writes held back writes one by one, for stores that can't do them all at
+ * once. */
+func putWrites(store Store, acct AccountKey, writes accountWrites) error {
+	for status, value := range writes.mappings {
+		if err := store.PutMapping(acct, status, value); err != nil {
+			return err
+		}
+	}
+	for status := range writes.done {
+		if err := store.RemoveRetry(acct, status); err != nil {
+			return err
+		}
+	}
+	if writes.cursor != nil {
+		return store.PutCursor(acct, *writes.cursor)
+	}
+	return nil
+}
+
+/* Has the store hold writes to the account back until flushWrites, if it's
+ * one that can. */
+func holdWrites(store Store, acct AccountKey) {
+	if cached, ok := store.(*cachedStore); ok {
+		cached.Hold(acct)
+	}
+}
+
+func flushWrites(store Store, acct AccountKey) error {
+	if cached, ok := store.(*cachedStore); ok {
+		return cached.Flush(acct)
+	}
+	return nil
+}
@@ -0,0 +1,820 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* Version of the bucket layout described below. Bump it whenever the layout
+ * changes, and teach migrateBoltLayout how to get there. */
+const BoltLayoutVersion = 4
+
+/* Oldest layout version whose vbc can read a store with this layout without
+ * writing to it, which is what rolling back a release takes until the store
+ * gets downgraded, see downgradeStore. Bump it along with BoltLayoutVersion
+ * whenever older vbc would misread the new layout rather than just miss out
+ * on what's new in it, as vbc with layout 3 do with the posts index. */
+const BoltReadableVersion = 3
+
+/* Names of the buckets and keys in the bolt file. */
+const (
+	BoltMetaBucket        = "meta"
+	BoltCredentialsBucket = "credentials"
+	BoltMastodonBucket    = "mastodon"
+	BoltBlueskyBucket     = "bluesky"
+	BoltAccountsBucket    = "accounts"
+	BoltMappingsBucket    = "mappings"
+	BoltQueueBucket       = "queue"
+	BoltDeadBucket        = "dead"
+	BoltPostsBucket       = "posts"
+	BoltEventsBucket      = "events"
+	BoltBlobsBucket       = "blobs"
+	BoltLikesBucket       = "likes"
+	BoltDigestsBucket     = "digests"
+	BoltInstancesBucket   = "instances"
+	BoltEngagementBucket  = "engagement"
+	BoltTargetsBucket     = "targets"
+
+	BoltVersionKey      = "version"
+	BoltReadableKey     = "readable"
+	BoltAppIdKey        = "id"
+	BoltAppSecretKey    = "secret"
+	BoltCursorKey       = "cursor"
+	BoltBootstrappedKey = "bootstrapped"
+)
+
+/* Store backed by a bolt file, laid out as follows:
+ *
+ *     meta/version                         version of the layout
+ *     meta/readable                        oldest version that can read it
+ *     credentials/mastodon/<instance>/     app ID and secret
+ *     credentials/bluesky/<handle>         OAuth session with Bluesky
+ *     accounts/<instance>/<account>/
+ *         bootstrapped                     when the account was bootstrapped
+ *         cursor                           ID of the newest status seen
+ *         mappings/<status>                what we did with each status
+ *         queue/<status>                   retry entries
+ *         dead/<status>                    dead letters
+ *         posts/<uri>                      status each post was made from
+ *         events/<sequence>                what was done with statuses
+ *     targets/<did>/<instance>/<account>/  same as above, for each of the
+ *                                          Bluesky accounts crossposted to
+ *     blobs/<did>/<media>                  blobs uploaded to each repo
+ *     likes/<did>/<status>                 likes mirroring favourites
+ *     digests/<did>                        when the last digest was sent
+ *     engagement/<did>/<post>              how each crosspost is doing
+ *
+ * Account and status IDs are big endian, so they sort numerically. */
+type boltStore struct {
+	/* Held for reading by every transaction, and for writing while the
+	 * file is swapped for a compacted copy of it, see Compact. */
+	mu sync.RWMutex
+	db *bolt.DB
+	/* Where db is, which stays the same however many times it's swapped
+	 * out, so it can be had without holding mu. */
+	path string
+	/* When the last write went in, in Unix nanoseconds, see Idle. */
+	written atomic.Int64
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	return openBoltStoreWith(path, nil)
+}
+
+func openBoltStoreWith(path string, options *bolt.Options) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.IsReadOnly() {
+		if err := db.View(checkBoltLayout); err != nil {
+			_ = db.Close()
+			return nil, errors.New(fmt.Sprintf("could not read %v: %v", path, err))
+		}
+	} else if err := db.Update(prepareBoltLayout); err != nil {
+		_ = db.Close()
+		return nil, errors.New(fmt.Sprintf("could not open %v: %v", path, err))
+	}
+	log.Printf("using bolt store at %v", path)
+
+	return &boltStore{db: db, path: path}, nil
+}
+
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	defer s.written.Store(time.Now().UnixNano())
+	return s.db.Update(fn)
+}
+
+/* How long it's been since anything was written. */
+func (s *boltStore) Idle() time.Duration {
+	written := s.written.Load()
+	if written == 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(time.Unix(0, written))
+}
+
+func boltIDKey(id int64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), uint64(id))
+}
+
+func boltIDFromKey(key []byte) (int64, error) {
+	if len(key) != 8 {
+		return 0, errors.New(fmt.Sprintf("ID key has %v bytes rather than 8", len(key)))
+	}
+	return int64(binary.BigEndian.Uint64(key)), nil
+}
+
+/* Looks up the bucket at the given path, nil if any of it is missing. */
+func boltBucket(tx *bolt.Tx, path ...[]byte) *bolt.Bucket {
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(name)
+	}
+	return bucket
+}
+
+/* Creates the bucket at the given path, along with any of its parents. */
+func boltCreateBucket(tx *bolt.Tx, path ...[]byte) (*bolt.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+	return bucket, err
+}
+
+/* The buckets holding the state of an account. */
+type boltAccount struct {
+	root     *bolt.Bucket
+	mappings *bolt.Bucket
+	queue    *bolt.Bucket
+	dead     *bolt.Bucket
+	posts    *bolt.Bucket
+}
+
+func boltAccountPath(acct AccountKey) [][]byte {
+	if acct.Target != "" {
+		return [][]byte{
+			[]byte(BoltTargetsBucket),
+			[]byte(acct.Target),
+			[]byte(acct.Instance),
+			boltIDKey(acct.ID),
+		}
+	}
+	return [][]byte{
+		[]byte(BoltAccountsBucket),
+		[]byte(acct.Instance),
+		boltIDKey(acct.ID),
+	}
+}
+
+/* Looks up the buckets of an account, nil if it hasn't been bootstrapped. */
+func openBoltAccount(tx *bolt.Tx, acct AccountKey) *boltAccount {
+	root := boltBucket(tx, boltAccountPath(acct)...)
+	if root == nil {
+		return nil
+	}
+
+	return &boltAccount{
+		root:     root,
+		mappings: root.Bucket([]byte(BoltMappingsBucket)),
+		queue:    root.Bucket([]byte(BoltQueueBucket)),
+		dead:     root.Bucket([]byte(BoltDeadBucket)),
+		posts:    root.Bucket([]byte(BoltPostsBucket)),
+	}
+}
+
+func createBoltAccount(tx *bolt.Tx, acct AccountKey) (*boltAccount, error) {
+	root, err := boltCreateBucket(tx, boltAccountPath(acct)...)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &boltAccount{root: root}
+	for name, bucket := range map[string]**bolt.Bucket{
+		BoltMappingsBucket: &account.mappings,
+		BoltQueueBucket:    &account.queue,
+		BoltDeadBucket:     &account.dead,
+		BoltPostsBucket:    &account.posts,
+	} {
+		*bucket, err = root.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+/* Puts a mapping in, pointing the posts it was made into at it in the index,
+ * and dropping the ones of the mapping it replaces. */
+func (account *boltAccount) putMapping(status int64, value []byte) error {
+	key := boltIDKey(status)
+	for _, uri := range mappingPostURIs(account.mappings.Get(key)) {
+		if err := account.posts.Delete([]byte(uri)); err != nil {
+			return err
+		}
+	}
+	for _, uri := range mappingPostURIs(value) {
+		if err := account.posts.Put([]byte(uri), key); err != nil {
+			return err
+		}
+	}
+	return account.mappings.Put(key, value)
+}
+
+/* Runs fn against the buckets of the given account. The account is nil if it
+ * hasn't been bootstrapped yet. */
+func (s *boltStore) withAccount(
+	acct AccountKey,
+	update bool,
+	fn func(account *boltAccount) error) error {
+
+	callback := func(tx *bolt.Tx) error {
+		return fn(openBoltAccount(tx, acct))
+	}
+
+	if update {
+		return s.update(callback)
+	} else {
+		return s.view(callback)
+	}
+}
+
+func (s *boltStore) AppCredentials(instance string) (*AppCredentials, error) {
+	var creds *AppCredentials
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx,
+			[]byte(BoltCredentialsBucket),
+			[]byte(BoltMastodonBucket),
+			[]byte(instance))
+		if bucket == nil {
+			return nil
+		}
+
+		storedAppId := bucket.Get([]byte(BoltAppIdKey))
+		storedAppSecret := bucket.Get([]byte(BoltAppSecretKey))
+		if storedAppId == nil || storedAppSecret == nil {
+			return nil
+		}
+
+		creds = &AppCredentials{
+			ID:     string(storedAppId),
+			Secret: string(storedAppSecret),
+		}
+		return nil
+	})
+	return creds, err
+}
+
+func (s *boltStore) PutAppCredentials(instance string, creds AppCredentials) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx,
+			[]byte(BoltCredentialsBucket),
+			[]byte(BoltMastodonBucket),
+			[]byte(instance))
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put([]byte(BoltAppIdKey), []byte(creds.ID))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(BoltAppSecretKey), []byte(creds.Secret))
+	})
+}
+
+func (s *boltStore) HasAccount(acct AccountKey) (bool, error) {
+	found := false
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		found = account != nil
+		return nil
+	})
+	return found, err
+}
+
+func (s *boltStore) BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if openBoltAccount(tx, acct) != nil {
+			return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", acct.ID, acct.Instance))
+		}
+
+		account, err := createBoltAccount(tx, acct)
+		if err != nil {
+			return err
+		}
+
+		for status, value := range mappings {
+			if err := account.putMapping(status, value); err != nil {
+				return err
+			}
+		}
+
+		now, _ := time.Now().UTC().MarshalText()
+		return account.root.Put([]byte(BoltBootstrappedKey), now)
+	})
+}
+
+func (s *boltStore) CopyAccount(from AccountKey, to AccountKey) error {
+	return s.update(func(tx *bolt.Tx) error {
+		src := openBoltAccount(tx, from)
+		if src == nil {
+			return ErrAccountNotBootstrapped
+		}
+		if openBoltAccount(tx, to) != nil {
+			return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", to.ID, to.Instance))
+		}
+
+		dst, err := createBoltAccount(tx, to)
+		if err != nil {
+			return err
+		}
+
+		copyBucket := func(src *bolt.Bucket, dst *bolt.Bucket) error {
+			return src.ForEach(func(k, v []byte) error {
+				/* Buckets come up with no value, and are copied on their own. */
+				if v == nil {
+					return nil
+				}
+				return dst.Put(k, v)
+			})
+		}
+		for _, pair := range [][2]*bolt.Bucket{
+			{src.mappings, dst.mappings},
+			{src.queue, dst.queue},
+			{src.dead, dst.dead},
+			{src.posts, dst.posts},
+			{src.root, dst.root},
+		} {
+			if err := copyBucket(pair[0], pair[1]); err != nil {
+				return err
+			}
+		}
+
+		/* Only accounts something was done with have events, and they go
+		 * over with their sequence, so new ones carry on after them. */
+		if events := src.root.Bucket([]byte(BoltEventsBucket)); events != nil {
+			copied, err := dst.root.CreateBucketIfNotExists([]byte(BoltEventsBucket))
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(events, copied); err != nil {
+				return err
+			}
+			return copied.SetSequence(events.Sequence())
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Mapping(acct AccountKey, status int64) ([]byte, error) {
+	var value []byte
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+
+		if stored := account.mappings.Get(boltIDKey(status)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Mappings(acct AccountKey) (map[int64][]byte, error) {
+	values := make(map[int64][]byte)
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+
+		return account.mappings.ForEach(func(key []byte, value []byte) error {
+			id, err := boltIDFromKey(key)
+			if err != nil {
+				return err
+			}
+			values[id] = copySlice[byte](value)
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (s *boltStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		return account.putMapping(status, value)
+	})
+}
+
+func (s *boltStore) PostStatus(acct AccountKey, uri string) (int64, error) {
+	var status int64
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil || account.posts == nil {
+			return nil
+		}
+
+		stored := account.posts.Get([]byte(uri))
+		if stored == nil {
+			return nil
+		}
+		var err error
+		status, err = boltIDFromKey(stored)
+		return err
+	})
+	return status, err
+}
+
+/* Writes everything held back for an account in a single transaction. */
+func (s *boltStore) PutWrites(acct AccountKey, writes accountWrites) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		for status, value := range writes.mappings {
+			if err := account.putMapping(status, value); err != nil {
+				return err
+			}
+		}
+		for status := range writes.done {
+			if err := account.queue.Delete(boltIDKey(status)); err != nil {
+				return err
+			}
+		}
+		if writes.cursor != nil {
+			return account.root.Put([]byte(BoltCursorKey), boltIDKey(*writes.cursor))
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Cursor(acct AccountKey) (int64, error) {
+	var cursor int64
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+
+		stored := account.root.Get([]byte(BoltCursorKey))
+		if stored == nil {
+			return nil
+		}
+
+		val, err := boltIDFromKey(stored)
+		cursor = val
+		return err
+	})
+	return cursor, err
+}
+
+func (s *boltStore) PutCursor(acct AccountKey, status int64) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		return account.root.Put([]byte(BoltCursorKey), boltIDKey(status))
+	})
+}
+
+/* Lists the retry entries in a bucket keyed by status ID, which come out
+ * oldest first on their own. */
+func boltRetryEntries(bucket *bolt.Bucket) ([]RetryEntry, error) {
+	entries := make([]RetryEntry, 0)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var entry RetryEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func boltPutRetryEntry(bucket *bolt.Bucket, entry RetryEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(boltIDKey(entry.Status), value)
+}
+
+func (s *boltStore) RetryQueue(acct AccountKey) ([]RetryEntry, error) {
+	entries := make([]RetryEntry, 0)
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+
+		var err error
+		entries, err = boltRetryEntries(account.queue)
+		return err
+	})
+	return entries, err
+}
+
+func (s *boltStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		return boltPutRetryEntry(account.queue, entry)
+	})
+}
+
+func (s *boltStore) RemoveRetry(acct AccountKey, status int64) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+		return account.queue.Delete(boltIDKey(status))
+	})
+}
+
+func (s *boltStore) DeadLetters(acct AccountKey) ([]RetryEntry, error) {
+	entries := make([]RetryEntry, 0)
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+
+		var err error
+		entries, err = boltRetryEntries(account.dead)
+		return err
+	})
+	return entries, err
+}
+
+func (s *boltStore) PutDeadLetter(acct AccountKey, entry RetryEntry) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		return boltPutRetryEntry(account.dead, entry)
+	})
+}
+
+func (s *boltStore) BlueskySession(handle string) ([]byte, error) {
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, []byte(BoltCredentialsBucket), []byte(BoltBlueskyBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		if stored := bucket.Get([]byte(handle)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) PutBlueskySession(handle string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltCredentialsBucket), []byte(BoltBlueskyBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(handle), value)
+	})
+}
+
+func (s *boltStore) Blob(did string, key string) ([]byte, error) {
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, []byte(BoltBlobsBucket), []byte(did))
+		if bucket == nil {
+			return nil
+		}
+
+		if stored := bucket.Get([]byte(key)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) PutBlob(did string, key string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltBlobsBucket), []byte(did))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Like(did string, status string) ([]byte, error) {
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, []byte(BoltLikesBucket), []byte(did))
+		if bucket == nil {
+			return nil
+		}
+
+		if stored := bucket.Get([]byte(status)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) PutLike(did string, status string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltLikesBucket), []byte(did))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(status), value)
+	})
+}
+
+func (s *boltStore) DigestCursor(did string) ([]byte, error) {
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, []byte(BoltDigestsBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		if stored := bucket.Get([]byte(did)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) PutDigestCursor(did string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltDigestsBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(did), value)
+	})
+}
+
+func (s *boltStore) InstanceInfo(instance string) ([]byte, error) {
+	var value []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, []byte(BoltInstancesBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		if stored := bucket.Get([]byte(instance)); stored != nil {
+			value = copySlice[byte](stored)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) PutInstanceInfo(instance string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltInstancesBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(instance), value)
+	})
+}
+
+func (s *boltStore) Engagement() (map[[2]string][]byte, error) {
+	values := make(map[[2]string][]byte)
+	err := s.view(func(tx *bolt.Tx) error {
+		root := boltBucket(tx, []byte(BoltEngagementBucket))
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(did []byte, _ []byte) error {
+			bucket := root.Bucket(did)
+			if bucket == nil {
+				return nil
+			}
+			return bucket.ForEach(func(uri []byte, value []byte) error {
+				values[[2]string{string(did), string(uri)}] = copySlice[byte](value)
+				return nil
+			})
+		})
+	})
+	return values, err
+}
+
+func (s *boltStore) PutEngagement(did string, uri string, value []byte) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateBucket(tx, []byte(BoltEngagementBucket), []byte(did))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(uri), value)
+	})
+}
+
+func (s *boltStore) Events(acct AccountKey) ([][]byte, error) {
+	values := make([][]byte, 0)
+	err := s.withAccount(acct, false, func(account *boltAccount) error {
+		if account == nil {
+			return nil
+		}
+		bucket := account.root.Bucket([]byte(BoltEventsBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_ []byte, value []byte) error {
+			values = append(values, copySlice[byte](value))
+			return nil
+		})
+	})
+	return values, err
+}
+
+/* Events are kept under sequence numbers, so they sort in the order they
+ * went in, and the oldest are the first ones dropped. As every one gets the
+ * next number, the ones to keep are the last keep numbers handed out, and
+ * only the few from before those, usually just the one, need looking at. */
+func (s *boltStore) PutEvent(acct AccountKey, value []byte, keep int) error {
+	return s.withAccount(acct, true, func(account *boltAccount) error {
+		if account == nil {
+			return ErrAccountNotBootstrapped
+		}
+		bucket, err := account.root.CreateBucketIfNotExists([]byte(BoltEventsBucket))
+		if err != nil {
+			return err
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(boltIDKey(int64(sequence)), value); err != nil {
+			return err
+		}
+
+		oldest := int64(sequence) - int64(keep) + 1
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.First() {
+			id, err := boltIDFromKey(k)
+			if err != nil {
+				return err
+			}
+			if id >= oldest {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Writes a consistent copy of the whole database to w. Runs in a read
+ * transaction, so it's fine to do while we keep on writing. */
+func (s *boltStore) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		written, err := tx.WriteTo(w)
+		n = written
+		return err
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
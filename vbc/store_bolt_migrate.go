@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* Keys of the original layout, where each instance got a top-level bucket
+ * holding the app credentials under backtick keys, next to a sub-bucket per
+ * account keyed by varint. The backticks were all that kept them from
+ * clashing with status IDs. */
+const (
+	LegacyAppIdKey           = "`appId"
+	LegacyAppSecretKey       = "`appSecret"
+	LegacyCursorKey          = "`cursor"
+	LegacyRetryQueueKey      = "`retry"
+	LegacyDeadLetterKey      = "`dead"
+	LegacyBlueskySessionsKey = "`bsky"
+)
+
+/* The layout version of the database, 1 for the original layout, which
+ * didn't write it down. */
+func boltLayoutVersion(tx *bolt.Tx) (int64, error) {
+	meta := tx.Bucket([]byte(BoltMetaBucket))
+	if meta == nil {
+		return 1, nil
+	}
+	stored := meta.Get([]byte(BoltVersionKey))
+	if stored == nil {
+		return 1, nil
+	}
+	return boltIDFromKey(stored)
+}
+
+/* The oldest layout version able to read the database, as the vbc that
+ * wrote it said. Stores from before that was written down can only be read
+ * by vbc with their own layout. */
+func boltReadableVersion(tx *bolt.Tx, version int64) (int64, error) {
+	meta := tx.Bucket([]byte(BoltMetaBucket))
+	if meta == nil {
+		return version, nil
+	}
+	stored := meta.Get([]byte(BoltReadableKey))
+	if stored == nil {
+		return version, nil
+	}
+	return boltIDFromKey(stored)
+}
+
+/* Why a store written by a newer vbc can't be written to, and what to do
+ * about it, which depends on whether it can at least be read. */
+func newerLayoutError(version int64, readable int64) error {
+	if readable <= BoltLayoutVersion {
+		return errors.New(fmt.Sprintf("store has layout version %v, which is newer than this vbc knows about. "+
+			"Commands that only read it, such as status and backup, still work, but nothing can be crossposted "+
+			"until it's brought back to version %v by running vbc store downgrade with the newer vbc",
+			version, BoltLayoutVersion))
+	}
+	return errors.New(fmt.Sprintf("store has layout version %v, which is newer than this vbc knows about, "+
+		"and can't be read by it. Bring it back to version %v by running vbc store downgrade with the newer vbc, "+
+		"or put back the copy vbc store upgrade left next to it",
+		version, BoltLayoutVersion))
+}
+
+/* Makes sure this vbc can read the database as it is, for when it's opened
+ * read-only, and so can't be migrated. */
+func checkBoltLayout(tx *bolt.Tx) error {
+	version, err := boltLayoutVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version <= BoltLayoutVersion {
+		return nil
+	}
+	readable, err := boltReadableVersion(tx, version)
+	if err != nil {
+		return err
+	}
+	if readable > BoltLayoutVersion {
+		return newerLayoutError(version, readable)
+	}
+	log.Printf("WARNING: store has layout version %v, which is newer than this vbc knows about, reading it as version %v", version, BoltLayoutVersion)
+	return nil
+}
+
+/* Gets the database ready to be written to. Only new ones get brought up to
+ * BoltLayoutVersion here, as they've nothing in them to lose, the rest have
+ * to go through vbc store upgrade, which keeps a copy of them as they were,
+ * see upgradeBoltFile. */
+func prepareBoltLayout(tx *bolt.Tx) error {
+	version, err := boltLayoutVersion(tx)
+	if err != nil {
+		return err
+	}
+	empty := true
+	err = tx.ForEach(func(_ []byte, _ *bolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if version < BoltLayoutVersion && !empty {
+		return errors.New(fmt.Sprintf("store has layout version %v, which is older than this vbc's %v. "+
+			"Run vbc store upgrade to bring it up to date, with vbc stopped",
+			version, BoltLayoutVersion))
+	}
+	return migrateBoltLayout(tx)
+}
+
+/* Brings the layout of the database up to BoltLayoutVersion. */
+func migrateBoltLayout(tx *bolt.Tx) error {
+	version, err := boltLayoutVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > BoltLayoutVersion {
+		readable, err := boltReadableVersion(tx, version)
+		if err != nil {
+			return err
+		}
+		return newerLayoutError(version, readable)
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(BoltMetaBucket))
+	if err != nil {
+		return err
+	}
+
+	/* Stores from before readable was written down get it too, for the
+	 * vbc that come after to go by. */
+	if err := meta.Put([]byte(BoltReadableKey), boltIDKey(BoltReadableVersion)); err != nil {
+		return err
+	}
+	if version == BoltLayoutVersion {
+		return nil
+	}
+
+	if version < 2 {
+		if err := migrateBoltLayoutV1(tx); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		if err := migrateBoltLayoutV2(tx); err != nil {
+			return err
+		}
+	}
+	if version < 4 {
+		if err := migrateBoltLayoutV3(tx); err != nil {
+			return err
+		}
+	}
+	return meta.Put([]byte(BoltVersionKey), boltIDKey(BoltLayoutVersion))
+}
+
+/* Moves everything from the original layout over to the namespaced one. New
+ * stores go through here too, and just have nothing to move. */
+func migrateBoltLayoutV1(tx *bolt.Tx) error {
+	var legacy [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		switch string(name) {
+		case BoltMetaBucket, BoltCredentialsBucket, BoltAccountsBucket:
+		default:
+			legacy = append(legacy, copySlice[byte](name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range legacy {
+		bucket := tx.Bucket(name)
+		if string(name) == LegacyBlueskySessionsKey {
+			err = migrateLegacyBlueskySessions(tx, bucket)
+		} else {
+			err = migrateLegacyInstance(tx, string(name), bucket)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	if len(legacy) > 0 {
+		log.Printf("migrated %v buckets of the store to layout version %v", len(legacy), BoltLayoutVersion)
+	}
+	return nil
+}
+
+func migrateLegacyBlueskySessions(tx *bolt.Tx, legacy *bolt.Bucket) error {
+	sessions, err := boltCreateBucket(tx, []byte(BoltCredentialsBucket), []byte(BoltBlueskyBucket))
+	if err != nil {
+		return err
+	}
+
+	return legacy.ForEach(func(k, v []byte) error {
+		return sessions.Put(k, v)
+	})
+}
+
+func migrateLegacyInstance(tx *bolt.Tx, instance string, legacy *bolt.Bucket) error {
+	appId := legacy.Get([]byte(LegacyAppIdKey))
+	appSecret := legacy.Get([]byte(LegacyAppSecretKey))
+	if appId != nil && appSecret != nil {
+		creds, err := boltCreateBucket(tx,
+			[]byte(BoltCredentialsBucket),
+			[]byte(BoltMastodonBucket),
+			[]byte(instance))
+		if err != nil {
+			return err
+		}
+
+		if err := creds.Put([]byte(BoltAppIdKey), appId); err != nil {
+			return err
+		}
+		if err := creds.Put([]byte(BoltAppSecretKey), appSecret); err != nil {
+			return err
+		}
+	}
+
+	return legacy.ForEach(func(k, v []byte) error {
+		/* Accounts are the sub-buckets, everything else is credentials. */
+		if v != nil {
+			return nil
+		}
+
+		id, err := boltKVToInt(k)
+		if err != nil {
+			return err
+		}
+		return migrateLegacyAccount(tx, AccountKey{Instance: instance, ID: id}, legacy.Bucket(k))
+	})
+}
+
+func migrateLegacyAccount(tx *bolt.Tx, acct AccountKey, legacy *bolt.Bucket) error {
+	account, err := createBoltAccount(tx, acct)
+	if err != nil {
+		return err
+	}
+
+	/* We don't know when it really happened, so now it is. */
+	now, _ := time.Now().UTC().MarshalText()
+	if err := account.root.Put([]byte(BoltBootstrappedKey), now); err != nil {
+		return err
+	}
+
+	return legacy.ForEach(func(k, v []byte) error {
+		switch string(k) {
+		case LegacyCursorKey:
+			cursor, err := boltKVToInt(v)
+			if err != nil {
+				return err
+			}
+			return account.root.Put([]byte(BoltCursorKey), boltIDKey(cursor))
+		case LegacyRetryQueueKey:
+			return migrateLegacyRetryEntries(legacy.Bucket(k), account.queue)
+		case LegacyDeadLetterKey:
+			return migrateLegacyRetryEntries(legacy.Bucket(k), account.dead)
+		}
+
+		status, err := boltKVToInt(k)
+		if err != nil {
+			return err
+		}
+		return account.mappings.Put(boltIDKey(status), v)
+	})
+}
+
+func migrateLegacyRetryEntries(legacy *bolt.Bucket, bucket *bolt.Bucket) error {
+	if legacy == nil {
+		return nil
+	}
+
+	return legacy.ForEach(func(k, v []byte) error {
+		status, err := boltKVToInt(k)
+		if err != nil {
+			return err
+		}
+
+		/* Older versions left the values empty. */
+		entry := RetryEntry{Status: status}
+		if len(v) > 0 {
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+		}
+		return boltPutRetryEntry(bucket, entry)
+	})
+}
+
+/* The root buckets of every account in the store, whatever its target. */
+func boltAccountRoots(tx *bolt.Tx) ([]*bolt.Bucket, error) {
+	var roots []*bolt.Bucket
+	var collect func(bucket *bolt.Bucket, depth int) error
+	collect = func(bucket *bolt.Bucket, depth int) error {
+		if bucket == nil {
+			return nil
+		}
+		if depth == 0 {
+			roots = append(roots, bucket)
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return collect(bucket.Bucket(k), depth-1)
+		})
+	}
+	if err := collect(tx.Bucket([]byte(BoltAccountsBucket)), 2); err != nil {
+		return nil, err
+	}
+	if err := collect(tx.Bucket([]byte(BoltTargetsBucket)), 3); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+/* Brings the mappings of every account over to the versioned format, see
+ * StatusMapping. */
+func migrateBoltLayoutV2(tx *bolt.Tx) error {
+	roots, err := boltAccountRoots(tx)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, root := range roots {
+		bucket := root.Bucket([]byte(BoltMappingsBucket))
+		if bucket == nil {
+			continue
+		}
+		updated := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			value, err := migrateMapping(v)
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				updated[string(k)] = value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range updated {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		migrated += len(updated)
+	}
+
+	if migrated > 0 {
+		log.Printf("migrated %v mappings of the store to layout version %v", migrated, BoltLayoutVersion)
+	}
+	return nil
+}
+
+/* Indexes the mappings of every account by the posts they were made into,
+ * see boltAccount.putMapping. */
+func migrateBoltLayoutV3(tx *bolt.Tx) error {
+	roots, err := boltAccountRoots(tx)
+	if err != nil {
+		return err
+	}
+
+	indexed := 0
+	for _, root := range roots {
+		mappings := root.Bucket([]byte(BoltMappingsBucket))
+		if mappings == nil {
+			continue
+		}
+		posts, err := root.CreateBucketIfNotExists([]byte(BoltPostsBucket))
+		if err != nil {
+			return err
+		}
+
+		err = mappings.ForEach(func(k, v []byte) error {
+			for _, uri := range mappingPostURIs(v) {
+				if err := posts.Put([]byte(uri), k); err != nil {
+					return err
+				}
+				indexed++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if indexed > 0 {
+		log.Printf("indexed %v posts of the store for layout version %v", indexed, BoltLayoutVersion)
+	}
+	return nil
+}
+
+/* Takes the last step of migrateBoltLayout back, dropping the posts index,
+ * which vbc with layout 3 neither read nor keep up to date. It's built again
+ * from the mappings once the store is upgraded again. */
+func downgradeBoltLayoutV4(tx *bolt.Tx) error {
+	roots, err := boltAccountRoots(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		if root.Bucket([]byte(BoltPostsBucket)) == nil {
+			continue
+		}
+		if err := root.DeleteBucket([]byte(BoltPostsBucket)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Brings a bolt file up to the current layout, having copied it to
+ * <path>.<time>.old first so there's a way back. This is the only way stores
+ * from an older vbc get upgraded, see prepareBoltLayout. */
+func upgradeBoltFile(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BackupLockWait})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return errors.New(fmt.Sprintf("%v is in use, stop vbc before upgrading it", path))
+	} else if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var version int64
+	err = db.View(func(tx *bolt.Tx) error {
+		version, err = boltLayoutVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > BoltLayoutVersion:
+		return errors.New(fmt.Sprintf("%v has layout version %v, which is newer than this vbc knows about", path, version))
+	case version == BoltLayoutVersion:
+		log.Printf("%v is already at layout version %v", path, version)
+		return nil
+	}
+
+	previous := fmt.Sprintf("%v.%v.old", path, time.Now().Unix())
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(previous, 0600)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not back it up to %v: %v", previous, err))
+	}
+
+	if err := db.Update(migrateBoltLayout); err != nil {
+		return err
+	}
+	log.Printf("upgraded %v from layout version %v to %v, the original is at %v", path, version, BoltLayoutVersion, previous)
+	return nil
+}
+
+/* Takes a bolt file from the current layout back to the one before it, for
+ * the vbc from before to carry on with it, having copied it to
+ * <path>.<time>.old first, as upgrading does. */
+func downgradeBoltFile(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BackupLockWait})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return errors.New(fmt.Sprintf("%v is in use, stop vbc before downgrading it", path))
+	} else if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var version int64
+	err = db.View(func(tx *bolt.Tx) error {
+		version, err = boltLayoutVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > BoltLayoutVersion:
+		return errors.New(fmt.Sprintf("%v has layout version %v, which is newer than this vbc knows about, downgrade it with the vbc that wrote it", path, version))
+	case version < BoltLayoutVersion:
+		log.Printf("%v is already at layout version %v", path, version)
+		return nil
+	}
+
+	previous := fmt.Sprintf("%v.%v.old", path, time.Now().Unix())
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(previous, 0600)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not back it up to %v: %v", previous, err))
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := downgradeBoltLayoutV4(tx); err != nil {
+			return err
+		}
+		/* Layout 3 didn't write readable down. */
+		meta := tx.Bucket([]byte(BoltMetaBucket))
+		if err := meta.Delete([]byte(BoltReadableKey)); err != nil {
+			return err
+		}
+		return meta.Put([]byte(BoltVersionKey), boltIDKey(BoltLayoutVersion-1))
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("downgraded %v from layout version %v to %v, the original is at %v", path, version, BoltLayoutVersion-1, previous)
+	return nil
+}
+
+/* The bolt store, along with the files of every pair next to it when it's
+ * split up, see shardedStore. */
+func boltStoreFiles() []string {
+	path := boltStorePath()
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("could not find store at %v: %v", path, err)
+	}
+
+	paths := []string{path}
+	if storePerAccount() {
+		pattern := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "-*.bolt"
+		shards, err := filepath.Glob(filepath.Join(filepath.Dir(path), pattern))
+		if err != nil {
+			log.Fatalf("could not list the per-account files next to %v: %v", path, err)
+		}
+		paths = append(paths, shards...)
+	}
+	return paths
+}
+
+/* Upgrades every file of the bolt store, see boltStoreFiles. */
+func upgradeStore() {
+	for _, path := range boltStoreFiles() {
+		if err := upgradeBoltFile(path); err != nil {
+			log.Fatalf("could not upgrade %v: %v", path, err)
+		}
+	}
+}
+
+/* Downgrades every file of the bolt store, see boltStoreFiles. */
+func downgradeStore() {
+	for _, path := range boltStoreFiles() {
+		if err := downgradeBoltFile(path); err != nil {
+			log.Fatalf("could not downgrade %v: %v", path, err)
+		}
+	}
+}
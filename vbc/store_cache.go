@@ -0,0 +1,340 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+/* How many mappings the cache in front of the store keeps around. Polling
+ * only ever looks at the latest few statuses of every account, so this is
+ * plenty even for a good many accounts. */
+const StoreCacheMappings = 4096
+
+/* A read-through cache in front of a store, so polling an account where
+ * nothing is new doesn't touch the store at all. Mappings, cursors and retry
+ * queues are kept as they were last read or written, which only holds for
+ * stores nobody else writes to, such as a bolt file, which is locked. */
+type cachedStore struct {
+	Store
+
+	mu       sync.Mutex
+	mappings map[cachedMappingKey]*list.Element
+	/* Mappings from most to least recently used. */
+	recent  *list.List
+	cursors map[AccountKey]int64
+	retries map[AccountKey][]RetryEntry
+	/* Writes to accounts being held back, see Hold. */
+	held map[AccountKey]*accountWrites
+}
+
+type cachedMappingKey struct {
+	acct   AccountKey
+	status int64
+}
+
+type cachedMapping struct {
+	key cachedMappingKey
+	/* Nil for statuses without a mapping, which get looked up just as
+	 * often. */
+	value []byte
+}
+
+func newCachedStore(store Store) *cachedStore {
+	return &cachedStore{
+		Store:    store,
+		mappings: make(map[cachedMappingKey]*list.Element),
+		recent:   list.New(),
+		cursors:  make(map[AccountKey]int64),
+		retries:  make(map[AccountKey][]RetryEntry),
+		held:     make(map[AccountKey]*accountWrites),
+	}
+}
+
+/* Must be called with mu held. */
+func (s *cachedStore) remember(key cachedMappingKey, value []byte) {
+	if element, found := s.mappings[key]; found {
+		element.Value.(*cachedMapping).value = value
+		s.recent.MoveToFront(element)
+		return
+	}
+	s.mappings[key] = s.recent.PushFront(&cachedMapping{key: key, value: value})
+	for s.recent.Len() > StoreCacheMappings {
+		oldest := s.recent.Back()
+		s.recent.Remove(oldest)
+		delete(s.mappings, oldest.Value.(*cachedMapping).key)
+	}
+}
+
+/* Forgets everything about an account, for when it changes wholesale. */
+func (s *cachedStore) forget(acct AccountKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, element := range s.mappings {
+		if key.acct == acct {
+			s.recent.Remove(element)
+			delete(s.mappings, key)
+		}
+	}
+	delete(s.cursors, acct)
+	delete(s.retries, acct)
+}
+
+func (s *cachedStore) BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error {
+	defer s.forget(acct)
+	return s.Store.BootstrapAccount(acct, mappings)
+}
+
+func (s *cachedStore) CopyAccount(from AccountKey, to AccountKey) error {
+	defer s.forget(to)
+	return s.Store.CopyAccount(from, to)
+}
+
+/* Holds mappings, cursors and retries that are done with back from the store
+ * until Flush, so a poll that crossposts a lot of statuses writes them all in
+ * one go rather than syncing the disk for each of them. Losing them to a crash
+ * is fine, as statuses go to the same records on Bluesky however many times
+ * they're crossposted, and reconcileAccount finds them their mappings. Whatever
+ * else hears of a crosspost, like a webhook, doesn't hear of it twice, as the
+ * pipeline flushes before telling it, see accountPipeline.crosspost. */
+func (s *cachedStore) Hold(acct AccountKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.held[acct] == nil {
+		s.held[acct] = &accountWrites{mappings: make(map[int64][]byte)}
+	}
+}
+
+/* Writes down everything held back for the account. */
+func (s *cachedStore) Flush(acct AccountKey) error {
+	s.mu.Lock()
+	writes := s.held[acct]
+	delete(s.held, acct)
+	s.mu.Unlock()
+	if writes == nil || writes.empty() {
+		return nil
+	}
+
+	var err error
+	if batch, ok := s.Store.(interface {
+		PutWrites(acct AccountKey, writes accountWrites) error
+	}); ok {
+		err = batch.PutWrites(acct, *writes)
+	} else {
+		err = putWrites(s.Store, acct, *writes)
+	}
+	if err != nil {
+		/* No telling what made it in. */
+		s.forget(acct)
+	}
+	return err
+}
+
+func (s *cachedStore) Close() error {
+	s.mu.Lock()
+	held := make([]AccountKey, 0, len(s.held))
+	for acct := range s.held {
+		held = append(held, acct)
+	}
+	s.mu.Unlock()
+
+	for _, acct := range held {
+		if err := s.Flush(acct); err != nil {
+			s.Store.Close()
+			return err
+		}
+	}
+	return s.Store.Close()
+}
+
+func (s *cachedStore) Mapping(acct AccountKey, status int64) ([]byte, error) {
+	key := cachedMappingKey{acct: acct, status: status}
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		if value, found := writes.mappings[status]; found {
+			s.mu.Unlock()
+			return value, nil
+		}
+	}
+	if element, found := s.mappings[key]; found {
+		s.recent.MoveToFront(element)
+		value := element.Value.(*cachedMapping).value
+		s.mu.Unlock()
+		return value, nil
+	}
+	s.mu.Unlock()
+
+	value, err := s.Store.Mapping(acct, status)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.remember(key, value)
+	s.mu.Unlock()
+	return value, nil
+}
+
+func (s *cachedStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	key := cachedMappingKey{acct: acct, status: status}
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		writes.mappings[status] = value
+		s.remember(key, value)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	err := s.Store.PutMapping(acct, status, value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		/* No telling what made it in. */
+		if element, found := s.mappings[key]; found {
+			s.recent.Remove(element)
+			delete(s.mappings, key)
+		}
+		return err
+	}
+	s.remember(key, value)
+	return nil
+}
+
+func (s *cachedStore) Cursor(acct AccountKey) (int64, error) {
+	s.mu.Lock()
+	cursor, found := s.cursors[acct]
+	s.mu.Unlock()
+	if found {
+		return cursor, nil
+	}
+
+	cursor, err := s.Store.Cursor(acct)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.cursors[acct] = cursor
+	s.mu.Unlock()
+	return cursor, nil
+}
+
+func (s *cachedStore) PutCursor(acct AccountKey, status int64) error {
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		writes.cursor = &status
+		s.cursors[acct] = status
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	err := s.Store.PutCursor(acct, status)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		delete(s.cursors, acct)
+		return err
+	}
+	s.cursors[acct] = status
+	return nil
+}
+
+/* Straight from the store, with whatever's held back on top. */
+func (s *cachedStore) Mappings(acct AccountKey) (map[int64][]byte, error) {
+	values, err := s.Store.Mappings(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if writes := s.held[acct]; writes != nil {
+		for id, value := range writes.mappings {
+			values[id] = value
+		}
+	}
+	return values, nil
+}
+
+/* Straight from the store, unless it's one of the posts held back. */
+func (s *cachedStore) PostStatus(acct AccountKey, uri string) (int64, error) {
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		for status, value := range writes.mappings {
+			for _, posted := range mappingPostURIs(value) {
+				if posted == uri {
+					s.mu.Unlock()
+					return status, nil
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	return s.Store.PostStatus(acct, uri)
+}
+
+func (s *cachedStore) RetryQueue(acct AccountKey) ([]RetryEntry, error) {
+	s.mu.Lock()
+	queue, found := s.retries[acct]
+	s.mu.Unlock()
+	if !found {
+		stored, err := s.Store.RetryQueue(acct)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.retries[acct] = stored
+		s.mu.Unlock()
+		queue = stored
+	}
+
+	/* Leaving out whatever's done with but still held back. */
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]RetryEntry, 0, len(queue))
+	for _, entry := range queue {
+		if writes := s.held[acct]; writes == nil || !writes.done[entry.Status] {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+/* The retry queue is kept in whatever order the store keeps it, so it's
+ * read again after any change rather than changed in place. */
+func (s *cachedStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		delete(writes.done, entry.Status)
+	}
+	s.mu.Unlock()
+
+	defer s.forgetRetries(acct)
+	return s.Store.PutRetry(acct, entry)
+}
+
+func (s *cachedStore) RemoveRetry(acct AccountKey, status int64) error {
+	s.mu.Lock()
+	if writes := s.held[acct]; writes != nil {
+		if writes.done == nil {
+			writes.done = make(map[int64]bool)
+		}
+		writes.done[status] = true
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	defer s.forgetRetries(acct)
+	return s.Store.RemoveRetry(acct, status)
+}
+
+func (s *cachedStore) forgetRetries(acct AccountKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.retries, acct)
+}
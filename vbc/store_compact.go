@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* How often the daemon checks whether the store needs compacting, unless
+ * VBC_STORE_COMPACT_INTERVAL says otherwise. */
+const StoreCompactIntervalDefault = 24 * time.Hour
+
+/* A store is compacted once at least this much of it, and at least half of
+ * it, is free room. */
+const StoreCompactMinFree = 1 << 20
+
+/* How long nothing has to have been written to the store for before it gets
+ * compacted, as everything else waits on it while it is. */
+const StoreCompactIdle = time.Minute
+
+/* How much gets copied over in each transaction while compacting. */
+const StoreCompactTxSize = 1 << 20
+
+/* How many times opening the store again after compacting it gets tried, and
+ * how long the first try waits on the file lock, doubling every time after,
+ * before the store is given up on. */
+const (
+	StoreReopenAttempts = 5
+	StoreReopenWait     = time.Second
+)
+
+/* The store could not be opened again after compacting it, and is closed for
+ * good, so there's no carrying on with it. */
+type storeLostError struct {
+	path string
+	err  error
+}
+
+func (e storeLostError) Error() string {
+	return fmt.Sprintf("could not open %v again after compacting it: %v", e.path, e.err)
+}
+
+/* Copies the store to a new file, leaving the free room behind, and puts the
+ * copy in place of the file. Nothing else gets to use the store while this
+ * runs. Hands back how many bytes it took off the file. */
+func (s *boltStore) Compact() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path
+	before, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	temp := path + ".compact"
+	_ = os.Remove(temp)
+	dst, err := bolt.Open(temp, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	err = bolt.Compact(dst, s.db, StoreCompactTxSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return 0, err
+	}
+
+	/* The old file has to be let go of before it can be replaced, on
+	 * Windows at least. Whatever happens after, the store has to be open
+	 * again by the time we're done, the compacted copy if it made it in
+	 * place and the file as it was otherwise. */
+	err = s.db.Close()
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if reopenErr := s.reopen(path); reopenErr != nil {
+		return 0, storeLostError{path: path, err: reopenErr}
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return 0, err
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return before.Size() - after.Size(), nil
+}
+
+/* Opens the file at path in place of the one Compact closed, trying again a
+ * few times before giving up, as s is of no use to anyone closed. */
+func (s *boltStore) reopen(path string) error {
+	wait := StoreReopenWait
+	var err error
+	for attempt := 1; attempt <= StoreReopenAttempts; attempt++ {
+		var db *bolt.DB
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: wait})
+		if err == nil {
+			s.db = db
+			return nil
+		}
+		log.Printf("WARNING: could not open %v again after compacting it, attempt %v of %v: %v", path, attempt, StoreReopenAttempts, err)
+		if attempt < StoreReopenAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return err
+}
+
+/* How often to check whether the store needs compacting, 0 for never. */
+func storeCompactInterval() (time.Duration, error) {
+	value := envOrNil("VBC_STORE_COMPACT_INTERVAL")
+	if value == nil {
+		return StoreCompactIntervalDefault, nil
+	}
+	interval, err := time.ParseDuration(*value)
+	if err != nil || interval < 0 {
+		return 0, errors.New(fmt.Sprintf("VBC_STORE_COMPACT_INTERVAL %q is not a duration, such as 24h, or 0", *value))
+	}
+	return interval, nil
+}
+
+/* Compacts the store every so often, once it's gone quiet, for as long as
+ * ctx isn't done, whenever enough of it is free room to be worth it. How
+ * much that gave back shows in vbc_store_reclaimed_bytes. */
+func compactStore(ctx context.Context, store *boltStore, interval time.Duration) {
+	file := filepath.Base(store.path)
+	compactions := 0
+	var reclaimed int64
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		for idle := store.Idle(); idle < StoreCompactIdle; idle = store.Idle() {
+			select {
+			case <-time.After(StoreCompactIdle - idle):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		stats, err := store.Stats()
+		if err != nil {
+			log.Printf("WARNING: could not measure %v to see if it needs compacting: %v", file, err)
+			continue
+		}
+		if stats.Free < StoreCompactMinFree || stats.Free*2 < stats.Size {
+			continue
+		}
+
+		log.Printf("compacting %v, %v of its %v are free", file, formatBytes(stats.Free), formatBytes(stats.Size))
+		started := time.Now()
+		n, err := store.Compact()
+		var lost storeLostError
+		if errors.As(err, &lost) {
+			/* Everything else would fail on a closed store until
+			 * restarted anyway. */
+			fatalf(ExitStore, "%v", err)
+		} else if err != nil {
+			log.Printf("ERROR: could not compact %v: %v", file, err)
+			continue
+		}
+		log.Printf("compacted %v in %v, taking %v off it", file, time.Since(started).Round(time.Millisecond), formatBytes(n))
+
+		compactions++
+		reclaimed += n
+		metrics.Set("vbc_store_compactions", "Times the store file was compacted since vbc started.", float64(compactions), "file", file)
+		metrics.Set("vbc_store_reclaimed_bytes", "Room compacting the store file gave back since vbc started.", float64(reclaimed), "file", file)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+/* State kept by the memory store for each account. */
+type memoryAccount struct {
+	mappings map[int64][]byte
+	cursor   int64
+	retries  map[int64]RetryEntry
+	dead     map[int64]RetryEntry
+	/* The status each post was made from, see mappingPostURIs. */
+	posts  map[string]int64
+	events [][]byte
+}
+
+func newMemoryAccount() *memoryAccount {
+	return &memoryAccount{
+		mappings: make(map[int64][]byte),
+		retries:  make(map[int64]RetryEntry),
+		dead:     make(map[int64]RetryEntry),
+		posts:    make(map[string]int64),
+	}
+}
+
+func (account *memoryAccount) putMapping(status int64, value []byte) {
+	for _, uri := range mappingPostURIs(account.mappings[status]) {
+		delete(account.posts, uri)
+	}
+	for _, uri := range mappingPostURIs(value) {
+		account.posts[uri] = status
+	}
+	account.mappings[status] = copySlice[byte](value)
+}
+
+/* Store that lives only as long as the process does. Good for tests, and for
+ * people who just want to crosspost from now on without keeping any state. */
+type memoryStore struct {
+	mu        sync.Mutex
+	apps      map[string]AppCredentials
+	accounts  map[AccountKey]*memoryAccount
+	sessions  map[string][]byte
+	blobs     map[[2]string][]byte
+	likes     map[[2]string][]byte
+	digests   map[string][]byte
+	instances map[string][]byte
+	engaged   map[[2]string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	log.Printf("using in-memory store, nothing will be persisted")
+
+	return &memoryStore{
+		apps:      make(map[string]AppCredentials),
+		accounts:  make(map[AccountKey]*memoryAccount),
+		sessions:  make(map[string][]byte),
+		blobs:     make(map[[2]string][]byte),
+		likes:     make(map[[2]string][]byte),
+		digests:   make(map[string][]byte),
+		instances: make(map[string][]byte),
+		engaged:   make(map[[2]string][]byte),
+	}
+}
+
+func (s *memoryStore) AppCredentials(instance string) (*AppCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	creds, found := s.apps[instance]
+	if !found {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+func (s *memoryStore) PutAppCredentials(instance string, creds AppCredentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apps[instance] = creds
+	return nil
+}
+
+func (s *memoryStore) HasAccount(acct AccountKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.accounts[acct]
+	return found, nil
+}
+
+func (s *memoryStore) BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.accounts[acct]; found {
+		return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", acct.ID, acct.Instance))
+	}
+
+	account := newMemoryAccount()
+	for status, value := range mappings {
+		account.putMapping(status, value)
+	}
+
+	s.accounts[acct] = account
+	return nil
+}
+
+func (s *memoryStore) CopyAccount(from AccountKey, to AccountKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, err := s.account(from)
+	if err != nil {
+		return err
+	}
+	if _, found := s.accounts[to]; found {
+		return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", to.ID, to.Instance))
+	}
+
+	dst := newMemoryAccount()
+	dst.cursor = src.cursor
+	for status, value := range src.mappings {
+		dst.putMapping(status, value)
+	}
+	for status, entry := range src.retries {
+		dst.retries[status] = entry
+	}
+	for status, entry := range src.dead {
+		dst.dead[status] = entry
+	}
+	dst.events = copySlice(src.events)
+
+	s.accounts[to] = dst
+	return nil
+}
+
+/* Returns the state of the account, failing if it hasn't been bootstrapped,
+ * same as the other stores do. */
+func (s *memoryStore) account(acct AccountKey) (*memoryAccount, error) {
+	account, found := s.accounts[acct]
+	if !found {
+		return nil, ErrAccountNotBootstrapped
+	}
+	return account, nil
+}
+
+func (s *memoryStore) Mapping(acct AccountKey, status int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, found := s.accounts[acct]
+	if !found {
+		return nil, nil
+	}
+
+	value, found := account.mappings[status]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) Mappings(acct AccountKey) (map[int64][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[int64][]byte)
+	if account, found := s.accounts[acct]; found {
+		for id, value := range account.mappings {
+			values[id] = copySlice[byte](value)
+		}
+	}
+	return values, nil
+}
+
+func (s *memoryStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.account(acct)
+	if err != nil {
+		return err
+	}
+
+	account.putMapping(status, value)
+	return nil
+}
+
+func (s *memoryStore) PostStatus(acct AccountKey, uri string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if account, found := s.accounts[acct]; found {
+		return account.posts[uri], nil
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) Cursor(acct AccountKey) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, found := s.accounts[acct]
+	if !found {
+		return 0, nil
+	}
+	return account.cursor, nil
+}
+
+func (s *memoryStore) PutCursor(acct AccountKey, status int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.account(acct)
+	if err != nil {
+		return err
+	}
+
+	account.cursor = status
+	return nil
+}
+
+func sortedRetryEntries(entries map[int64]RetryEntry) []RetryEntry {
+	sorted := make([]RetryEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Status < sorted[j].Status })
+	return sorted
+}
+
+func (s *memoryStore) RetryQueue(acct AccountKey) ([]RetryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, found := s.accounts[acct]
+	if !found {
+		return make([]RetryEntry, 0), nil
+	}
+	return sortedRetryEntries(account.retries), nil
+}
+
+func (s *memoryStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.account(acct)
+	if err != nil {
+		return err
+	}
+
+	account.retries[entry.Status] = entry
+	return nil
+}
+
+func (s *memoryStore) RemoveRetry(acct AccountKey, status int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if account, found := s.accounts[acct]; found {
+		delete(account.retries, status)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeadLetters(acct AccountKey) ([]RetryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, found := s.accounts[acct]
+	if !found {
+		return make([]RetryEntry, 0), nil
+	}
+	return sortedRetryEntries(account.dead), nil
+}
+
+func (s *memoryStore) PutDeadLetter(acct AccountKey, entry RetryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.account(acct)
+	if err != nil {
+		return err
+	}
+
+	account.dead[entry.Status] = entry
+	return nil
+}
+
+func (s *memoryStore) BlueskySession(handle string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.sessions[handle]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) PutBlueskySession(handle string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[handle] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) Blob(did string, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.blobs[[2]string{did, key}]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) PutBlob(did string, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[[2]string{did, key}] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) Like(did string, status string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.likes[[2]string{did, status}]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) PutLike(did string, status string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.likes[[2]string{did, status}] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) DigestCursor(did string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.digests[did]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) PutDigestCursor(did string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.digests[did] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) InstanceInfo(instance string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.instances[instance]
+	if !found {
+		return nil, nil
+	}
+	return copySlice[byte](value), nil
+}
+
+func (s *memoryStore) PutInstanceInfo(instance string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.instances[instance] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) Engagement() (map[[2]string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[[2]string][]byte, len(s.engaged))
+	for key, value := range s.engaged {
+		values[key] = copySlice[byte](value)
+	}
+	return values, nil
+}
+
+func (s *memoryStore) PutEngagement(did string, uri string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.engaged[[2]string{did, uri}] = copySlice[byte](value)
+	return nil
+}
+
+func (s *memoryStore) Events(acct AccountKey) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, found := s.accounts[acct]
+	if !found {
+		return make([][]byte, 0), nil
+	}
+	values := make([][]byte, 0, len(account.events))
+	for _, value := range account.events {
+		values = append(values, copySlice[byte](value))
+	}
+	return values, nil
+}
+
+func (s *memoryStore) PutEvent(acct AccountKey, value []byte, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.account(acct)
+	if err != nil {
+		return err
+	}
+
+	account.events = append(account.events, copySlice[byte](value))
+	if over := len(account.events) - keep; over > 0 {
+		account.events = copySlice(account.events[over:])
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
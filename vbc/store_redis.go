@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+const RedisKeyPrefix = "vbc"
+
+/* Writes to an account, which only go through once it's bootstrapped, the
+ * same as with the other stores. The bootstrap key of the account is always
+ * KEYS[1], and they return 0 if it isn't there, see evalAccount. */
+const (
+	/* Sets KEYS[2] with the command in ARGV[1], given the rest of ARGV. */
+	redisAccountWriteScript = `if redis.call("exists", KEYS[1]) == 0 then return 0 end
+redis.call(ARGV[1], KEYS[2], unpack(ARGV, 2))
+return 1`
+	/* Puts mapping ARGV[2] of status ARGV[1] in the KEYS[2] hash, and
+	 * moves the posts in the KEYS[3] index over, the ARGV[4] URIs after it
+	 * being the ones of the mapping it replaces, and the rest the ones of
+	 * the new one. Returns -1 without doing anything if the mapping it
+	 * replaces is no longer ARGV[3]. */
+	redisPutMappingScript = `if redis.call("exists", KEYS[1]) == 0 then return 0 end
+if (redis.call("hget", KEYS[2], ARGV[1]) or "") ~= ARGV[3] then return -1 end
+local stale = tonumber(ARGV[4])
+for i = 5, 4 + stale do redis.call("hdel", KEYS[3], ARGV[i]) end
+for i = 5 + stale, #ARGV do redis.call("hset", KEYS[3], ARGV[i], ARGV[1]) end
+redis.call("hset", KEYS[2], ARGV[1], ARGV[2])
+return 1`
+	/* Bootstraps the account, the same as bolt does, returning 0 without
+	 * doing anything if it already is. KEYS[2] and KEYS[3] are its
+	 * mappings and posts, KEYS[4] its indexed key, and the rest its other
+	 * keys, emptied of whatever a bootstrap that didn't get through left
+	 * behind. The first ARGV[1] pairs of ARGV after it are statuses and
+	 * their mappings, and the rest posts and their statuses. */
+	redisBootstrapScript = `if redis.call("exists", KEYS[1]) == 1 then return 0 end
+redis.call("del", unpack(KEYS, 2))
+local mapped = 1 + 2 * tonumber(ARGV[1])
+for i = 2, mapped, 2 do redis.call("hset", KEYS[2], ARGV[i], ARGV[i + 1]) end
+for i = mapped + 1, #ARGV, 2 do redis.call("hset", KEYS[3], ARGV[i], ARGV[i + 1]) end
+redis.call("set", KEYS[4], "1")
+redis.call("set", KEYS[1], "1")
+return 1`
+	/* Copies every key of an account over to another, KEYS[1] and KEYS[2]
+	 * being the bootstrap keys of the two, and the rest the keys of the
+	 * first followed by the same of the second. Returns 0 if the first
+	 * isn't bootstrapped, and -1 if the second already is. */
+	redisCopyAccountScript = `if redis.call("exists", KEYS[1]) == 0 then return 0 end
+if redis.call("exists", KEYS[2]) == 1 then return -1 end
+local n = (#KEYS - 2) / 2
+for i = 3, 2 + n do
+	if redis.call("copy", KEYS[i], KEYS[i + n], "replace") == 0 then redis.call("del", KEYS[i + n]) end
+end
+redis.call("set", KEYS[2], "1")
+return 1`
+	/* Adds event ARGV[1] to the KEYS[2] list, keeping the last ARGV[2]. */
+	redisPutEventScript = `if redis.call("exists", KEYS[1]) == 0 then return 0 end
+redis.call("rpush", KEYS[2], ARGV[1])
+redis.call("ltrim", KEYS[2], -tonumber(ARGV[2]), -1)
+return 1`
+)
+
+/* Store backed by Redis, for container deployments where there's no disk to
+ * keep a bolt file on. Keys are laid out as follows:
+ *
+ *     vbc:<instance>:app                 hash of the app ID and secret
+ *     vbc:<instance>:<account>:bootstrap set once the account is bootstrapped
+ *     vbc:<instance>:<account>:mappings  hash of status ID to mapping
+ *     vbc:<instance>:<account>:posts     hash of post URI to status ID
+ *     vbc:<instance>:<account>:indexed   set once posts has every mapping
+ *     vbc:<instance>:<account>:cursor    ID of the newest status seen
+ *     vbc:<instance>:<account>:retry     hash of status ID to retry entry
+ *     vbc:<instance>:<account>:dead      hash of status ID to dead letter
+ *     vbc:<instance>:<account>:events    list of what was done with statuses
+ *     vbc:bsky:<handle>:session          OAuth session with Bluesky
+ */
+type redisStore struct {
+	rc *redisClient
+}
+
+func openRedisStore(rawURL string) (*redisStore, error) {
+	rc, err := dialRedis(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("using redis store")
+
+	return &redisStore{rc: rc}, nil
+}
+
+func (s *redisStore) instanceKey(instance string, name string) string {
+	return fmt.Sprintf("%v:%v:%v", RedisKeyPrefix, instance, name)
+}
+
+func (s *redisStore) accountKey(acct AccountKey, name string) string {
+	if acct.Target != "" {
+		return fmt.Sprintf("%v:%v:%v@%v:%v", RedisKeyPrefix, acct.Instance, acct.ID, acct.Target, name)
+	}
+	return fmt.Sprintf("%v:%v:%v:%v", RedisKeyPrefix, acct.Instance, acct.ID, name)
+}
+
+func (s *redisStore) AppCredentials(instance string) (*AppCredentials, error) {
+	reply, err := s.rc.Do("HMGET", s.instanceKey(instance, "app"), "id", "secret")
+	if err != nil {
+		return nil, err
+	}
+
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return nil, errors.New(fmt.Sprintf("unexpected HMGET reply: %v", reply))
+	}
+	id, idOk := fields[0].(string)
+	secret, secretOk := fields[1].(string)
+	if !idOk || !secretOk {
+		return nil, nil
+	}
+
+	return &AppCredentials{ID: id, Secret: secret}, nil
+}
+
+func (s *redisStore) PutAppCredentials(instance string, creds AppCredentials) error {
+	_, err := s.rc.Do("HSET", s.instanceKey(instance, "app"),
+		"id", creds.ID,
+		"secret", creds.Secret)
+	return err
+}
+
+/* Runs one of the scripts writing to an account, with the keys of the
+ * account with the given names after its bootstrap key. */
+func (s *redisStore) evalAccount(acct AccountKey, script string, names []string, args ...string) (interface{}, error) {
+	cmd := []string{"EVAL", script, strconv.Itoa(len(names) + 1), s.accountKey(acct, "bootstrap")}
+	for _, name := range names {
+		cmd = append(cmd, s.accountKey(acct, name))
+	}
+	reply, err := s.rc.Do(append(cmd, args...)...)
+	if err == nil && reply == int64(0) {
+		return nil, ErrAccountNotBootstrapped
+	}
+	return reply, err
+}
+
+func (s *redisStore) HasAccount(acct AccountKey) (bool, error) {
+	reply, err := s.rc.Do("EXISTS", s.accountKey(acct, "bootstrap"))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+/* Keys of an account other than its bootstrap key, see redisStore. */
+var redisAccountKeys = []string{"mappings", "posts", "indexed", "cursor", "retry", "dead", "events"}
+
+func (s *redisStore) BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error {
+	cmd := []string{"EVAL", redisBootstrapScript, strconv.Itoa(len(redisAccountKeys) + 1), s.accountKey(acct, "bootstrap")}
+	for _, name := range redisAccountKeys {
+		cmd = append(cmd, s.accountKey(acct, name))
+	}
+	cmd = append(cmd, strconv.Itoa(len(mappings)))
+	for status, value := range mappings {
+		cmd = append(cmd, strconv.FormatInt(status, 10), string(value))
+	}
+	for status, value := range mappings {
+		for _, uri := range mappingPostURIs(value) {
+			cmd = append(cmd, uri, strconv.FormatInt(status, 10))
+		}
+	}
+
+	reply, err := s.rc.Do(cmd...)
+	if err == nil && reply == int64(0) {
+		return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", acct.ID, acct.Instance))
+	}
+	return err
+}
+
+/* Indexes the given mappings of an account by the posts they were made into,
+ * marking the index as having everything in it. */
+func (s *redisStore) indexPosts(acct AccountKey, mappings map[int64][]byte) error {
+	args := []string{"HSET", s.accountKey(acct, "posts")}
+	for status, value := range mappings {
+		for _, uri := range mappingPostURIs(value) {
+			args = append(args, uri, strconv.FormatInt(status, 10))
+		}
+	}
+	if len(args) > 2 {
+		if _, err := s.rc.Do(args...); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.rc.Do("SET", s.accountKey(acct, "indexed"), "1")
+	return err
+}
+
+/* Needs Redis 6.2 or newer, for COPY. */
+func (s *redisStore) CopyAccount(from AccountKey, to AccountKey) error {
+	cmd := []string{"EVAL", redisCopyAccountScript, strconv.Itoa(2*len(redisAccountKeys) + 2),
+		s.accountKey(from, "bootstrap"),
+		s.accountKey(to, "bootstrap")}
+	for _, acct := range []AccountKey{from, to} {
+		for _, name := range redisAccountKeys {
+			cmd = append(cmd, s.accountKey(acct, name))
+		}
+	}
+
+	reply, err := s.rc.Do(cmd...)
+	if err != nil {
+		return err
+	}
+	switch reply {
+	case int64(0):
+		return ErrAccountNotBootstrapped
+	case int64(-1):
+		return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", to.ID, to.Instance))
+	}
+	return nil
+}
+
+func (s *redisStore) Mapping(acct AccountKey, status int64) ([]byte, error) {
+	reply, err := s.rc.Do("HGET", s.accountKey(acct, "mappings"), strconv.FormatInt(status, 10))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected HGET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+/* The mapping and the index of the posts it was made into change together,
+ * starting over should the mapping change in between reading it and
+ * replacing it. */
+func (s *redisStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	for {
+		previous, err := s.Mapping(acct, status)
+		if err != nil {
+			return err
+		}
+
+		stale := mappingPostURIs(previous)
+		args := []string{strconv.FormatInt(status, 10), string(value), string(previous), strconv.Itoa(len(stale))}
+		args = append(args, stale...)
+		args = append(args, mappingPostURIs(value)...)
+
+		reply, err := s.evalAccount(acct, redisPutMappingScript, []string{"mappings", "posts"}, args...)
+		if err != nil || reply != int64(-1) {
+			return err
+		}
+	}
+}
+
+/* Accounts bootstrapped before there was an index get theirs the first time
+ * it's needed. */
+func (s *redisStore) PostStatus(acct AccountKey, uri string) (int64, error) {
+	reply, err := s.rc.Do("EXISTS", s.accountKey(acct, "indexed"))
+	if err != nil {
+		return 0, err
+	}
+	if reply != int64(1) {
+		if bootstrapped, err := s.HasAccount(acct); err != nil || !bootstrapped {
+			return 0, err
+		}
+		mappings, err := s.Mappings(acct)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.indexPosts(acct, mappings); err != nil {
+			return 0, err
+		}
+	}
+
+	reply, err = s.rc.Do("HGET", s.accountKey(acct, "posts"), uri)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unexpected HGET reply: %v", reply))
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (s *redisStore) Mappings(acct AccountKey) (map[int64][]byte, error) {
+	reply, err := s.rc.Do("HGETALL", s.accountKey(acct, "mappings"))
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("unexpected HGETALL reply: %v", reply))
+	}
+
+	values := make(map[int64][]byte, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		field, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[id] = []byte(value)
+	}
+	return values, nil
+}
+
+func (s *redisStore) Cursor(acct AccountKey) (int64, error) {
+	reply, err := s.rc.Do("GET", s.accountKey(acct, "cursor"))
+	if err != nil || reply == nil {
+		return 0, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unexpected GET reply: %v", reply))
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (s *redisStore) PutCursor(acct AccountKey, status int64) error {
+	_, err := s.evalAccount(acct, redisAccountWriteScript, []string{"cursor"}, "set", strconv.FormatInt(status, 10))
+	return err
+}
+
+/* Lists the entries in one of the hashes of an account holding retry
+ * entries, keyed by status ID. */
+func (s *redisStore) retryEntries(acct AccountKey, name string) ([]RetryEntry, error) {
+	reply, err := s.rc.Do("HVALS", s.accountKey(acct, name))
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected HVALS reply: %v", reply))
+	}
+
+	entries := make([]RetryEntry, 0, len(values))
+	for _, value := range values {
+		str, _ := value.(string)
+
+		var entry RetryEntry
+		if err := json.Unmarshal([]byte(str), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Status < entries[j].Status })
+	return entries, nil
+}
+
+func (s *redisStore) putRetryEntry(acct AccountKey, name string, entry RetryEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.evalAccount(acct, redisAccountWriteScript, []string{name}, "hset", strconv.FormatInt(entry.Status, 10), string(value))
+	return err
+}
+
+func (s *redisStore) RetryQueue(acct AccountKey) ([]RetryEntry, error) {
+	return s.retryEntries(acct, "retry")
+}
+
+func (s *redisStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	return s.putRetryEntry(acct, "retry", entry)
+}
+
+func (s *redisStore) RemoveRetry(acct AccountKey, status int64) error {
+	_, err := s.rc.Do("HDEL", s.accountKey(acct, "retry"), strconv.FormatInt(status, 10))
+	return err
+}
+
+func (s *redisStore) DeadLetters(acct AccountKey) ([]RetryEntry, error) {
+	return s.retryEntries(acct, "dead")
+}
+
+func (s *redisStore) PutDeadLetter(acct AccountKey, entry RetryEntry) error {
+	return s.putRetryEntry(acct, "dead", entry)
+}
+
+func (s *redisStore) BlueskySession(handle string) ([]byte, error) {
+	key := fmt.Sprintf("%v:bsky:%v:session", RedisKeyPrefix, handle)
+	reply, err := s.rc.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected GET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) PutBlueskySession(handle string, value []byte) error {
+	key := fmt.Sprintf("%v:bsky:%v:session", RedisKeyPrefix, handle)
+	_, err := s.rc.Do("SET", key, string(value))
+	return err
+}
+
+func (s *redisStore) Blob(did string, key string) ([]byte, error) {
+	reply, err := s.rc.Do("HGET", fmt.Sprintf("%v:blobs:%v", RedisKeyPrefix, did), key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected HGET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) PutBlob(did string, key string, value []byte) error {
+	_, err := s.rc.Do("HSET", fmt.Sprintf("%v:blobs:%v", RedisKeyPrefix, did), key, string(value))
+	return err
+}
+
+func (s *redisStore) Like(did string, status string) ([]byte, error) {
+	reply, err := s.rc.Do("HGET", fmt.Sprintf("%v:likes:%v", RedisKeyPrefix, did), status)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected HGET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) PutLike(did string, status string, value []byte) error {
+	_, err := s.rc.Do("HSET", fmt.Sprintf("%v:likes:%v", RedisKeyPrefix, did), status, string(value))
+	return err
+}
+
+func (s *redisStore) DigestCursor(did string) ([]byte, error) {
+	reply, err := s.rc.Do("GET", fmt.Sprintf("%v:digests:%v", RedisKeyPrefix, did))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected GET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) PutDigestCursor(did string, value []byte) error {
+	_, err := s.rc.Do("SET", fmt.Sprintf("%v:digests:%v", RedisKeyPrefix, did), string(value))
+	return err
+}
+
+func (s *redisStore) InstanceInfo(instance string) ([]byte, error) {
+	reply, err := s.rc.Do("GET", fmt.Sprintf("%v:instances:%v", RedisKeyPrefix, instance))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected GET reply: %v", reply))
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) PutInstanceInfo(instance string, value []byte) error {
+	_, err := s.rc.Do("SET", fmt.Sprintf("%v:instances:%v", RedisKeyPrefix, instance), string(value))
+	return err
+}
+
+func (s *redisStore) Engagement() (map[[2]string][]byte, error) {
+	reply, err := s.rc.Do("SMEMBERS", fmt.Sprintf("%v:engagement", RedisKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	dids, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected SMEMBERS reply: %v", reply))
+	}
+
+	values := make(map[[2]string][]byte)
+	for _, did := range dids {
+		did, _ := did.(string)
+		reply, err := s.rc.Do("HGETALL", fmt.Sprintf("%v:engagement:%v", RedisKeyPrefix, did))
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := reply.([]interface{})
+		if !ok || len(fields)%2 != 0 {
+			return nil, errors.New(fmt.Sprintf("unexpected HGETALL reply: %v", reply))
+		}
+		for i := 0; i < len(fields); i += 2 {
+			uri, _ := fields[i].(string)
+			value, _ := fields[i+1].(string)
+			values[[2]string{did, uri}] = []byte(value)
+		}
+	}
+	return values, nil
+}
+
+func (s *redisStore) PutEngagement(did string, uri string, value []byte) error {
+	if _, err := s.rc.Do("SADD", fmt.Sprintf("%v:engagement", RedisKeyPrefix), did); err != nil {
+		return err
+	}
+	_, err := s.rc.Do("HSET", fmt.Sprintf("%v:engagement:%v", RedisKeyPrefix, did), uri, string(value))
+	return err
+}
+
+func (s *redisStore) Events(acct AccountKey) ([][]byte, error) {
+	reply, err := s.rc.Do("LRANGE", s.accountKey(acct, "events"), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected LRANGE reply: %v", reply))
+	}
+
+	values := make([][]byte, 0, len(items))
+	for _, item := range items {
+		value, _ := item.(string)
+		values = append(values, []byte(value))
+	}
+	return values, nil
+}
+
+func (s *redisStore) PutEvent(acct AccountKey, value []byte, keep int) error {
+	_, err := s.evalAccount(acct, redisPutEventScript, []string{"events"}, string(value), strconv.Itoa(keep))
+	return err
+}
+
+func (s *redisStore) Close() error {
+	return s.rc.Close()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Whether VBC_STORE_PER_ACCOUNT asks for a bolt file for each account. */
+func storePerAccount() bool {
+	perAccount, _ := strconv.ParseBool(envOrDefault("VBC_STORE_PER_ACCOUNT", "false"))
+	return perAccount
+}
+
+/* Store backed by a bolt file for each pair of accounts, next to the one
+ * given, with whatever isn't tied to a pair, such as app credentials and
+ * blobs, left in that one. A pair's file can then be backed up, moved or
+ * deleted to start over without touching any of the others. Files are named
+ * after the one given, <name>-<instance>-<account>-<did>.bolt, the DID left
+ * out for state from before there could be more than one target, and get
+ * created the first time their account comes up. */
+type shardedStore struct {
+	*boltStore
+	path string
+
+	mu     sync.Mutex
+	shards map[AccountKey]*boltStore
+
+	/* Whether the files get looked at through snapshots, see
+	 * openStoreForReading, and what removes those once closed. */
+	snapshots bool
+	cleanups  []func()
+	/* Called with each file once it's opened, to serve snapshots of it. */
+	opened func(path string, shard *boltStore)
+}
+
+func openShardedStore(path string) (*shardedStore, error) {
+	root, err := openBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return &shardedStore{
+		boltStore: root,
+		path:      path,
+		shards:    make(map[AccountKey]*boltStore),
+	}, nil
+}
+
+/* Where the state of a pair of accounts goes. */
+func shardPath(path string, acct AccountKey) string {
+	host := acct.Instance
+	if u, err := url.Parse(acct.Instance); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	name := fmt.Sprintf("%v-%v-%v", strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), host, acct.ID)
+	if acct.Target != "" {
+		name += "-" + acct.Target
+	}
+	/* DIDs have colons in them, which not every filesystem takes. */
+	name = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(name)
+	return filepath.Join(filepath.Dir(path), name+".bolt")
+}
+
+/* The store of a pair of accounts, opening it if it isn't already. State the
+ * pair had in the main file, from before it was split up, gets copied over
+ * the first time around. */
+func (s *shardedStore) shard(acct AccountKey) (*boltStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if shard, found := s.shards[acct]; found {
+		return shard, nil
+	}
+
+	path := shardPath(s.path, acct)
+	_, err := os.Stat(path)
+	fresh := errors.Is(err, os.ErrNotExist)
+	if s.snapshots {
+		return s.shardSnapshot(acct, path, fresh)
+	}
+	shard, err := openBoltStore(path)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	if fresh {
+		bootstrapped, err := s.boltStore.HasAccount(acct)
+		if err == nil && bootstrapped {
+			log.Printf("moving the state of account %v on %v over to %v", acct.ID, acct.Instance, path)
+			err = copyAccountState(s.boltStore, acct, shard, acct)
+		}
+		if err != nil {
+			_ = shard.Close()
+			_ = os.Remove(path)
+			return nil, errors.New(fmt.Sprintf("could not move account %v on %v over to %v: %v", acct.ID, acct.Instance, path, err))
+		}
+	}
+	s.shards[acct] = shard
+	if s.opened != nil {
+		s.opened(path, shard)
+	}
+	return shard, nil
+}
+
+/* A snapshot of the file of a pair, or an empty store when it has none, as
+ * the state of the pair is then still in the main file. */
+func (s *shardedStore) shardSnapshot(acct AccountKey, path string, fresh bool) (*boltStore, error) {
+	if fresh {
+		s.shards[acct] = s.boltStore
+		return s.boltStore, nil
+	}
+	shard, cleanup, err := openBoltSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	s.shards[acct] = shard
+	s.cleanups = append(s.cleanups, cleanup)
+	return shard, nil
+}
+
+/* Copies everything kept for an account from one store to another, through
+ * nothing but the Store interface, bootstrapping it in the other store. */
+func copyAccountState(src Store, from AccountKey, dst Store, to AccountKey) error {
+	mappings, err := src.Mappings(from)
+	if err != nil {
+		return err
+	}
+	if err := dst.BootstrapAccount(to, mappings); err != nil {
+		return err
+	}
+
+	cursor, err := src.Cursor(from)
+	if err != nil {
+		return err
+	}
+	if cursor != 0 {
+		if err := dst.PutCursor(to, cursor); err != nil {
+			return err
+		}
+	}
+	queue, err := src.RetryQueue(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range queue {
+		if err := dst.PutRetry(to, entry); err != nil {
+			return err
+		}
+	}
+	dead, err := src.DeadLetters(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dead {
+		if err := dst.PutDeadLetter(to, entry); err != nil {
+			return err
+		}
+	}
+	events, err := src.Events(from)
+	if err != nil {
+		return err
+	}
+	for _, value := range events {
+		if err := dst.PutEvent(to, value, EventLogSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) HasAccount(acct AccountKey) (bool, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return false, err
+	}
+	return shard.HasAccount(acct)
+}
+
+func (s *shardedStore) BootstrapAccount(acct AccountKey, mappings map[int64][]byte) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.BootstrapAccount(acct, mappings)
+}
+
+func (s *shardedStore) CopyAccount(from AccountKey, to AccountKey) error {
+	src, err := s.shard(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.shard(to)
+	if err != nil {
+		return err
+	}
+	if bootstrapped, err := src.HasAccount(from); err != nil {
+		return err
+	} else if !bootstrapped {
+		return ErrAccountNotBootstrapped
+	}
+	if bootstrapped, err := dst.HasAccount(to); err != nil {
+		return err
+	} else if bootstrapped {
+		return errors.New(fmt.Sprintf("account %v on %v is already bootstrapped", to.ID, to.Instance))
+	}
+	return copyAccountState(src, from, dst, to)
+}
+
+func (s *shardedStore) Mapping(acct AccountKey, status int64) ([]byte, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Mapping(acct, status)
+}
+
+func (s *shardedStore) PutMapping(acct AccountKey, status int64, value []byte) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutMapping(acct, status, value)
+}
+
+func (s *shardedStore) Mappings(acct AccountKey) (map[int64][]byte, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Mappings(acct)
+}
+
+func (s *shardedStore) PostStatus(acct AccountKey, uri string) (int64, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return 0, err
+	}
+	return shard.PostStatus(acct, uri)
+}
+
+func (s *shardedStore) PutWrites(acct AccountKey, writes accountWrites) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutWrites(acct, writes)
+}
+
+func (s *shardedStore) Cursor(acct AccountKey) (int64, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return 0, err
+	}
+	return shard.Cursor(acct)
+}
+
+func (s *shardedStore) PutCursor(acct AccountKey, status int64) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutCursor(acct, status)
+}
+
+func (s *shardedStore) RetryQueue(acct AccountKey) ([]RetryEntry, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return nil, err
+	}
+	return shard.RetryQueue(acct)
+}
+
+func (s *shardedStore) PutRetry(acct AccountKey, entry RetryEntry) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutRetry(acct, entry)
+}
+
+func (s *shardedStore) RemoveRetry(acct AccountKey, status int64) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.RemoveRetry(acct, status)
+}
+
+func (s *shardedStore) DeadLetters(acct AccountKey) ([]RetryEntry, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return nil, err
+	}
+	return shard.DeadLetters(acct)
+}
+
+func (s *shardedStore) PutDeadLetter(acct AccountKey, entry RetryEntry) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutDeadLetter(acct, entry)
+}
+
+func (s *shardedStore) Events(acct AccountKey) ([][]byte, error) {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Events(acct)
+}
+
+func (s *shardedStore) PutEvent(acct AccountKey, value []byte, keep int) error {
+	shard, err := s.shard(acct)
+	if err != nil {
+		return err
+	}
+	return shard.PutEvent(acct, value, keep)
+}
+
+func (s *shardedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.boltStore.Close()
+	for acct, shard := range s.shards {
+		if shard == s.boltStore {
+			continue
+		}
+		if closeErr := shard.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.shards, acct)
+	}
+	for _, cleanup := range s.cleanups {
+		cleanup()
+	}
+	s.cleanups = nil
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* How often the daemon measures the store, for the vbc_store_* gauges. */
+const StoreStatsInterval = 5 * time.Minute
+
+/* How big the store is and what's taking up the room, so growth shows up
+ * before the disk fills. */
+type storeStats struct {
+	/* Size of the file, and how much of it is free pages bolt reuses rather
+	 * than giving back, which only goes away by compacting it, see
+	 * compactStore. */
+	Size int64
+	Free int64
+	/* Keys under each of the top level buckets, nested ones included. */
+	Keys map[string]int
+	/* Entries across the retry queues and dead letters of every account. */
+	Queued int
+	Dead   int
+}
+
+/* Counts the keys in the queue and dead letter buckets anywhere under
+ * bucket. */
+func boltCountQueues(bucket *bolt.Bucket, stats *storeStats) {
+	_ = bucket.ForEach(func(name []byte, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		child := bucket.Bucket(name)
+		switch string(name) {
+		case BoltQueueBucket:
+			stats.Queued += child.Stats().KeyN
+		case BoltDeadBucket:
+			stats.Dead += child.Stats().KeyN
+		default:
+			boltCountQueues(child, stats)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Stats() (storeStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := storeStats{Keys: make(map[string]int)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stats.Size = tx.Size()
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			stats.Keys[string(name)] = bucket.Stats().KeyN
+			switch string(name) {
+			case BoltAccountsBucket, BoltTargetsBucket:
+				boltCountQueues(bucket, &stats)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		stats.Size = info.Size()
+	}
+	db := s.db.Stats()
+	stats.Free = int64(db.FreePageN+db.PendingPageN) * int64(s.db.Info().PageSize)
+	return stats, nil
+}
+
+/* Sets the vbc_store_* gauges. */
+func reportStoreStats(stats storeStats) {
+	metrics.Set("vbc_store_size_bytes", "Size of the store file.", float64(stats.Size))
+	metrics.Set("vbc_store_free_bytes", "Room in the store file that's free for reuse.", float64(stats.Free))
+	metrics.Set("vbc_store_queued", "Statuses waiting in the retry queues of every account.", float64(stats.Queued))
+	metrics.Set("vbc_store_dead", "Statuses given up on across every account.", float64(stats.Dead))
+	for bucket, keys := range stats.Keys {
+		metrics.Set("vbc_store_keys", "Keys under each top level bucket of the store.", float64(keys), "bucket", bucket)
+	}
+}
+
+/* Keeps the vbc_store_* gauges up to date until ctx is done. */
+func watchStoreStats(ctx context.Context, store *boltStore) {
+	for {
+		stats, err := store.Stats()
+		if err != nil {
+			log.Printf("WARNING: could not measure the store: %v", err)
+		} else {
+			reportStoreStats(stats)
+		}
+
+		select {
+		case <-time.After(StoreStatsInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/* Prints how big the store is, and what's in it. */
+func printStoreStats(store Store) error {
+	measured, ok := store.(interface {
+		Stats() (storeStats, error)
+	})
+	if !ok {
+		fmt.Printf("Store statistics are only kept for bolt stores.\n")
+		return nil
+	}
+	stats, err := measured.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Store at %v:\n", storeSpec())
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "size\t%v\n", formatBytes(stats.Size))
+	fmt.Fprintf(w, "free\t%v\n", formatBytes(stats.Free))
+	fmt.Fprintf(w, "retry queue\t%v status(es)\n", stats.Queued)
+	fmt.Fprintf(w, "dead letters\t%v status(es)\n", stats.Dead)
+
+	buckets := make([]string, 0, len(stats.Keys))
+	for bucket := range stats.Keys {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		fmt.Fprintf(w, "%v/\t%v key(s)\n", bucket, stats.Keys[bucket])
+	}
+	return w.Flush()
+}
+
+/* Sizes for people to read, in powers of 1024. */
+func formatBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%v %v", n, units[0])
+	}
+	return fmt.Sprintf("%.1f %v", size, units[unit])
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* The same suite runs against every store that doesn't need a server. */
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return newMemoryStore()
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		store, err := openBoltStore(filepath.Join(t.TempDir(), "vbc.bolt"))
+		if err != nil {
+			t.Fatalf("could not open bolt store: %v", err)
+		}
+		return store
+	})
+}
+
+/* Runs against the Redis server at VBC_TEST_REDIS, when it's set, emptying
+ * its database before every test, so it's best given one of its own. */
+func TestRedisStore(t *testing.T) {
+	url := os.Getenv("VBC_TEST_REDIS")
+	if url == "" {
+		t.Skip("VBC_TEST_REDIS is not set")
+	}
+	open := func(t *testing.T) *redisStore {
+		store, err := openRedisStore(url)
+		if err != nil {
+			t.Fatalf("could not open redis store: %v", err)
+		}
+		if _, err := store.rc.Do("FLUSHDB"); err != nil {
+			t.Fatalf("could not empty redis database: %v", err)
+		}
+		return store
+	}
+	testStore(t, func(t *testing.T) Store {
+		return open(t)
+	})
+
+	/* What a bootstrap or a copy that didn't get through leaves behind is
+	 * gone once one does. */
+	t.Run("Leftovers", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+
+		carried := testAccount
+		carried.Target = "did:plc:vbcotherbcotherbcother"
+		for _, acct := range []AccountKey{testAccount, carried} {
+			if _, err := store.rc.Do("HSET", store.accountKey(acct, "mappings"), "7", "{}"); err != nil {
+				t.Fatalf("could not leave a mapping behind: %v", err)
+			}
+			if _, err := store.rc.Do("SET", store.accountKey(acct, "cursor"), "7"); err != nil {
+				t.Fatalf("could not leave a cursor behind: %v", err)
+			}
+		}
+
+		mustBootstrap(t, store, map[int64][]byte{1: []byte("{}")})
+		if err := store.CopyAccount(testAccount, carried); err != nil {
+			t.Fatalf("could not copy account: %v", err)
+		}
+		for _, acct := range []AccountKey{testAccount, carried} {
+			if value, err := store.Mapping(acct, 7); err != nil || value != nil {
+				t.Errorf("mapping left behind in %v came back as %q, %v", acct.Target, value, err)
+			}
+			if cursor, err := store.Cursor(acct); err != nil || cursor != 0 {
+				t.Errorf("cursor left behind in %v came back as %v, %v", acct.Target, cursor, err)
+			}
+		}
+	})
+}
+
+var testAccount = AccountKey{
+	Instance: "https://tiggi.es",
+	ID:       109000000000000001,
+	Target:   "did:plc:vbcfakevbcfakevbcfake",
+}
+
+/* Runs every store test against what open hands back, a new, empty store
+ * each time. */
+func testStore(t *testing.T, open func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store Store)
+	}{
+		{"Bootstrap", testStoreBootstrap},
+		{"Mappings", testStoreMappings},
+		{"Cursor", testStoreCursor},
+		{"RetryQueue", testStoreRetryQueue},
+		{"DeadLetters", testStoreDeadLetters},
+		{"Events", testStoreEvents},
+		{"CopyAccount", testStoreCopyAccount},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			tt.test(t, store)
+		})
+	}
+}
+
+func mustBootstrap(t *testing.T, store Store, mappings map[int64][]byte) {
+	t.Helper()
+	if err := store.BootstrapAccount(testAccount, mappings); err != nil {
+		t.Fatalf("could not bootstrap: %v", err)
+	}
+}
+
+func testStoreBootstrap(t *testing.T, store Store) {
+	if found, err := store.HasAccount(testAccount); err != nil || found {
+		t.Fatalf("new store has the account: %v, %v", found, err)
+	}
+	if err := store.PutMapping(testAccount, 1, []byte("{}")); !errors.Is(err, ErrAccountNotBootstrapped) {
+		t.Errorf("mapping went in before bootstrapping: %v", err)
+	}
+	if err := store.PutRetry(testAccount, RetryEntry{Status: 1}); !errors.Is(err, ErrAccountNotBootstrapped) {
+		t.Errorf("retry entry went in before bootstrapping: %v", err)
+	}
+
+	mustBootstrap(t, store, map[int64][]byte{1: []byte(`{"version":1}`)})
+	if found, err := store.HasAccount(testAccount); err != nil || !found {
+		t.Fatalf("account missing after bootstrapping: %v, %v", found, err)
+	}
+	if value, err := store.Mapping(testAccount, 1); err != nil || string(value) != `{"version":1}` {
+		t.Errorf("bootstrapped mapping came back as %q, %v", value, err)
+	}
+
+	/* Bootstrapping again would throw away what's been done since. */
+	if err := store.BootstrapAccount(testAccount, map[int64][]byte{2: []byte(`{"version":1}`)}); err == nil {
+		t.Errorf("account bootstrapped twice")
+	}
+	if value, err := store.Mapping(testAccount, 1); err != nil || string(value) != `{"version":1}` {
+		t.Errorf("mapping came back as %q, %v after bootstrapping again", value, err)
+	}
+	if value, err := store.Mapping(testAccount, 2); err != nil || value != nil {
+		t.Errorf("bootstrapping again put in mapping %q, %v", value, err)
+	}
+}
+
+func testStoreMappings(t *testing.T, store Store) {
+	mustBootstrap(t, store, nil)
+
+	if value, err := store.Mapping(testAccount, 42); err != nil || value != nil {
+		t.Fatalf("missing mapping came back as %q, %v", value, err)
+	}
+
+	uri := "at://did:plc:vbcfakevbcfakevbcfake/app.bsky.feed.post/3jzfcijpj2z2a"
+	posted, err := encodeMapping(newPostedMapping(uri, "bafyreifake"))
+	if err != nil {
+		t.Fatalf("could not encode mapping: %v", err)
+	}
+	if err := store.PutMapping(testAccount, 42, posted); err != nil {
+		t.Fatalf("could not put mapping: %v", err)
+	}
+	value, err := store.Mapping(testAccount, 42)
+	if err != nil || string(value) != string(posted) {
+		t.Fatalf("mapping came back as %q, %v", value, err)
+	}
+	if status, err := store.PostStatus(testAccount, uri); err != nil || status != 42 {
+		t.Errorf("post indexed to %v, %v rather than 42", status, err)
+	}
+
+	/* Replacing a mapping takes what it pointed to out of the index. */
+	skipped, err := encodeMapping(newMapping(MappingSkipped))
+	if err != nil {
+		t.Fatalf("could not encode mapping: %v", err)
+	}
+	if err := store.PutMapping(testAccount, 42, skipped); err != nil {
+		t.Fatalf("could not replace mapping: %v", err)
+	}
+	if status, err := store.PostStatus(testAccount, uri); err != nil || status != 0 {
+		t.Errorf("replaced post still indexed to %v, %v", status, err)
+	}
+
+	if err := store.PutMapping(testAccount, 43, skipped); err != nil {
+		t.Fatalf("could not put mapping: %v", err)
+	}
+	mappings, err := store.Mappings(testAccount)
+	if err != nil {
+		t.Fatalf("could not list mappings: %v", err)
+	}
+	expected := map[int64][]byte{42: skipped, 43: skipped}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("mappings came back as %q rather than %q", mappings, expected)
+	}
+}
+
+func testStoreCursor(t *testing.T, store Store) {
+	mustBootstrap(t, store, nil)
+
+	if cursor, err := store.Cursor(testAccount); err != nil || cursor != 0 {
+		t.Fatalf("new account has cursor %v, %v", cursor, err)
+	}
+	for _, status := range []int64{1, 110000000000000000, 5} {
+		if err := store.PutCursor(testAccount, status); err != nil {
+			t.Fatalf("could not put cursor: %v", err)
+		}
+		if cursor, err := store.Cursor(testAccount); err != nil || cursor != status {
+			t.Errorf("cursor came back as %v, %v rather than %v", cursor, err, status)
+		}
+	}
+}
+
+func retryStatuses(entries []RetryEntry) []int64 {
+	statuses := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		statuses = append(statuses, entry.Status)
+	}
+	return statuses
+}
+
+func testStoreRetryQueue(t *testing.T, store Store) {
+	mustBootstrap(t, store, nil)
+
+	if queue, err := store.RetryQueue(testAccount); err != nil || len(queue) != 0 {
+		t.Fatalf("new account has a retry queue of %v, %v", queue, err)
+	}
+
+	next := time.Date(2023, 5, 6, 12, 0, 0, 0, time.UTC)
+	for _, status := range []int64{30, 10, 20} {
+		if err := store.PutRetry(testAccount, RetryEntry{Status: status, Attempts: 1, NextAttempt: next}); err != nil {
+			t.Fatalf("could not put retry entry: %v", err)
+		}
+	}
+	/* Putting one again replaces it. */
+	replaced := RetryEntry{Status: 20, Attempts: 2, NextAttempt: next.Add(time.Minute), LastError: "502 Bad Gateway"}
+	if err := store.PutRetry(testAccount, replaced); err != nil {
+		t.Fatalf("could not replace retry entry: %v", err)
+	}
+
+	queue, err := store.RetryQueue(testAccount)
+	if err != nil {
+		t.Fatalf("could not read retry queue: %v", err)
+	}
+	if statuses := retryStatuses(queue); !reflect.DeepEqual(statuses, []int64{10, 20, 30}) {
+		t.Fatalf("retry queue has %v, rather than 10, 20 and 30, oldest first", statuses)
+	}
+	if got := queue[1]; got.Attempts != replaced.Attempts || got.LastError != replaced.LastError || !got.NextAttempt.Equal(replaced.NextAttempt) {
+		t.Errorf("replaced entry came back as %+v rather than %+v", got, replaced)
+	}
+
+	if err := store.RemoveRetry(testAccount, 10); err != nil {
+		t.Fatalf("could not remove retry entry: %v", err)
+	}
+	/* Removing what isn't there is fine. */
+	if err := store.RemoveRetry(testAccount, 99); err != nil {
+		t.Errorf("removing a missing entry failed: %v", err)
+	}
+	queue, err = store.RetryQueue(testAccount)
+	if err != nil {
+		t.Fatalf("could not read retry queue: %v", err)
+	}
+	if statuses := retryStatuses(queue); !reflect.DeepEqual(statuses, []int64{20, 30}) {
+		t.Errorf("retry queue has %v after removing 10", statuses)
+	}
+}
+
+func testStoreDeadLetters(t *testing.T, store Store) {
+	mustBootstrap(t, store, nil)
+
+	for _, status := range []int64{2, 1} {
+		entry := RetryEntry{Status: status, Attempts: 5, LastError: "gave up"}
+		if err := store.PutDeadLetter(testAccount, entry); err != nil {
+			t.Fatalf("could not put dead letter: %v", err)
+		}
+	}
+	dead, err := store.DeadLetters(testAccount)
+	if err != nil {
+		t.Fatalf("could not read dead letters: %v", err)
+	}
+	if statuses := retryStatuses(dead); !reflect.DeepEqual(statuses, []int64{1, 2}) {
+		t.Errorf("dead letters have %v rather than 1 and 2, oldest first", statuses)
+	}
+	if queue, err := store.RetryQueue(testAccount); err != nil || len(queue) != 0 {
+		t.Errorf("dead letters ended up in the retry queue: %v, %v", queue, err)
+	}
+}
+
+func testStoreEvents(t *testing.T, store Store) {
+	mustBootstrap(t, store, nil)
+
+	const keep = 3
+	for _, event := range []string{"a", "b", "c", "d", "e"} {
+		if err := store.PutEvent(testAccount, []byte(event), keep); err != nil {
+			t.Fatalf("could not put event: %v", err)
+		}
+	}
+	events, err := store.Events(testAccount)
+	if err != nil {
+		t.Fatalf("could not read events: %v", err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, string(event))
+	}
+	if !reflect.DeepEqual(got, []string{"c", "d", "e"}) {
+		t.Errorf("events came back as %v rather than the last %v, oldest first", got, keep)
+	}
+}
+
+/* Accounts carried over to another place to crosspost to take everything
+ * about them along, see accountPipeline.Run. */
+func testStoreCopyAccount(t *testing.T, store Store) {
+	mapping := []byte(`{"version":1}`)
+	mustBootstrap(t, store, map[int64][]byte{1: mapping})
+	if err := store.PutCursor(testAccount, 3); err != nil {
+		t.Fatalf("could not put cursor: %v", err)
+	}
+	if err := store.PutRetry(testAccount, RetryEntry{Status: 2, Attempts: 1}); err != nil {
+		t.Fatalf("could not put retry entry: %v", err)
+	}
+	if err := store.PutDeadLetter(testAccount, RetryEntry{Status: 3, Attempts: 5}); err != nil {
+		t.Fatalf("could not put dead letter: %v", err)
+	}
+	if err := store.PutEvent(testAccount, []byte("a"), 10); err != nil {
+		t.Fatalf("could not put event: %v", err)
+	}
+
+	carried := testAccount
+	carried.Target = "did:plc:vbcotherbcotherbcother"
+	if err := store.CopyAccount(carried, testAccount); !errors.Is(err, ErrAccountNotBootstrapped) {
+		t.Errorf("copied an account that isn't bootstrapped: %v", err)
+	}
+	if err := store.CopyAccount(testAccount, carried); err != nil {
+		t.Fatalf("could not copy account: %v", err)
+	}
+	if err := store.CopyAccount(testAccount, carried); err == nil {
+		t.Errorf("copied onto an account that's already bootstrapped")
+	}
+	if found, err := store.HasAccount(carried); err != nil || !found {
+		t.Fatalf("copy is not bootstrapped: %v, %v", found, err)
+	}
+	if value, err := store.Mapping(carried, 1); err != nil || string(value) != string(mapping) {
+		t.Errorf("mapping came over as %q, %v", value, err)
+	}
+	if cursor, err := store.Cursor(carried); err != nil || cursor != 3 {
+		t.Errorf("cursor came over as %v, %v", cursor, err)
+	}
+	if queue, err := store.RetryQueue(carried); err != nil || !reflect.DeepEqual(retryStatuses(queue), []int64{2}) {
+		t.Errorf("retry queue came over as %v, %v", queue, err)
+	}
+	if dead, err := store.DeadLetters(carried); err != nil || !reflect.DeepEqual(retryStatuses(dead), []int64{3}) {
+		t.Errorf("dead letters came over as %v, %v", dead, err)
+	}
+
+	/* New events go after the ones that came over. */
+	if err := store.PutEvent(carried, []byte("b"), 10); err != nil {
+		t.Fatalf("could not put event: %v", err)
+	}
+	events, err := store.Events(carried)
+	if err != nil {
+		t.Fatalf("could not read events: %v", err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, string(event))
+	}
+	if !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("events came over as %v rather than a, then b", got)
+	}
+}
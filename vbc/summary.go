@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/McKael/madon"
+)
+
+/* Whether to log what was done to every status on its way to Bluesky. */
+var verbose bool
+
+/* Sums up, in a line, what the pipeline did to a status to get the posts it
+ * turned into, so it's easy to tell whether it did the right thing. */
+func summarizeTransform(status *madon.Status, posts []*postRecord) string {
+	original := renderStatusText(status.Content)
+
+	final := make([]string, 0, len(posts))
+	length := 0
+	images := 0
+	cards := 0
+	for _, post := range posts {
+		final = append(final, post.Text)
+		length += utf8.RuneCountInString(post.Text)
+		if post.Embed != nil {
+			images += len(post.Embed.Images)
+			if post.Embed.External != nil {
+				cards++
+			}
+		}
+	}
+	joined := strings.Join(final, "\n")
+	lower := strings.ToLower(joined)
+
+	changes := []string{
+		fmt.Sprintf("%v -> %v characters", utf8.RuneCountInString(original), length),
+	}
+
+	changed := 0
+	for _, link := range linkRe.FindAllString(original, -1) {
+		if !strings.Contains(joined, link) {
+			changed++
+		}
+	}
+	if changed > 0 {
+		changes = append(changes, fmt.Sprintf("%v URL(s) shortened or dropped", changed))
+	}
+
+	stripped := 0
+	for _, tag := range status.Tags {
+		if !strings.Contains(lower, "#"+strings.ToLower(tag.Name)) {
+			stripped++
+		}
+	}
+	if stripped > 0 {
+		changes = append(changes, fmt.Sprintf("%v tag(s) stripped", stripped))
+	}
+
+	if len(posts) > 1 {
+		changes = append(changes, fmt.Sprintf("split into %v posts", len(posts)))
+	}
+	if images > 0 || len(status.MediaAttachments) > 0 {
+		changes = append(changes, fmt.Sprintf("%v of %v attachment(s) as images", images, len(status.MediaAttachments)))
+	}
+	if cards > 0 {
+		changes = append(changes, fmt.Sprintf("%v link card(s)", cards))
+	}
+	if len(posts) > 0 && posts[0].Labels != nil {
+		values := make([]string, 0, len(posts[0].Labels.Values))
+		for _, label := range posts[0].Labels.Values {
+			values = append(values, label.Val)
+		}
+		changes = append(changes, fmt.Sprintf("labeled %v", strings.Join(values, ", ")))
+	}
+
+	return strings.Join(changes, ", ")
+}
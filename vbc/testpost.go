@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+/* A flag that may be given more than once. */
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func testPostCommand(args []string) {
+	fs := flag.NewFlagSet("test-post", flag.ExitOnError)
+	var images stringsFlag
+	fs.Var(&images, "image", "URL of an image to attach, may be given more than once")
+	cw := fs.String("cw", "", "content warning to put on the post")
+	lang := fs.String("lang", "", "language of the post, such as en")
+	sensitive := fs.Bool("sensitive", false, "mark the images as sensitive")
+	remove := fs.Bool("delete", false, "delete the post once it's up, without asking")
+	keep := fs.Bool("keep", false, "keep the post, without asking")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc test-post [flags] <text>\n\n")
+		fmt.Fprintf(fs.Output(), "Crossposts a made up status with the given text to VBC_BSKY_HANDLE, going\n")
+		fmt.Fprintf(fs.Output(), "through the whole pipeline, to check that logging in, images and link cards\n")
+		fmt.Fprintf(fs.Output(), "all work without having to wait for a real status. Asks whether to delete\n")
+		fmt.Fprintf(fs.Output(), "the post again once it's up. It's not written down as a crosspost.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 || (*remove && *keep) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+	pair := config.PairFor(requireEnv("VBC_BSKY_HANDLE"))
+	transform := config.TransformFor(pair.Instance, pair.AccountID, pair.Handle)
+
+	refuseWhileRunning()
+	store, err := openStore(storeSpec())
+	if err != nil {
+		log.Fatalf("could not open store, vbc may have to be stopped first: %v", err)
+	}
+	defer store.Close()
+
+	bs, err := newBlueskySession(ctx, store, pair.Server, pair.Handle, pair.AppKey, 0)
+	if err != nil {
+		log.Fatalf("could not log into Bluesky as @%v: %v", pair.Handle, err)
+	}
+	profile, err := bs.FetchProfile(ctx, pair.Handle)
+	if err != nil {
+		log.Fatalf("could not fetch Bluesky profile of @%v: %v", pair.Handle, err)
+	}
+	if err := checkExpectedDID(pair.Handle, profile.DID); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	status := testStatus(fs.Arg(0), images, *cw, *lang, *sensitive)
+	key := AccountKey{Instance: pair.Instance, ID: pair.AccountID, Target: profile.DID}
+	mapping, err := repost(ctx, store, key, status, &statusExtras{}, bs, profile, transform)
+	if err != nil {
+		log.Fatalf("could not crosspost the test post: %v", err)
+	}
+
+	/* Every post of the thread, so all of them can be deleted again. */
+	var rkeys []string
+	records, _, err := listRecentPosts(ctx, bs, profile.DID)
+	if err != nil {
+		log.Fatalf("could not list the posts of @%v: %v", pair.Handle, err)
+	}
+	for i := 0; i < len(records); i++ {
+		if _, found := records[statusRkey(status, i)]; found {
+			rkeys = append(rkeys, statusRkey(status, i))
+		}
+	}
+	if len(rkeys) == 0 {
+		rkeys = append(rkeys, mapping.Uri[strings.LastIndex(mapping.Uri, "/")+1:])
+	}
+	fmt.Printf("posted %v post(s), see %v\n", len(rkeys), blueskyPostURL(pair.Handle, mapping.Uri))
+
+	if *keep {
+		return
+	}
+	if !*remove {
+		fmt.Printf("delete it again? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return
+		}
+	}
+
+	if transform.Threadgate != nil {
+		if err := deleteRecord(ctx, bs, profile.DID, ThreadgateCollection, rkeys[0]); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if hasPostgate(transform.Quotes) {
+		if err := deleteRecord(ctx, bs, profile.DID, PostgateCollection, rkeys[0]); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	/* Replies first, so the thread never points to a post that's gone. */
+	for i := len(rkeys) - 1; i >= 0; i-- {
+		if err := deleteRecord(ctx, bs, profile.DID, PostCollection, rkeys[i]); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	fmt.Printf("deleted %v post(s)\n", len(rkeys))
+}
+
+/* A public status with text, as Mastodon would have rendered it, and
+ * whatever images and content warning it was asked for. It's made up as of
+ * now, so every test post lands on records of its own. */
+func testStatus(text string, images []string, cw string, lang string, sensitive bool) *madon.Status {
+	paragraphs := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n")
+	for i, paragraph := range paragraphs {
+		paragraphs[i] = "<p>" + strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>") + "</p>"
+	}
+
+	now := time.Now()
+	status := &madon.Status{
+		URI:         fmt.Sprintf("vbc:test-post:%v", now.UnixNano()),
+		URL:         "test post",
+		Content:     strings.Join(paragraphs, ""),
+		CreatedAt:   now,
+		Sensitive:   sensitive,
+		SpoilerText: cw,
+		Visibility:  "public",
+		Language:    lang,
+	}
+	for i, image := range images {
+		status.MediaAttachments = append(status.MediaAttachments, madon.Attachment{
+			ID:   int64(i + 1),
+			Type: "image",
+			URL:  image,
+		})
+	}
+	return status
+}
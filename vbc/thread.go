@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* The thread of a status is up already, from an earlier attempt whose outcome
+ * never made it to the store. Creating it again would fail, so it has to be
+ * put over one record at a time instead, see putPosts. */
+var errThreadExists = errors.New("thread already exists")
+
+/* A write of com.atproto.repo.applyWrites. */
+type repoWrite struct {
+	LexiconTypeID string      `json:"$type"`
+	Collection    string      `json:"collection"`
+	Rkey          string      `json:"rkey"`
+	Value         interface{} `json:"value"`
+}
+
+func createWrite(collection string, rkey string, value interface{}) repoWrite {
+	return repoWrite{
+		LexiconTypeID: "com.atproto.repo.applyWrites#create",
+		Collection:    collection,
+		Rkey:          rkey,
+		Value:         value,
+	}
+}
+
+/* Creates every post of a thread, or a single post, along with its gates if
+ * it has any, in a single commit to the repo, so either all of them go up or
+ * none do.
+ * Replies have to point to the posts before them by CID, which we work out
+ * ourselves, as none of them exist yet. */
+func putThread(
+	ctx context.Context,
+	bs *blueskySession,
+	did string,
+	status *madon.Status,
+	posts []*postRecord,
+	shape recordShape,
+	threadgate []string,
+	quotes string) (*atproto.RepoPutRecord_Output, error) {
+
+	refs := make([]atproto.RepoStrongRef, len(posts))
+	writes := make([]repoWrite, 0, len(posts)+2)
+	for i, post := range posts {
+		if i > 0 {
+			root := &atproto.RepoStrongRef{Cid: refs[0].Cid, Uri: refs[0].Uri}
+			if posts[0].Reply != nil {
+				root = posts[0].Reply.Root
+			}
+			post.Reply = &bsky.FeedPost_ReplyRef{
+				Root:   root,
+				Parent: &atproto.RepoStrongRef{Cid: refs[i-1].Cid, Uri: refs[i-1].Uri},
+			}
+		}
+
+		record, err := shape.Record(post)
+		if err != nil {
+			return nil, err
+		}
+		cid, err := recordCID(record)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not work out the CID of post %v: %v", i, err)))
+		}
+		rkey := statusRkey(status, i)
+		refs[i] = atproto.RepoStrongRef{
+			Cid: cid,
+			Uri: fmt.Sprintf("at://%v/%v/%v", did, shape.Collection, rkey),
+		}
+		writes = append(writes, createWrite(shape.Collection, rkey, record))
+	}
+	if threadgate != nil {
+		gate := threadgateRecord(refs[0].Uri, threadgate, posts[0].CreatedAt)
+		writes = append(writes, createWrite(ThreadgateCollection, statusRkey(status, 0), gate))
+	}
+	if hasPostgate(quotes) {
+		gate := postgateRecord(refs[0].Uri, posts[0].CreatedAt)
+		writes = append(writes, createWrite(PostgateCollection, statusRkey(status, 0), gate))
+	}
+
+	ctx, span := startSpan(ctx, "apply-writes", "bluesky.rkey", statusRkey(status, 0))
+	err := bs.CustomCall(ctx, func(client *xrpc.Client) error {
+		input := map[string]interface{}{
+			"repo":   did,
+			"writes": writes,
+		}
+		err := client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.applyWrites", nil, input, nil)
+		if err == nil {
+			return nil
+		}
+
+		params := map[string]interface{}{
+			"repo":       did,
+			"collection": shape.Collection,
+			"rkey":       statusRkey(status, 0),
+		}
+		if client.Do(ctx, xrpc.Query, "", "com.atproto.repo.getRecord", params, nil, nil) == nil {
+			return errThreadExists
+		}
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+		log.Printf("Bluesky: reposted to %v", ref.Uri)
+	}
+	return &atproto.RepoPutRecord_Output{Cid: refs[0].Cid, Uri: refs[0].Uri}, nil
+}
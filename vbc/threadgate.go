@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+/* The collection threadgates live in. A threadgate shares its rkey with the
+ * post it gates. */
+const ThreadgateCollection = "app.bsky.feed.threadgate"
+
+/* Builds the threadgate record for a post. The version of indigo we're on
+ * doesn't know about threadgates, so this is plain JSON. */
+func threadgateRecord(postURI string, rules []string, createdAt string) map[string]interface{} {
+	allow := make([]map[string]string, 0, len(rules))
+	for _, rule := range rules {
+		switch rule {
+		case ThreadgateMentioned:
+			allow = append(allow, map[string]string{"$type": "app.bsky.feed.threadgate#mentionRule"})
+		case ThreadgateFollowing:
+			allow = append(allow, map[string]string{"$type": "app.bsky.feed.threadgate#followingRule"})
+		}
+	}
+
+	/* Leaving allow empty is what keeps everyone out. */
+	return map[string]interface{}{
+		"$type":     ThreadgateCollection,
+		"post":      postURI,
+		"allow":     allow,
+		"createdAt": createdAt,
+	}
+}
+
+/* The collection postgates live in, with the same rkey as the post they
+ * gate, like threadgates. */
+const PostgateCollection = "app.bsky.feed.postgate"
+
+/* Whether posts get a postgate, which they only need when quotes are off. */
+func hasPostgate(quotes string) bool {
+	return quotes == QuotesNobody
+}
+
+/* Builds the postgate record keeping a post from being quoted. Plain JSON,
+ * same as threadgates. */
+func postgateRecord(postURI string, createdAt string) map[string]interface{} {
+	return map[string]interface{}{
+		"$type":                 PostgateCollection,
+		"post":                  postURI,
+		"detachedEmbeddingUris": []string{},
+		"embeddingRules": []map[string]string{
+			{"$type": "app.bsky.feed.postgate#disableRule"},
+		},
+		"createdAt": createdAt,
+	}
+}
+
+/* Puts a record that isn't one of the types indigo knows about. */
+func putRawRecord(
+	ctx context.Context,
+	client *xrpc.Client,
+	repo string,
+	collection string,
+	rkey string,
+	record interface{}) (*atproto.RepoPutRecord_Output, error) {
+
+	input := map[string]interface{}{
+		"repo":       repo,
+		"collection": collection,
+		"rkey":       rkey,
+		"record":     record,
+	}
+
+	var output atproto.RepoPutRecord_Output
+	err := client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.putRecord", nil, input, &output)
+	if err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+
+	"github.com/McKael/madon"
+)
+
+/* Alphabet of the base32-sortable encoding used by TIDs. */
+const tidAlphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+/* Builds a TID out of a timestamp in microseconds and a clock ID, laid out
+ * the same way PDSes lay out the ones they generate. */
+func encodeTID(micros int64, clockId uint64) string {
+	v := (uint64(micros)&(1<<53-1))<<10 | clockId&0x3ff
+
+	var out [13]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = tidAlphabet[v&31]
+		v >>= 5
+	}
+	return string(out[:])
+}
+
+/* Derives the record key for a part of a crossposted status. The key only
+ * depends on the status itself, so posting the same status again writes over
+ * the record we made for it the first time instead of duplicating it, even if
+ * the store got lost in between.
+ *
+ * Mastodon only gives creation times down to the millisecond, so the
+ * microseconds below it are free: a hash of the URI picks where in its
+ * millisecond a status lands, on top of picking the clock ID, which leaves
+ * two statuses from the same millisecond about a million ways to tell
+ * themselves apart, rather than the thousand the clock ID has on its own.
+ * FNV, which keys used to be hashed with, spreads URIs that only differ in
+ * their last few digits too little for that, so it's SHA-256 now.
+ * Parts of a thread follow each other a microsecond apart, which is what
+ * nextStatusRkey counts on. */
+func statusRkey(status *madon.Status, part int) string {
+	digest := sha256.Sum256([]byte(status.URI))
+	sum := binary.BigEndian.Uint64(digest[:])
+
+	millis := status.CreatedAt.UnixMilli()
+	offset := int64((sum >> 10) % 1000)
+	return encodeTID(millis*1000+offset+int64(part), sum)
+}
+
+/* The record key statusRkey used to give a status, before it spread statuses
+ * out over their millisecond. Crossposts made back then are still under it. */
+func legacyStatusRkey(status *madon.Status, part int) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(status.URI))
+
+	micros := status.CreatedAt.UnixMicro() + int64(part)
+	return encodeTID(micros, h.Sum64())
+}
+
+/* The record key of the part of a crossposted status after the one with the
+ * given key, see statusRkey. Keys that aren't TIDs have nothing after them. */
+func nextStatusRkey(rkey string) string {
+	if len(rkey) != 13 {
+		return ""
+	}
+	var v uint64
+	for _, c := range rkey {
+		i := strings.IndexRune(tidAlphabet, c)
+		if i < 0 {
+			return ""
+		}
+		v = v<<5 | uint64(i)
+	}
+	micros := int64(v>>10) + 1
+	return encodeTID(micros, v&0x3ff)
+}
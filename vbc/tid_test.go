@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/McKael/madon"
+)
+
+func tidStatus(uri string, createdAt time.Time) *madon.Status {
+	return &madon.Status{URI: uri, CreatedAt: createdAt}
+}
+
+/* The same status has to get the same keys however many times it's asked
+ * about, as that's what keeps posting it again from duplicating it. */
+func TestStatusRkeyIsDeterministic(t *testing.T) {
+	createdAt := time.Date(2023, 5, 6, 12, 0, 0, 123000000, time.UTC)
+	a := tidStatus("https://tiggi.es/users/mbr/statuses/1", createdAt)
+	b := tidStatus("https://tiggi.es/users/mbr/statuses/1", createdAt)
+
+	for part := 0; part < 3; part++ {
+		if statusRkey(a, part) != statusRkey(b, part) {
+			t.Errorf("part %v got %v and then %v", part, statusRkey(a, part), statusRkey(b, part))
+		}
+	}
+	if len(statusRkey(a, 0)) != 13 {
+		t.Errorf("%v is not a TID", statusRkey(a, 0))
+	}
+}
+
+/* Statuses from the same millisecond, which on a busy instance are far from
+ * rare, still have to land on records of their own, parts and all. */
+func TestStatusRkeyTellsApartStatusesFromTheSameMillisecond(t *testing.T) {
+	createdAt := time.Date(2023, 5, 6, 12, 0, 0, 123000000, time.UTC)
+
+	seen := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		uri := fmt.Sprintf("https://mastodon.social/users/someone%v/statuses/%v", i, 110000000000000000+i)
+		status := tidStatus(uri, createdAt)
+		for part := 0; part < 3; part++ {
+			rkey := statusRkey(status, part)
+			if other, found := seen[rkey]; found {
+				t.Fatalf("%v part %v got %v, which %v already has", uri, part, rkey, other)
+			}
+			seen[rkey] = fmt.Sprintf("%v part %v", uri, part)
+		}
+	}
+}
+
+/* The parts of a thread sort after one another, and each one is where
+ * nextStatusRkey says it will be, as deleting them goes by that alone. */
+func TestStatusRkeyThreadParts(t *testing.T) {
+	status := tidStatus(
+		"https://tiggi.es/users/mbr/statuses/1",
+		time.Date(2023, 5, 6, 12, 0, 0, 999000000, time.UTC))
+
+	for part := 0; part < 5; part++ {
+		rkey, next := statusRkey(status, part), statusRkey(status, part+1)
+		if next <= rkey {
+			t.Errorf("part %v got %v, which does not sort after %v", part+1, next, rkey)
+		}
+		if nextStatusRkey(rkey) != next {
+			t.Errorf("the part after %v is %v, but nextStatusRkey says %v", rkey, next, nextStatusRkey(rkey))
+		}
+	}
+
+	/* Crossposts from before keys were spread out follow the same way. */
+	legacy := legacyStatusRkey(status, 0)
+	if nextStatusRkey(legacy) != legacyStatusRkey(status, 1) {
+		t.Errorf("the part after %v is %v, but nextStatusRkey says %v", legacy, legacyStatusRkey(status, 1), nextStatusRkey(legacy))
+	}
+}
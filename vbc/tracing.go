@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/* Whether every span gets logged as it ends, with how long it took, built
+ * with OpenTelemetry support or not, see canaryCommand. */
+var logSpans bool
+
+/* Whether an OTLP endpoint was given, in which case crossposts get traced.
+ * Tracing needs vbc to be built with -tags otel. */
+func tracingConfigured() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+/* Logs a span that ended, when logSpans is set. Attributes come in pairs of
+ * key and value, as for startSpan. */
+func logSpan(name string, attrs []string, started time.Time, err error) {
+	if !logSpans {
+		return
+	}
+	var pairs []string
+	for i := 0; i+1 < len(attrs); i += 2 {
+		pairs = append(pairs, attrs[i]+"="+attrs[i+1])
+	}
+	outcome := "ok"
+	var skip skipError
+	if errors.As(err, &skip) {
+		outcome = "skipped: " + skip.reason
+	} else if err != nil {
+		outcome = "failed: " + err.Error()
+	}
+	log.Printf("trace: %v %v took %v, %v", name, strings.Join(pairs, " "), time.Since(started).Round(time.Millisecond), outcome)
+}
@@ -0,0 +1,40 @@
+//go:build !otel
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+/* A step of the crosspost pipeline, see startSpan. Does nothing without
+ * OpenTelemetry support, other than being logged, see logSpans. */
+type traceSpan struct {
+	name    string
+	attrs   []string
+	started time.Time
+}
+
+func setupTracing(ctx context.Context) error {
+	if tracingConfigured() {
+		log.Printf("WARNING: tracing is configured, but vbc was built without it, rebuild it with -tags otel")
+	}
+	return nil
+}
+
+/* Nothing to send traces to, so nothing to flush. */
+func flushTracing(ctx context.Context) {}
+
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, traceSpan) {
+	if !logSpans {
+		return ctx, traceSpan{}
+	}
+	return ctx, traceSpan{name: name, attrs: attrs, started: time.Now()}
+}
+
+func (s traceSpan) End(err error) {
+	if s.name != "" {
+		logSpan(s.name, s.attrs, s.started, err)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* A step of the crosspost pipeline, see startSpan. */
+type traceSpan struct {
+	span trace.Span
+
+	/* What gets logged, see logSpans. */
+	name    string
+	attrs   []string
+	started time.Time
+}
+
+/* Set once tracing is, for flushTracing. */
+var tracerProvider *sdktrace.TracerProvider
+
+/* Sets up exporting traces over OTLP, configured through the usual
+ * OTEL_EXPORTER_OTLP_* environment variables. Without an endpoint, nothing
+ * gets exported. */
+func setupTracing(ctx context.Context) error {
+	if !tracingConfigured() {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", envOrDefault("OTEL_SERVICE_NAME", "vbc")))))
+	otel.SetTracerProvider(provider)
+	tracerProvider = provider
+	return nil
+}
+
+/* Sends what's been traced so far on its way, for commands that exit right
+ * after, before it would have been. */
+func flushTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		log.Printf("WARNING: could not send traces: %v", err)
+	}
+}
+
+/* Starts a span as a child of whatever span is in ctx. Attributes come in
+ * pairs of key and value. */
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, traceSpan) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		kvs = append(kvs, attribute.String(attrs[i], attrs[i+1]))
+	}
+
+	ctx, span := otel.Tracer("lobisomem.gay/vbc").Start(ctx, name, trace.WithAttributes(kvs...))
+	return ctx, traceSpan{span: span, name: name, attrs: attrs, started: time.Now()}
+}
+
+/* Ends the span, marking it as failed if err isn't nil. Skipped statuses
+ * aren't failures. */
+func (s traceSpan) End(err error) {
+	var skip skipError
+	if errors.As(err, &skip) {
+		s.span.SetAttributes(attribute.String("vbc.skipped", skip.reason))
+	} else if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+	logSpan(s.name, s.attrs, s.started, err)
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/McKael/madon"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+/* The collection crossposts get created in. */
+const PostCollection = "app.bsky.feed.post"
+
+/* How long a Bluesky post can be. Bluesky counts graphemes, we count runes,
+ * which is never less. */
+const PostLengthLimit = 300
+
+/* The post a content warning gets, when it gets one of its own. */
+const ContentWarningFormat = "CW: %v (in the replies)"
+
+/* What the last post of a thread cut short by maxThread ends with. */
+const ThreadOverflowFormat = "continue reading: %v"
+
+/* Marks a status that was left out on purpose, rather than one that failed.
+ * Statuses left out for a reason that has a kind of its own, such as
+ * ErrTooLong, are that kind as well. */
+type skipError struct {
+	reason string
+	kind   error
+}
+
+func (e skipError) Error() string {
+	return "skipped: " + e.reason
+}
+
+func (e skipError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+func skipped(format string, args ...interface{}) error {
+	return skipError{reason: fmt.Sprintf(format, args...)}
+}
+
+/* What templates and footers get to work with. */
+type templateData struct {
+	Text        string
+	SpoilerText string
+	URL         string
+	Visibility  string
+	Language    string
+	Tags        []string
+	CreatedAt   time.Time
+	/* Who posted the status, as user@instance, and their display name. */
+	Account     string
+	DisplayName string
+}
+
+/* Helpers templates get on top of the ones Go comes with, for putting
+ * together richer posts than the fields alone make for. */
+var templateFuncs = template.FuncMap{
+	/* Cuts text down to at most n characters, ending it with an ellipsis,
+	 * as in {{.Text | truncate 100}}. */
+	"truncate": func(n int, text string) string {
+		if n < 1 {
+			return ""
+		}
+		return truncateText(text, n)
+	},
+	/* Takes whatever HTML is in text out, leaving its text. */
+	"stripTags": stripTags,
+	/* A link as vbc shows links, without its scheme and with long paths cut
+	 * short. */
+	"shortURL": linkDisplayText,
+	/* A time in a Go layout, as in {{.CreatedAt | formatTime "2006-01-02"}}. */
+	"formatTime": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	/* Hashtags put together with sep, as in {{tagJoin " " .Tags}}. */
+	"tagJoin": func(sep string, tags []string) string {
+		hashtags := make([]string, len(tags))
+		for i, tag := range tags {
+			hashtags[i] = "#" + strings.TrimPrefix(tag, "#")
+		}
+		return strings.Join(hashtags, sep)
+	},
+}
+
+/* Parses a template of the configuration, helpers and all. */
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func executeTemplate(name string, text string, data templateData) (string, error) {
+	tmpl, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+/* Checks a post against the visibility rules and filters, returning why it
+ * should be skipped, if it should. */
+func filterPost(post *Post, config TransformConfig) error {
+	text := post.Text()
+
+	/* Not even configuration gets to change this one. */
+	if hasLocalOnlyMarker(text) {
+		return skipped("status is marked as local-only")
+	}
+
+	visible := false
+	for _, visibility := range config.Visibility {
+		visible = visible || visibility == post.Visibility
+	}
+	if !visible {
+		return skipped("visibility %v is not crossposted", post.Visibility)
+	}
+
+	filters := config.Filters
+	if filters == nil {
+		return nil
+	}
+	if filters.SkipSensitive && post.Sensitive {
+		return skipped("status is marked as sensitive")
+	}
+
+	hasTag := func(tags []string) string {
+		for _, tag := range post.Tags {
+			for _, wanted := range tags {
+				if strings.EqualFold(tag, strings.TrimPrefix(wanted, "#")) {
+					return tag
+				}
+			}
+		}
+		return ""
+	}
+	if tag := hasTag(filters.SkipTags); tag != "" {
+		return skipped("status is tagged #%v", tag)
+	}
+	if len(filters.OnlyTags) > 0 && hasTag(filters.OnlyTags) == "" {
+		return skipped("status has none of the tags that get crossposted")
+	}
+
+	language := post.Language
+	if language == "" {
+		language = UnknownLanguage
+	}
+	for _, skip := range filters.SkipLanguages {
+		if matchesLanguage(language, skip) {
+			return skipped("status is in %v", language)
+		}
+	}
+	if len(filters.OnlyLanguages) > 0 {
+		wanted := false
+		for _, only := range filters.OnlyLanguages {
+			wanted = wanted || matchesLanguage(language, only)
+		}
+		if !wanted {
+			return skipped("status is in %v, which is not crossposted", language)
+		}
+	}
+
+	haystack := strings.ToLower(post.ContentWarning + "\n" + text)
+	for _, word := range filters.SkipWords {
+		if strings.Contains(haystack, strings.ToLower(word)) {
+			return skipped("status contains %q", word)
+		}
+	}
+
+	if filters.BlockedLinks != BlockedLinksStrip {
+		for _, segment := range post.Segments {
+			if domain := blockedDomain(segment.Link, filters.BlockDomains); domain != "" {
+				return skipped("status links to blocked domain %v", domain)
+			}
+		}
+	}
+	return nil
+}
+
+/* Lowercases a domain in a blocklist, and takes off the *. or . it may have
+ * been written with to say its subdomains are blocked too, as they always
+ * are. */
+func normalizeDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSpace(domain), "*")
+	return strings.Trim(strings.ToLower(domain), ".")
+}
+
+/* The domain in a blocklist a link goes to, if any, the link going either to
+ * it or to one of its subdomains. */
+func blockedDomain(link string, domains []string) string {
+	if link == "" || len(domains) == 0 {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain
+		}
+	}
+	return ""
+}
+
+/* Takes the links to blocked domains out of a post, when those are to be
+ * stripped rather than have the post skipped. */
+func stripBlockedLinks(post *Post, config TransformConfig) {
+	filters := config.Filters
+	if filters == nil || filters.BlockedLinks != BlockedLinksStrip {
+		return
+	}
+
+	segments := post.Segments[:0]
+	for _, segment := range post.Segments {
+		if domain := blockedDomain(segment.Link, filters.BlockDomains); domain != "" {
+			log.Printf("stripping link to blocked domain %v from %v", domain, post.URL)
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	post.Segments = segments
+}
+
+/* What statuses that don't say which language they're in are taken to be in,
+ * the ISO 639 code for an undetermined language. */
+const UnknownLanguage = "und"
+
+/* Whether a language matches one in a filter, ignoring case. A filter naming
+ * just a language, such as pt, matches all of its regional variants, such as
+ * pt-BR, while one naming a variant only matches that. */
+func matchesLanguage(language string, filter string) bool {
+	language = strings.ReplaceAll(language, "_", "-")
+	filter = strings.ReplaceAll(filter, "_", "-")
+	if strings.EqualFold(language, filter) {
+		return true
+	}
+	base, _, _ := strings.Cut(language, "-")
+	return !strings.Contains(filter, "-") && strings.EqualFold(base, filter)
+}
+
+/* Splits text into chunks that each fit in a post on a sink, preferring to
+ * break between paragraphs, then lines, then words. */
+func splitText(text string, limits sinkLimits) []string {
+	var parts []string
+	for limits.Count(text) > limits.Length {
+		runes := []rune(text)
+		fit := limits.Fit(text)
+		head := string(runes[:fit])
+
+		cut := fit
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			/* Breaking too early leaves lots of tiny posts, so don't. */
+			i := strings.LastIndex(head, sep)
+			if i > 0 && utf8.RuneCountInString(head[:i]) > fit/2 {
+				cut = utf8.RuneCountInString(head[:i])
+				break
+			}
+		}
+
+		parts = append(parts, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+/* Cuts text down to at most limit runes, ending it with an ellipsis. */
+func truncateText(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	head := string([]rune(text)[:limit-1])
+	if i := strings.LastIndex(head, " "); i > len(head)/2 {
+		head = head[:i]
+	}
+	return strings.TrimSpace(head) + "…"
+}
+
+/* The full handle of an account, which Mastodon leaves the instance out of
+ * for local accounts. */
+func accountHandle(account *madon.Account) string {
+	if strings.Contains(account.Acct, "@") {
+		return account.Acct
+	}
+	if u, err := url.Parse(account.URL); err == nil && u.Host != "" {
+		return account.Acct + "@" + u.Host
+	}
+	return account.Acct
+}
+
+func appendFooter(body string, footer string) string {
+	if footer == "" {
+		return body
+	}
+	return body + "\n\n" + footer
+}
+
+/* A time as it's shown to people, in the configured timezone. */
+func localTime(t time.Time, config TransformConfig) time.Time {
+	if config.Timezone == "" {
+		return t.UTC()
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return t.UTC()
+	}
+	return t.In(location)
+}
+
+/* Works out the text of each post on a sink a post turns into, with its
+ * links shown as text. */
+func postTexts(post *Post, text string, config TransformConfig, limits sinkLimits) ([]string, error) {
+	data := templateData{
+		Text:        text,
+		SpoilerText: post.ContentWarning,
+		URL:         post.URL,
+		Visibility:  post.Visibility,
+		Language:    post.Language,
+		Tags:        post.Tags,
+		CreatedAt:   localTime(post.CreatedAt, config),
+		Account:     post.Author,
+		DisplayName: post.AuthorName,
+	}
+
+	body, err := executeTemplate("template", config.Template, data)
+	if err != nil {
+		return nil, permanent(errors.New(fmt.Sprintf("could not render template: %v", err)))
+	}
+	if strings.TrimSpace(text) == "" && len(post.Media) > 0 && config.MediaCaption != nil {
+		caption, err := executeTemplate("media caption", *config.MediaCaption, data)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not render media caption: %v", err)))
+		}
+		body = strings.TrimSpace(body + "\n\n" + caption)
+	}
+	footer := ""
+	if config.Footer != nil {
+		footer, err = executeTemplate("footer", *config.Footer, data)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not render footer: %v", err)))
+		}
+	}
+
+	/* The attribution sticks with the footer, so it survives truncation. */
+	if config.Attribution != nil {
+		attribution, err := executeTemplate("attribution", *config.Attribution, data)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not render attribution: %v", err)))
+		}
+		footer = strings.TrimSpace(attribution + "\n" + footer)
+	}
+
+	texts, err := fitTexts(body, footer, post.URL, config, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Put the content warning up front, for people to open the replies to
+	 * see what it's about, like it's done by hand on Bluesky. */
+	if hidesBehindWarning(post, config) {
+		warning := fmt.Sprintf(ContentWarningFormat, strings.TrimSpace(post.ContentWarning))
+		texts = append([]string{limits.Truncate(warning)}, texts...)
+	}
+	return texts, nil
+}
+
+/* Whether the post goes in replies to its content warning. */
+func hidesBehindWarning(post *Post, config TransformConfig) bool {
+	return config.ContentWarnings == ContentWarningsThread && strings.TrimSpace(post.ContentWarning) != ""
+}
+
+/* Fits the body and footer of a status into as many posts on a sink as the
+ * split mode allows. */
+func fitTexts(body string, footer string, url string, config TransformConfig, limits sinkLimits) ([]string, error) {
+	full := appendFooter(body, footer)
+	length := limits.Count(full)
+	if length <= limits.Length {
+		return []string{full}, nil
+	}
+
+	switch config.Split {
+	case SplitSkip:
+		return nil, skipError{
+			reason: fmt.Sprintf("%v characters is over the limit of %v on %v", length, limits.Length, limits.Name),
+			kind:   ErrTooLong,
+		}
+	case SplitTruncate:
+		room := limits.Length
+		if footer != "" {
+			room -= limits.Count(footer) + 2
+		}
+		if room < 1 {
+			return nil, skipped("footer leaves no room for the status")
+		}
+		return []string{appendFooter(limits.Within(room).Truncate(body), footer)}, nil
+	default:
+		texts := splitText(full, limits)
+		if config.MaxThread == nil || *config.MaxThread <= 0 || len(texts) <= *config.MaxThread || url == "" {
+			return texts, nil
+		}
+		return capThread(body, footer, url, *config.MaxThread, limits)
+	}
+}
+
+/* Splits the body into a thread of at most limit posts, the last of which
+ * is cut short to make room for a link to the rest of the status on
+ * Mastodon, and the footer. */
+func capThread(body string, footer string, url string, limit int, limits sinkLimits) ([]string, error) {
+	tail := appendFooter(fmt.Sprintf(ThreadOverflowFormat, url), footer)
+	room := limits.Length - limits.Count(tail) - 2
+	if room < 1 {
+		return nil, skipped("footer leaves no room for the status")
+	}
+
+	texts := splitText(body, limits)
+	if len(texts) > limit {
+		texts = texts[:limit]
+	}
+	last := len(texts) - 1
+	texts[last] = appendFooter(limits.Within(room).Truncate(texts[last]), tail)
+	return texts, nil
+}
+
+/* Turns a Mastodon status into the posts that make it up on Bluesky. When
+ * there's more than one, they're meant to be posted as a thread, in order. */
+func transformStatus(status *madon.Status, extras *statusExtras, config TransformConfig) ([]*postRecord, error) {
+	post, err := postFromStatus(status, extras, config)
+	if err != nil {
+		return nil, err
+	}
+	return blueskyPosts(post, config)
+}
+
+/* When the Bluesky posts of a post say they were made. */
+func postCreatedAt(post *Post, config TransformConfig) string {
+	if config.Timestamps == TimestampsNow {
+		return time.Now().UTC().Format(time.RFC3339)
+	}
+	return post.CreatedAt.Format(time.RFC3339)
+}
+
+/* The link a post is nothing but, if it's that. Posts with a content
+ * warning, or media, are always more than their link. */
+func onlyLink(post *Post) string {
+	if post.ContentWarning != "" || len(post.Media) > 0 {
+		return ""
+	}
+	link := ""
+	for _, segment := range post.Segments {
+		switch {
+		case segment.Link != "" && link == "":
+			link = segment.Link
+		case segment.Link != "" || strings.TrimSpace(segment.Text) != "":
+			return ""
+		}
+	}
+	return link
+}
+
+/* Turns a post into the Bluesky posts that make it up. */
+func blueskyPosts(post *Post, config TransformConfig) ([]*postRecord, error) {
+	/* Threads of the author's own go up as threads, see replyRef. */
+	if post.ReplyTo != "" && !post.ReplyToSelf {
+		return nil, skipped("status replies to someone else")
+	}
+	if err := filterPost(post, config); err != nil {
+		return nil, err
+	}
+	stripBlockedLinks(post, config)
+
+	var warning contentWarningAction
+	if config.ContentWarningRules != "" && strings.TrimSpace(post.ContentWarning) != "" {
+		rules, err := loadContentWarningRules(config.ContentWarningRules)
+		if err != nil {
+			return nil, permanent(errors.New(fmt.Sprintf("could not load content warning rules: %v", err)))
+		}
+		warning = matchContentWarning(rules, post.ContentWarning)
+		if warning.Skip != "" {
+			return nil, skipped("content warning mentions %q", warning.Skip)
+		}
+	}
+
+	/* Hooks get the last word before the post is put together, and may
+	 * even drop the media. */
+	hooked, err := runHooks(newHookPost(post), config)
+	if err != nil {
+		return nil, err
+	}
+	post.applyHooks(hooked)
+	embeds, left := imageEmbeds(post.Media, config.Crop)
+	if config.Media == MediaLink && len(post.Media) > 0 && post.URL != "" {
+		embeds, left = []*postEmbed{mediaLinkEmbed(post)}, 0
+	}
+
+	/* Long links eat into the length limit, so they can be shown shortened,
+	 * with facets pointing them to where they really go. */
+	links := make(map[string]string)
+	shorten := config.ShortenLinks != nil && *config.ShortenLinks
+	text := segmentsText(post.Segments, links, shorten)
+
+	/* A status that's nothing but a link can be just the card for it, the
+	 * way links get shared on Bluesky. */
+	if link := onlyLink(post); link != "" && config.LinkOnly == LinkOnlyCard && config.Links != LinksPlain {
+		record := &postRecord{
+			FeedPost: &bsky.FeedPost{
+				LexiconTypeID: PostCollection,
+				CreatedAt:     postCreatedAt(post, config),
+			},
+			Tags:     mirrorTags(config),
+			cardLink: link,
+		}
+		return []*postRecord{record}, nil
+	}
+
+	if warning.Prefix && !hidesBehindWarning(post, config) {
+		text = fmt.Sprintf(ContentWarningPrefixFormat, strings.TrimSpace(post.ContentWarning)) + "\n\n" + text
+	}
+	texts, err := postTexts(post, text, config, BlueskyLimits)
+	if err != nil {
+		return nil, err
+	}
+	if config.EmptyPosts != EmptyPostsKeep && len(embeds) == 0 && left == 0 && strings.TrimSpace(strings.Join(texts, "")) == "" {
+		return nil, skipped("status has nothing left in it once turned into a post")
+	}
+
+	/* Media hidden behind a click on Mastodon should be on Bluesky too,
+	 * labeled the way the rules for its content warning say, if any do. */
+	var labels *selfLabels
+	if warning.Matched {
+		labels = newSelfLabels(warning.Labels)
+	} else if post.Sensitive {
+		labels = newSelfLabels(config.SensitiveLabels)
+	}
+
+	/* Build the posts, with the images spread across them in order. Should
+	 * there be more images than posts, the rest get posts of their own. A
+	 * content warning post of its own gets no images, they're what it's
+	 * warning about. */
+	first := 0
+	if hidesBehindWarning(post, config) {
+		first = 1
+	}
+	records := make([]*postRecord, 0, len(texts))
+	for i := 0; i < len(texts) || i < first+len(embeds); i++ {
+		record := &postRecord{
+			FeedPost: &bsky.FeedPost{
+				LexiconTypeID: PostCollection,
+				CreatedAt:     postCreatedAt(post, config),
+			},
+			Labels: labels,
+			Tags:   mirrorTags(config),
+		}
+		if i < len(texts) {
+			record.Text = texts[i]
+		}
+		if i >= first && i-first < len(embeds) {
+			record.Embed = embeds[i-first]
+		}
+		records = append(records, record)
+	}
+	for _, record := range records {
+		record.Facets = linkFacets(record.Text, links)
+	}
+	if left > 0 {
+		records = linkOriginal(records, post.URL)
+	}
+	return records, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Checks every setting the crossposter needs before anything gets going,
+ * handing back a description of each problem found, rather than stopping
+ * at the first one. */
+func validateSettings(ephemeral bool) []string {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	required := func(name string) (string, bool) {
+		value, found := os.LookupEnv(name)
+		if !found || value == "" {
+			problem("%v (--%v) is not set", name, settingFlagName(name))
+			return "", false
+		}
+		return value, true
+	}
+
+	config, err := loadConfigFromEnv()
+	if err != nil {
+		problem("VBC_CONFIG could not be loaded: %v", err)
+	}
+
+	/* The accounts in the environment can be left out when the ones in the
+	 * configuration are all there is to crosspost. */
+	pairs := 0
+	if config != nil {
+		for _, account := range config.Accounts {
+			if account.Bluesky != "" {
+				pairs++
+			}
+		}
+		if config.Community != nil {
+			pairs++
+		}
+	}
+	if pairs > 0 &&
+		envOrNil("VBC_MASTODON_INSTANCE") == nil &&
+		envOrNil("VBC_MASTODON_ACCOUNT_ID") == nil &&
+		envOrNil("VBC_BSKY_HANDLE") == nil {
+
+		required = func(name string) (string, bool) {
+			return "", false
+		}
+	}
+
+	if instance, ok := required("VBC_MASTODON_INSTANCE"); ok {
+		if err := checkServerURL(instance); err != nil {
+			problem("VBC_MASTODON_INSTANCE %q is not a valid instance URL: %v", instance, err)
+		}
+	}
+	if id, ok := required("VBC_MASTODON_ACCOUNT_ID"); ok {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			problem("VBC_MASTODON_ACCOUNT_ID %q is not a number, it should be the ID of the account rather than its handle", id)
+		}
+	}
+	if handle, ok := required("VBC_BSKY_HANDLE"); ok && strings.HasPrefix(handle, "@") {
+		problem("VBC_BSKY_HANDLE %q should not start with an @", handle)
+	}
+	if did := envOrNil("VBC_BSKY_DID"); did != nil && !strings.HasPrefix(*did, "did:") {
+		problem("VBC_BSKY_DID %q is not a DID, such as did:plc:ewvi7nxzyoun6zhxrhs64oiz", *did)
+	}
+	if server := envOrNil("VBC_BSKY_SERVER"); server != nil {
+		if err := checkServerURL(*server); err != nil {
+			problem("VBC_BSKY_SERVER %q is not a valid server URL: %v", *server, err)
+		}
+	}
+	if (envOrNil("VBC_MASTODON_APP_ID") == nil) != (envOrNil("VBC_MASTODON_APP_SECRET") == nil) {
+		problem("VBC_MASTODON_APP_ID and VBC_MASTODON_APP_SECRET have to be set together")
+	}
+
+	if value := envOrNil("VBC_VERBOSE"); value != nil {
+		if _, err := strconv.ParseBool(*value); err != nil {
+			problem("VBC_VERBOSE %q is neither true nor false", *value)
+		}
+	}
+	if value := envOrNil("VBC_STORE_PER_ACCOUNT"); value != nil {
+		if _, err := strconv.ParseBool(*value); err != nil {
+			problem("VBC_STORE_PER_ACCOUNT %q is neither true nor false", *value)
+		}
+	}
+	if value := envOrNil("VBC_STORE_COMPACT_INTERVAL"); value != nil {
+		if d, err := time.ParseDuration(*value); err != nil || d < 0 {
+			problem("VBC_STORE_COMPACT_INTERVAL %q is not a duration, such as 24h, or 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_BIND_ADDR"); value != nil {
+		if _, err := bindAddrs(*value); err != nil {
+			problem("VBC_BIND_ADDR %q can't be connected from: %v", *value, err)
+		}
+	}
+	if value := envOrNil("VBC_HEALTH_PROBE"); value != nil {
+		if _, err := strconv.ParseBool(*value); err != nil {
+			problem("VBC_HEALTH_PROBE %q is neither true nor false", *value)
+		}
+	}
+	if value := envOrNil("VBC_OFFLINE_MODE"); value != nil {
+		if _, err := strconv.ParseBool(*value); err != nil {
+			problem("VBC_OFFLINE_MODE %q is neither true nor false", *value)
+		}
+	}
+	if value := envOrNil("VBC_POLL_INTERVAL"); value != nil {
+		if d, err := time.ParseDuration(*value); err != nil || d <= 0 {
+			problem("VBC_POLL_INTERVAL %q is not a positive duration, such as 1s or 500ms", *value)
+		}
+	}
+	if value := envOrNil("VBC_BSKY_RATE_LIMIT"); value != nil {
+		if n, err := strconv.ParseFloat(*value, 64); err != nil || n < 0 {
+			problem("VBC_BSKY_RATE_LIMIT %q is not a number of at least 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_HOST_RATE_LIMIT"); value != nil {
+		if _, err := parseHostRateLimits(*value); err != nil {
+			problem("VBC_HOST_RATE_LIMIT %q is not valid: %v", *value, err)
+		}
+	}
+	if value := envOrNil("VBC_PAUSE_AFTER"); value != nil {
+		if n, err := strconv.Atoi(*value); err != nil || n < 0 {
+			problem("VBC_PAUSE_AFTER %q is not a number of at least 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_RECONCILE_LAST"); value != nil {
+		if n, err := strconv.Atoi(*value); err != nil || n < 0 || n > ReconcileLastMax {
+			problem("VBC_RECONCILE_LAST %q is not a number from 0 to %v", *value, ReconcileLastMax)
+		}
+	}
+	if value := envOrNil("VBC_LOG_FILE"); value != nil {
+		if info, err := os.Stat(*value); err == nil && info.IsDir() {
+			problem("VBC_LOG_FILE %q is a directory", *value)
+		}
+	}
+	if value := envOrNil("VBC_LOG_MAX_SIZE"); value != nil {
+		if n, err := strconv.ParseInt(*value, 10, 64); err != nil || n < 0 {
+			problem("VBC_LOG_MAX_SIZE %q is not a number of megabytes of at least 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_LOG_MAX_AGE"); value != nil {
+		if d, err := time.ParseDuration(*value); err != nil || d < 0 {
+			problem("VBC_LOG_MAX_AGE %q is not a duration, such as 24h, or 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_LOG_KEEP"); value != nil {
+		if n, err := strconv.Atoi(*value); err != nil || n < 0 {
+			problem("VBC_LOG_KEEP %q is not a number of at least 0", *value)
+		}
+	}
+	if value := envOrNil("VBC_MEDIA_CACHE_DIR"); value != nil {
+		if info, err := os.Stat(*value); err == nil && !info.IsDir() {
+			problem("VBC_MEDIA_CACHE_DIR %q is not a directory", *value)
+		}
+	}
+	if value := envOrNil("VBC_MEDIA_CACHE_SIZE"); value != nil {
+		if n, err := strconv.ParseInt(*value, 10, 64); err != nil || n < 1 {
+			problem("VBC_MEDIA_CACHE_SIZE %q is not a number of megabytes of at least 1", *value)
+		}
+	}
+	if value := envOrNil("VBC_DIGEST_INTERVAL"); value != nil {
+		if d, err := time.ParseDuration(*value); err != nil || d < time.Minute {
+			problem("VBC_DIGEST_INTERVAL %q is not a duration of at least 1m", *value)
+		}
+	}
+	if value := envOrNil("VBC_DIGEST"); value != nil && *value != DigestToLog && *value != DigestToDM {
+		if err := checkServerURL(*value); err != nil {
+			problem("VBC_DIGEST is neither log, dm nor a valid URL: %v", err)
+		}
+	}
+	if value := envOrNil("VBC_METRICS_LISTEN"); value != nil {
+		if _, _, err := net.SplitHostPort(*value); err != nil {
+			problem("VBC_METRICS_LISTEN %q is not a host and port to listen on: %v", *value, err)
+		}
+	}
+	if value := envOrNil("VBC_ADMIN_LISTEN"); value != nil {
+		if _, _, err := net.SplitHostPort(*value); err != nil {
+			problem("VBC_ADMIN_LISTEN %q is not a host and port to listen on: %v", *value, err)
+		}
+		if envOrDefault("VBC_ADMIN_TOKEN", "") == "" {
+			problem("VBC_ADMIN_LISTEN is set, but VBC_ADMIN_TOKEN isn't, and the admin API needs one")
+		}
+	}
+	if value := envOrNil("VBC_LEADER_TTL"); value != nil {
+		if d, err := time.ParseDuration(*value); err != nil || d < 3*time.Second {
+			problem("VBC_LEADER_TTL %q is not a duration of at least 3s", *value)
+		}
+	}
+	if value := envOrNil("VBC_LEADER_LOCK"); value != nil {
+		if !strings.HasPrefix(*value, "redis://") && !strings.HasPrefix(*value, "rediss://") {
+			problem("VBC_LEADER_LOCK has to be a redis:// or rediss:// URL")
+		}
+	}
+
+	if !ephemeral {
+		if err := checkStoreSpec(storeSpec()); err != nil {
+			problem("store %v can't be used: %v", storeSpec(), err)
+		}
+	}
+
+	if dsn := envOrNil("VBC_SENTRY_DSN"); dsn != nil {
+		if _, err := parseSentryDSN(*dsn); err != nil {
+			problem("VBC_SENTRY_DSN is not a valid DSN: %v", err)
+		}
+	}
+	if webhook := envOrNil("VBC_ERROR_WEBHOOK"); webhook != nil {
+		if err := checkServerURL(*webhook); err != nil {
+			problem("VBC_ERROR_WEBHOOK is not a valid URL: %v", err)
+		}
+	}
+	return problems
+}
+
+func checkServerURL(raw string) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("it should start with https://")
+	}
+	if u.Host == "" {
+		return errors.New("it has no host")
+	}
+	return nil
+}
+
+/* Makes sure the store can be opened, without opening it. */
+func checkStoreSpec(spec string) error {
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		_, err := url.Parse(spec)
+		return err
+	}
+
+	info, err := os.Stat(spec)
+	if err == nil {
+		if info.IsDir() {
+			return errors.New("it is a directory")
+		}
+		file, err := os.OpenFile(spec, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	/* It gets created, so it's the directory that has to be writable. */
+	file, err := os.CreateTemp(filepath.Dir(spec), ".vbc-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
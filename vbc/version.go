@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+/* Dependencies worth knowing the version of when something breaks, which is
+ * usually when one of the APIs changes under us. */
+var versionDependencies = []string{
+	"github.com/McKael/madon",
+	"github.com/bluesky-social/indigo",
+	"github.com/karalabe/go-bluesky",
+}
+
+/* What we know about the binary that's running. */
+type buildInfo struct {
+	Version      string
+	Commit       string
+	Date         string
+	Modified     bool
+	GoVersion    string
+	Dependencies map[string]string
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:      "unknown",
+		GoVersion:    runtime.Version(),
+		Dependencies: make(map[string]string),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.Date = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	for _, dep := range bi.Deps {
+		for _, wanted := range versionDependencies {
+			if dep.Path != wanted {
+				continue
+			}
+			version := dep.Version
+			if dep.Replace != nil {
+				version = fmt.Sprintf("%v => %v %v", version, dep.Replace.Path, dep.Replace.Version)
+			}
+			info.Dependencies[wanted] = version
+		}
+	}
+	return info
+}
+
+/* A single line, for the log. */
+func (b buildInfo) String() string {
+	parts := []string{b.Version}
+	if b.Commit != "" {
+		commit := b.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if b.Modified {
+			commit += "-dirty"
+		}
+		parts = append(parts, "commit "+commit)
+	}
+	if b.Date != "" {
+		parts = append(parts, "built from "+b.Date)
+	}
+	parts = append(parts, b.GoVersion)
+	for _, dep := range versionDependencies {
+		if version, found := b.Dependencies[dep]; found {
+			parts = append(parts, dep[strings.LastIndex(dep, "/")+1:]+" "+version)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func versionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: vbc version\n\n")
+		fmt.Fprintf(fs.Output(), "Prints the version of vbc and of the API clients it was built with, which\n")
+		fmt.Fprintf(fs.Output(), "is good to include when reporting bugs.\n")
+	}
+	_ = fs.Parse(args)
+
+	info := readBuildInfo()
+	fmt.Printf("vbc %v\n", info.Version)
+	if info.Commit != "" {
+		dirty := ""
+		if info.Modified {
+			dirty = " (modified)"
+		}
+		fmt.Printf("commit:  %v%v\n", info.Commit, dirty)
+	}
+	if info.Date != "" {
+		fmt.Printf("date:    %v\n", info.Date)
+	}
+	fmt.Printf("go:      %v\n", info.GoVersion)
+	for _, dep := range versionDependencies {
+		version, found := info.Dependencies[dep]
+		if !found {
+			version = "unknown"
+		}
+		fmt.Printf("%v %v\n", dep, version)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* How long telling the webhook about a crosspost may take. */
+const CrosspostWebhookTimeout = 10 * time.Second
+
+/* What the webhook gets told about a crosspost. */
+type crosspostEvent struct {
+	Status  string    `json:"status"`
+	Post    string    `json:"post"`
+	Uri     string    `json:"uri"`
+	Text    string    `json:"text"`
+	Posts   []string  `json:"posts"`
+	Account string    `json:"account"`
+	Handle  string    `json:"handle"`
+	Time    time.Time `json:"time"`
+}
+
+var crosspostWebhookClient = &http.Client{Timeout: CrosspostWebhookTimeout}
+
+/* Tells the webhook about a crosspost, in the background, so a slow webhook
+ * doesn't hold the next one up. Failing to is only logged. */
+func sendCrosspostWebhook(webhook string, event crosspostEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("WARNING: could not tell webhook about %v: %v", event.Status, err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), CrosspostWebhookTimeout)
+		defer cancel()
+
+		err := func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := crosspostWebhookClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode < 200 || res.StatusCode >= 300 {
+				return errors.New(fmt.Sprintf("bad server status code (%v)", res.StatusCode))
+			}
+			return nil
+		}()
+		if err != nil {
+			log.Printf("WARNING: could not tell webhook about %v: %v", event.Status, err)
+		}
+	}()
+}